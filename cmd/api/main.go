@@ -3,15 +3,21 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/suPer8Hu/ai-platform/internal/chat"
 	"github.com/suPer8Hu/ai-platform/internal/config"
 	"github.com/suPer8Hu/ai-platform/internal/db"
+	"github.com/suPer8Hu/ai-platform/internal/dlq"
+	"github.com/suPer8Hu/ai-platform/internal/docs"
 	"github.com/suPer8Hu/ai-platform/internal/httpapi"
+	"github.com/suPer8Hu/ai-platform/internal/metrics"
 	"github.com/suPer8Hu/ai-platform/internal/models"
 	"github.com/suPer8Hu/ai-platform/internal/store/redisstore"
+	"github.com/suPer8Hu/ai-platform/internal/vision"
 )
 
 func main() {
@@ -23,7 +29,7 @@ func main() {
 	cfg := config.Load()
 	// MySQL
 	database := db.Connect(cfg.DBDSN)
-	if err := database.AutoMigrate(&models.User{}, &chat.Message{}, &chat.Session{}, &chat.Job{}); err != nil {
+	if err := database.AutoMigrate(&models.User{}, &models.RefreshToken{}, &chat.Message{}, &chat.Session{}, &chat.Job{}, &chat.Summary{}, &chat.Persona{}, &chat.MessageEmbedding{}, &chat.Share{}, &chat.WebhookDelivery{}, &chat.OutboxMessage{}, &chat.Attachment{}, &docs.Document{}, &docs.Chunk{}, &docs.SessionDocument{}, &dlq.ArchivedMessage{}, &vision.BatchJob{}, &vision.BatchItem{}); err != nil {
 		log.Fatalf("auto migrate failed: %v", err)
 	}
 
@@ -37,8 +43,33 @@ func main() {
 
 	r := httpapi.NewRouter(database, cfg, rds)
 
+	// /metrics stays off the public port
+	if addr := metricsAddr(); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("metrics server: %v", err)
+			}
+		}()
+		log.Printf("metrics listening on %s", addr)
+	}
+
 	log.Printf("server listening on :%s", port)
 	if err := r.Run(":" + port); err != nil {
 		log.Fatalf("server failed: %v", err)
 	}
 }
+
+// metricsAddr is where /metrics is served; "off" disables it.
+func metricsAddr() string {
+	v := strings.TrimSpace(os.Getenv("METRICS_ADDR"))
+	switch v {
+	case "":
+		return ":9092"
+	case "off":
+		return ""
+	}
+	return v
+}
@@ -0,0 +1,146 @@
+// Command dlqctl inspects and drains the chat worker's dead-letter queue.
+//
+//	dlqctl list [-limit 100] [-json]
+//	dlqctl replay  (-job ID[,ID...] | -all)
+//	dlqctl purge   (-job ID[,ID...] | -all)
+//	dlqctl archive (-job ID[,ID...] | -all)
+//
+// It reads the same environment as the worker (DB_DSN, RABBIT_URL, RABBIT_QUEUE).
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/suPer8Hu/ai-platform/internal/config"
+	"github.com/suPer8Hu/ai-platform/internal/db"
+	"github.com/suPer8Hu/ai-platform/internal/dlq"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage:
+  dlqctl list [-limit N] [-json]
+  dlqctl replay  (-job ID[,ID...] | -all)
+  dlqctl purge   (-job ID[,ID...] | -all)
+  dlqctl archive (-job ID[,ID...] | -all)
+`)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	limit := fs.Int("limit", dlq.DefaultListLimit, "messages to show (list)")
+	asJSON := fs.Bool("json", false, "print JSON")
+	jobs := fs.String("job", "", "comma-separated job ids")
+	all := fs.Bool("all", false, "every message in the DLQ")
+	_ = fs.Parse(args)
+
+	cfg := config.Load()
+	in := dlq.NewInspector(cfg.RabbitURL, cfg.RabbitQueue, db.Connect(cfg.DBDSN))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sel := dlq.Selection{All: *all}
+	for _, id := range strings.Split(*jobs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			sel.JobIDs = append(sel.JobIDs, id)
+		}
+	}
+
+	var run func(context.Context, dlq.Selection) (*dlq.Result, error)
+	switch cmd {
+	case "list":
+		rep, err := in.List(ctx, *limit)
+		if err != nil {
+			fatal(err)
+		}
+		if *asJSON {
+			printJSON(rep)
+			return
+		}
+		printReport(rep)
+		return
+	case "replay":
+		run = in.Replay
+	case "purge":
+		run = in.Purge
+	case "archive":
+		run = in.Archive
+	default:
+		usage()
+	}
+
+	res, err := run(ctx, sel)
+	if err != nil {
+		if res != nil && res.Processed > 0 {
+			fmt.Fprintf(os.Stderr, "%s stopped after %d message(s)\n", cmd, res.Processed)
+		}
+		fatal(err)
+	}
+	if *asJSON {
+		printJSON(res)
+		return
+	}
+	fmt.Printf("%s: matched=%d processed=%d skipped=%d\n", cmd, res.Matched, res.Processed, len(res.Skipped))
+	for _, s := range res.Skipped {
+		fmt.Printf("  skipped %s: %s\n", s.JobID, s.Reason)
+	}
+}
+
+func printReport(rep *dlq.Report) {
+	fmt.Printf("queue %s: %d message(s), showing %d\n\n", rep.Queue, rep.Depth, rep.Scanned)
+	if rep.Scanned == 0 {
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COUNT\tPROVIDER\tLAST SEEN\tREASON")
+	for _, g := range rep.Groups {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", g.Count, orDash(g.Provider), g.LastSeen.Format(time.RFC3339), g.Reason)
+	}
+	_ = tw.Flush()
+	fmt.Println()
+
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tUSER\tSTATUS\tRETRIES\tDEAD AT\tREASON")
+	for _, m := range rep.Messages {
+		user, status := "-", "missing"
+		if m.Job != nil {
+			user, status = fmt.Sprint(m.Job.UserID), string(m.Job.Status)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", orDash(m.JobID), user, status, m.RetryCount, m.Timestamp.Format(time.RFC3339), m.Reason)
+	}
+	_ = tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "dlqctl:", err)
+	os.Exit(1)
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
@@ -18,20 +20,34 @@ import (
 	"github.com/suPer8Hu/ai-platform/internal/chat"
 	"github.com/suPer8Hu/ai-platform/internal/config"
 	"github.com/suPer8Hu/ai-platform/internal/db"
+	"github.com/suPer8Hu/ai-platform/internal/docs"
+	"github.com/suPer8Hu/ai-platform/internal/metrics"
+	"github.com/suPer8Hu/ai-platform/internal/store/blob"
+	"github.com/suPer8Hu/ai-platform/internal/store/rabbitmq"
+	"github.com/suPer8Hu/ai-platform/internal/store/redisstore"
+	"github.com/suPer8Hu/ai-platform/internal/vision"
 )
 
 const (
 	retryHeaderKey  = "x-retry-count"
 	errorHeaderKey  = "x-last-error"
+	deferHeaderKey  = "x-defer-count"
 	maxRetryDefault = 5
 
+	webhookDispatchInterval = 5 * time.Second
+	outboxRelayInterval     = 2 * time.Second
+	jobSweepInterval        = time.Minute
+	attachmentSweepInterval = 10 * time.Minute
+	embedBackfillInterval   = 30 * time.Second
+
 	// test-only switches (no effect unless you set env vars)
 	testFailJobEnv     = "FAIL_JOB_ID"      // always fail for this job_id (drives into DLQ)
 	testFailJobOnceEnv = "FAIL_ONCE_JOB_ID" // fail only once for this job_id (validates retry then success)
 )
 
 type jobMsg struct {
-	JobID string `json:"job_id"`
+	JobID  string `json:"job_id"`
+	UserID uint64 `json:"user_id"`
 }
 
 func workerConcurrency() int {
@@ -49,6 +65,25 @@ func workerConcurrency() int {
 	return n
 }
 
+// userConcurrency is how many jobs of one user may run at once in this worker; by default
+// half the pool, so a user with a large backlog leaves room for everyone else. The limit is
+// per worker process: with N workers a user may run up to N times as many jobs.
+func userConcurrency(pool int) int {
+	def := max(1, pool/2)
+	v := strings.TrimSpace(os.Getenv("WORKER_USER_CONCURRENCY"))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return def
+	}
+	if n > pool {
+		return pool
+	}
+	return n
+}
+
 func maxRetries() int {
 	v := strings.TrimSpace(os.Getenv("WORKER_MAX_RETRIES"))
 	if v == "" {
@@ -64,6 +99,34 @@ func maxRetries() int {
 	return n
 }
 
+// metricsAddr is where /metrics is served; "off" disables it.
+func metricsAddr() string {
+	v := strings.TrimSpace(os.Getenv("WORKER_METRICS_ADDR"))
+	switch v {
+	case "":
+		return ":9091"
+	case "off":
+		return ""
+	}
+	return v
+}
+
+func metricsMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+// deferDelayMs is how long a job of a user at their cap waits before it is offered again:
+// 1s doubling with every deferral, capped at 30s.
+func deferDelayMs(deferCount int) int32 {
+	d := time.Second << min(deferCount, 5)
+	if d > 30*time.Second {
+		d = 30 * time.Second
+	}
+	return int32(d / time.Millisecond)
+}
+
 // exponential backoff with cap, in milliseconds
 func retryDelayMs(retryCount int) int32 {
 	// retryCount is the *next* attempt number (1..)
@@ -83,10 +146,14 @@ func max(a, b int) int {
 }
 
 func getRetryCount(d amqp.Delivery) int {
+	return headerInt(d, retryHeaderKey)
+}
+
+func headerInt(d amqp.Delivery, key string) int {
 	if d.Headers == nil {
 		return 0
 	}
-	v, ok := d.Headers[retryHeaderKey]
+	v, ok := d.Headers[key]
 	if !ok || v == nil {
 		return 0
 	}
@@ -108,17 +175,19 @@ func getRetryCount(d amqp.Delivery) int {
 	}
 }
 
-// publishToQueue republishes the same payload with headers to a queue.
-func publishToQueue(ctx context.Context, ch *amqp.Channel, queue string, body []byte, headers amqp.Table) error {
+// publishToQueue republishes the same payload with headers to a queue and waits for the
+// broker's confirm.
+func publishToQueue(ctx context.Context, rc *rabbitmq.Conn, queue string, body []byte, headers amqp.Table, priority uint8) error {
 	pub := amqp.Publishing{
 		ContentType: "application/json",
 		Body:        body,
 		Headers:     headers,
+		Priority:    priority,
 		// persistent message
 		DeliveryMode: amqp.Persistent,
 		Timestamp:    time.Now(),
 	}
-	return ch.PublishWithContext(ctx, "", queue, false, false, pub)
+	return rc.Publish(ctx, queue, pub)
 }
 
 func shouldFailJob(jobID string) bool {
@@ -155,6 +224,7 @@ func main() {
 
 	// Provider registry (route by session.Provider + session.Model)
 	reg := ai.NewRegistry()
+	reg.SetObserver(metrics.NewProviderObserver(cfg.KnownModels()...))
 
 	// Register Ollama (default)
 	reg.Register("ollama", func(ctx context.Context, model string) (ai.Provider, error) {
@@ -182,163 +252,144 @@ func main() {
 		), nil
 	})
 
-	svc := chat.NewService(repo, reg, cfg.ChatContextWindowSize)
+	// per-provider circuit breakers and the global fallback chain
+	reg.SetBreakerConfig(ai.BreakerConfig{FailureThreshold: cfg.AIBreakerFailures, OpenTimeout: cfg.AIBreakerCooldown})
 
-	conn, err := amqp.Dial(cfg.RabbitURL)
-	if err != nil {
-		log.Fatalf("rabbit dial: %v", err)
+	svc := chat.NewService(repo, reg, cfg.ChatContextWindowSize)
+	if chain, err := ai.ParseTargets(cfg.AIFallbackChain); err != nil {
+		log.Printf("AI_FALLBACK_CHAIN ignored: %v", err)
+	} else {
+		svc.SetFallbackChain(chain)
 	}
-	defer conn.Close()
 
-	ch, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("rabbit channel: %v", err)
+	// Redis: daily token quota accounting and live job events for async replies
+	rds := redisstore.New(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
+	pingCtx, pingCancel := context.WithTimeout(context.Background(), 2*time.Second)
+	if err := rds.Ping(pingCtx); err != nil {
+		log.Printf("redis ping failed, token quota accounting and job events disabled: %v", err)
+	} else {
+		svc.SetUsageCounter(rds)
+		svc.SetJobEvents(rds)
 	}
-	defer ch.Close()
-
-	// Queue names
-	mainQ := cfg.RabbitQueue
-	retryQ := cfg.RabbitQueue + ".retry"
-	dlqQ := cfg.RabbitQueue + ".dlq"
-
-	// Declare DLQ first
-	_, err = ch.QueueDeclare(dlqQ, true, false, false, false, nil)
-	if err != nil {
-		log.Fatalf("queue declare dlq: %v", err)
+	pingCancel()
+	if budgets, err := chat.ResolveTokenBudgets(strings.TrimSpace(cfg.ChatTokenBudgetsPath), cfg.ChatContextTokens); err != nil {
+		log.Printf("token budgets disabled: %v", err)
+	} else {
+		svc.SetTokenBudgets(budgets)
 	}
-
-	// Retry queue: TTL + dead-letter back to main queue
-	_, err = ch.QueueDeclare(retryQ, true, false, false, false, amqp.Table{
-		"x-dead-letter-exchange":    "",
-		"x-dead-letter-routing-key": mainQ,
-		// NOTE: x-message-ttl is per-queue; we will override per-message via "expiration"
+	if p := strings.TrimSpace(cfg.ChatEmbedProvider); p != "" {
+		// the worker embeds new messages for semantic search
+		svc.SetEmbeddings(p, cfg.ChatEmbedModel)
+		docSvc := docs.NewService(docs.NewRepo(gdb), reg, p, cfg.ChatEmbedModel)
+		docSvc.SetTopK(cfg.DocsTopK)
+		svc.SetRetriever(docSvc)
+	}
+	if cfg.ChatToolsEnabled {
+		tools := chat.NewToolRegistry()
+		chat.RegisterBuiltinTools(tools, gdb)
+		svc.SetTools(tools)
+	}
+	if cfg.WebhookSecret != "" {
+		svc.SetWebhooks(cfg.WebhookSecret, cfg.WebhookAllowPrivate)
+	}
+	// must point at the same store as the API to see uploaded images
+	store, err := blob.Open(cfg.AttachmentsStore, cfg.AttachmentsDir, blob.S3Config{
+		Endpoint:  cfg.S3Endpoint,
+		Bucket:    cfg.S3Bucket,
+		Region:    cfg.S3Region,
+		AccessKey: cfg.S3AccessKey,
+		SecretKey: cfg.S3SecretKey,
+		PathStyle: cfg.S3PathStyle,
 	})
 	if err != nil {
-		log.Fatalf("queue declare retry: %v", err)
+		log.Printf("image attachments and batch recognition disabled: %v", err)
+	} else {
+		svc.SetAttachmentStore(store)
 	}
 
-	// Main queue: dead-letter to DLQ when rejected/nacked(requeue=false) or expired
-	_, err = ch.QueueDeclare(mainQ, true, false, false, false, amqp.Table{
-		"x-dead-letter-exchange":    "",
-		"x-dead-letter-routing-key": dlqQ,
+	// reconnects and redeclares the queues whenever the broker goes away
+	rc, err := rabbitmq.Dial(cfg.RabbitURL, cfg.RabbitQueue, rabbitmq.Options{
+		MaxPriority: uint8(min(max(cfg.RabbitMaxPriority, 0), 255)),
+		Queues:      []string{cfg.VisionQueue},
 	})
 	if err != nil {
-		log.Fatalf("queue declare main: %v", err)
+		log.Fatalf("rabbit: %v", err)
+	}
+	defer rc.Close()
+
+	mainQ := cfg.RabbitQueue
+
+	// publishes the job outbox: jobs the API stored but could not enqueue, and stuck jobs
+	svc.SetJobPublisher(rabbitmq.NewPublisher(rc))
+
+	// batch image recognition; without a classifier its jobs wait in their queue
+	var batches *vision.Batches
+	if store != nil {
+		if models := newVisionModels(cfg); models != nil {
+			batches = vision.NewBatches(gdb, store, models)
+			batches.SetPublisher(rabbitmq.NewQueuePublisher(rc, cfg.VisionQueue))
+		}
 	}
 
 	//  strict concurrency control
 	concurrency := workerConcurrency()
 	maxR := maxRetries()
+	limiter := newUserLimiter(userConcurrency(concurrency))
 
-	if err := ch.Qos(concurrency, 0, false); err != nil {
-		log.Fatalf("qos: %v", err)
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	msgs, err := ch.Consume(mainQ, "", false, false, false, false, nil)
-	if err != nil {
-		log.Fatalf("consume: %v", err)
+	if addr := metricsAddr(); addr != "" {
+		srv := &http.Server{Addr: addr, Handler: metricsMux(), ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("metrics server: %v", err)
+			}
+		}()
+		defer srv.Close()
+		log.Printf("metrics listening on %s", addr)
 	}
+	metrics.WorkerConcurrency.Set(float64(concurrency))
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stop()
+	log.Printf("worker started, queue=%s concurrency=%d per_user=%d max_retries=%d", mainQ, concurrency, limiter.max, maxR)
+
+	// prefetch = concurrency; the channel is closed once ctx ends
+	msgs := rc.Consume(ctx, mainQ, concurrency)
+
+	if cfg.WebhookSecret != "" {
+		go runWebhookDispatcher(ctx, svc)
+	}
+	go runOutboxRelay(ctx, svc)
+	go runJobSweeper(ctx, "job", svc.SweepStuckJobs, cfg.JobStuckQueuedAfter, cfg.JobStuckRunningAfter)
+	if strings.TrimSpace(cfg.ChatEmbedProvider) != "" {
+		go runEmbeddingBackfill(ctx, svc)
+	}
+	if store != nil && cfg.AttachmentsUnattachedTTL > 0 {
+		go runAttachmentSweeper(ctx, svc, cfg.AttachmentsUnattachedTTL)
+	}
 
-	log.Printf("worker started, queue=%s concurrency=%d max_retries=%d", mainQ, concurrency, maxR)
+	var wg sync.WaitGroup
+	if batches != nil {
+		go runJobSweeper(ctx, "vision job", batches.SweepStuck, cfg.JobStuckQueuedAfter, cfg.JobStuckRunningAfter)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runVisionWorker(ctx, rc, batches, cfg.VisionQueue, maxR)
+		}()
+	}
 
 	// worker pool
 	jobs := make(chan amqp.Delivery, concurrency*2)
 
-	var wg sync.WaitGroup
 	wg.Add(concurrency)
 	for i := 0; i < concurrency; i++ {
 		go func(workerID int) {
 			defer wg.Done()
 			for d := range jobs {
-				var m jobMsg
-				if err := json.Unmarshal(d.Body, &m); err != nil || m.JobID == "" {
-					log.Printf("worker=%d bad message: %v", workerID, err)
-					// reject -> goes to DLQ by main queue's DLX
-					_ = d.Reject(false)
-					continue
-				}
-
-				start := time.Now()
-
-				// test-only failure injection, fail should before processing
-				var err error
-				if shouldFailJobOnce(m.JobID) {
-					// disable after first trigger so the retry attempt can proceed
-					err = fmt.Errorf("simulated failure once (FAIL_ONCE_JOB_ID=%s)", m.JobID)
-				} else if shouldFailJob(m.JobID) {
-					err = fmt.Errorf("simulated failure (FAIL_JOB_ID=%s)", m.JobID)
-				} else {
-					err = handleJob(ctx, svc, repo, m.JobID)
-				}
-
-				if err != nil {
-					cost := time.Since(start)
-					retryCount := getRetryCount(d)
-					nextRetry := retryCount + 1
-
-					log.Printf("worker=%d job=%s failed cost=%s retry=%d err=%v", workerID, m.JobID, cost, retryCount, err)
-
-					// Decide retry vs DLQ
-					if retryCount < maxR {
-						// Publish to retry queue with incremented retry count and delay.
-						h := amqp.Table{}
-						for k, v := range d.Headers {
-							h[k] = v
-						}
-						h[retryHeaderKey] = int32(nextRetry)
-						h[errorHeaderKey] = truncateErr(err)
-
-						delay := retryDelayMs(nextRetry)
-						pub := amqp.Publishing{
-							ContentType:  "application/json",
-							Body:         d.Body,
-							Headers:      h,
-							DeliveryMode: amqp.Persistent,
-							Timestamp:    time.Now(),
-							Expiration:   strconv.Itoa(int(delay)), // per-message TTL in ms
-						}
-
-						if pubErr := ch.PublishWithContext(ctx, "", retryQ, false, false, pub); pubErr != nil {
-							// If we can't re-publish, do NOT ack; let main-queue DLQ handle it via reject.
-							log.Printf("worker=%d republish-retry failed job=%s err=%v", workerID, m.JobID, pubErr)
-							_ = d.Reject(false)
-							continue
-						}
-
-						// Ack original so it doesn't stay unacked / redeliver immediately.
-						if ackErr := d.Ack(false); ackErr != nil {
-							log.Printf("worker=%d ack-after-republish failed job=%s err=%v", workerID, m.JobID, ackErr)
-						}
-						continue
-					}
-
-					// Exceeded retries: send to DLQ with context, then ack.
-					h := amqp.Table{}
-					for k, v := range d.Headers {
-						h[k] = v
-					}
-					h[retryHeaderKey] = int32(retryCount)
-					h[errorHeaderKey] = truncateErr(err)
-
-					if pubErr := publishToQueue(ctx, ch, dlqQ, d.Body, h); pubErr != nil {
-						log.Printf("worker=%d publish-dlq failed job=%s err=%v", workerID, m.JobID, pubErr)
-						// fallback: reject to main queue's DLQ routing
-						_ = d.Reject(false)
-						continue
-					}
-
-					if ackErr := d.Ack(false); ackErr != nil {
-						log.Printf("worker=%d ack-after-dlq failed job=%s err=%v", workerID, m.JobID, ackErr)
-					}
-					continue
-				}
-
-				if err := d.Ack(false); err != nil {
-					log.Printf("worker=%d ack failed job=%s err=%v", workerID, m.JobID, err)
-				}
+				metrics.WorkerBacklog.Set(float64(len(jobs)))
+				metrics.WorkerBusy.Inc()
+				processDelivery(ctx, rc, svc, limiter, d, workerID, maxR, mainQ)
+				metrics.WorkerBusy.Dec()
 			}
 		}(i)
 	}
@@ -354,78 +405,405 @@ func main() {
 
 		case d, ok := <-msgs:
 			if !ok {
-				log.Printf("delivery channel closed")
-				time.Sleep(1 * time.Second)
+				// only once ctx ended; lost connections are resubscribed by rc
+				msgs = nil
 				continue
 			}
 			jobs <- d
+			metrics.WorkerBacklog.Set(float64(len(jobs)))
 		}
 	}
 }
 
-func handleJob(ctx context.Context, svc *chat.Service, repo *chat.Repo, jobID string) error {
-	jobStart := time.Now()
+// processDelivery runs one job and then acks it, schedules a retry or dead-letters it.
+func processDelivery(ctx context.Context, rc *rabbitmq.Conn, svc *chat.Service, limiter *userLimiter, d amqp.Delivery, workerID, maxR int, queue string) {
+	var m jobMsg
+	if err := json.Unmarshal(d.Body, &m); err != nil || m.JobID == "" {
+		log.Printf("worker=%d bad message: %v", workerID, err)
+		// reject -> goes to DLQ by main queue's DLX
+		_ = d.Reject(false)
+		metrics.JobsProcessed.WithLabelValues("rejected").Inc()
+		return
+	}
 
-	t0 := time.Now()
-	_ = repo.UpdateJobStatusRunning(ctx, jobID)
-	updateCost := time.Since(t0)
+	if m.UserID == 0 {
+		// published before messages carried the user
+		if j, err := svc.GetJob(ctx, m.JobID); err == nil {
+			m.UserID = j.UserID
+		}
+	}
+	if m.UserID != 0 {
+		if !limiter.acquire(m.UserID) {
+			deferDelivery(ctx, rc, svc, d, workerID, m.JobID, rabbitmq.RetryQueue(queue))
+			return
+		}
+		defer limiter.release(m.UserID)
+	}
+
+	start := time.Now()
+
+	// test-only failure injection, fail should before processing
+	var err error
+	if shouldFailJobOnce(m.JobID) {
+		// disable after first trigger so the retry attempt can proceed
+		err = fmt.Errorf("simulated failure once (FAIL_ONCE_JOB_ID=%s)", m.JobID)
+	} else if shouldFailJob(m.JobID) {
+		err = fmt.Errorf("simulated failure (FAIL_JOB_ID=%s)", m.JobID)
+	} else {
+		err = handleJob(ctx, svc, m.JobID)
+	}
+
+	if errors.Is(err, chat.ErrJobCancelled) {
+		// cancelled by the user: nothing to retry
+		log.Printf("worker=%d job=%s cancelled cost=%s", workerID, m.JobID, time.Since(start))
+		if ackErr := d.Ack(false); ackErr != nil {
+			log.Printf("worker=%d ack failed job=%s err=%v", workerID, m.JobID, ackErr)
+		}
+		observeJob("cancelled", start)
+		return
+	}
 
-	t1 := time.Now()
-	j, err := repo.GetJobByID(ctx, jobID)
-	getJobCost := time.Since(t1)
 	if err != nil {
-		if time.Since(jobStart) > 500*time.Millisecond {
-			log.Printf("job_timing job=%s update=%s getJob=%s total=%s err=%v",
-				jobID, updateCost, getJobCost, time.Since(jobStart), err,
-			)
+		log.Printf("worker=%d job=%s failed cost=%s retry=%d err=%v", workerID, m.JobID, time.Since(start), getRetryCount(d), err)
+		outcome := retryOrDeadLetter(ctx, rc, d, workerID, m.JobID, err, maxR, queue,
+			func(errMsg string) error { return svc.RetryJob(ctx, m.JobID, errMsg) },
+			func(errMsg string) error { return svc.FailJob(ctx, m.JobID, errMsg) },
+		)
+		observeJob(outcome, start)
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Printf("worker=%d ack failed job=%s err=%v", workerID, m.JobID, err)
+	}
+	observeJob("succeeded", start)
+}
+
+// retryOrDeadLetter handles a failed delivery of job jobID from queue. While retries remain
+// the job is reset with requeue and goes around the retry queue with a growing delay;
+// after that it is marked with fail and moved to the DLQ with the last error. The delivery
+// is acked once its copy is published, or rejected into the DLQ if that fails. It returns
+// the outcome: "retried" or "dead_lettered".
+func retryOrDeadLetter(ctx context.Context, rc *rabbitmq.Conn, d amqp.Delivery, workerID int, jobID string, err error, maxR int, queue string, requeue, fail func(errMsg string) error) string {
+	retryCount := getRetryCount(d)
+	nextRetry := retryCount + 1
+
+	// Decide retry vs DLQ
+	if retryCount < maxR {
+		// Publish to retry queue with incremented retry count and delay.
+		h := amqp.Table{}
+		for k, v := range d.Headers {
+			h[k] = v
 		}
-		return err
+		h[retryHeaderKey] = int32(nextRetry)
+		h[errorHeaderKey] = truncateErr(err)
+
+		delay := retryDelayMs(nextRetry)
+		pub := amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         d.Body,
+			Headers:      h,
+			DeliveryMode: amqp.Persistent,
+			Priority:     d.Priority,
+			Timestamp:    time.Now(),
+			Expiration:   strconv.Itoa(int(delay)), // per-message TTL in ms
+		}
+
+		if dbErr := requeue(truncateErr(err)); dbErr != nil {
+			log.Printf("worker=%d requeue job=%s err=%v", workerID, jobID, dbErr)
+		}
+		if pubErr := rc.Publish(ctx, rabbitmq.RetryQueue(queue), pub); pubErr != nil {
+			// If we can't re-publish, do NOT ack; let main-queue DLQ handle it via reject.
+			log.Printf("worker=%d republish-retry failed job=%s err=%v", workerID, jobID, pubErr)
+			_ = d.Reject(false)
+			return "dead_lettered"
+		}
+
+		// Ack original so it doesn't stay unacked / redeliver immediately.
+		if ackErr := d.Ack(false); ackErr != nil {
+			log.Printf("worker=%d ack-after-republish failed job=%s err=%v", workerID, jobID, ackErr)
+		}
+		return "retried"
 	}
 
-	t2 := time.Now()
-	reply, assistantMsgID, err := svc.GenerateAssistantReplyAndInsert(ctx, j.UserID, j.SessionID)
-	genCost := time.Since(t2)
+	// Exceeded retries: send to DLQ with context, then ack.
+	h := amqp.Table{}
+	for k, v := range d.Headers {
+		h[k] = v
+	}
+	h[retryHeaderKey] = int32(retryCount)
+	h[errorHeaderKey] = truncateErr(err)
+
+	if dbErr := fail(err.Error()); dbErr != nil {
+		log.Printf("worker=%d mark-failed job=%s err=%v", workerID, jobID, dbErr)
+	}
+
+	if pubErr := publishToQueue(ctx, rc, rabbitmq.DeadLetterQueue(queue), d.Body, h, d.Priority); pubErr != nil {
+		log.Printf("worker=%d publish-dlq failed job=%s err=%v", workerID, jobID, pubErr)
+		// fallback: reject to main queue's DLQ routing
+		_ = d.Reject(false)
+		return "dead_lettered"
+	}
+
+	if ackErr := d.Ack(false); ackErr != nil {
+		log.Printf("worker=%d ack-after-dlq failed job=%s err=%v", workerID, jobID, ackErr)
+	}
+	return "dead_lettered"
+}
+
+// deferDelivery sends a job of a user at their concurrency cap around the retry queue again,
+// without counting a retry, and acks the original. The job stays queued.
+func deferDelivery(ctx context.Context, rc *rabbitmq.Conn, svc *chat.Service, d amqp.Delivery, workerID int, jobID, retryQ string) {
+	start := time.Now()
+	deferCount := headerInt(d, deferHeaderKey)
+
+	h := amqp.Table{}
+	for k, v := range d.Headers {
+		h[k] = v
+	}
+	h[deferHeaderKey] = int32(deferCount + 1)
+	pub := amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         d.Body,
+		Headers:      h,
+		DeliveryMode: amqp.Persistent,
+		Priority:     d.Priority,
+		Timestamp:    time.Now(),
+		Expiration:   strconv.Itoa(int(deferDelayMs(deferCount))),
+	}
 
+	// keeps the sweeper from taking a long-deferred job for lost
+	if err := svc.DeferJob(ctx, jobID); err != nil {
+		log.Printf("worker=%d defer job=%s err=%v", workerID, jobID, err)
+	}
+	if err := rc.Publish(ctx, retryQ, pub); err != nil {
+		log.Printf("worker=%d republish-deferred failed job=%s err=%v", workerID, jobID, err)
+		_ = d.Nack(false, true)
+		observeJob("deferred", start)
+		return
+	}
+	if err := d.Ack(false); err != nil {
+		log.Printf("worker=%d ack-after-defer failed job=%s err=%v", workerID, jobID, err)
+	}
+	observeJob("deferred", start)
+}
+
+// userLimiter caps the jobs one user has in progress in this worker. It only counts this
+// process's jobs; other workers keep their own counts.
+type userLimiter struct {
+	mu      sync.Mutex
+	max     int
+	running map[uint64]int
+}
+
+func newUserLimiter(max int) *userLimiter {
+	return &userLimiter{max: max, running: make(map[uint64]int)}
+}
+
+func (l *userLimiter) acquire(userID uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[userID] >= l.max {
+		return false
+	}
+	l.running[userID]++
+	return true
+}
+
+func (l *userLimiter) release(userID uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[userID] <= 1 {
+		delete(l.running, userID)
+		return
+	}
+	l.running[userID]--
+}
+
+func observeJob(outcome string, start time.Time) {
+	metrics.JobsProcessed.WithLabelValues(outcome).Inc()
+	metrics.JobDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
+// handleJob runs one delivery of a job. Failures are recorded by the caller, which knows
+// whether the job will be retried.
+func handleJob(ctx context.Context, svc *chat.Service, jobID string) error {
+	jobStart := time.Now()
+
+	t0 := time.Now()
+	j, err := svc.StartJob(ctx, jobID)
+	startCost := time.Since(t0)
+	metrics.JobStageDuration.WithLabelValues("mark_running").Observe(startCost.Seconds())
+	if errors.Is(err, chat.ErrJobTaken) {
+		// duplicate delivery, e.g. published again by the outbox relay
+		log.Printf("job=%s skipped: already running", jobID)
+		return nil
+	}
 	if err != nil {
-		t3 := time.Now()
-		_ = repo.MarkJobFailed(ctx, jobID, err.Error())
-		markFailCost := time.Since(t3)
+		log.Printf("job_timing_failed job=%s start=%s err=%v", jobID, startCost, err)
+		return err
+	}
+	switch j.Status {
+	case chat.JobRunning:
+	case chat.JobCancelled:
+		return chat.ErrJobCancelled
+	default:
+		// finished by an earlier delivery
+		log.Printf("job=%s skipped status=%s", jobID, j.Status)
+		return nil
+	}
 
-		log.Printf("job_timing_failed job=%s update=%s getJob=%s gen=%s markFail=%s total=%s err=%v",
-			jobID, updateCost, getJobCost, genCost, markFailCost, time.Since(jobStart), err,
+	t1 := time.Now()
+	assistantMsgID, err := svc.RunJob(ctx, j)
+	genCost := time.Since(t1)
+	metrics.JobStageDuration.WithLabelValues("generate").Observe(genCost.Seconds())
+	if err != nil {
+		log.Printf("job_timing_failed job=%s start=%s gen=%s total=%s err=%v",
+			jobID, startCost, genCost, time.Since(jobStart), err,
 		)
 		return err
 	}
-	_ = reply
 
-	t4 := time.Now()
-	if err := repo.MarkJobSucceeded(ctx, jobID, assistantMsgID); err != nil {
-		markSuccCost := time.Since(t4)
-		log.Printf("job_timing_failed job=%s update=%s getJob=%s gen=%s markSucc=%s total=%s err=%v",
-			jobID, updateCost, getJobCost, genCost, markSuccCost, time.Since(jobStart), err,
+	t2 := time.Now()
+	if err := svc.FinishJob(ctx, jobID, assistantMsgID); err != nil {
+		markSuccCost := time.Since(t2)
+		log.Printf("job_timing_failed job=%s start=%s gen=%s markSucc=%s total=%s err=%v",
+			jobID, startCost, genCost, markSuccCost, time.Since(jobStart), err,
 		)
 		return err
 	}
-	markSuccCost := time.Since(t4)
+	markSuccCost := time.Since(t2)
+	metrics.JobStageDuration.WithLabelValues("mark_done").Observe(markSuccCost.Seconds())
 
 	total := time.Since(jobStart)
 
 	if total > 2*time.Second {
-		log.Printf("job_timing job=%s update=%s getJob=%s gen=%s markSucc=%s total=%s",
-			jobID, updateCost, getJobCost, genCost, markSuccCost, total,
+		log.Printf("job_timing job=%s start=%s gen=%s markSucc=%s total=%s",
+			jobID, startCost, genCost, markSuccCost, total,
 		)
 	}
 
 	return nil
 }
 
-// truncateErr keeps headers small
+// runWebhookDispatcher retries pending job webhooks until ctx ends. First attempts are made
+// as jobs finish; this only picks up the failed ones once their backoff is over.
+func runWebhookDispatcher(ctx context.Context, svc *chat.Service) {
+	t := time.NewTicker(webhookDispatchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := svc.DeliverDueWebhooks(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("webhook dispatch failed: %v", err)
+			}
+		}
+	}
+}
+
+// runOutboxRelay publishes due job outbox entries until ctx ends. The API publishes new jobs
+// itself; this picks up the ones it could not, and the jobs requeued by runJobSweeper.
+func runOutboxRelay(ctx context.Context, svc *chat.Service) {
+	t := time.NewTicker(outboxRelayInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := svc.RelayOutbox(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("outbox relay failed: %v", err)
+			}
+		}
+	}
+}
+
+// runEmbeddingBackfill embeds messages for semantic search until ctx ends, right away again
+// while a backlog remains.
+func runEmbeddingBackfill(ctx context.Context, svc *chat.Service) {
+	t := time.NewTicker(embedBackfillInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for {
+			n, err := svc.BackfillEmbeddings(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("embedding backfill failed: %v", err)
+			}
+			if err != nil || n == 0 || ctx.Err() != nil {
+				break
+			}
+			log.Printf("embedding backfill embedded %d message(s)", n)
+		}
+	}
+}
+
+// runAttachmentSweeper removes uploads left unattached for longer than ttl until ctx ends.
+func runAttachmentSweeper(ctx context.Context, svc *chat.Service, ttl time.Duration) {
+	t := time.NewTicker(attachmentSweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := svc.SweepUnattachedAttachments(ctx, time.Now().Add(-ttl))
+			if err != nil && ctx.Err() == nil {
+				log.Printf("attachment sweep failed: %v", err)
+			}
+			if n > 0 {
+				log.Printf("attachment sweep removed %d upload(s)", n)
+			}
+		}
+	}
+}
+
+// runJobSweeper requeues jobs stuck in queued or running for longer than the given thresholds
+// (0 disables a check) with sweep until ctx ends. kind names the jobs in logs.
+func runJobSweeper(ctx context.Context, kind string, sweep func(ctx context.Context, queuedBefore, runningBefore time.Time) (int, error), queuedAfter, runningAfter time.Duration) {
+	if queuedAfter <= 0 && runningAfter <= 0 {
+		return
+	}
+	t := time.NewTicker(jobSweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			now := time.Now()
+			var queuedBefore, runningBefore time.Time
+			if queuedAfter > 0 {
+				queuedBefore = now.Add(-queuedAfter)
+			}
+			if runningAfter > 0 {
+				runningBefore = now.Add(-runningAfter)
+			}
+			n, err := sweep(ctx, queuedBefore, runningBefore)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("%s sweep failed: %v", kind, err)
+			}
+			if n > 0 {
+				log.Printf("%s sweep requeued %d job(s)", kind, n)
+			}
+		}
+	}
+}
+
+// truncateErr keeps headers small. Joined errors (one per fallback target) stay apart as
+// "; "-separated parts so DLQ tooling can tell which providers failed.
 func truncateErr(err error) string {
 	if err == nil {
 		return ""
 	}
 	s := err.Error()
-	s = strings.ReplaceAll(s, "\n", " ")
+	s = strings.ReplaceAll(s, "\n", "; ")
 	if len(s) > 500 {
 		return s[:500]
 	}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/suPer8Hu/ai-platform/internal/config"
+	"github.com/suPer8Hu/ai-platform/internal/metrics"
+	"github.com/suPer8Hu/ai-platform/internal/store/rabbitmq"
+	"github.com/suPer8Hu/ai-platform/internal/vision"
+)
+
+// newVisionModels loads the classifiers the same way the API does; nil when none is
+// configured or loads.
+func newVisionModels(cfg config.Config) *vision.Registry {
+	models, err := vision.LoadRegistry(cfg.VisionModelsPath, vision.Config{
+		ModelPath:      cfg.VisionModelPath,
+		LabelsPath:     cfg.VisionLabelsPath,
+		InputH:         cfg.VisionInputH,
+		InputW:         cfg.VisionInputW,
+		InputName:      cfg.VisionInputName,
+		OutputName:     cfg.VisionOutputName,
+		OrtLibraryPath: cfg.VisionOrtLibPath,
+	}, cfg.VisionTopK, cfg.VisionTopKMax)
+	if err != nil {
+		log.Printf("batch recognition disabled: %v", err)
+		return nil
+	}
+	return models
+}
+
+// runVisionWorker runs batch recognition jobs from queue one at a time until ctx ends; the
+// classifier handles one image at a time anyway. Failed jobs take the same retry queue and
+// DLQ path as chat jobs.
+func runVisionWorker(ctx context.Context, rc *rabbitmq.Conn, batches *vision.Batches, queue string, maxR int) {
+	log.Printf("vision worker started, queue=%s", queue)
+	for d := range rc.Consume(ctx, queue, 1) {
+		processVisionDelivery(ctx, rc, batches, d, maxR, queue)
+	}
+}
+
+func processVisionDelivery(ctx context.Context, rc *rabbitmq.Conn, batches *vision.Batches, d amqp.Delivery, maxR int, queue string) {
+	const workerID = -1 // logs tell it apart from the chat pool
+
+	var m jobMsg
+	if err := json.Unmarshal(d.Body, &m); err != nil || m.JobID == "" {
+		log.Printf("vision worker bad message: %v", err)
+		_ = d.Reject(false)
+		metrics.VisionJobsProcessed.WithLabelValues("rejected").Inc()
+		return
+	}
+
+	start := time.Now()
+	err := batches.Run(ctx, m.JobID)
+	if errors.Is(err, vision.ErrBatchTaken) {
+		// duplicate delivery, e.g. published again by the sweeper
+		log.Printf("vision job=%s skipped: already running", m.JobID)
+		err = nil
+	}
+	if err != nil && ctx.Err() != nil {
+		// shutting down: hand the job back as it is; the next run resumes at the first
+		// image without a result
+		if rqErr := batches.Requeue(context.WithoutCancel(ctx), m.JobID, "worker shut down"); rqErr != nil {
+			log.Printf("vision job=%s requeue err=%v", m.JobID, rqErr)
+		}
+		_ = d.Nack(false, true)
+		return
+	}
+	if err != nil {
+		log.Printf("vision job=%s failed cost=%s retry=%d err=%v", m.JobID, time.Since(start), getRetryCount(d), err)
+		outcome := retryOrDeadLetter(ctx, rc, d, workerID, m.JobID, err, maxR, queue,
+			func(errMsg string) error { return batches.Requeue(ctx, m.JobID, errMsg) },
+			func(errMsg string) error { return batches.Fail(ctx, m.JobID, errMsg) },
+		)
+		metrics.VisionJobsProcessed.WithLabelValues(outcome).Inc()
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Printf("vision ack failed job=%s err=%v", m.JobID, err)
+	}
+	metrics.VisionJobsProcessed.WithLabelValues("succeeded").Inc()
+	if cost := time.Since(start); cost > 2*time.Second {
+		log.Printf("vision_job_timing job=%s total=%s", m.JobID, cost)
+	}
+}
@@ -0,0 +1,132 @@
+package ai
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned for calls rejected by an open circuit breaker.
+var ErrCircuitOpen = errors.New("circuit open")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half_open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+type BreakerConfig struct {
+	// consecutive provider faults (see IsProviderFault) that open the circuit; <= 0 disables breakers
+	FailureThreshold int
+	// how long an open circuit rejects calls before letting a single probe through
+	OpenTimeout time.Duration
+}
+
+// CircuitBreaker is a consecutive-failure breaker. After OpenTimeout an open circuit
+// turns half-open and admits one probe: success closes it, a fault re-opens it.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	cfg      BreakerConfig
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	onChange func(BreakerState)
+	now      func() time.Time
+}
+
+func NewCircuitBreaker(cfg BreakerConfig, onChange func(BreakerState)) *CircuitBreaker {
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	return &CircuitBreaker{cfg: cfg, onChange: onChange, now: time.Now}
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether a call may go through. Every allowed call must be followed by Record.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cfg.OpenTimeout {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Record reports the outcome of an allowed call.
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fault := IsProviderFault(err)
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probing = false
+		if callerGaveUp(err) {
+			// the probe told us nothing; let the next call try again
+			return
+		}
+		if fault {
+			b.trip()
+			return
+		}
+		b.failures = 0
+		b.setState(BreakerClosed)
+	case BreakerClosed:
+		if !fault {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.cfg.FailureThreshold {
+			b.trip()
+		}
+	}
+	// open: a straggler admitted before the trip, nothing to learn
+}
+
+func (b *CircuitBreaker) trip() {
+	b.openedAt = b.now()
+	b.failures = 0
+	b.setState(BreakerOpen)
+}
+
+func (b *CircuitBreaker) setState(s BreakerState) {
+	if b.state == s {
+		return
+	}
+	b.state = s
+	if b.onChange != nil {
+		b.onChange(s)
+	}
+}
@@ -0,0 +1,57 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Embedder is an optional interface for providers that can turn texts into vectors.
+// The result has one vector per input, in input order.
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// Embedder returns the embedding model of provider name. It fails when the provider
+// does not implement Embedder.
+func (r *Registry) Embedder(ctx context.Context, name, model string) (Embedder, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	r.mu.RLock()
+	f, ok := r.factories[name]
+	obs := r.obs
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown ai provider: %s", name)
+	}
+	p, err := f(ctx, model)
+	if err != nil {
+		return nil, err
+	}
+	e, ok := p.(Embedder)
+	if !ok {
+		return nil, fmt.Errorf("ai provider %s does not support embeddings", name)
+	}
+	m := strings.TrimSpace(model)
+	if m == "" {
+		m = modelName(p)
+	}
+	if obs != nil {
+		e = observedEmbedder{inner: e, provider: name, model: m, obs: obs}
+	}
+	return e, nil
+}
+
+type observedEmbedder struct {
+	inner    Embedder
+	provider string
+	model    string
+	obs      Observer
+}
+
+func (o observedEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	start := time.Now()
+	out, err := o.inner.Embed(ctx, texts)
+	o.obs.ObserveCall(o.provider, o.model, "embed", time.Since(start), err)
+	return out, err
+}
@@ -0,0 +1,42 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// StatusError is a non-2xx HTTP response from a provider.
+type StatusError struct {
+	Provider   string
+	StatusCode int
+	// Message is the (truncated) response body, if any
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s: %s", e.Provider, e.Message)
+	}
+	return fmt.Sprintf("%s: status %d", e.Provider, e.StatusCode)
+}
+
+// IsProviderFault reports whether err says something about the provider's health
+// (unreachable, overloaded, rate limited) rather than about the request or the caller.
+// Only these errors trip circuit breakers. A cancelled or expired context is the caller
+// giving up: a client leaving or a short request deadline says nothing about the provider.
+func IsProviderFault(err error) bool {
+	if err == nil || callerGaveUp(err) {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode == 429 || se.StatusCode == 408 || se.StatusCode >= 500
+	}
+	return true
+}
+
+// callerGaveUp reports whether err comes from the caller's context ending.
+func callerGaveUp(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,215 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Target is one entry of a fallback chain.
+type Target struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+}
+
+func (t Target) String() string {
+	if t.Model == "" {
+		return t.Provider
+	}
+	return t.Provider + ":" + t.Model
+}
+
+// ParseTargets parses a comma-separated list of provider[:model] entries, e.g.
+// "openrouter:openai/gpt-4o-mini,ollama:llama3:latest". Only the first ':' separates
+// provider from model, since model names may contain ':' themselves.
+func ParseTargets(spec string) ([]Target, error) {
+	var out []Target
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		provider, model, _ := strings.Cut(part, ":")
+		provider = strings.ToLower(strings.TrimSpace(provider))
+		if provider == "" {
+			return nil, fmt.Errorf("invalid fallback target %q", part)
+		}
+		out = append(out, Target{Provider: provider, Model: strings.TrimSpace(model)})
+	}
+	return out, nil
+}
+
+// FormatTargets is the inverse of ParseTargets.
+func FormatTargets(ts []Target) string {
+	parts := make([]string, 0, len(ts))
+	for _, t := range ts {
+		parts = append(parts, t.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// Fallback returns a provider that tries chain in order. A target is skipped while its
+// provider's circuit is open, and the next one is tried when a call fails. Streams only
+// fall back before their first chunk; after that a failure is returned as is.
+//
+// Targets without tool support answer ChatWithTools with a plain Chat, and targets
+// without streaming answer StreamChat with a single chunk, so a degraded reply beats none.
+func (r *Registry) Fallback(chain []Target) Provider {
+	return &fallbackProvider{reg: r, chain: chain}
+}
+
+type fallbackProvider struct {
+	reg   *Registry
+	chain []Target
+}
+
+// noFallback marks a failure that must not move on to the next target.
+type noFallback struct{ err error }
+
+func (e noFallback) Error() string { return e.err.Error() }
+
+// try calls fn with each target until one succeeds. fn gets the resolved model name.
+func (f *fallbackProvider) try(ctx context.Context, fn func(p Provider, model string) error) error {
+	if len(f.chain) == 0 {
+		return errors.New("no ai provider configured")
+	}
+	var errs []error
+	for i, t := range f.chain {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p, model, err := f.reg.get(ctx, t.Provider, t.Model)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		b := f.reg.breaker(t.Provider, model)
+		if b != nil && !b.Allow() {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", t.Provider, model, ErrCircuitOpen))
+			continue
+		}
+
+		err = fn(p, model)
+		var stop noFallback
+		isStop := errors.As(err, &stop)
+		if isStop {
+			err = stop.err
+		}
+		if b != nil {
+			b.Record(err)
+		}
+		if err == nil {
+			if i > 0 {
+				if obs := f.reg.observer(); obs != nil {
+					obs.ObserveFallback(t.Provider, model)
+				}
+			}
+			return nil
+		}
+		if isStop || ctx.Err() != nil {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return fmt.Errorf("all ai providers failed: %w", errors.Join(errs...))
+}
+
+func (f *fallbackProvider) Chat(ctx context.Context, messages []Message) (Response, error) {
+	var out Response
+	err := f.try(ctx, func(p Provider, model string) error {
+		resp, err := p.Chat(ctx, messages)
+		if err != nil {
+			return err
+		}
+		out = withModel(resp, model)
+		return nil
+	})
+	return out, err
+}
+
+func (f *fallbackProvider) ChatWithTools(ctx context.Context, messages []Message, tools []Tool) (Response, error) {
+	var out Response
+	err := f.try(ctx, func(p Provider, model string) error {
+		var resp Response
+		var err error
+		if tp, ok := p.(ToolProvider); ok {
+			resp, err = tp.ChatWithTools(ctx, messages, tools)
+		} else {
+			resp, err = p.Chat(ctx, messages)
+		}
+		if err != nil {
+			return err
+		}
+		out = withModel(resp, model)
+		return nil
+	})
+	return out, err
+}
+
+func (f *fallbackProvider) StreamChat(ctx context.Context, messages []Message) (<-chan StreamChunk, <-chan error) {
+	chunks := make(chan StreamChunk, 16)
+	errs := make(chan error, 1)
+
+	send := func(c StreamChunk) {
+		select {
+		case chunks <- c:
+		case <-ctx.Done():
+		}
+	}
+
+	go func() {
+		defer close(chunks)
+		defer close(errs)
+
+		err := f.try(ctx, func(p Provider, model string) error {
+			sp, ok := p.(StreamProvider)
+			if !ok {
+				resp, err := p.Chat(ctx, messages)
+				if err != nil {
+					return err
+				}
+				resp = withModel(resp, model)
+				send(StreamChunk{Delta: resp.Content})
+				send(StreamChunk{Usage: &resp.Usage, Model: resp.Model})
+				return nil
+			}
+
+			in, inErrs := sp.StreamChat(ctx, messages)
+			started, sawModel := false, false
+			for c := range in {
+				started = true
+				if c.Model != "" {
+					sawModel = true
+				}
+				send(c)
+			}
+			if err := <-inErrs; err != nil {
+				if started {
+					// the caller already has part of this reply
+					return noFallback{err}
+				}
+				return err
+			}
+			if !sawModel && model != "" {
+				send(StreamChunk{Model: model})
+			}
+			return nil
+		})
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return chunks, errs
+}
+
+// withModel makes sure the response names the model that answered.
+func withModel(resp Response, model string) Response {
+	if resp.Model == "" {
+		resp.Model = model
+	}
+	return resp
+}
@@ -0,0 +1,112 @@
+package ai
+
+import (
+	"context"
+	"time"
+)
+
+// Observer receives per-call measurements for providers handed out by a Registry.
+// op is "chat", "chat_tools", "stream" or "embed".
+type Observer interface {
+	ObserveCall(provider, model, op string, d time.Duration, err error)
+	ObserveFirstToken(provider, model string, d time.Duration)
+	// ObserveBreakerState is called on every circuit breaker transition.
+	ObserveBreakerState(provider, model string, state BreakerState)
+	// ObserveFallback is called when a reply came from a target other than the first in its chain.
+	ObserveFallback(provider, model string)
+}
+
+// observe wraps p so every call is reported to obs. The wrapper implements
+// ToolProvider/StreamProvider only when p does, so capability checks still work.
+func observe(p Provider, provider, model string, obs Observer) Provider {
+	base := &observed{inner: p, provider: provider, model: model, obs: obs}
+	_, tools := p.(ToolProvider)
+	_, stream := p.(StreamProvider)
+	switch {
+	case tools && stream:
+		return observedToolsStream{observedTools{base}, observedStream{base}}
+	case tools:
+		return observedTools{base}
+	case stream:
+		return observedStream{base}
+	default:
+		return base
+	}
+}
+
+type observed struct {
+	inner    Provider
+	provider string
+	model    string
+	obs      Observer
+}
+
+func (o *observed) Chat(ctx context.Context, messages []Message) (Response, error) {
+	start := time.Now()
+	resp, err := o.inner.Chat(ctx, messages)
+	o.obs.ObserveCall(o.provider, o.model, "chat", time.Since(start), err)
+	return resp, err
+}
+
+type observedTools struct{ *observed }
+
+func (o observedTools) ChatWithTools(ctx context.Context, messages []Message, tools []Tool) (Response, error) {
+	start := time.Now()
+	resp, err := o.inner.(ToolProvider).ChatWithTools(ctx, messages, tools)
+	o.obs.ObserveCall(o.provider, o.model, "chat_tools", time.Since(start), err)
+	return resp, err
+}
+
+type observedStream struct{ *observed }
+
+func (o observedStream) StreamChat(ctx context.Context, messages []Message) (<-chan StreamChunk, <-chan error) {
+	start := time.Now()
+	inChunks, inErrs := o.inner.(StreamProvider).StreamChat(ctx, messages)
+
+	chunks := make(chan StreamChunk, 16)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+		defer close(errs)
+
+		first := true
+		for c := range inChunks {
+			if first && c.Delta != "" {
+				first = false
+				o.obs.ObserveFirstToken(o.provider, o.model, time.Since(start))
+			}
+			select {
+			case chunks <- c:
+			case <-ctx.Done():
+				// the reader is gone; keep draining so the inner provider can exit
+			}
+		}
+		err := <-inErrs
+		o.obs.ObserveCall(o.provider, o.model, "stream", time.Since(start), err)
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return chunks, errs
+}
+
+type observedToolsStream struct {
+	observedTools
+	observedStream
+}
+
+// both embedded wrappers share the same *observed; resolve the ambiguity explicitly
+func (o observedToolsStream) Chat(ctx context.Context, messages []Message) (Response, error) {
+	return o.observedTools.Chat(ctx, messages)
+}
+
+// modelName reports the model a built-in provider was configured with.
+func modelName(p Provider) string {
+	switch t := p.(type) {
+	case *OllamaProvider:
+		return t.Model
+	case *OpenRouterProvider:
+		return t.Model
+	}
+	return ""
+}
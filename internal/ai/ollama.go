@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,9 +19,12 @@ type OllamaProvider struct {
 }
 
 type ollamaStreamResp struct {
-	Message ollamaMsg `json:"message"`
-	Done    bool      `json:"done"`
-	Error   string    `json:"error,omitempty"`
+	Model           string    `json:"model"`
+	Message         ollamaMsg `json:"message"`
+	Done            bool      `json:"done"`
+	PromptEvalCount int       `json:"prompt_eval_count"`
+	EvalCount       int       `json:"eval_count"`
+	Error           string    `json:"error,omitempty"`
 }
 
 func NewOllamaProvider(baseURL, model string) *OllamaProvider {
@@ -38,74 +42,202 @@ func NewOllamaProvider(baseURL, model string) *OllamaProvider {
 }
 
 type ollamaChatReq struct {
-	Model    string      `json:"model"`
-	Messages []ollamaMsg `json:"messages"`
-	Stream   bool        `json:"stream"`
+	Model    string         `json:"model"`
+	Messages []ollamaMsg    `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Tools    []ollamaTool   `json:"tools,omitempty"`
+	Options  map[string]any `json:"options,omitempty"`
+}
+
+// ollamaOptions maps generation params to Ollama's model options.
+func ollamaOptions(ctx context.Context) map[string]any {
+	p := GenerationParamsFrom(ctx)
+	if p.IsZero() {
+		return nil
+	}
+	opts := make(map[string]any, 4)
+	if p.Temperature != nil {
+		opts["temperature"] = *p.Temperature
+	}
+	if p.TopP != nil {
+		opts["top_p"] = *p.TopP
+	}
+	if p.MaxTokens != nil {
+		opts["num_predict"] = *p.MaxTokens
+	}
+	if len(p.Stop) > 0 {
+		opts["stop"] = p.Stop
+	}
+	return opts
 }
 
 type ollamaMsg struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+	// base64 encoded, no data: prefix
+	Images []string `json:"images,omitempty"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+// Ollama returns arguments as a JSON object and does not assign call ids.
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+func toOllamaMsgs(messages []Message) []ollamaMsg {
+	out := make([]ollamaMsg, 0, len(messages))
+	for _, m := range messages {
+		om := ollamaMsg{Role: m.Role, Content: m.Content, ToolName: m.ToolName}
+		for _, img := range m.Images() {
+			om.Images = append(om.Images, base64.StdEncoding.EncodeToString(img.Data))
+		}
+		for _, tc := range m.ToolCalls {
+			var c ollamaToolCall
+			c.Function.Name = tc.Name
+			c.Function.Arguments = json.RawMessage(tc.Arguments)
+			if len(c.Function.Arguments) == 0 {
+				c.Function.Arguments = json.RawMessage("{}")
+			}
+			om.ToolCalls = append(om.ToolCalls, c)
+		}
+		out = append(out, om)
+	}
+	return out
 }
 
 type ollamaChatResp struct {
-	Message ollamaMsg `json:"message"`
-	Error   string    `json:"error,omitempty"`
+	Model           string    `json:"model"`
+	Message         ollamaMsg `json:"message"`
+	PromptEvalCount int       `json:"prompt_eval_count"`
+	EvalCount       int       `json:"eval_count"`
+	Error           string    `json:"error,omitempty"`
 }
 
-func (p *OllamaProvider) Chat(ctx context.Context, messages []Message) (string, error) {
-	if p.Client == nil {
-		return "", errors.New("ollama: http client is nil")
+func (p *OllamaProvider) response(decoded *ollamaChatResp) Response {
+	model := decoded.Model
+	if model == "" {
+		model = p.Model
+	}
+	return Response{
+		Message: Message{Role: RoleAssistant, Content: decoded.Message.Content},
+		Usage: Usage{
+			PromptTokens:     decoded.PromptEvalCount,
+			CompletionTokens: decoded.EvalCount,
+		},
+		Model: model,
 	}
+}
 
+func (p *OllamaProvider) Chat(ctx context.Context, messages []Message) (Response, error) {
+	decoded, err := p.chat(ctx, ollamaChatReq{
+		Model:    p.Model,
+		Stream:   false,
+		Messages: toOllamaMsgs(messages),
+		Options:  ollamaOptions(ctx),
+	})
+	if err != nil {
+		return Response{}, err
+	}
+	return p.response(decoded), nil
+}
+
+// ChatWithTools implements ToolProvider.
+func (p *OllamaProvider) ChatWithTools(ctx context.Context, messages []Message, tools []Tool) (Response, error) {
 	reqBody := ollamaChatReq{
-		Model:  p.Model,
-		Stream: false,
-		Messages: func() []ollamaMsg {
-			out := make([]ollamaMsg, 0, len(messages))
-			for _, m := range messages {
-				out = append(out, ollamaMsg{Role: m.Role, Content: m.Content})
-			}
-			return out
-		}(),
+		Model:    p.Model,
+		Stream:   false,
+		Messages: toOllamaMsgs(messages),
+		Options:  ollamaOptions(ctx),
+	}
+	for _, t := range tools {
+		var ot ollamaTool
+		ot.Type = "function"
+		ot.Function.Name = t.Name
+		ot.Function.Description = t.Description
+		ot.Function.Parameters = t.Parameters
+		reqBody.Tools = append(reqBody.Tools, ot)
+	}
+
+	decoded, err := p.chat(ctx, reqBody)
+	if err != nil {
+		return Response{}, err
+	}
+
+	out := p.response(decoded)
+	// Ollama does not name calls: number them on from the calls already in the conversation,
+	// so every round of a turn gets ids of its own
+	seen := 0
+	for _, m := range messages {
+		seen += len(m.ToolCalls)
+	}
+	for i, tc := range decoded.Message.ToolCalls {
+		args := string(tc.Function.Arguments)
+		if args == "" || args == "null" {
+			args = "{}"
+		}
+		out.ToolCalls = append(out.ToolCalls, ToolCall{
+			ID:        fmt.Sprintf("call_%d", seen+i),
+			Name:      tc.Function.Name,
+			Arguments: args,
+		})
+	}
+	return out, nil
+}
+
+func (p *OllamaProvider) chat(ctx context.Context, reqBody ollamaChatReq) (*ollamaChatResp, error) {
+	if p.Client == nil {
+		return nil, errors.New("ollama: http client is nil")
 	}
 
 	b, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	url := fmt.Sprintf("%s/api/chat", p.BaseURL)
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := p.Client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return "", fmt.Errorf("ollama: status %d", resp.StatusCode)
+		return nil, &StatusError{Provider: "ollama", StatusCode: resp.StatusCode}
 	}
 
 	var decoded ollamaChatResp
 	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
-		return "", err
+		return nil, err
 	}
 	if decoded.Error != "" {
-		return "", errors.New(decoded.Error)
+		return nil, errors.New(decoded.Error)
 	}
-	return decoded.Message.Content, nil
+	return &decoded, nil
 }
 
 // StreamChat streams assistant content chunks.
 // It returns immediately with two channels; both will be closed when streaming ends.
-func (p *OllamaProvider) StreamChat(ctx context.Context, messages []Message) (<-chan string, <-chan error) {
-	chunks := make(chan string, 16)
+func (p *OllamaProvider) StreamChat(ctx context.Context, messages []Message) (<-chan StreamChunk, <-chan error) {
+	chunks := make(chan StreamChunk, 16)
 	errs := make(chan error, 1)
 
 	go func() {
@@ -118,15 +250,10 @@ func (p *OllamaProvider) StreamChat(ctx context.Context, messages []Message) (<-
 		}
 
 		reqBody := ollamaChatReq{
-			Model:  p.Model,
-			Stream: true,
-			Messages: func() []ollamaMsg {
-				out := make([]ollamaMsg, 0, len(messages))
-				for _, m := range messages {
-					out = append(out, ollamaMsg{Role: m.Role, Content: m.Content})
-				}
-				return out
-			}(),
+			Model:    p.Model,
+			Stream:   true,
+			Messages: toOllamaMsgs(messages),
+			Options:  ollamaOptions(ctx),
 		}
 
 		b, err := json.Marshal(reqBody)
@@ -156,7 +283,7 @@ func (p *OllamaProvider) StreamChat(ctx context.Context, messages []Message) (<-
 		defer resp.Body.Close()
 
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			errs <- fmt.Errorf("ollama: status %d", resp.StatusCode)
+			errs <- &StatusError{Provider: "ollama", StatusCode: resp.StatusCode}
 			return
 		}
 
@@ -182,10 +309,19 @@ func (p *OllamaProvider) StreamChat(ctx context.Context, messages []Message) (<-
 			}
 
 			if decoded.Message.Content != "" {
-				chunks <- decoded.Message.Content
+				chunks <- StreamChunk{Delta: decoded.Message.Content}
 			}
 
 			if decoded.Done {
+				// the final line carries the token counts
+				model := decoded.Model
+				if model == "" {
+					model = p.Model
+				}
+				chunks <- StreamChunk{
+					Usage: &Usage{PromptTokens: decoded.PromptEvalCount, CompletionTokens: decoded.EvalCount},
+					Model: model,
+				}
 				return
 			}
 		}
@@ -198,3 +334,53 @@ func (p *OllamaProvider) StreamChat(ctx context.Context, messages []Message) (<-
 
 	return chunks, errs
 }
+
+type ollamaEmbedReq struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type ollamaEmbedResp struct {
+	Embeddings [][]float32 `json:"embeddings"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// Embed implements Embedder via /api/embed.
+func (p *OllamaProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if p.Client == nil {
+		return nil, errors.New("ollama: http client is nil")
+	}
+	b, err := json.Marshal(ollamaEmbedReq{Model: p.Model, Input: texts})
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/api/embed", p.BaseURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &StatusError{Provider: "ollama", StatusCode: resp.StatusCode}
+	}
+
+	var decoded ollamaEmbedResp
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, err
+	}
+	if decoded.Error != "" {
+		return nil, errors.New(decoded.Error)
+	}
+	if len(decoded.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("ollama: got %d embeddings for %d inputs", len(decoded.Embeddings), len(texts))
+	}
+	return decoded.Embeddings, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,26 +24,167 @@ type OpenRouterProvider struct {
 }
 
 type openRouterMsg struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string               `json:"role"`
+	Content    openRouterContent    `json:"content"`
+	ToolCalls  []openRouterToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string               `json:"tool_call_id,omitempty"`
+}
+
+// openRouterContent is a message content: a plain string, or an array of text and
+// image_url parts for messages with images.
+type openRouterContent struct {
+	Text  string
+	Parts []openRouterPart
+}
+
+type openRouterPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+func (c openRouterContent) MarshalJSON() ([]byte, error) {
+	if len(c.Parts) == 0 {
+		return json.Marshal(c.Text)
+	}
+	return json.Marshal(c.Parts)
+}
+
+func (c *openRouterContent) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '[' {
+		if err := json.Unmarshal(b, &c.Parts); err != nil {
+			return err
+		}
+		var sb strings.Builder
+		for _, p := range c.Parts {
+			sb.WriteString(p.Text)
+		}
+		c.Text = sb.String()
+		return nil
+	}
+	if string(b) == "null" {
+		return nil
+	}
+	return json.Unmarshal(b, &c.Text)
+}
+
+func toOpenRouterContent(m Message) openRouterContent {
+	c := openRouterContent{Text: m.Content}
+	images := m.Images()
+	if len(images) == 0 {
+		return c
+	}
+	if m.Content != "" {
+		c.Parts = append(c.Parts, openRouterPart{Type: "text", Text: m.Content})
+	}
+	for _, img := range images {
+		p := openRouterPart{Type: "image_url"}
+		p.ImageURL = &struct {
+			URL string `json:"url"`
+		}{URL: "data:" + img.MimeType + ";base64," + base64.StdEncoding.EncodeToString(img.Data)}
+		c.Parts = append(c.Parts, p)
+	}
+	return c
+}
+
+type openRouterTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type openRouterToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
 }
 
 type openRouterChatReq struct {
-	Model    string         `json:"model"`
-	Messages []openRouterMsg `json:"messages"`
-	Stream   bool           `json:"stream"`
+	Model         string                   `json:"model"`
+	Messages      []openRouterMsg          `json:"messages"`
+	Stream        bool                     `json:"stream"`
+	StreamOptions *openRouterStreamOptions `json:"stream_options,omitempty"`
+	Tools         []openRouterTool         `json:"tools,omitempty"`
+
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+func (r *openRouterChatReq) setParams(ctx context.Context) {
+	p := GenerationParamsFrom(ctx)
+	r.Temperature = p.Temperature
+	r.TopP = p.TopP
+	r.MaxTokens = p.MaxTokens
+	r.Stop = p.Stop
+}
+
+type openRouterStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openRouterUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
 }
 
 type openRouterChatResp struct {
+	Model   string `json:"model"`
 	Choices []struct {
 		Message openRouterMsg `json:"message"`
 	} `json:"choices"`
+	Usage *openRouterUsage `json:"usage,omitempty"`
 	Error *struct {
 		Message string `json:"message"`
 	} `json:"error,omitempty"`
 }
 
+func (p *OpenRouterProvider) response(decoded *openRouterChatResp) Response {
+	out := Response{
+		Message: Message{Role: RoleAssistant, Content: decoded.Choices[0].Message.Content.Text},
+		Model:   decoded.Model,
+	}
+	if out.Model == "" {
+		out.Model = p.Model
+	}
+	if decoded.Usage != nil {
+		out.Usage = Usage{
+			PromptTokens:     decoded.Usage.PromptTokens,
+			CompletionTokens: decoded.Usage.CompletionTokens,
+		}
+	}
+	return out
+}
+
+func toOpenRouterMsgs(messages []Message) []openRouterMsg {
+	out := make([]openRouterMsg, 0, len(messages))
+	for _, m := range messages {
+		om := openRouterMsg{Role: m.Role, Content: toOpenRouterContent(m), ToolCallID: m.ToolCallID}
+		for _, tc := range m.ToolCalls {
+			var c openRouterToolCall
+			c.ID = tc.ID
+			c.Type = "function"
+			c.Function.Name = tc.Name
+			c.Function.Arguments = tc.Arguments
+			om.ToolCalls = append(om.ToolCalls, c)
+		}
+		out = append(out, om)
+	}
+	return out
+}
+
 type openRouterStreamResp struct {
+	Model   string           `json:"model"`
+	Usage   *openRouterUsage `json:"usage,omitempty"`
 	Choices []struct {
 		Delta struct {
 			Content string `json:"content"`
@@ -67,39 +209,72 @@ func NewOpenRouterProvider(baseURL, apiKey, model, siteURL, appName string) *Ope
 	}
 }
 
-func (p *OpenRouterProvider) Chat(ctx context.Context, messages []Message) (string, error) {
+func (p *OpenRouterProvider) Chat(ctx context.Context, messages []Message) (Response, error) {
+	decoded, err := p.chat(ctx, openRouterChatReq{
+		Stream:   false,
+		Messages: toOpenRouterMsgs(messages),
+	})
+	if err != nil {
+		return Response{}, err
+	}
+	return p.response(decoded), nil
+}
+
+// ChatWithTools implements ToolProvider.
+func (p *OpenRouterProvider) ChatWithTools(ctx context.Context, messages []Message, tools []Tool) (Response, error) {
+	reqBody := openRouterChatReq{
+		Stream:   false,
+		Messages: toOpenRouterMsgs(messages),
+	}
+	for _, t := range tools {
+		var ot openRouterTool
+		ot.Type = "function"
+		ot.Function.Name = t.Name
+		ot.Function.Description = t.Description
+		ot.Function.Parameters = t.Parameters
+		reqBody.Tools = append(reqBody.Tools, ot)
+	}
+
+	decoded, err := p.chat(ctx, reqBody)
+	if err != nil {
+		return Response{}, err
+	}
+
+	out := p.response(decoded)
+	for _, tc := range decoded.Choices[0].Message.ToolCalls {
+		out.ToolCalls = append(out.ToolCalls, ToolCall{
+			ID:        tc.ID,
+			Name:      tc.Function.Name,
+			Arguments: tc.Function.Arguments,
+		})
+	}
+	return out, nil
+}
+
+// chat sends a non-streaming completion request; the returned response has at least one choice.
+func (p *OpenRouterProvider) chat(ctx context.Context, reqBody openRouterChatReq) (*openRouterChatResp, error) {
 	if p.Client == nil {
-		return "", errors.New("openrouter: http client is nil")
+		return nil, errors.New("openrouter: http client is nil")
 	}
 	if strings.TrimSpace(p.APIKey) == "" {
-		return "", errors.New("openrouter: api key is required")
+		return nil, errors.New("openrouter: api key is required")
 	}
 	model := strings.TrimSpace(p.Model)
 	if model == "" {
-		return "", errors.New("openrouter: model is required")
-	}
-
-	reqBody := openRouterChatReq{
-		Model:  model,
-		Stream: false,
-		Messages: func() []openRouterMsg {
-			out := make([]openRouterMsg, 0, len(messages))
-			for _, m := range messages {
-				out = append(out, openRouterMsg{Role: m.Role, Content: m.Content})
-			}
-			return out
-		}(),
+		return nil, errors.New("openrouter: model is required")
 	}
+	reqBody.Model = model
+	reqBody.setParams(ctx)
 
 	b, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	url := fmt.Sprintf("%s/chat/completions", strings.TrimRight(p.BaseURL, "/"))
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+p.APIKey)
@@ -112,35 +287,31 @@ func (p *OpenRouterProvider) Chat(ctx context.Context, messages []Message) (stri
 
 	resp, err := p.Client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4*1024))
-		msg := strings.TrimSpace(string(body))
-		if msg == "" {
-			msg = fmt.Sprintf("status %d", resp.StatusCode)
-		}
-		return "", fmt.Errorf("openrouter: %s", msg)
+		return nil, &StatusError{Provider: "openrouter", StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
 	}
 
 	var decoded openRouterChatResp
 	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
-		return "", err
+		return nil, err
 	}
 	if decoded.Error != nil && decoded.Error.Message != "" {
-		return "", errors.New(decoded.Error.Message)
+		return nil, errors.New(decoded.Error.Message)
 	}
 	if len(decoded.Choices) == 0 {
-		return "", errors.New("openrouter: empty response")
+		return nil, errors.New("openrouter: empty response")
 	}
-	return decoded.Choices[0].Message.Content, nil
+	return &decoded, nil
 }
 
 // StreamChat streams assistant content chunks via SSE.
-func (p *OpenRouterProvider) StreamChat(ctx context.Context, messages []Message) (<-chan string, <-chan error) {
-	chunks := make(chan string, 16)
+func (p *OpenRouterProvider) StreamChat(ctx context.Context, messages []Message) (<-chan StreamChunk, <-chan error) {
+	chunks := make(chan StreamChunk, 16)
 	errs := make(chan error, 1)
 
 	go func() {
@@ -162,16 +333,12 @@ func (p *OpenRouterProvider) StreamChat(ctx context.Context, messages []Message)
 		}
 
 		reqBody := openRouterChatReq{
-			Model:  model,
-			Stream: true,
-			Messages: func() []openRouterMsg {
-				out := make([]openRouterMsg, 0, len(messages))
-				for _, m := range messages {
-					out = append(out, openRouterMsg{Role: m.Role, Content: m.Content})
-				}
-				return out
-			}(),
+			Model:         model,
+			Stream:        true,
+			StreamOptions: &openRouterStreamOptions{IncludeUsage: true},
+			Messages:      toOpenRouterMsgs(messages),
 		}
+		reqBody.setParams(ctx)
 
 		b, err := json.Marshal(reqBody)
 		if err != nil {
@@ -207,11 +374,7 @@ func (p *OpenRouterProvider) StreamChat(ctx context.Context, messages []Message)
 
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4*1024))
-			msg := strings.TrimSpace(string(body))
-			if msg == "" {
-				msg = fmt.Sprintf("status %d", resp.StatusCode)
-			}
-			errs <- fmt.Errorf("openrouter: %s", msg)
+			errs <- &StatusError{Provider: "openrouter", StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
 			return
 		}
 
@@ -237,12 +400,19 @@ func (p *OpenRouterProvider) StreamChat(ctx context.Context, messages []Message)
 				errs <- errors.New(decoded.Error.Message)
 				return
 			}
+			if decoded.Usage != nil {
+				// sent once, in the last chunk before [DONE]
+				chunks <- StreamChunk{
+					Usage: &Usage{PromptTokens: decoded.Usage.PromptTokens, CompletionTokens: decoded.Usage.CompletionTokens},
+					Model: decoded.Model,
+				}
+			}
 			if len(decoded.Choices) == 0 {
 				continue
 			}
 			delta := decoded.Choices[0].Delta.Content
 			if delta != "" {
-				chunks <- delta
+				chunks <- StreamChunk{Delta: delta}
 			}
 		}
 
@@ -254,3 +424,83 @@ func (p *OpenRouterProvider) StreamChat(ctx context.Context, messages []Message)
 
 	return chunks, errs
 }
+
+type openRouterEmbedReq struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type openRouterEmbedResp struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// Embed implements Embedder via the OpenAI-compatible /embeddings endpoint.
+func (p *OpenRouterProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if p.Client == nil {
+		return nil, errors.New("openrouter: http client is nil")
+	}
+	if strings.TrimSpace(p.APIKey) == "" {
+		return nil, errors.New("openrouter: api key is required")
+	}
+	model := strings.TrimSpace(p.Model)
+	if model == "" {
+		return nil, errors.New("openrouter: model is required")
+	}
+
+	b, err := json.Marshal(openRouterEmbedReq{Model: model, Input: texts})
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/embeddings", strings.TrimRight(p.BaseURL, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	if p.SiteURL != "" {
+		req.Header.Set("HTTP-Referer", p.SiteURL)
+	}
+	if p.AppName != "" {
+		req.Header.Set("X-Title", p.AppName)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4*1024))
+		return nil, &StatusError{Provider: "openrouter", StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+
+	var decoded openRouterEmbedResp
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, err
+	}
+	if decoded.Error != nil && decoded.Error.Message != "" {
+		return nil, errors.New(decoded.Error.Message)
+	}
+	out := make([][]float32, len(texts))
+	for _, d := range decoded.Data {
+		if d.Index < 0 || d.Index >= len(out) {
+			return nil, fmt.Errorf("openrouter: embedding index %d out of range", d.Index)
+		}
+		out[d.Index] = d.Embedding
+	}
+	for i, v := range out {
+		if len(v) == 0 {
+			return nil, fmt.Errorf("openrouter: missing embedding for input %d", i)
+		}
+	}
+	return out, nil
+}
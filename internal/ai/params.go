@@ -0,0 +1,33 @@
+package ai
+
+import "context"
+
+// GenerationParams are optional sampling parameters for one call. Nil/empty fields are left
+// to the provider's defaults.
+type GenerationParams struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+func (p GenerationParams) IsZero() bool {
+	return p.Temperature == nil && p.TopP == nil && p.MaxTokens == nil && len(p.Stop) == 0
+}
+
+type paramsKey struct{}
+
+// WithGenerationParams attaches p to ctx. Providers read it on every Chat, ChatWithTools and
+// StreamChat call, so it passes through the fallback and observer wrappers unchanged.
+func WithGenerationParams(ctx context.Context, p GenerationParams) context.Context {
+	if p.IsZero() {
+		return ctx
+	}
+	return context.WithValue(ctx, paramsKey{}, p)
+}
+
+// GenerationParamsFrom returns the params attached to ctx, if any.
+func GenerationParamsFrom(ctx context.Context) GenerationParams {
+	p, _ := ctx.Value(paramsKey{}).(GenerationParams)
+	return p
+}
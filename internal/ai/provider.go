@@ -2,11 +2,72 @@ package ai
 
 import "context"
 
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool"
+)
+
 type Message struct {
-	Role    string
-	Content string
+	Role    string `json:"role"`
+	Content string `json:"content"`
+
+	// assistant messages: calls requested by the model
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// tool messages: which call this is the result of
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	ToolName   string `json:"tool_name,omitempty"`
+
+	// user messages: images sent along with Content to vision-capable models
+	Parts []Part `json:"-"`
+}
+
+const PartImage = "image"
+
+// Part is a non-text piece of a message. Only images so far.
+type Part struct {
+	Type     string
+	MimeType string
+	Data     []byte
+}
+
+// Images returns the image parts of m.
+func (m Message) Images() []Part {
+	var out []Part
+	for _, p := range m.Parts {
+		if p.Type == PartImage {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Usage is the token accounting reported by the provider for one call.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+func (u Usage) TotalTokens() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+func (u Usage) Add(o Usage) Usage {
+	return Usage{
+		PromptTokens:     u.PromptTokens + o.PromptTokens,
+		CompletionTokens: u.CompletionTokens + o.CompletionTokens,
+	}
+}
+
+// Response is the assistant message plus call metadata.
+// Model is the model that actually answered (e.g. what openrouter/auto resolved to).
+type Response struct {
+	Message
+	Usage Usage
+	Model string
 }
 
 type Provider interface {
-	Chat(ctx context.Context, messages []Message) (string, error)
+	Chat(ctx context.Context, messages []Message) (Response, error)
 }
@@ -12,10 +12,17 @@ type ProviderFactory func(ctx context.Context, model string) (Provider, error)
 type Registry struct {
 	mu        sync.RWMutex
 	factories map[string]ProviderFactory
+	obs       Observer
+
+	breakerCfg BreakerConfig
+	breakers   map[string]*CircuitBreaker
 }
 
 func NewRegistry() *Registry {
-	return &Registry{factories: make(map[string]ProviderFactory)}
+	return &Registry{
+		factories: make(map[string]ProviderFactory),
+		breakers:  make(map[string]*CircuitBreaker),
+	}
 }
 
 func (r *Registry) Register(name string, f ProviderFactory) {
@@ -25,13 +32,88 @@ func (r *Registry) Register(name string, f ProviderFactory) {
 	r.factories[name] = f
 }
 
+// Has reports whether a provider is registered under name.
+func (r *Registry) Has(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.factories[name]
+	return ok
+}
+
+// SetObserver reports latency and errors of every provider returned by Get to o.
+func (r *Registry) SetObserver(o Observer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.obs = o
+}
+
+func (r *Registry) observer() Observer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.obs
+}
+
+// SetBreakerConfig enables one circuit breaker per provider and model for calls made through
+// Fallback, so one failing model does not cut off the provider's others. Existing breakers are
+// reset.
+func (r *Registry) SetBreakerConfig(cfg BreakerConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.breakerCfg = cfg
+	r.breakers = make(map[string]*CircuitBreaker)
+}
+
+// breaker returns the breaker of the provider's model, or nil when breakers are disabled.
+func (r *Registry) breaker(name, model string) *CircuitBreaker {
+	key := name + "\x00" + model
+	r.mu.RLock()
+	b, ok := r.breakers[key]
+	cfg := r.breakerCfg
+	r.mu.RUnlock()
+	if ok || cfg.FailureThreshold <= 0 {
+		return b
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.breakers[key]; ok {
+		return b
+	}
+	b = NewCircuitBreaker(cfg, func(s BreakerState) {
+		if obs := r.observer(); obs != nil {
+			obs.ObserveBreakerState(name, model, s)
+		}
+	})
+	r.breakers[key] = b
+	return b
+}
+
 func (r *Registry) Get(ctx context.Context, name string, model string) (Provider, error) {
+	p, _, err := r.get(ctx, name, model)
+	return p, err
+}
+
+// get also returns the resolved model name (the factory default when model is empty).
+func (r *Registry) get(ctx context.Context, name string, model string) (Provider, string, error) {
 	name = strings.ToLower(strings.TrimSpace(name))
 	r.mu.RLock()
 	f, ok := r.factories[name]
+	obs := r.obs
 	r.mu.RUnlock()
 	if !ok {
-		return nil, fmt.Errorf("unknown ai provider: %s", name)
+		return nil, "", fmt.Errorf("unknown ai provider: %s", name)
+	}
+	p, err := f(ctx, model)
+	if err != nil {
+		return nil, "", err
+	}
+	m := strings.TrimSpace(model)
+	if m == "" {
+		m = modelName(p)
+	}
+	if obs != nil {
+		p = observe(p, name, m, obs)
 	}
-	return f(ctx, model)
+	return p, m, nil
 }
@@ -2,7 +2,15 @@ package ai
 
 import "context"
 
+// StreamChunk is one streamed delta. The last chunk of a successful stream may carry
+// only Usage/Model (empty Delta) when the provider reports them.
+type StreamChunk struct {
+	Delta string
+	Usage *Usage
+	Model string
+}
+
 // StreamProvider is an optional interface. Providers may implement streaming chat.
 type StreamProvider interface {
-	StreamChat(ctx context.Context, messages []Message) (<-chan string, <-chan error)
+	StreamChat(ctx context.Context, messages []Message) (<-chan StreamChunk, <-chan error)
 }
@@ -0,0 +1,27 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Tool describes a function the model may call. Parameters is a JSON Schema object.
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// ToolCall is a single function call requested by the model.
+// Arguments is the raw JSON object produced by the model.
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolProvider is an optional interface. Providers that support native tool calling
+// return an assistant message that either has Content (final answer) or ToolCalls.
+type ToolProvider interface {
+	ChatWithTools(ctx context.Context, messages []Message, tools []Tool) (Response, error)
+}
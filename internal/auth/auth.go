@@ -1,10 +1,15 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -22,15 +27,20 @@ func VerifyPassword(hash string, pw string) bool {
 
 type Claims struct {
 	UserID uint64 `json:"user_id"`
+	// TokenVersion is the user's token generation at signing time;
+	// bumping the generation revokes every older access token.
+	TokenVersion int64 `json:"ver"`
 	jwt.RegisteredClaims
 }
 
-func SignJWT(userID uint64, secret string, ttl time.Duration) (string, error) {
+func SignJWT(userID uint64, tokenVersion int64, secret string, ttl time.Duration) (string, error) {
 	now := time.Now()
 
 	claims := Claims{
-		UserID: userID,
+		UserID:       userID,
+		TokenVersion: tokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(), // jti, used by the logout denylist
 			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
 			IssuedAt:  jwt.NewNumericDate(now),
 		},
@@ -58,3 +68,19 @@ func ParseJWT(tokenStr string, secret string) (*Claims, error) {
 	}
 	return claims, nil
 }
+
+// NewRefreshToken returns an opaque random token for the client and the hash to store.
+func NewRefreshToken() (raw string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	raw = base64.RawURLEncoding.EncodeToString(b)
+	return raw, HashRefreshToken(raw), nil
+}
+
+// HashRefreshToken is a plain SHA-256: refresh tokens are high-entropy, unlike passwords.
+func HashRefreshToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,286 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"time"
+
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+	"github.com/suPer8Hu/ai-platform/internal/store/blob"
+	_ "golang.org/x/image/webp"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrAttachmentsDisabled is returned when no attachment store is configured.
+	ErrAttachmentsDisabled = errors.New("attachments are not configured")
+	// ErrAttachmentNotFound is returned for attachment ids that do not exist, belong to another
+	// user or session, or are already attached to a message.
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrUnsupportedImage   = errors.New("unsupported image: use png, jpeg, gif or webp")
+	ErrTooManyAttachments = fmt.Errorf("at most %d attachments per message", maxMessageAttachments)
+	// ErrTooManyPendingAttachments is returned for uploads beyond maxPendingAttachments.
+	ErrTooManyPendingAttachments = fmt.Errorf("at most %d uploads may wait for a message; send or delete some first", maxPendingAttachments)
+)
+
+const (
+	maxMessageAttachments = 4
+	// uploads of one user not attached to a message yet; concurrent uploads may overshoot a little
+	maxPendingAttachments = 20
+	// unattached uploads removed per SweepUnattachedAttachments call
+	attachmentSweepBatch = 100
+	// images sent with the history, newest first; older ones are left out of the context
+	maxContextImages = 4
+	// rough prompt cost of one image, for the token budget
+	imageTokenEstimate = 800
+)
+
+var imageMimeTypes = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+func (s *Service) SetAttachmentStore(store blob.Store) {
+	s.attachments = store
+}
+
+// UploadAttachment stores an image for the next user message of the session. It is sent to
+// the model with that message and with later turns while it stays in the context.
+func (s *Service) UploadAttachment(ctx context.Context, userID uint64, sessionID string, data []byte) (*Attachment, error) {
+	if s.attachments == nil {
+		return nil, ErrAttachmentsDisabled
+	}
+	if err := s.ValidateSessionOwner(ctx, userID, sessionID); err != nil {
+		return nil, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+	mimeType, ok := imageMimeTypes[format]
+	if !ok {
+		return nil, ErrUnsupportedImage
+	}
+	pending, err := s.repo.CountUnattachedAttachments(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if pending >= maxPendingAttachments {
+		return nil, ErrTooManyPendingAttachments
+	}
+
+	id, err := NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	a := &Attachment{
+		UserID:     userID,
+		SessionID:  sessionID,
+		MimeType:   mimeType,
+		Size:       int64(len(data)),
+		Width:      cfg.Width,
+		Height:     cfg.Height,
+		SHA256:     hex.EncodeToString(sum[:]),
+		StorageKey: fmt.Sprintf("attachments/%d/%s/%s.%s", userID, sessionID, id, format),
+	}
+	if err := s.attachments.Put(ctx, a.StorageKey, data, mimeType); err != nil {
+		return nil, err
+	}
+	if err := s.repo.CreateAttachment(ctx, a); err != nil {
+		s.deleteBlobs(ctx, []string{a.StorageKey})
+		return nil, err
+	}
+	return a, nil
+}
+
+// GetAttachment returns an attachment of the user with its image data.
+func (s *Service) GetAttachment(ctx context.Context, userID, id uint64) (*Attachment, error) {
+	if s.attachments == nil {
+		return nil, ErrAttachmentsDisabled
+	}
+	a, err := s.repo.GetAttachment(ctx, userID, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	a.Data, err = s.attachments.Get(ctx, a.StorageKey)
+	if err != nil {
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// DeleteAttachment removes an attachment that is not attached to a message yet.
+func (s *Service) DeleteAttachment(ctx context.Context, userID, id uint64) error {
+	a, err := s.repo.GetAttachment(ctx, userID, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAttachmentNotFound
+		}
+		return err
+	}
+	n, err := s.repo.DeleteUnattachedAttachment(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAttachmentNotFound
+	}
+	s.deleteBlobs(ctx, []string{a.StorageKey})
+	return nil
+}
+
+// SweepUnattachedAttachments removes uploads created before before that never made it into
+// a message, rows and images, and returns how many it removed. Uploads attached meanwhile are
+// kept.
+func (s *Service) SweepUnattachedAttachments(ctx context.Context, before time.Time) (int, error) {
+	if s.attachments == nil {
+		return 0, nil
+	}
+	stale, err := s.repo.ListUnattachedAttachments(ctx, before, attachmentSweepBatch)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, a := range stale {
+		deleted, err := s.repo.DeleteUnattachedAttachment(ctx, a.UserID, a.ID)
+		if err != nil {
+			return n, err
+		}
+		if deleted == 0 {
+			continue
+		}
+		s.deleteBlobs(ctx, []string{a.StorageKey})
+		n++
+	}
+	return n, nil
+}
+
+// attachmentRefs turns the ids sent with a user message into the Attachments insertMessage links.
+func (s *Service) attachmentRefs(ids []uint64) ([]Attachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if s.attachments == nil {
+		return nil, ErrAttachmentsDisabled
+	}
+	if len(ids) > maxMessageAttachments {
+		return nil, ErrTooManyAttachments
+	}
+	var out []Attachment
+	seen := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		if id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		out = append(out, Attachment{ID: id})
+	}
+	return out, nil
+}
+
+func (s *Service) deleteBlobs(ctx context.Context, keys []string) {
+	if s.attachments == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	for _, k := range keys {
+		if err := s.attachments.Delete(ctx, k); err != nil {
+			log.Printf("chat: delete attachment %s: %v", k, err)
+		}
+	}
+}
+
+// UserAttachmentKeys returns the storage keys of all attachments of the user, so their images
+// can be removed with DeleteAttachmentBlobs once the rows are gone.
+func (s *Service) UserAttachmentKeys(ctx context.Context, userID uint64) ([]string, error) {
+	return s.repo.ListAttachmentKeys(ctx, userID, "")
+}
+
+// DeleteAttachmentBlobs removes stored images, logging failures.
+func (s *Service) DeleteAttachmentBlobs(ctx context.Context, keys []string) {
+	s.deleteBlobs(ctx, keys)
+}
+
+// withAttachments fills in the attachments of the user messages in msgs (without image data).
+func (s *Service) withAttachments(ctx context.Context, userID uint64, msgs []Message) error {
+	if s.attachments == nil {
+		return nil
+	}
+	ids := make([]uint64, 0, len(msgs))
+	for _, m := range msgs {
+		if m.Role == RoleUser {
+			ids = append(ids, m.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := s.repo.ListMessageAttachments(ctx, userID, ids)
+	if err != nil {
+		return err
+	}
+	byMsg := make(map[uint64][]Attachment)
+	for _, a := range rows {
+		byMsg[*a.MessageID] = append(byMsg[*a.MessageID], a)
+	}
+	for i := range msgs {
+		msgs[i].Attachments = byMsg[msgs[i].ID]
+	}
+	return nil
+}
+
+// loadContextImages fills in the attachments of the DESC-ordered history rows and loads the
+// image data of the newest maxContextImages of them. Images that fail to load are left out:
+// they only cost context.
+func (s *Service) loadContextImages(ctx context.Context, userID uint64, recentDesc []Message) error {
+	if err := s.withAttachments(ctx, userID, recentDesc); err != nil {
+		return err
+	}
+	n := 0
+	for i := range recentDesc {
+		for j := range recentDesc[i].Attachments {
+			if n == maxContextImages {
+				return nil
+			}
+			a := &recentDesc[i].Attachments[j]
+			data, err := s.attachments.Get(ctx, a.StorageKey)
+			if err != nil {
+				log.Printf("chat: load attachment %d: %v", a.ID, err)
+				continue
+			}
+			a.Data = data
+			n++
+		}
+	}
+	return nil
+}
+
+// imageParts returns the loaded images of m as provider message parts.
+func imageParts(m Message) []ai.Part {
+	var out []ai.Part
+	for _, a := range m.Attachments {
+		if a.Data != nil {
+			out = append(out, ai.Part{Type: ai.PartImage, MimeType: a.MimeType, Data: a.Data})
+		}
+	}
+	return out
+}
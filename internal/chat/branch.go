@@ -0,0 +1,206 @@
+package chat
+
+import (
+	"context"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrMessageNotFound is returned for message ids that do not exist or belong to another user.
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrMessageNotEditable is returned when editing anything but a user message.
+	ErrMessageNotEditable = errors.New("only user messages can be edited")
+	// ErrNothingToRegenerate is returned when a message has no user message to answer above it.
+	ErrNothingToRegenerate = errors.New("no user message to regenerate a reply for")
+)
+
+// BranchMessage is a message on the active branch together with the ids of all its
+// siblings (itself included, ASC), so clients can render "< 2/3 >" switchers.
+type BranchMessage struct {
+	Message
+	SiblingIDs []uint64 `json:"sibling_ids"`
+}
+
+// EditMessage stores content as a new sibling of the user message messageID, switches the
+// session to that branch and generates a reply to it. The new message keeps the original's
+// attachments. The original message and its replies stay reachable through ActivateMessage.
+func (s *Service) EditMessage(ctx context.Context, userID, messageID uint64, content string) (userMsg, reply *Message, err error) {
+	orig, sess, err := s.ownedMessage(ctx, userID, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if orig.Role != RoleUser {
+		return nil, nil, ErrMessageNotEditable
+	}
+	provider, err := s.providerForSession(ctx, sess)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	userMsg = &Message{
+		SessionID: sess.SessionID,
+		UserID:    userID,
+		Role:      RoleUser,
+		Content:   content,
+		ParentID:  orig.ParentID,
+	}
+	// without an attachment store there are no attachments to carry over
+	if s.attachments != nil {
+		err = s.repo.InsertEditedMessage(ctx, userMsg, orig.ID)
+	} else {
+		err = s.repo.InsertMessageAt(ctx, userMsg)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reply, err = s.replyOnBranch(ctx, provider, sess, userID, userMsg.ID, nil)
+	if err != nil {
+		return userMsg, nil, err
+	}
+	return userMsg, reply, nil
+}
+
+// RegenerateMessage generates a new reply to the user message messageID answers (or to
+// messageID itself when it is a user message), stored as a sibling of the existing replies.
+func (s *Service) RegenerateMessage(ctx context.Context, userID, messageID uint64) (*Message, error) {
+	m, sess, err := s.ownedMessage(ctx, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	// assistant and tool rows hang below the user message they answer
+	for m.Role != RoleUser {
+		if m.ParentID == nil {
+			return nil, ErrNothingToRegenerate
+		}
+		m, err = s.repo.GetMessageByID(ctx, userID, *m.ParentID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	provider, err := s.providerForSession(ctx, sess)
+	if err != nil {
+		return nil, err
+	}
+	return s.replyOnBranch(ctx, provider, sess, userID, m.ID, nil)
+}
+
+// ActivateMessage switches the session to the branch containing messageID, following the
+// newest child below it, and returns the new active leaf id.
+func (s *Service) ActivateMessage(ctx context.Context, userID, messageID uint64) (uint64, error) {
+	m, sess, err := s.ownedMessage(ctx, userID, messageID)
+	if err != nil {
+		return 0, err
+	}
+	leaf, err := s.repo.LatestLeafUnder(ctx, userID, sess.SessionID, m.ID)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.repo.SetActiveLeaf(ctx, userID, sess.SessionID, leaf); err != nil {
+		return 0, err
+	}
+	return leaf, nil
+}
+
+// ListActiveBranch returns the session's active branch in DESC order (leaf first).
+// beforeID continues a previous page from the parent of that message.
+func (s *Service) ListActiveBranch(ctx context.Context, userID uint64, sessionID string, limit int, beforeID uint64) ([]BranchMessage, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	if err := s.ValidateSessionOwner(ctx, userID, sessionID); err != nil {
+		return nil, err
+	}
+	if err := s.repo.LinkLegacyMessages(ctx, userID, sessionID); err != nil {
+		return nil, err
+	}
+
+	var msgs []Message
+	var err error
+	if beforeID > 0 {
+		before, err := s.repo.GetMessageByID(ctx, userID, beforeID)
+		if err != nil || before.SessionID != sessionID {
+			return nil, ErrMessageNotFound
+		}
+		if before.ParentID == nil {
+			return []BranchMessage{}, nil
+		}
+		msgs, err = s.repo.ListBranchDesc(ctx, userID, sessionID, *before.ParentID, limit)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		msgs, err = s.repo.ListActiveBranchDesc(ctx, userID, sessionID, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.withAttachments(ctx, userID, msgs); err != nil {
+		return nil, err
+	}
+
+	parents := make([]uint64, 0, len(msgs))
+	roots := false
+	for _, m := range msgs {
+		if m.ParentID == nil {
+			roots = true
+		} else {
+			parents = append(parents, *m.ParentID)
+		}
+	}
+	siblings, err := s.repo.SiblingIDs(ctx, userID, sessionID, parents, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]BranchMessage, 0, len(msgs))
+	for _, m := range msgs {
+		var key uint64
+		if m.ParentID != nil {
+			key = *m.ParentID
+		}
+		ids := siblings[key]
+		if len(ids) == 0 {
+			ids = []uint64{m.ID}
+		}
+		out = append(out, BranchMessage{Message: m, SiblingIDs: ids})
+	}
+	return out, nil
+}
+
+// ownedMessage loads messageID and its session, making sure both belong to userID and that
+// pre-branching messages of the session are linked.
+func (s *Service) ownedMessage(ctx context.Context, userID, messageID uint64) (*Message, *Session, error) {
+	m, err := s.repo.GetMessageByID(ctx, userID, messageID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrMessageNotFound
+		}
+		return nil, nil, err
+	}
+	sess, err := s.repo.GetSessionBySessionID(ctx, m.SessionID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrMessageNotFound
+		}
+		return nil, nil, err
+	}
+	if sess.UserID != userID {
+		return nil, nil, ErrMessageNotFound
+	}
+	if sess.ActiveLeafID == nil {
+		if err := s.repo.LinkLegacyMessages(ctx, userID, sess.SessionID); err != nil {
+			return nil, nil, err
+		}
+		// parent pointers may have just been filled in
+		if m, err = s.repo.GetMessageByID(ctx, userID, messageID); err != nil {
+			return nil, nil, err
+		}
+	}
+	return m, sess, nil
+}
@@ -0,0 +1,331 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+)
+
+// Tokenizer estimates how many tokens a text costs a model. Estimates only need to be
+// in the right ballpark: budgets should leave headroom for the reply anyway.
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+// EstimateTokenizer assumes ~4 bytes per token for ASCII text and one token per
+// non-ASCII rune, which over- rather than under-counts for CJK text.
+type EstimateTokenizer struct{}
+
+func (EstimateTokenizer) CountTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < 0x80 {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// per-message overhead of role markers and separators in chat templates
+const messageTokenOverhead = 4
+
+// TokenBudgets maps a model name to the number of prompt tokens the chat history may use.
+// The "*" entry, if present, applies to unlisted models.
+type TokenBudgets map[string]int
+
+// LoadTokenBudgets reads a JSON object of model -> token budget.
+func LoadTokenBudgets(path string) (TokenBudgets, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read token budgets: %w", err)
+	}
+	var t TokenBudgets
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("parse token budgets: %w", err)
+	}
+	return t, nil
+}
+
+// ResolveTokenBudgets loads the per-model budgets at path (if set) and applies def to the
+// models it does not list. The result is empty, i.e. budgeting is off, when neither is set.
+func ResolveTokenBudgets(path string, def int) (TokenBudgets, error) {
+	t := TokenBudgets{}
+	if path != "" {
+		loaded, err := LoadTokenBudgets(path)
+		if err != nil {
+			return nil, err
+		}
+		t = loaded
+	}
+	if _, ok := t["*"]; !ok && def > 0 {
+		t["*"] = def
+	}
+	return t, nil
+}
+
+func (t TokenBudgets) Budget(model string) int {
+	if n, ok := t[model]; ok {
+		return n
+	}
+	return t["*"]
+}
+
+const (
+	// upper bound of branch rows loaded when the history is budgeted in tokens
+	maxHistoryScan = 500
+	// when the history overflows, keep this share of the budget as verbatim recent turns
+	// and condense the rest, so the next few turns fit without summarizing again
+	summaryKeepRatio = 0.5
+	// cap on the transcript sent to the summarizer, in estimated tokens
+	maxSummaryInputTokens = 16 * 1024
+)
+
+const summaryPrompt = "Summarize the conversation so far for your own future reference. " +
+	"Keep facts, names, numbers, decisions and open questions; drop pleasantries. " +
+	"Write plain prose, at most 250 words. Return only the summary."
+
+// buildContext returns the provider messages (ASC) for the branch ending at leafID, led by the
+// session's system prompt and excerpts of its attached documents relevant to the leaf message.
+// The excerpts are returned as citations for the reply.
+func (s *Service) buildContext(ctx context.Context, provider ai.Provider, sess *Session, userID, leafID uint64) ([]ai.Message, []Citation, error) {
+	var lead []ai.Message
+	if sess.SystemPrompt != "" {
+		lead = append(lead, ai.Message{Role: ai.RoleSystem, Content: sess.SystemPrompt})
+	}
+	citations := s.retrieve(ctx, sess, userID, leafID)
+	if len(citations) > 0 {
+		lead = append(lead, ai.Message{Role: ai.RoleSystem, Content: citationPrompt(citations)})
+	}
+
+	budget := s.budgets.Budget(sess.Model)
+	if budget > 0 {
+		for _, m := range lead {
+			budget -= s.countTokens(m.Content)
+		}
+		// keep budgeting on even when the lead alone eats the budget
+		budget = max(budget, 1)
+	}
+	msgs, err := s.buildHistory(ctx, provider, sess, userID, leafID, budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(lead, msgs...), citations, nil
+}
+
+// buildHistory returns the chat history (ASC) for the branch ending at leafID.
+//
+// Without a token budget this is the last contextWindowSize messages. With one, it is the
+// newest messages that fit the budget, preceded by a summary of everything older. Summaries
+// are stored and reused: later calls only read messages newer than the latest summary on the
+// branch, and only condense again once those overflow the budget.
+func (s *Service) buildHistory(ctx context.Context, provider ai.Provider, sess *Session, userID, leafID uint64, budget int) ([]ai.Message, error) {
+	if budget <= 0 {
+		recentDesc, err := s.repo.ListBranchDesc(ctx, userID, sess.SessionID, leafID, s.contextWindowSize)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.loadContextImages(ctx, userID, recentDesc); err != nil {
+			return nil, err
+		}
+		return toProviderMessages(recentDesc), nil
+	}
+
+	branchDesc, err := s.repo.ListBranchDesc(ctx, userID, sess.SessionID, leafID, maxHistoryScan)
+	if err != nil {
+		return nil, err
+	}
+	// the leaf's turn (its user message and any tool rounds since) is always sent
+	// verbatim, so a summary cutting into it, e.g. when regenerating the reply to a
+	// condensed message, doesn't apply
+	turn := leafTurnLen(branchDesc)
+	summary, err := s.latestSummaryOnBranch(ctx, userID, sess.SessionID, branchDesc[turn:])
+	if err != nil {
+		return nil, err
+	}
+
+	// everything at or above the summary point is covered by the summary
+	if summary != nil {
+		for i, m := range branchDesc {
+			if m.ID <= summary.UptoMessageID {
+				branchDesc = branchDesc[:i]
+				break
+			}
+		}
+	}
+	if err := s.loadContextImages(ctx, userID, branchDesc); err != nil {
+		return nil, err
+	}
+
+	summaryCost := 0
+	if summary != nil {
+		summaryCost = s.countTokens(summary.Content)
+	}
+	if summaryCost+s.historyTokens(branchDesc) <= budget {
+		return withSummary(summary, branchDesc), nil
+	}
+
+	// overflow: keep the newest turns verbatim (always at least the leaf's turn) and condense the rest
+	keepBudget := int(float64(budget) * summaryKeepRatio)
+	keep := turn
+	used := s.historyTokens(branchDesc[:turn])
+	for keep < len(branchDesc) {
+		cost := s.messageTokens(branchDesc[keep])
+		if used+cost > keepBudget {
+			break
+		}
+		used += cost
+		keep++
+	}
+	kept, condense := branchDesc[:keep], branchDesc[keep:]
+	if len(condense) == 0 {
+		return withSummary(summary, kept), nil
+	}
+
+	// each pass folds the oldest rows that fit the transcript cap into the summary
+	for len(condense) > 0 {
+		next, err := s.summarize(ctx, provider, sess, userID, summary, condense)
+		if err != nil {
+			// a missing summary only costs context; the reply itself can still be generated,
+			// and the rows not condensed yet are picked up again next time
+			log.Printf("chat: summarize session %s: %v", sess.SessionID, err)
+			return withSummary(summary, kept), nil
+		}
+		summary = next
+		for i, m := range condense {
+			if m.ID <= summary.UptoMessageID {
+				condense = condense[:i]
+				break
+			}
+		}
+	}
+	return withSummary(summary, kept), nil
+}
+
+// leafTurnLen returns how many of the DESC-ordered branch rows belong to the leaf's
+// turn: everything down to and including the newest user message.
+func leafTurnLen(branchDesc []Message) int {
+	for i, m := range branchDesc {
+		if m.Role == RoleUser {
+			return i + 1
+		}
+	}
+	return len(branchDesc)
+}
+
+// latestSummaryOnBranch returns the newest stored summary whose cut-off message lies on the branch.
+func (s *Service) latestSummaryOnBranch(ctx context.Context, userID uint64, sessionID string, branchDesc []Message) (*Summary, error) {
+	if len(branchDesc) == 0 {
+		return nil, nil
+	}
+	summaries, err := s.repo.ListSummaries(ctx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(summaries) == 0 {
+		return nil, nil
+	}
+	onBranch := make(map[uint64]bool, len(branchDesc))
+	for _, m := range branchDesc {
+		onBranch[m.ID] = true
+	}
+	// summaries are newest first
+	for i := range summaries {
+		if onBranch[summaries[i].UptoMessageID] {
+			return &summaries[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// summarize condenses prev (if any) plus the oldest of the DESC-ordered condense rows that
+// fit maxSummaryInputTokens into a new stored summary, whose cut-off is the newest row included.
+func (s *Service) summarize(ctx context.Context, provider ai.Provider, sess *Session, userID uint64, prev *Summary, condense []Message) (*Summary, error) {
+	var b strings.Builder
+	if prev != nil {
+		b.WriteString("Summary of the earlier conversation:\n")
+		b.WriteString(prev.Content)
+		b.WriteString("\n\n")
+	}
+	b.WriteString("Conversation:\n")
+
+	// oldest first until the transcript cap; the rest is left for the next pass
+	first, used := len(condense)-1, s.messageTokens(condense[len(condense)-1])
+	for first > 0 {
+		cost := s.messageTokens(condense[first-1])
+		if used+cost > maxSummaryInputTokens {
+			break
+		}
+		used += cost
+		first--
+	}
+	for i := len(condense) - 1; i >= first; i-- {
+		m := condense[i]
+		switch m.Role {
+		case RoleUser, RoleAssistant:
+			fmt.Fprintf(&b, "%s: %s\n", m.Role, m.Content)
+		case RoleToolResult:
+			fmt.Fprintf(&b, "tool %s returned: %s\n", m.ToolName, m.Content)
+		}
+	}
+
+	resp, err := provider.Chat(ctx, []ai.Message{
+		{Role: ai.RoleSystem, Content: summaryPrompt},
+		{Role: ai.RoleUser, Content: b.String()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	content := strings.TrimSpace(resp.Content)
+	if content == "" {
+		return nil, fmt.Errorf("empty summary")
+	}
+
+	sum := &Summary{
+		SessionID:        sess.SessionID,
+		UserID:           userID,
+		UptoMessageID:    condense[first].ID,
+		Content:          content,
+		Model:            responseModel(resp.Model, sess),
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	}
+	if err := s.repo.InsertSummary(ctx, sum); err != nil {
+		return nil, err
+	}
+	s.countUsage(ctx, userID, resp.Usage)
+	return sum, nil
+}
+
+func withSummary(sum *Summary, recentDesc []Message) []ai.Message {
+	msgs := toProviderMessages(recentDesc)
+	if sum == nil {
+		return msgs
+	}
+	return append([]ai.Message{{
+		Role:    ai.RoleSystem,
+		Content: "Summary of the earlier conversation:\n" + sum.Content,
+	}}, msgs...)
+}
+
+func (s *Service) countTokens(text string) int {
+	return s.tokenizer.CountTokens(text) + messageTokenOverhead
+}
+
+func (s *Service) messageTokens(m Message) int {
+	return s.countTokens(m.Content) + s.tokenizer.CountTokens(m.ToolCalls) + len(imageParts(m))*imageTokenEstimate
+}
+
+func (s *Service) historyTokens(msgsDesc []Message) int {
+	n := 0
+	for _, m := range msgsDesc {
+		n += s.messageTokens(m)
+	}
+	return n
+}
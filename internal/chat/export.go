@@ -0,0 +1,598 @@
+package chat
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+	"gorm.io/gorm"
+)
+
+// Export formats. JSON is lossless (every branch, tool rows, usage); Markdown and OpenAI JSONL
+// carry the system prompt and the user/assistant turns of the active branch only.
+const (
+	ExportJSON     = "json"
+	ExportMarkdown = "markdown"
+	ExportOpenAI   = "openai-jsonl"
+)
+
+var (
+	// ErrInvalidFormat is returned for unknown export/import formats.
+	ErrInvalidFormat = errors.New("unsupported format")
+	// ErrInvalidImport is returned for import files that cannot be parsed or fail validation.
+	ErrInvalidImport = errors.New("invalid import")
+)
+
+const (
+	exportVersion = 1
+	// upper bounds per imported file
+	maxImportSessions = 100
+	maxImportMessages = 10000
+	maxImportRunes    = 200000 // per message
+)
+
+type exportFormat struct {
+	ext         string
+	contentType string
+}
+
+var exportFormats = map[string]exportFormat{
+	ExportJSON:     {"json", "application/json"},
+	ExportMarkdown: {"md", "text/markdown; charset=utf-8"},
+	ExportOpenAI:   {"jsonl", "application/jsonl"},
+}
+
+// ExportFileInfo returns the file extension and content type of format.
+func ExportFileInfo(format string) (ext, contentType string, err error) {
+	f, ok := exportFormats[format]
+	if !ok {
+		return "", "", ErrInvalidFormat
+	}
+	return f.ext, f.contentType, nil
+}
+
+// SessionExport is a session with all of its messages, oldest first. It is the JSON export
+// format and the common form every import format is parsed into.
+type SessionExport struct {
+	Version      int       `json:"version"`
+	SessionID    string    `json:"session_id"`
+	Title        string    `json:"title"`
+	Provider     string    `json:"provider"`
+	Model        string    `json:"model"`
+	Fallbacks    string    `json:"fallbacks,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	ActiveLeafID *uint64   `json:"active_leaf_id,omitempty"`
+	GenerationSettings
+	Messages []Message `json:"messages"`
+}
+
+// ImportedSession is a session created by an import.
+type ImportedSession struct {
+	*Session
+	Messages int `json:"messages"`
+}
+
+// ExportSession loads the session and every message in it.
+func (s *Service) ExportSession(ctx context.Context, userID uint64, sessionID string) (*SessionExport, error) {
+	sess, err := s.repo.GetSessionBySessionID(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if sess.UserID != userID {
+		return nil, gorm.ErrRecordNotFound
+	}
+	msgs, err := s.repo.ListSessionMessagesAsc(ctx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionExport{
+		Version:            exportVersion,
+		SessionID:          sess.SessionID,
+		Title:              sess.Title,
+		Provider:           sess.Provider,
+		Model:              sess.Model,
+		Fallbacks:          sess.Fallbacks,
+		CreatedAt:          sess.CreatedAt,
+		UpdatedAt:          sess.UpdatedAt,
+		ActiveLeafID:       sess.ActiveLeafID,
+		GenerationSettings: sess.GenerationSettings,
+		Messages:           msgs,
+	}, nil
+}
+
+// ExportAll writes a zip of every session of the user in format, one file per session plus
+// a manifest.json. Sessions are loaded one at a time, so memory stays bounded.
+func (s *Service) ExportAll(ctx context.Context, userID uint64, format string, w io.Writer) error {
+	ext, _, err := ExportFileInfo(format)
+	if err != nil {
+		return err
+	}
+
+	type manifestEntry struct {
+		SessionID string `json:"session_id"`
+		Title     string `json:"title"`
+		File      string `json:"file"`
+		Messages  int    `json:"messages"`
+	}
+	manifest := struct {
+		Version    int             `json:"version"`
+		Format     string          `json:"format"`
+		ExportedAt time.Time       `json:"exported_at"`
+		Sessions   []manifestEntry `json:"sessions"`
+	}{Version: exportVersion, Format: format, ExportedAt: time.Now().UTC(), Sessions: []manifestEntry{}}
+
+	zw := zip.NewWriter(w)
+	var afterID uint64
+	for {
+		page, err := s.repo.ListSessionsAfter(ctx, userID, afterID, 100)
+		if err != nil {
+			return err
+		}
+		for _, sess := range page {
+			e, err := s.ExportSession(ctx, userID, sess.SessionID)
+			if err != nil {
+				return err
+			}
+			name := "sessions/" + sess.SessionID + "." + ext
+			f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: sess.UpdatedAt})
+			if err != nil {
+				return err
+			}
+			if err := e.Write(f, format); err != nil {
+				return err
+			}
+			manifest.Sessions = append(manifest.Sessions, manifestEntry{sess.SessionID, sess.Title, name, len(e.Messages)})
+		}
+		if len(page) < 100 {
+			break
+		}
+		afterID = page[len(page)-1].ID
+	}
+
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Write encodes the export in format.
+func (e *SessionExport) Write(w io.Writer, format string) error {
+	switch format {
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e)
+	case ExportMarkdown:
+		return e.writeMarkdown(w)
+	case ExportOpenAI:
+		return e.writeOpenAI(w)
+	default:
+		return ErrInvalidFormat
+	}
+}
+
+// activeBranch returns the messages on the path to the active leaf, oldest first. Sessions
+// without a leaf (no messages, or only pre-branching ones) are a single branch.
+func (e *SessionExport) activeBranch() []Message {
+	if e.ActiveLeafID == nil {
+		return e.Messages
+	}
+	byID := make(map[uint64]*Message, len(e.Messages))
+	for i := range e.Messages {
+		byID[e.Messages[i].ID] = &e.Messages[i]
+	}
+	var desc []Message
+	for id := e.ActiveLeafID; id != nil; {
+		m, ok := byID[*id]
+		if !ok || len(desc) > len(e.Messages) {
+			break
+		}
+		desc = append(desc, *m)
+		id = m.ParentID
+	}
+	out := make([]Message, len(desc))
+	for i, m := range desc {
+		out[len(desc)-1-i] = m
+	}
+	return out
+}
+
+// turns are the user/assistant messages with text on the active branch.
+func (e *SessionExport) turns() []Message {
+	var out []Message
+	for _, m := range e.activeBranch() {
+		if (m.Role == RoleUser || m.Role == RoleAssistant) && strings.TrimSpace(m.Content) != "" {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Markdown layout: a "# title" line, "- key: value" metadata, then one "## role · time"
+// section per message. Content lines that look like a section heading are escaped with "\".
+var mdHeading = regexp.MustCompile(`^## (system|user|assistant)(?: · (\S+))?$`)
+
+func (e *SessionExport) writeMarkdown(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	title := e.Title
+	if strings.TrimSpace(title) == "" {
+		title = "Untitled chat"
+	}
+	fmt.Fprintf(bw, "# %s\n\n", strings.Join(strings.Fields(title), " "))
+	fmt.Fprintf(bw, "- session: %s\n- provider: %s\n- model: %s\n- created: %s\n",
+		e.SessionID, e.Provider, e.Model, e.CreatedAt.UTC().Format(time.RFC3339))
+	if e.SystemPrompt != "" {
+		fmt.Fprintf(bw, "\n## system\n\n%s\n", escapeMarkdown(e.SystemPrompt))
+	}
+	for _, m := range e.turns() {
+		fmt.Fprintf(bw, "\n## %s · %s\n\n%s\n", m.Role, m.CreatedAt.UTC().Format(time.RFC3339), escapeMarkdown(m.Content))
+	}
+	return bw.Flush()
+}
+
+func escapeMarkdown(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i, l := range lines {
+		if mdHeading.MatchString(strings.TrimLeft(l, `\`)) {
+			lines[i] = `\` + l
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+type openAIMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type openAIConversation struct {
+	Messages []openAIMessage `json:"messages"`
+}
+
+// writeOpenAI writes one line in the chat fine-tuning format.
+func (e *SessionExport) writeOpenAI(w io.Writer) error {
+	conv := openAIConversation{Messages: []openAIMessage{}}
+	add := func(role, content string) {
+		b, _ := json.Marshal(content)
+		conv.Messages = append(conv.Messages, openAIMessage{Role: role, Content: b})
+	}
+	if e.SystemPrompt != "" {
+		add(ai.RoleSystem, e.SystemPrompt)
+	}
+	for _, m := range e.turns() {
+		add(m.Role, m.Content)
+	}
+	return json.NewEncoder(w).Encode(conv)
+}
+
+// ParseExports reads the sessions in an import file. JSON and Markdown files hold one
+// session; OpenAI JSONL holds one per line, without timestamps.
+func ParseExports(r io.Reader, format string) ([]SessionExport, error) {
+	switch format {
+	case ExportJSON:
+		var e SessionExport
+		dec := json.NewDecoder(r)
+		if err := dec.Decode(&e); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+		}
+		return []SessionExport{e}, nil
+	case ExportMarkdown:
+		e, err := parseMarkdown(r)
+		if err != nil {
+			return nil, err
+		}
+		return []SessionExport{*e}, nil
+	case ExportOpenAI:
+		return parseOpenAI(r)
+	default:
+		return nil, ErrInvalidFormat
+	}
+}
+
+func parseMarkdown(r io.Reader) (*SessionExport, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	e := &SessionExport{}
+	var cur *Message
+	var body []string
+	system := false
+	flush := func() {
+		text := strings.TrimSpace(strings.Join(body, "\n"))
+		switch {
+		case system:
+			e.SystemPrompt = text
+		case cur != nil:
+			cur.Content = text
+			e.Messages = append(e.Messages, *cur)
+		}
+		cur, body, system = nil, nil, false
+	}
+
+	inHeader := true
+	for _, line := range strings.Split(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n") {
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			flush()
+			inHeader = false
+			if m[1] == "system" {
+				system = true
+				continue
+			}
+			cur = &Message{Role: m[1]}
+			if m[2] != "" {
+				t, err := time.Parse(time.RFC3339, m[2])
+				if err != nil {
+					return nil, fmt.Errorf("%w: bad timestamp %q", ErrInvalidImport, m[2])
+				}
+				cur.CreatedAt = t
+			}
+			continue
+		}
+		if inHeader {
+			switch {
+			case strings.HasPrefix(line, "# ") && e.Title == "":
+				e.Title = strings.TrimSpace(line[2:])
+			case strings.HasPrefix(line, "- "):
+				k, v, _ := strings.Cut(line[2:], ":")
+				v = strings.TrimSpace(v)
+				switch strings.TrimSpace(k) {
+				case "provider":
+					e.Provider = v
+				case "model":
+					e.Model = v
+				case "created":
+					if t, err := time.Parse(time.RFC3339, v); err == nil {
+						e.CreatedAt = t
+					}
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(line, `\`) && mdHeading.MatchString(strings.TrimLeft(line, `\`)) {
+			line = line[1:]
+		}
+		body = append(body, line)
+	}
+	flush()
+	if len(e.Messages) == 0 {
+		return nil, fmt.Errorf("%w: no messages found", ErrInvalidImport)
+	}
+	return e, nil
+}
+
+func parseOpenAI(r io.Reader) ([]SessionExport, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var out []SessionExport
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(out) == maxImportSessions {
+			return nil, fmt.Errorf("%w: more than %d conversations", ErrInvalidImport, maxImportSessions)
+		}
+		var conv openAIConversation
+		if err := json.Unmarshal(line, &conv); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidImport, n, err)
+		}
+		var e SessionExport
+		for _, m := range conv.Messages {
+			text, err := openAIText(m.Content)
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidImport, n, err)
+			}
+			switch m.Role {
+			case ai.RoleSystem, "developer":
+				if e.SystemPrompt == "" {
+					e.SystemPrompt = text
+				}
+			case RoleUser, RoleAssistant:
+				// assistant tool-call turns have no text
+				if strings.TrimSpace(text) != "" {
+					e.Messages = append(e.Messages, Message{Role: m.Role, Content: text})
+				}
+			}
+		}
+		if len(e.Messages) == 0 {
+			return nil, fmt.Errorf("%w: line %d has no user or assistant messages", ErrInvalidImport, n)
+		}
+		out = append(out, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: no conversations found", ErrInvalidImport)
+	}
+	return out, nil
+}
+
+// openAIText accepts string content or an array of content parts, keeping the text parts.
+func openAIText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", errors.New("content must be a string or an array of parts")
+	}
+	var texts []string
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// ImportSessions parses r and creates one new session per conversation in it, keeping roles,
+// timestamps and (for JSON) the branch structure. Sessions get new ids; unknown providers
+// fall back to the default provider and model.
+func (s *Service) ImportSessions(ctx context.Context, userID uint64, format string, r io.Reader) ([]ImportedSession, error) {
+	exports, err := ParseExports(r, format)
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]*importPlan, 0, len(exports))
+	for i := range exports {
+		p, err := s.planImport(userID, &exports[i])
+		if err != nil {
+			if len(exports) > 1 {
+				return nil, fmt.Errorf("conversation %d: %w", i+1, err)
+			}
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+
+	out := make([]ImportedSession, 0, len(plans))
+	for _, p := range plans {
+		if err := s.repo.CreateImportedSession(ctx, p.session, p.messages, p.parents, p.leaf); err != nil {
+			return nil, err
+		}
+		out = append(out, ImportedSession{Session: p.session, Messages: len(p.messages)})
+	}
+	return out, nil
+}
+
+// importPlan is a validated session to insert. parents[i] is the index of message i's parent
+// (-1 for a root) and leaf the index of the active leaf.
+type importPlan struct {
+	session  *Session
+	messages []Message
+	parents  []int
+	leaf     int
+}
+
+func (s *Service) planImport(userID uint64, e *SessionExport) (*importPlan, error) {
+	if len(e.Messages) == 0 {
+		return nil, fmt.Errorf("%w: no messages", ErrInvalidImport)
+	}
+	if len(e.Messages) > maxImportMessages {
+		return nil, fmt.Errorf("%w: more than %d messages", ErrInvalidImport, maxImportMessages)
+	}
+	if err := e.GenerationSettings.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+
+	sid, err := NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+	provider, model := strings.ToLower(strings.TrimSpace(e.Provider)), strings.TrimSpace(e.Model)
+	if provider == "" || !s.registry.Has(provider) {
+		provider, model = defaultProvider, defaultModel
+	}
+	if model == "" || len(model) > 64 {
+		model = defaultModel
+	}
+	fallbacks := ""
+	if ts, err := ai.ParseTargets(e.Fallbacks); err == nil && s.validateFallbacks(ts) == nil {
+		fallbacks = ai.FormatTargets(ts)
+	}
+	title := strings.Join(strings.Fields(e.Title), " ")
+	if utf8.RuneCountInString(title) > 128 {
+		title = string([]rune(title)[:128])
+	}
+	if title == "" {
+		title = makeTitleFromText(e.Messages[0].Content)
+	}
+
+	p := &importPlan{
+		session: &Session{
+			SessionID:          sid,
+			UserID:             userID,
+			Provider:           provider,
+			Model:              model,
+			Title:              title,
+			Fallbacks:          fallbacks,
+			CreatedAt:          e.CreatedAt,
+			UpdatedAt:          e.UpdatedAt,
+			GenerationSettings: e.GenerationSettings,
+		},
+		messages: make([]Message, len(e.Messages)),
+		parents:  make([]int, len(e.Messages)),
+		leaf:     len(e.Messages) - 1,
+	}
+
+	// without parent ids the messages form a single branch in file order
+	tree := false
+	for _, m := range e.Messages {
+		if m.ParentID != nil {
+			tree = true
+			break
+		}
+	}
+	index := make(map[uint64]int, len(e.Messages))
+	for i, m := range e.Messages {
+		switch m.Role {
+		case RoleUser, RoleAssistant, RoleToolCall, RoleToolResult:
+		default:
+			return nil, fmt.Errorf("%w: message %d has unknown role %q", ErrInvalidImport, i+1, m.Role)
+		}
+		if utf8.RuneCountInString(m.Content) > maxImportRunes {
+			return nil, fmt.Errorf("%w: message %d is longer than %d characters", ErrInvalidImport, i+1, maxImportRunes)
+		}
+		switch {
+		case !tree:
+			p.parents[i] = i - 1
+		case m.ParentID == nil:
+			p.parents[i] = -1
+		default:
+			// parents always precede their children in an export
+			j, ok := index[*m.ParentID]
+			if !ok {
+				return nil, fmt.Errorf("%w: message %d has an unknown parent_id", ErrInvalidImport, i+1)
+			}
+			p.parents[i] = j
+		}
+		if m.ID != 0 {
+			index[m.ID] = i
+		}
+		// model and token counts are left out: usage is only what this server generated,
+		// and the file's numbers would be counted again or could be made up
+		p.messages[i] = Message{
+			SessionID:  sid,
+			UserID:     userID,
+			Role:       m.Role,
+			Content:    m.Content,
+			CreatedAt:  m.CreatedAt,
+			ToolCalls:  m.ToolCalls,
+			ToolCallID: m.ToolCallID,
+			ToolName:   m.ToolName,
+			Citations:  m.Citations,
+		}
+	}
+	if tree && e.ActiveLeafID != nil {
+		if j, ok := index[*e.ActiveLeafID]; ok {
+			p.leaf = j
+		}
+	}
+	return p, nil
+}
@@ -1,6 +1,15 @@
 package chat
 
-import "time"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/suPer8Hu/ai-platform/internal/models"
+	"gorm.io/gorm"
+)
 
 type JobStatus string
 
@@ -9,8 +18,14 @@ const (
 	JobRunning   JobStatus = "running"
 	JobSucceeded JobStatus = "succeeded"
 	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
 )
 
+// Terminal reports whether a job in this status will not change anymore.
+func (st JobStatus) Terminal() bool {
+	return st == JobSucceeded || st == JobFailed || st == JobCancelled
+}
+
 type Job struct {
 	ID string `gorm:"primaryKey;size:26"` // ULID length
 
@@ -19,16 +34,400 @@ type Job struct {
 
 	Prompt string `gorm:"type:text;not null"`
 
+	// The user message the job answers; nil for jobs stored before it was recorded, which
+	// answer the session's active leaf
+	MessageID *uint64
+
 	IdempotencyKey *string `gorm:"type:varchar(128);index:uniq_user_idempo,unique" json:"idempotency_key"`
 
+	// Notified when the job succeeds or fails (see WebhookDelivery)
+	CallbackURL *string `gorm:"type:varchar(2048)"`
+
 	Status JobStatus `gorm:"type:varchar(16);index;not null"`
 
+	// RabbitMQ message priority, see JobPriority
+	Priority uint8 `gorm:"not null;default:0"`
+
 	// Filled when succeeded
 	ResultMessageID *uint64 `gorm:"index"`
 
 	// Filled when failed
 	Error *string `gorm:"type:text"`
 
+	// Bumped by the worker while the job runs; a running job whose heartbeat stopped is
+	// requeued by SweepStuckJobs
+	HeartbeatAt *time.Time
+	// When SweepStuckJobs last requeued the job
+	RequeuedAt *time.Time
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
+
+// Job priorities. Higher ones are consumed first when the job queue is declared with
+// x-max-priority (see rabbitmq.Options).
+const (
+	JobPriorityLow    uint8 = 1
+	JobPriorityNormal uint8 = 5
+	JobPriorityHigh   uint8 = 9
+)
+
+var jobPriorityNames = map[string]uint8{
+	"low":    JobPriorityLow,
+	"normal": JobPriorityNormal,
+	"high":   JobPriorityHigh,
+}
+
+// JobPriority picks the priority of a job from the user's plan and the priority the request
+// asked for ("low", "normal", "high" or "" for the plan's default). Only the pro plan may ask
+// for high; anyone may lower their jobs to low, e.g. for bulk work.
+func JobPriority(plan, requested string) (uint8, error) {
+	def, top := JobPriorityNormal, JobPriorityNormal
+	if plan == models.PlanPro {
+		def, top = JobPriorityHigh, JobPriorityHigh
+	}
+	if requested == "" {
+		return def, nil
+	}
+	p, ok := jobPriorityNames[requested]
+	if !ok {
+		return 0, ErrInvalidJobPriority
+	}
+	if p > top {
+		return 0, ErrJobPriorityNotAllowed
+	}
+	return p, nil
+}
+
+var (
+	// ErrInvalidJobPriority and ErrJobPriorityNotAllowed are returned by JobPriority.
+	ErrInvalidJobPriority    = errors.New("priority must be low, normal or high")
+	ErrJobPriorityNotAllowed = errors.New("priority not available on your plan")
+	// ErrJobCancelled is returned when a job is cancelled while it is being processed.
+	ErrJobCancelled = errors.New("job cancelled")
+	// ErrJobTaken is returned by StartJob for a job another delivery is already running.
+	ErrJobTaken = errors.New("job already running")
+	// ErrJobNotCancellable is returned for cancelling jobs that already finished.
+	ErrJobNotCancellable = errors.New("job already finished")
+	// ErrJobEventsDisabled is returned for watching jobs when no event bus is configured.
+	ErrJobEventsDisabled = errors.New("job events are not configured")
+)
+
+// Job event types.
+const (
+	JobEventStatus = "status"
+	JobEventChunk  = "chunk"
+)
+
+// JobEvent is a live update of a job: a status change, or a chunk of the reply being
+// generated. A job that is retried goes back to queued and streams its reply again.
+type JobEvent struct {
+	Type            string    `json:"type"`
+	Status          JobStatus `json:"status,omitempty"`
+	Delta           string    `json:"delta,omitempty"`
+	ResultMessageID *uint64   `json:"result_message_id,omitempty"`
+	Error           *string   `json:"error,omitempty"`
+}
+
+func jobStatusEvent(j *Job) JobEvent {
+	return JobEvent{Type: JobEventStatus, Status: j.Status, ResultMessageID: j.ResultMessageID, Error: j.Error}
+}
+
+// JobEvents carries job events from the worker to API instances (see redisstore.Store).
+// Delivery is best effort; the job row stays the source of truth.
+type JobEvents interface {
+	PublishJobEvent(ctx context.Context, jobID string, payload string) error
+	SubscribeJobEvents(ctx context.Context, jobID string) (<-chan string, func(), error)
+}
+
+const (
+	// how often a running job re-reads its row in case a cancel event was missed
+	jobCancelPollInterval = 2 * time.Second
+	// how often watchers re-read the job row in case status events were missed
+	jobWatchPollInterval = 5 * time.Second
+	// how often a running job bumps its heartbeat
+	jobHeartbeatInterval = 30 * time.Second
+)
+
+func (s *Service) SetJobEvents(e JobEvents) {
+	s.jobEvents = e
+}
+
+func (s *Service) publishJobEvent(ctx context.Context, jobID string, ev JobEvent) {
+	if s.jobEvents == nil {
+		return
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	if err := s.jobEvents.PublishJobEvent(ctx, jobID, string(b)); err != nil {
+		log.Printf("chat: publish job %s event: %v", jobID, err)
+	}
+}
+
+// publishJobStatus reloads the job and publishes its status.
+func (s *Service) publishJobStatus(ctx context.Context, jobID string) (*Job, error) {
+	j, err := s.repo.GetJobByID(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	s.publishJobEvent(ctx, jobID, jobStatusEvent(j))
+	return j, nil
+}
+
+// CancelJob cancels the user's job if it is still queued or running. Cancelling a cancelled
+// job is a no-op.
+func (s *Service) CancelJob(ctx context.Context, userID uint64, jobID string) (*Job, error) {
+	n, err := s.repo.CancelJob(ctx, userID, jobID)
+	if err != nil {
+		return nil, err
+	}
+	j, err := s.repo.GetJobByID(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if j.UserID != userID {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if n == 0 {
+		if j.Status == JobCancelled {
+			return j, nil
+		}
+		return j, ErrJobNotCancellable
+	}
+	s.publishJobEvent(ctx, jobID, jobStatusEvent(j))
+	return j, nil
+}
+
+// StartJob marks a queued job running and returns it. Jobs that are not running afterwards
+// were cancelled or finished by an earlier delivery and must not be processed. A job that
+// was running already returns ErrJobTaken: a duplicate delivery must not run it twice, and
+// if its worker died SweepStuckJobs requeues it.
+func (s *Service) StartJob(ctx context.Context, jobID string) (*Job, error) {
+	n, err := s.repo.UpdateJobStatusRunning(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	j, err := s.repo.GetJobByID(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if j.Status == JobRunning {
+		if n == 0 {
+			return j, ErrJobTaken
+		}
+		s.publishJobEvent(ctx, jobID, jobStatusEvent(j))
+	}
+	return j, nil
+}
+
+// RunJob generates and stores the reply of a running job, publishing its chunks as they
+// arrive. It returns ErrJobCancelled when the job is cancelled before the reply is stored.
+func (s *Service) RunJob(ctx context.Context, j *Job) (uint64, error) {
+	jctx, stop := s.watchJobCancel(ctx, j.ID)
+	defer stop()
+	go s.beatJob(jctx, j.ID)
+
+	var onDelta func(string)
+	if s.jobEvents != nil {
+		onDelta = func(delta string) {
+			s.publishJobEvent(ctx, j.ID, JobEvent{Type: JobEventChunk, Delta: delta})
+		}
+	}
+	var parentID uint64
+	if j.MessageID != nil {
+		parentID = *j.MessageID
+	}
+	_, msgID, err := s.GenerateAssistantReplyStream(jctx, j.UserID, j.SessionID, parentID, onDelta)
+	if err != nil && errors.Is(context.Cause(jctx), ErrJobCancelled) {
+		return 0, ErrJobCancelled
+	}
+	return msgID, err
+}
+
+// watchJobCancel returns a context that is cancelled with ErrJobCancelled once the job is.
+func (s *Service) watchJobCancel(ctx context.Context, jobID string) (context.Context, context.CancelFunc) {
+	jctx, cancel := context.WithCancelCause(ctx)
+
+	var events <-chan string
+	stopEvents := func() {}
+	if s.jobEvents != nil {
+		ch, stop, err := s.jobEvents.SubscribeJobEvents(jctx, jobID)
+		if err != nil {
+			log.Printf("chat: subscribe job %s events: %v", jobID, err)
+		} else {
+			events, stopEvents = ch, stop
+		}
+	}
+
+	cancelled := func() bool {
+		j, err := s.repo.GetJobByID(jctx, jobID)
+		return err == nil && j.Status == JobCancelled
+	}
+	go func() {
+		defer stopEvents()
+		// a cancel may have landed before the subscription
+		if cancelled() {
+			cancel(ErrJobCancelled)
+			return
+		}
+		poll := time.NewTicker(jobCancelPollInterval)
+		defer poll.Stop()
+		for {
+			select {
+			case <-jctx.Done():
+				return
+			case p, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				var ev JobEvent
+				if json.Unmarshal([]byte(p), &ev) == nil && ev.Status == JobCancelled {
+					cancel(ErrJobCancelled)
+					return
+				}
+			case <-poll.C:
+				if cancelled() {
+					cancel(ErrJobCancelled)
+					return
+				}
+			}
+		}
+	}()
+	return jctx, func() { cancel(context.Canceled) }
+}
+
+// beatJob bumps the heartbeat of a running job until ctx ends, so SweepStuckJobs leaves it
+// alone however long it runs.
+func (s *Service) beatJob(ctx context.Context, jobID string) {
+	t := time.NewTicker(jobHeartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.repo.HeartbeatJob(ctx, jobID); err != nil && ctx.Err() == nil {
+				log.Printf("chat: heartbeat job %s: %v", jobID, err)
+			}
+		}
+	}
+}
+
+// FinishJob records the reply of a job. It returns ErrJobCancelled when the job was cancelled
+// in the meantime; the reply is kept then.
+func (s *Service) FinishJob(ctx context.Context, jobID string, assistantMsgID uint64) error {
+	if err := s.repo.MarkJobSucceeded(ctx, jobID, assistantMsgID); err != nil {
+		return err
+	}
+	j, err := s.publishJobStatus(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	if j.Status == JobCancelled {
+		return ErrJobCancelled
+	}
+	s.enqueueWebhook(ctx, j)
+	return nil
+}
+
+// RetryJob puts a failed attempt back into the queued state until it is delivered again.
+func (s *Service) RetryJob(ctx context.Context, jobID string, errMsg string) error {
+	if err := s.repo.RequeueJob(ctx, jobID, errMsg); err != nil {
+		return err
+	}
+	_, err := s.publishJobStatus(ctx, jobID)
+	return err
+}
+
+// FailJob marks a job failed for good.
+func (s *Service) FailJob(ctx context.Context, jobID string, errMsg string) error {
+	if err := s.repo.MarkJobFailed(ctx, jobID, errMsg); err != nil {
+		return err
+	}
+	j, err := s.publishJobStatus(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	s.enqueueWebhook(ctx, j)
+	return nil
+}
+
+// WatchJob returns the events of the user's job: its current status first, then live status
+// changes and reply chunks. The channel is closed after a terminal status or when ctx ends.
+func (s *Service) WatchJob(ctx context.Context, userID uint64, jobID string) (<-chan JobEvent, error) {
+	if s.jobEvents == nil {
+		return nil, ErrJobEventsDisabled
+	}
+	j, err := s.repo.GetJobByID(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if j.UserID != userID {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	events, stop, err := s.jobEvents.SubscribeJobEvents(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	// the job may have moved on while subscribing
+	if j, err = s.repo.GetJobByID(ctx, jobID); err != nil {
+		stop()
+		return nil, err
+	}
+
+	out := make(chan JobEvent, 16)
+	go func() {
+		defer close(out)
+		defer stop()
+
+		send := func(ev JobEvent) bool {
+			select {
+			case out <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		last := j.Status
+		if !send(jobStatusEvent(j)) || last.Terminal() {
+			return
+		}
+		poll := time.NewTicker(jobWatchPollInterval)
+		defer poll.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case p, ok := <-events:
+				if !ok {
+					return
+				}
+				var ev JobEvent
+				if json.Unmarshal([]byte(p), &ev) != nil {
+					continue
+				}
+				if ev.Type == JobEventStatus {
+					last = ev.Status
+				}
+				if !send(ev) || (ev.Type == JobEventStatus && ev.Status.Terminal()) {
+					return
+				}
+			case <-poll.C:
+				cur, err := s.repo.GetJobByID(ctx, jobID)
+				if err != nil || cur.Status == last {
+					continue
+				}
+				last = cur.Status
+				if !send(jobStatusEvent(cur)) || last.Terminal() {
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
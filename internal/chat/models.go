@@ -1,6 +1,11 @@
 package chat
 
-import "time"
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
 
 type Session struct {
 	ID        uint64    `gorm:"primaryKey;autoIncrement" json:"-"`
@@ -11,10 +16,78 @@ type Session struct {
 	Title     string    `gorm:"type:varchar(128);not null;default:''" json:"title"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// comma-separated provider:model targets tried when Provider/Model fails; empty uses the global chain
+	Fallbacks string `gorm:"type:varchar(512);not null;default:''" json:"fallbacks,omitempty"`
+
+	// system prompt and sampling parameters sent with every reply
+	GenerationSettings `gorm:"embedded"`
+
+	// last message of the branch the user is on; nil for sessions without messages
+	// (or created before branching, until their first new message)
+	ActiveLeafID *uint64 `json:"active_leaf_id,omitempty"`
 }
 
 func (Session) TableName() string { return "chat_sessions" }
 
+// GenerationSettings are the system prompt and sampling parameters of a session or persona.
+// Nil/empty fields use the provider's defaults.
+type GenerationSettings struct {
+	SystemPrompt string     `gorm:"type:text" json:"system_prompt,omitempty"`
+	Temperature  *float64   `json:"temperature,omitempty"`
+	TopP         *float64   `json:"top_p,omitempty"`
+	MaxTokens    *int       `json:"max_tokens,omitempty"`
+	Stop         StringList `gorm:"type:text" json:"stop,omitempty"`
+}
+
+// StringList is stored as a JSON array.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal([]string(l))
+	return string(b), err
+}
+
+func (l *StringList) Scan(src any) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("StringList: cannot scan %T", src)
+	}
+	if len(b) == 0 {
+		*l = nil
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+// Persona is a named, reusable set of generation settings (and optionally a provider/model)
+// a user can start sessions from.
+type Persona struct {
+	ID          uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID      uint64    `gorm:"not null;uniqueIndex:uniq_chat_persona_user_name,priority:1" json:"-"`
+	Name        string    `gorm:"type:varchar(64);not null;uniqueIndex:uniq_chat_persona_user_name,priority:2" json:"name"`
+	Description string    `gorm:"type:varchar(255);not null;default:''" json:"description"`
+	Provider    string    `gorm:"type:varchar(32);not null;default:''" json:"provider,omitempty"`
+	Model       string    `gorm:"type:varchar(64);not null;default:''" json:"model,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	GenerationSettings `gorm:"embedded"`
+}
+
+func (Persona) TableName() string { return "chat_personas" }
+
 type Message struct {
 	ID             uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
 	SessionID      string    `gorm:"type:varchar(26);not null;index:idx_chat_msg_user_session_id,priority:2;index:uniq_chat_msg_idempo,unique,priority:2" json:"session_id"`
@@ -23,6 +96,141 @@ type Message struct {
 	Content        string    `gorm:"type:text;not null" json:"content"`
 	IdempotencyKey *string   `gorm:"type:varchar(128);index:uniq_chat_msg_idempo,unique,priority:3" json:"-"`
 	CreatedAt      time.Time `json:"created_at"`
+
+	// messages form a tree per session: edits and regenerations add siblings under the same parent
+	ParentID *uint64 `gorm:"index" json:"parent_id,omitempty"`
+
+	// tool_call rows: JSON array of ai.ToolCall; tool_result rows: the call they answer
+	ToolCalls  string `gorm:"type:text" json:"tool_calls,omitempty"`
+	ToolCallID string `gorm:"type:varchar(64);not null;default:''" json:"tool_call_id,omitempty"`
+	ToolName   string `gorm:"type:varchar(64);not null;default:''" json:"tool_name,omitempty"`
+
+	// assistant rows: document excerpts that were given to the model
+	Citations CitationList `gorm:"type:text" json:"citations,omitempty"`
+
+	// assistant/tool_call rows: the model that answered and the tokens it reported
+	Model            string `gorm:"type:varchar(128);not null;default:''" json:"model,omitempty"`
+	PromptTokens     int    `gorm:"not null;default:0" json:"prompt_tokens,omitempty"`
+	CompletionTokens int    `gorm:"not null;default:0" json:"completion_tokens,omitempty"`
+
+	// user rows: uploaded images. Set to the ids to attach when inserting; filled in on reads.
+	Attachments []Attachment `gorm:"-" json:"attachments,omitempty"`
 }
 
+// Message roles. tool_call/tool_result rows record the tool loop of an assistant turn.
+const (
+	RoleUser       = "user"
+	RoleAssistant  = "assistant"
+	RoleToolCall   = "tool_call"
+	RoleToolResult = "tool_result"
+)
+
 func (Message) TableName() string { return "chat_messages" }
+
+// Attachment is an image uploaded to a session and attached to one of its user messages.
+// Uploads stay unattached (MessageID nil) until a message names them. The image itself lives
+// in a blob.Store under StorageKey.
+type Attachment struct {
+	ID         uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID     uint64    `gorm:"not null;index:idx_chat_attach_user_session,priority:1" json:"-"`
+	SessionID  string    `gorm:"type:varchar(26);not null;index:idx_chat_attach_user_session,priority:2" json:"session_id"`
+	MessageID  *uint64   `gorm:"index" json:"message_id,omitempty"`
+	MimeType   string    `gorm:"type:varchar(64);not null" json:"mime_type"`
+	Size       int64     `gorm:"not null" json:"size"`
+	Width      int       `gorm:"not null" json:"width"`
+	Height     int       `gorm:"not null" json:"height"`
+	SHA256     string    `gorm:"size:64;not null" json:"sha256"`
+	StorageKey string    `gorm:"type:varchar(255);not null" json:"-"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+
+	// loaded on demand
+	Data []byte `gorm:"-" json:"-"`
+}
+
+func (Attachment) TableName() string { return "chat_attachments" }
+
+// Summary condenses the messages of a branch from its root down to and including UptoMessageID.
+// It replaces those messages in the provider context of every later turn on that branch.
+type Summary struct {
+	ID            uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	SessionID     string    `gorm:"type:varchar(26);not null;index:idx_chat_summary_user_session,priority:2" json:"session_id"`
+	UserID        uint64    `gorm:"not null;index:idx_chat_summary_user_session,priority:1" json:"-"`
+	UptoMessageID uint64    `gorm:"not null" json:"upto_message_id"`
+	Content       string    `gorm:"type:text;not null" json:"content"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	// the model that wrote the summary and the tokens it reported
+	Model            string `gorm:"type:varchar(128);not null;default:''" json:"model,omitempty"`
+	PromptTokens     int    `gorm:"not null;default:0" json:"prompt_tokens,omitempty"`
+	CompletionTokens int    `gorm:"not null;default:0" json:"completion_tokens,omitempty"`
+}
+
+func (Summary) TableName() string { return "chat_summaries" }
+
+// MessageEmbedding is the vector of a message's content under one embedding model, used by
+// semantic search. Vector holds Dim little-endian float32 values.
+type MessageEmbedding struct {
+	MessageID uint64 `gorm:"primaryKey;autoIncrement:false"`
+	Model     string `gorm:"primaryKey;type:varchar(128);index:idx_chat_embed_user_model,priority:2"`
+	UserID    uint64 `gorm:"not null;index:idx_chat_embed_user_model,priority:1"`
+	SessionID string `gorm:"type:varchar(26);not null;index"`
+	Dim       int    `gorm:"not null"`
+	Vector    []byte `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+func (MessageEmbedding) TableName() string { return "chat_message_embeddings" }
+
+// Share is a read-only link to a session, frozen at the branch that was active when it was
+// created. Only the hash of its token is stored.
+type Share struct {
+	ID        string     `gorm:"primaryKey;type:varchar(26)" json:"id"`
+	UserID    uint64     `gorm:"not null;index" json:"-"`
+	SessionID string     `gorm:"type:varchar(26);not null;index" json:"session_id"`
+	TokenHash string     `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	LeafID    uint64     `gorm:"not null" json:"-"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (Share) TableName() string { return "chat_shares" }
+
+// WebhookDelivery is the delivery log of one job webhook. Each job sends each event at most
+// once; retries and redeliveries reuse the row.
+type WebhookDelivery struct {
+	ID             uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID         uint64     `gorm:"not null;index" json:"-"`
+	SessionID      string     `gorm:"type:varchar(26);not null;index" json:"session_id"`
+	JobID          string     `gorm:"type:varchar(26);not null;uniqueIndex:uniq_webhook_job_event,priority:1" json:"job_id"`
+	Event          string     `gorm:"type:varchar(32);not null;uniqueIndex:uniq_webhook_job_event,priority:2" json:"event"`
+	URL            string     `gorm:"type:varchar(2048);not null" json:"url"`
+	Payload        string     `gorm:"type:text;not null" json:"-"`
+	Status         string     `gorm:"type:varchar(16);not null;index:idx_webhook_due,priority:1" json:"status"`
+	Attempts       int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  time.Time  `gorm:"index:idx_webhook_due,priority:2" json:"next_attempt_at"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      *string    `gorm:"type:text" json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+func (WebhookDelivery) TableName() string { return "chat_webhook_deliveries" }
+
+// OutboxMessage is a job waiting to be published to the job queue. It is written in the same
+// transaction as the job and deleted once the broker has confirmed the message.
+type OutboxMessage struct {
+	ID            uint64    `gorm:"primaryKey;autoIncrement"`
+	UserID        uint64    `gorm:"not null;index"`
+	SessionID     string    `gorm:"type:varchar(26);not null;index"`
+	JobID         string    `gorm:"type:varchar(26);not null;index"`
+	Priority      uint8     `gorm:"not null;default:0"`
+	Attempts      int       `gorm:"not null;default:0"`
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     *string   `gorm:"type:text"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (OutboxMessage) TableName() string { return "chat_job_outbox" }
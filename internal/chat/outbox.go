@@ -0,0 +1,182 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// JobPublisher puts a job on the queue the worker consumes (see rabbitmq.Publisher) with the
+// given message priority. It returns once the broker has confirmed the message.
+type JobPublisher interface {
+	PublishJob(ctx context.Context, jobID string, userID uint64, priority uint8) error
+}
+
+const (
+	outboxBatchSize = 100
+	// how long a claimed outbox entry is left to its relay before another one may try
+	outboxLease      = 30 * time.Second
+	outboxMaxBackoff = time.Minute
+
+	sweepBatchSize = 100
+)
+
+func (s *Service) SetJobPublisher(p JobPublisher) {
+	s.jobPublisher = p
+}
+
+// EnqueueJob stores a queued job, its user message and an outbox entry in one transaction and
+// then tries to publish the job right away. When that fails the entry stays in the outbox for
+// RelayOutbox, so a stored job always reaches the queue. If the job's idempotency key was used
+// before, the existing job is returned instead and created is false. attachmentIDs are
+// attached to the user message.
+func (s *Service) EnqueueJob(ctx context.Context, job *Job, attachmentIDs ...uint64) (*Job, bool, error) {
+	attachments, err := s.attachmentRefs(attachmentIDs)
+	if err != nil {
+		return nil, false, err
+	}
+	msg := &Message{
+		UserID:         job.UserID,
+		SessionID:      job.SessionID,
+		Role:           "user",
+		Content:        job.Prompt,
+		IdempotencyKey: job.IdempotencyKey,
+		Attachments:    attachments,
+	}
+	out, err := s.repo.CreateJobWithOutbox(ctx, job, msg)
+	if err != nil {
+		if job.IdempotencyKey != nil && !errors.Is(err, gorm.ErrRecordNotFound) && !errors.Is(err, ErrAttachmentNotFound) {
+			if existing, getErr := s.repo.GetJobByUserAndIdempotencyKey(ctx, job.UserID, *job.IdempotencyKey); getErr == nil {
+				return existing, false, nil
+			}
+		}
+		return nil, false, err
+	}
+	s.maybeSetSessionTitle(ctx, job.UserID, job.SessionID, job.Prompt)
+	s.relayOutboxMessage(ctx, out.ID)
+	return job, true, nil
+}
+
+// RelayOutbox publishes the outbox entries that are due and returns how many it published.
+// Entries are claimed before publishing, so several relays can run side by side; a job may
+// still be published twice, which StartJob tolerates.
+func (s *Service) RelayOutbox(ctx context.Context) (int, error) {
+	if s.jobPublisher == nil {
+		return 0, nil
+	}
+	ids, err := s.repo.ListDueOutbox(ctx, time.Now(), outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		if s.relayOutboxMessage(ctx, id) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// relayOutboxMessage makes one publish attempt for a due outbox entry, unless another relay
+// claimed it first, and reports whether the broker took it.
+func (s *Service) relayOutboxMessage(ctx context.Context, id uint64) bool {
+	if s.jobPublisher == nil {
+		return false
+	}
+	now := time.Now()
+	claimed, err := s.repo.ClaimOutboxMessage(ctx, id, now, now.Add(outboxLease))
+	if err != nil || !claimed {
+		if err != nil {
+			log.Printf("chat: claim outbox=%d: %v", id, err)
+		}
+		return false
+	}
+	m, err := s.repo.GetOutboxMessage(ctx, id)
+	if err != nil {
+		log.Printf("chat: load outbox=%d: %v", id, err)
+		return false
+	}
+
+	if pubErr := s.jobPublisher.PublishJob(ctx, m.JobID, m.UserID, m.Priority); pubErr != nil {
+		log.Printf("chat: publish job=%s outbox=%d attempt=%d: %v", m.JobID, id, m.Attempts, pubErr)
+		msg := pubErr.Error()
+		if err := s.repo.UpdateOutboxMessage(ctx, id, map[string]any{
+			"next_attempt_at": time.Now().Add(outboxBackoff(m.Attempts)),
+			"last_error":      msg,
+		}); err != nil {
+			log.Printf("chat: update outbox=%d: %v", id, err)
+		}
+		return false
+	}
+	if err := s.repo.DeleteOutboxMessage(ctx, id); err != nil {
+		// published; the lease runs out and the job is published once more
+		log.Printf("chat: delete outbox=%d: %v", id, err)
+	}
+	return true
+}
+
+// jobDeferTouchInterval is how often a job that keeps being deferred marks itself as waiting.
+const jobDeferTouchInterval = time.Minute
+
+// DeferJob records that a queued job was put back on the queue without running (see the
+// worker's per-user limit), so SweepStuckJobs does not take it for lost. It writes at most
+// once a minute per job.
+func (s *Service) DeferJob(ctx context.Context, jobID string) error {
+	_, err := s.repo.TouchQueuedJob(ctx, jobID, time.Now().Add(-jobDeferTouchInterval))
+	return err
+}
+
+// outboxBackoff is the wait after the given number of failed publishes: 1s doubling up to a minute.
+func outboxBackoff(attempts int) time.Duration {
+	d := time.Second << min(max(attempts-1, 0), 6)
+	return min(d, outboxMaxBackoff)
+}
+
+// SweepStuckJobs requeues jobs that look lost and returns how many it requeued: jobs queued
+// since before queuedBefore with nothing in the outbox, whose message never arrived or was
+// dropped, and running jobs whose heartbeat stopped before runningBefore, whose worker died.
+// A job requeued after a cutoff is not swept again until it passes that cutoff too. The
+// requeued jobs are published by the next RelayOutbox. A zero cutoff skips that check.
+func (s *Service) SweepStuckJobs(ctx context.Context, queuedBefore, runningBefore time.Time) (int, error) {
+	sweeps := []struct {
+		status JobStatus
+		before time.Time
+		errMsg string
+	}{
+		{JobQueued, queuedBefore, ""},
+		{JobRunning, runningBefore, "requeued after its worker stopped responding"},
+	}
+	n := 0
+	for _, sw := range sweeps {
+		if sw.before.IsZero() {
+			continue
+		}
+		ids, err := s.repo.ListStuckJobs(ctx, sw.status, sw.before, sweepBatchSize)
+		if err != nil {
+			return n, err
+		}
+		for _, id := range ids {
+			ok, err := s.repo.RequeueStuckJob(ctx, id, sw.status, sw.before, sw.errMsg)
+			if err != nil {
+				return n, err
+			}
+			if !ok {
+				continue
+			}
+			n++
+			log.Printf("chat: requeued stuck job=%s status=%s", id, sw.status)
+			if sw.status != JobQueued {
+				if _, err := s.publishJobStatus(ctx, id); err != nil {
+					log.Printf("chat: publish job %s status: %v", id, err)
+				}
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,176 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidSettings is returned for out-of-range generation settings.
+	ErrInvalidSettings = errors.New("invalid generation settings")
+	// ErrPersonaNotFound is returned for persona ids that do not exist or belong to another user.
+	ErrPersonaNotFound = errors.New("persona not found")
+	// ErrPersonaExists is returned when the user already has a persona with that name.
+	ErrPersonaExists = errors.New("persona name already exists")
+)
+
+const (
+	maxSystemPromptRunes = 8000
+	maxStopSequences     = 4
+	maxStopRunes         = 64
+	maxMaxTokens         = 32768
+	maxPersonasPerUser   = 50
+)
+
+func (g GenerationSettings) Validate() error {
+	if utf8.RuneCountInString(g.SystemPrompt) > maxSystemPromptRunes {
+		return fmt.Errorf("%w: system_prompt longer than %d characters", ErrInvalidSettings, maxSystemPromptRunes)
+	}
+	if g.Temperature != nil && (*g.Temperature < 0 || *g.Temperature > 2) {
+		return fmt.Errorf("%w: temperature must be within [0, 2]", ErrInvalidSettings)
+	}
+	if g.TopP != nil && (*g.TopP <= 0 || *g.TopP > 1) {
+		return fmt.Errorf("%w: top_p must be within (0, 1]", ErrInvalidSettings)
+	}
+	if g.MaxTokens != nil && (*g.MaxTokens < 1 || *g.MaxTokens > maxMaxTokens) {
+		return fmt.Errorf("%w: max_tokens must be within [1, %d]", ErrInvalidSettings, maxMaxTokens)
+	}
+	if len(g.Stop) > maxStopSequences {
+		return fmt.Errorf("%w: at most %d stop sequences", ErrInvalidSettings, maxStopSequences)
+	}
+	for _, s := range g.Stop {
+		if s == "" || utf8.RuneCountInString(s) > maxStopRunes {
+			return fmt.Errorf("%w: stop sequences must be 1-%d characters", ErrInvalidSettings, maxStopRunes)
+		}
+	}
+	return nil
+}
+
+// Merge returns g with every field that is set in o replaced by o's value.
+func (g GenerationSettings) Merge(o GenerationSettings) GenerationSettings {
+	if o.SystemPrompt != "" {
+		g.SystemPrompt = o.SystemPrompt
+	}
+	if o.Temperature != nil {
+		g.Temperature = o.Temperature
+	}
+	if o.TopP != nil {
+		g.TopP = o.TopP
+	}
+	if o.MaxTokens != nil {
+		g.MaxTokens = o.MaxTokens
+	}
+	if o.Stop != nil {
+		g.Stop = o.Stop
+	}
+	return g
+}
+
+func (g GenerationSettings) params() ai.GenerationParams {
+	return ai.GenerationParams{
+		Temperature: g.Temperature,
+		TopP:        g.TopP,
+		MaxTokens:   g.MaxTokens,
+		Stop:        g.Stop,
+	}
+}
+
+// SetSessionSettings replaces the session's system prompt and sampling parameters.
+func (s *Service) SetSessionSettings(ctx context.Context, userID uint64, sessionID string, g GenerationSettings) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+	if err := s.ValidateSessionOwner(ctx, userID, sessionID); err != nil {
+		return err
+	}
+	return s.repo.UpdateSessionSettings(ctx, userID, sessionID, g)
+}
+
+func (s *Service) ListPersonas(ctx context.Context, userID uint64) ([]Persona, error) {
+	return s.repo.ListPersonas(ctx, userID)
+}
+
+func (s *Service) GetPersona(ctx context.Context, userID, id uint64) (*Persona, error) {
+	p, err := s.repo.GetPersona(ctx, userID, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPersonaNotFound
+	}
+	return p, err
+}
+
+func (s *Service) CreatePersona(ctx context.Context, userID uint64, p *Persona) error {
+	p.ID = 0
+	p.UserID = userID
+	if err := s.validatePersona(p); err != nil {
+		return err
+	}
+	n, err := s.repo.CountPersonas(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if n >= maxPersonasPerUser {
+		return fmt.Errorf("%w: at most %d personas", ErrInvalidSettings, maxPersonasPerUser)
+	}
+	if _, err := s.repo.GetPersonaByName(ctx, userID, p.Name); err == nil {
+		return ErrPersonaExists
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return s.repo.CreatePersona(ctx, p)
+}
+
+// UpdatePersona replaces every field of the persona id with p's. Sessions created from it
+// keep the settings they were created with.
+func (s *Service) UpdatePersona(ctx context.Context, userID, id uint64, p *Persona) error {
+	p.ID = id
+	p.UserID = userID
+	if err := s.validatePersona(p); err != nil {
+		return err
+	}
+	if _, err := s.GetPersona(ctx, userID, id); err != nil {
+		return err
+	}
+	if other, err := s.repo.GetPersonaByName(ctx, userID, p.Name); err == nil && other.ID != id {
+		return ErrPersonaExists
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return s.repo.UpdatePersona(ctx, p)
+}
+
+func (s *Service) DeletePersona(ctx context.Context, userID, id uint64) error {
+	n, err := s.repo.DeletePersona(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrPersonaNotFound
+	}
+	return nil
+}
+
+func (s *Service) validatePersona(p *Persona) error {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Description = strings.TrimSpace(p.Description)
+	p.Provider = strings.ToLower(strings.TrimSpace(p.Provider))
+	p.Model = strings.TrimSpace(p.Model)
+	if p.Name == "" || utf8.RuneCountInString(p.Name) > 64 {
+		return fmt.Errorf("%w: name must be 1-64 characters", ErrInvalidSettings)
+	}
+	if utf8.RuneCountInString(p.Description) > 255 {
+		return fmt.Errorf("%w: description longer than 255 characters", ErrInvalidSettings)
+	}
+	if p.Provider != "" && !s.registry.Has(p.Provider) {
+		return fmt.Errorf("%w: unknown provider %q", ErrInvalidSettings, p.Provider)
+	}
+	if len(p.Model) > 64 {
+		return fmt.Errorf("%w: model name too long", ErrInvalidSettings)
+	}
+	return p.GenerationSettings.Validate()
+}
@@ -3,8 +3,11 @@ package chat
 import (
 	"context"
 	"errors"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Repo struct {
@@ -36,6 +39,26 @@ func (r *Repo) UpdateSessionTitle(ctx context.Context, userID uint64, sessionID,
 		Update("title", title).Error
 }
 
+func (r *Repo) UpdateSessionFallbacks(ctx context.Context, userID uint64, sessionID, fallbacks string) error {
+	return r.db.WithContext(ctx).
+		Model(&Session{}).
+		Where("session_id = ? AND user_id = ?", sessionID, userID).
+		Update("fallbacks", fallbacks).Error
+}
+
+func (r *Repo) UpdateSessionSettings(ctx context.Context, userID uint64, sessionID string, g GenerationSettings) error {
+	return r.db.WithContext(ctx).
+		Model(&Session{}).
+		Where("session_id = ? AND user_id = ?", sessionID, userID).
+		Updates(map[string]any{
+			"system_prompt": g.SystemPrompt,
+			"temperature":   g.Temperature,
+			"top_p":         g.TopP,
+			"max_tokens":    g.MaxTokens,
+			"stop":          g.Stop,
+		}).Error
+}
+
 func (r *Repo) DeleteSessionCascade(ctx context.Context, userID uint64, sessionID string) error {
 	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		if err := tx.Where("user_id = ? AND session_id = ?", userID, sessionID).
@@ -46,6 +69,30 @@ func (r *Repo) DeleteSessionCascade(ctx context.Context, userID uint64, sessionI
 			Delete(&Job{}).Error; err != nil {
 			return err
 		}
+		if err := tx.Where("user_id = ? AND session_id = ?", userID, sessionID).
+			Delete(&Summary{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND session_id = ?", userID, sessionID).
+			Delete(&MessageEmbedding{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND session_id = ?", userID, sessionID).
+			Delete(&Share{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND session_id = ?", userID, sessionID).
+			Delete(&WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND session_id = ?", userID, sessionID).
+			Delete(&OutboxMessage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND session_id = ?", userID, sessionID).
+			Delete(&Attachment{}).Error; err != nil {
+			return err
+		}
 		if err := tx.Where("user_id = ? AND session_id = ?", userID, sessionID).
 			Delete(&Session{}).Error; err != nil {
 			return err
@@ -74,8 +121,146 @@ func (r *Repo) ListSessions(ctx context.Context, userID uint64, limit int, befor
 	return sess, nil
 }
 
+// InsertMessage appends m to the session's active branch (m.ParentID is set to the
+// active leaf unless already set) and makes it the new active leaf.
 func (r *Repo) InsertMessage(ctx context.Context, m *Message) error {
-	return r.db.WithContext(ctx).Create(m).Error
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return insertMessage(tx, m, true)
+	})
+}
+
+// InsertMessageAt stores m under m.ParentID exactly as given (nil starts a new root)
+// and makes it the active leaf. Used to create sibling branches.
+func (r *Repo) InsertMessageAt(ctx context.Context, m *Message) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return insertMessage(tx, m, false)
+	})
+}
+
+// InsertEditedMessage is InsertMessageAt for the edited copy of message origID: m gets
+// attachment rows of its own that point at the images of origID's attachments.
+func (r *Repo) InsertEditedMessage(ctx context.Context, m *Message, origID uint64) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := insertMessage(tx, m, false); err != nil {
+			return err
+		}
+		var atts []Attachment
+		if err := tx.Where("user_id = ? AND message_id = ?", m.UserID, origID).Order("id ASC").Find(&atts).Error; err != nil {
+			return err
+		}
+		if len(atts) == 0 {
+			return nil
+		}
+		for i := range atts {
+			atts[i].ID = 0
+			atts[i].MessageID = &m.ID
+			atts[i].CreatedAt = time.Time{}
+		}
+		if err := tx.Create(&atts).Error; err != nil {
+			return err
+		}
+		m.Attachments = atts
+		return nil
+	})
+}
+
+// insertMessage locks the session row until the transaction ends, so concurrent inserts into
+// one session see each other's leaf instead of forking the branch.
+func insertMessage(tx *gorm.DB, m *Message, attachToLeaf bool) error {
+	var sess Session
+	if err := tx.Select("id", "active_leaf_id").
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("session_id = ? AND user_id = ?", m.SessionID, m.UserID).
+		First(&sess).Error; err != nil {
+		return err
+	}
+	leaf := sess.ActiveLeafID
+	if leaf == nil {
+		last, err := linkLegacyMessages(tx, m.UserID, m.SessionID)
+		if err != nil {
+			return err
+		}
+		if last > 0 {
+			leaf = &last
+		}
+	}
+	if attachToLeaf && m.ParentID == nil {
+		m.ParentID = leaf
+	}
+	if err := tx.Create(m).Error; err != nil {
+		return err
+	}
+	if len(m.Attachments) > 0 {
+		if err := attachToMessage(tx, m); err != nil {
+			return err
+		}
+	}
+	return tx.Model(&Session{}).Where("id = ?", sess.ID).Update("active_leaf_id", m.ID).Error
+}
+
+// attachToMessage links the unattached uploads named in m.Attachments to m and loads them in
+// their place. Any id that cannot be linked fails the whole insert.
+func attachToMessage(tx *gorm.DB, m *Message) error {
+	ids := make([]uint64, len(m.Attachments))
+	for i, a := range m.Attachments {
+		ids[i] = a.ID
+	}
+	res := tx.Model(&Attachment{}).
+		Where("id IN ? AND user_id = ? AND session_id = ? AND message_id IS NULL", ids, m.UserID, m.SessionID).
+		Update("message_id", m.ID)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != int64(len(ids)) {
+		return ErrAttachmentNotFound
+	}
+	return tx.Where("message_id = ?", m.ID).Order("id ASC").Find(&m.Attachments).Error
+}
+
+// linkLegacyMessages chains messages stored before branching existed (in id order) so
+// they form a single branch, and returns the id of the last one (0 if none).
+func linkLegacyMessages(tx *gorm.DB, userID uint64, sessionID string) (uint64, error) {
+	var rows []Message
+	if err := tx.Select("id", "parent_id").
+		Where("user_id = ? AND session_id = ?", userID, sessionID).
+		Order("id ASC").
+		Find(&rows).Error; err != nil {
+		return 0, err
+	}
+	for i := 1; i < len(rows); i++ {
+		if rows[i].ParentID != nil {
+			continue
+		}
+		if err := tx.Model(&Message{}).Where("id = ?", rows[i].ID).
+			Update("parent_id", rows[i-1].ID).Error; err != nil {
+			return 0, err
+		}
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return rows[len(rows)-1].ID, nil
+}
+
+// LinkLegacyMessages chains a session's pre-branching messages and points the active leaf at
+// the newest one. No-op once the session has an active leaf.
+func (r *Repo) LinkLegacyMessages(ctx context.Context, userID uint64, sessionID string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var sess Session
+		if err := tx.Select("id", "active_leaf_id").
+			Where("session_id = ? AND user_id = ?", sessionID, userID).
+			First(&sess).Error; err != nil {
+			return err
+		}
+		if sess.ActiveLeafID != nil {
+			return nil
+		}
+		last, err := linkLegacyMessages(tx, userID, sessionID)
+		if err != nil || last == 0 {
+			return err
+		}
+		return tx.Model(&Session{}).Where("id = ?", sess.ID).Update("active_leaf_id", last).Error
+	})
 }
 
 // ListMessages returns messages in DESC id order (newest -> oldest).
@@ -112,6 +297,286 @@ func (r *Repo) ListRecentMessagesDesc(ctx context.Context, userID uint64, sessio
 	return msgs, nil
 }
 
+// ListBranchDesc returns up to limit messages on the path from leafID up to the root,
+// in DESC order (leaf first).
+func (r *Repo) ListBranchDesc(ctx context.Context, userID uint64, sessionID string, leafID uint64, limit int) ([]Message, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+	var msgs []Message
+	err := r.db.WithContext(ctx).Raw(`
+WITH RECURSIVE branch (id, parent_id, depth) AS (
+	SELECT id, parent_id, 1 FROM chat_messages WHERE id = ? AND user_id = ? AND session_id = ?
+	UNION ALL
+	SELECT m.id, m.parent_id, b.depth + 1 FROM chat_messages m JOIN branch b ON m.id = b.parent_id
+	WHERE b.depth < ?
+)
+SELECT chat_messages.* FROM chat_messages JOIN branch ON chat_messages.id = branch.id
+ORDER BY branch.depth ASC`, leafID, userID, sessionID, limit).Scan(&msgs).Error
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// ListActiveBranchDesc is ListRecentMessagesDesc restricted to the session's active branch.
+// Sessions without an active leaf yet (no messages, or only pre-branching ones) are flat.
+func (r *Repo) ListActiveBranchDesc(ctx context.Context, userID uint64, sessionID string, limit int) ([]Message, error) {
+	sess, err := r.GetSessionBySessionID(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if sess.UserID != userID {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if sess.ActiveLeafID == nil {
+		return r.ListRecentMessagesDesc(ctx, userID, sessionID, limit)
+	}
+	return r.ListBranchDesc(ctx, userID, sessionID, *sess.ActiveLeafID, limit)
+}
+
+func (r *Repo) GetMessageByID(ctx context.Context, userID uint64, id uint64) (*Message, error) {
+	var m Message
+	if err := r.db.WithContext(ctx).
+		Where("id = ? AND user_id = ?", id, userID).
+		First(&m).Error; err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (r *Repo) SetActiveLeaf(ctx context.Context, userID uint64, sessionID string, leafID uint64) error {
+	return r.db.WithContext(ctx).
+		Model(&Session{}).
+		Where("session_id = ? AND user_id = ?", sessionID, userID).
+		Update("active_leaf_id", leafID).Error
+}
+
+// LatestLeafUnder follows the newest child from id down to a leaf and returns the leaf's id.
+func (r *Repo) LatestLeafUnder(ctx context.Context, userID uint64, sessionID string, id uint64) (uint64, error) {
+	// descendants always have larger ids than their ancestors
+	var rows []Message
+	if err := r.db.WithContext(ctx).
+		Select("id", "parent_id").
+		Where("user_id = ? AND session_id = ? AND id > ? AND parent_id IS NOT NULL", userID, sessionID, id).
+		Find(&rows).Error; err != nil {
+		return 0, err
+	}
+	newestChild := make(map[uint64]uint64, len(rows))
+	for _, m := range rows {
+		if m.ID > newestChild[*m.ParentID] {
+			newestChild[*m.ParentID] = m.ID
+		}
+	}
+	leaf := id
+	for {
+		next, ok := newestChild[leaf]
+		if !ok {
+			return leaf, nil
+		}
+		leaf = next
+	}
+}
+
+// SiblingIDs returns, for each parent in parentIDs, the ids of its children in ASC order.
+// The zero key holds root messages (parent_id IS NULL) when includeRoots is set.
+func (r *Repo) SiblingIDs(ctx context.Context, userID uint64, sessionID string, parentIDs []uint64, includeRoots bool) (map[uint64][]uint64, error) {
+	out := make(map[uint64][]uint64)
+	if len(parentIDs) == 0 && !includeRoots {
+		return out, nil
+	}
+	q := r.db.WithContext(ctx).
+		Select("id", "parent_id").
+		Where("user_id = ? AND session_id = ?", userID, sessionID)
+	switch {
+	case len(parentIDs) > 0 && includeRoots:
+		q = q.Where("parent_id IN ? OR parent_id IS NULL", parentIDs)
+	case len(parentIDs) > 0:
+		q = q.Where("parent_id IN ?", parentIDs)
+	default:
+		q = q.Where("parent_id IS NULL")
+	}
+	var rows []Message
+	if err := q.Order("id ASC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, m := range rows {
+		var key uint64
+		if m.ParentID != nil {
+			key = *m.ParentID
+		}
+		out[key] = append(out[key], m.ID)
+	}
+	return out, nil
+}
+
+func (r *Repo) InsertSummary(ctx context.Context, s *Summary) error {
+	return r.db.WithContext(ctx).Create(s).Error
+}
+
+// ListSummaries returns the session's summaries, newest first.
+func (r *Repo) ListSummaries(ctx context.Context, userID uint64, sessionID string) ([]Summary, error) {
+	var out []Summary
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ? AND session_id = ?", userID, sessionID).
+		Order("upto_message_id DESC").
+		Order("id DESC").
+		Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// searchable roles: tool rows and summaries are plumbing, not conversation
+var searchRoles = []string{RoleUser, RoleAssistant}
+
+// SearchMessages returns the user's newest messages whose content contains every term
+// (case-insensitive under the default collations), in DESC id order.
+func (r *Repo) SearchMessages(ctx context.Context, userID uint64, terms []string, limit int) ([]Message, error) {
+	q := r.db.WithContext(ctx).
+		Where("user_id = ? AND role IN ?", userID, searchRoles)
+	for _, t := range terms {
+		q = q.Where("content LIKE ? ESCAPE '!'", "%"+escapeLike(t)+"%")
+	}
+	var msgs []Message
+	if err := q.Order("id DESC").Limit(limit).Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+func (r *Repo) GetMessagesByIDs(ctx context.Context, userID uint64, ids []uint64) ([]Message, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var msgs []Message
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ? AND id IN ?", userID, ids).
+		Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// unembeddedMessages selects the searchable messages of userID, or of every user when userID
+// is 0, without a vector under model.
+func (r *Repo) unembeddedMessages(ctx context.Context, userID uint64, model string) *gorm.DB {
+	q := r.db.WithContext(ctx).
+		Model(&Message{}).
+		Joins("LEFT JOIN chat_message_embeddings e ON e.message_id = chat_messages.id AND e.model = ?", model).
+		Where("chat_messages.role IN ? AND e.message_id IS NULL", searchRoles)
+	if userID != 0 {
+		q = q.Where("chat_messages.user_id = ?", userID)
+	}
+	return q
+}
+
+// ListUnembeddedMessages returns up to limit of the newest messages of userID (0 for every
+// user) not yet embedded with model.
+func (r *Repo) ListUnembeddedMessages(ctx context.Context, userID uint64, model string, limit int) ([]Message, error) {
+	var msgs []Message
+	if err := r.unembeddedMessages(ctx, userID, model).
+		Select("chat_messages.*").
+		Order("chat_messages.id DESC").
+		Limit(limit).
+		Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (r *Repo) CountUnembeddedMessages(ctx context.Context, userID uint64, model string) (int64, error) {
+	var n int64
+	err := r.unembeddedMessages(ctx, userID, model).Count(&n).Error
+	return n, err
+}
+
+// InsertEmbeddings stores vectors, ignoring ones that already exist.
+func (r *Repo) InsertEmbeddings(ctx context.Context, rows []MessageEmbedding) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	return r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&rows).Error
+}
+
+// ListEmbeddings returns the vectors of the user's newest limit embedded messages.
+func (r *Repo) ListEmbeddings(ctx context.Context, userID uint64, model string, limit int) ([]MessageEmbedding, error) {
+	var rows []MessageEmbedding
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ? AND model = ?", userID, model).
+		Order("message_id DESC").
+		Limit(limit).
+		Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Persona CRUD
+func (r *Repo) ListPersonas(ctx context.Context, userID uint64) ([]Persona, error) {
+	var out []Persona
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("name ASC").
+		Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *Repo) GetPersona(ctx context.Context, userID, id uint64) (*Persona, error) {
+	var p Persona
+	if err := r.db.WithContext(ctx).
+		Where("id = ? AND user_id = ?", id, userID).
+		First(&p).Error; err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r *Repo) GetPersonaByName(ctx context.Context, userID uint64, name string) (*Persona, error) {
+	var p Persona
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ? AND name = ?", userID, name).
+		First(&p).Error; err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r *Repo) CountPersonas(ctx context.Context, userID uint64) (int64, error) {
+	var n int64
+	err := r.db.WithContext(ctx).Model(&Persona{}).Where("user_id = ?", userID).Count(&n).Error
+	return n, err
+}
+
+func (r *Repo) CreatePersona(ctx context.Context, p *Persona) error {
+	return r.db.WithContext(ctx).Create(p).Error
+}
+
+// UpdatePersona writes every column of p, including zero and nil values.
+func (r *Repo) UpdatePersona(ctx context.Context, p *Persona) error {
+	return r.db.WithContext(ctx).
+		Model(p).
+		Where("user_id = ?", p.UserID).
+		Select("*").
+		Omit("id", "user_id", "created_at").
+		Updates(p).Error
+}
+
+func (r *Repo) DeletePersona(ctx context.Context, userID, id uint64) (int64, error) {
+	res := r.db.WithContext(ctx).
+		Where("id = ? AND user_id = ?", id, userID).
+		Delete(&Persona{})
+	return res.RowsAffected, res.Error
+}
+
 // Job CRUD
 func (r *Repo) CreateJob(ctx context.Context, job *Job) error {
 	return r.db.WithContext(ctx).Create(job).Error
@@ -125,15 +590,25 @@ func (r *Repo) GetJobByID(ctx context.Context, id string) (*Job, error) {
 	return &j, nil
 }
 
-func (r *Repo) UpdateJobStatusRunning(ctx context.Context, id string) error {
-	return r.db.WithContext(ctx).Model(&Job{}).
+// UpdateJobStatusRunning claims a queued job and returns the rows changed: 0 means it was not queued.
+func (r *Repo) UpdateJobStatusRunning(ctx context.Context, id string) (int64, error) {
+	res := r.db.WithContext(ctx).Model(&Job{}).
 		Where("id = ? AND status = ?", id, JobQueued).
-		Update("status", JobRunning).Error
+		Updates(map[string]any{"status": JobRunning, "heartbeat_at": time.Now()})
+	return res.RowsAffected, res.Error
+}
+
+// HeartbeatJob records that the worker running a job is still alive.
+func (r *Repo) HeartbeatJob(ctx context.Context, id string) error {
+	return r.db.WithContext(ctx).Model(&Job{}).
+		Where("id = ? AND status = ?", id, JobRunning).
+		UpdateColumn("heartbeat_at", time.Now()).Error
 }
 
+// MarkJobSucceeded and MarkJobFailed leave cancelled jobs alone: a cancel always wins.
 func (r *Repo) MarkJobSucceeded(ctx context.Context, id string, assistantMsgID uint64) error {
 	return r.db.WithContext(ctx).Model(&Job{}).
-		Where("id = ?", id).
+		Where("id = ? AND status <> ?", id, JobCancelled).
 		Updates(map[string]any{
 			"status":            JobSucceeded,
 			"result_message_id": assistantMsgID,
@@ -143,7 +618,7 @@ func (r *Repo) MarkJobSucceeded(ctx context.Context, id string, assistantMsgID u
 
 func (r *Repo) MarkJobFailed(ctx context.Context, id string, errMsg string) error {
 	return r.db.WithContext(ctx).Model(&Job{}).
-		Where("id = ?", id).
+		Where("id = ? AND status <> ?", id, JobCancelled).
 		Updates(map[string]any{
 			"status":            JobFailed,
 			"error":             errMsg,
@@ -151,6 +626,190 @@ func (r *Repo) MarkJobFailed(ctx context.Context, id string, errMsg string) erro
 		}).Error
 }
 
+// RequeueJob puts a job that is going to be retried back into the queued state.
+func (r *Repo) RequeueJob(ctx context.Context, id string, errMsg string) error {
+	return r.db.WithContext(ctx).Model(&Job{}).
+		Where("id = ? AND status <> ?", id, JobCancelled).
+		Updates(map[string]any{
+			"status":            JobQueued,
+			"error":             errMsg,
+			"result_message_id": nil,
+		}).Error
+}
+
+func (r *Repo) GetJobsByIDs(ctx context.Context, ids []string) ([]Job, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var out []Job
+	if err := r.db.WithContext(ctx).Where("id IN ?", ids).Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReplayJob resets a failed (or never started) job so its next delivery runs it from scratch.
+func (r *Repo) ReplayJob(ctx context.Context, id string) (int64, error) {
+	res := r.db.WithContext(ctx).Model(&Job{}).
+		Where("id = ? AND status IN ?", id, []JobStatus{JobFailed, JobQueued}).
+		Updates(map[string]any{
+			"status":            JobQueued,
+			"error":             nil,
+			"result_message_id": nil,
+		})
+	return res.RowsAffected, res.Error
+}
+
+// UndoReplayJob puts a job reset by ReplayJob back to status and errMsg, as long as no worker
+// has picked it up since.
+func (r *Repo) UndoReplayJob(ctx context.Context, id string, status JobStatus, errMsg *string) error {
+	return r.db.WithContext(ctx).Model(&Job{}).
+		Where("id = ? AND status = ?", id, JobQueued).
+		Updates(map[string]any{"status": status, "error": errMsg}).Error
+}
+
+// CancelJob cancels the user's job if it has not finished yet and returns the rows changed.
+func (r *Repo) CancelJob(ctx context.Context, userID uint64, id string) (int64, error) {
+	res := r.db.WithContext(ctx).Model(&Job{}).
+		Where("id = ? AND user_id = ? AND status IN ?", id, userID, []JobStatus{JobQueued, JobRunning}).
+		Update("status", JobCancelled)
+	return res.RowsAffected, res.Error
+}
+
+// CreateJobWithOutbox stores a job, its user message and the outbox entry that will publish it
+// in one transaction, and sets job.MessageID. A user message with the same idempotency key is
+// not stored twice.
+func (r *Repo) CreateJobWithOutbox(ctx context.Context, job *Job, msg *Message) (*OutboxMessage, error) {
+	out := &OutboxMessage{UserID: job.UserID, SessionID: job.SessionID, JobID: job.ID, Priority: job.Priority, NextAttemptAt: time.Now()}
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing []Message
+		if msg.IdempotencyKey != nil {
+			if err := tx.Select("id").
+				Where("user_id = ? AND session_id = ? AND idempotency_key = ? AND role = ?", msg.UserID, msg.SessionID, *msg.IdempotencyKey, "user").
+				Limit(1).
+				Find(&existing).Error; err != nil {
+				return err
+			}
+		}
+		if len(existing) > 0 {
+			msg.ID = existing[0].ID
+		} else if err := insertMessage(tx, msg, true); err != nil {
+			return err
+		}
+		job.MessageID = &msg.ID
+		if err := tx.Create(job).Error; err != nil {
+			return err
+		}
+		return tx.Create(out).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// stuckJobs selects jobs in status that were not requeued since before and have not changed
+// since before; for running jobs, whose heartbeat stopped before then.
+func stuckJobs(db *gorm.DB, status JobStatus, before time.Time) *gorm.DB {
+	db = db.Where("status = ? AND (requeued_at IS NULL OR requeued_at < ?)", status, before)
+	if status == JobRunning {
+		// jobs started before heartbeats were recorded have none
+		return db.Where("COALESCE(heartbeat_at, updated_at) < ?", before)
+	}
+	return db.Where("updated_at < ?", before)
+}
+
+// ListStuckJobs returns the stuck jobs in status (see stuckJobs) that have nothing waiting in
+// the outbox.
+func (r *Repo) ListStuckJobs(ctx context.Context, status JobStatus, before time.Time, limit int) ([]string, error) {
+	var ids []string
+	err := stuckJobs(r.db.WithContext(ctx).Model(&Job{}), status, before).
+		Where("NOT EXISTS (SELECT 1 FROM chat_job_outbox o WHERE o.job_id = jobs.id)").
+		Order("updated_at ASC").
+		Limit(limit).
+		Pluck("id", &ids).Error
+	return ids, err
+}
+
+// RequeueStuckJob puts a job that is still stuck in status (see stuckJobs) back to queued,
+// recording when, and adds an outbox entry for it. It reports false when the job moved on in
+// the meantime.
+func (r *Repo) RequeueStuckJob(ctx context.Context, id string, status JobStatus, before time.Time, errMsg string) (bool, error) {
+	requeued := false
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		fields := map[string]any{"status": JobQueued, "requeued_at": now, "updated_at": now, "heartbeat_at": nil}
+		if errMsg != "" {
+			fields["error"] = errMsg
+		}
+		res := stuckJobs(tx.Model(&Job{}).Where("id = ?", id), status, before).
+			Updates(fields)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		var j Job
+		if err := tx.Select("id", "user_id", "session_id", "priority").First(&j, "id = ?", id).Error; err != nil {
+			return err
+		}
+		requeued = true
+		return tx.Create(&OutboxMessage{UserID: j.UserID, SessionID: j.SessionID, JobID: j.ID, Priority: j.Priority, NextAttemptAt: time.Now()}).Error
+	})
+	return requeued, err
+}
+
+// TouchQueuedJob bumps updated_at of a job that is still queued and has not been touched since
+// before, and reports whether it did.
+func (r *Repo) TouchQueuedJob(ctx context.Context, id string, before time.Time) (bool, error) {
+	res := r.db.WithContext(ctx).Model(&Job{}).
+		Where("id = ? AND status = ? AND updated_at < ?", id, JobQueued, before).
+		Update("updated_at", time.Now())
+	return res.RowsAffected > 0, res.Error
+}
+
+// ListDueOutbox returns the ids of outbox entries whose next attempt is due.
+func (r *Repo) ListDueOutbox(ctx context.Context, now time.Time, limit int) ([]uint64, error) {
+	var ids []uint64
+	err := r.db.WithContext(ctx).
+		Model(&OutboxMessage{}).
+		Where("next_attempt_at <= ?", now).
+		Order("next_attempt_at ASC").
+		Limit(limit).
+		Pluck("id", &ids).Error
+	return ids, err
+}
+
+// ClaimOutboxMessage takes a due entry for one publish attempt, pushing its next attempt to
+// leaseUntil so other relays skip it meanwhile.
+func (r *Repo) ClaimOutboxMessage(ctx context.Context, id uint64, now, leaseUntil time.Time) (bool, error) {
+	res := r.db.WithContext(ctx).
+		Model(&OutboxMessage{}).
+		Where("id = ? AND next_attempt_at <= ?", id, now).
+		Updates(map[string]any{
+			"attempts":        gorm.Expr("attempts + 1"),
+			"next_attempt_at": leaseUntil,
+		})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (r *Repo) GetOutboxMessage(ctx context.Context, id uint64) (*OutboxMessage, error) {
+	var m OutboxMessage
+	if err := r.db.WithContext(ctx).First(&m, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (r *Repo) UpdateOutboxMessage(ctx context.Context, id uint64, fields map[string]any) error {
+	return r.db.WithContext(ctx).
+		Model(&OutboxMessage{}).
+		Where("id = ?", id).
+		Updates(fields).Error
+}
+
+func (r *Repo) DeleteOutboxMessage(ctx context.Context, id uint64) error {
+	return r.db.WithContext(ctx).Delete(&OutboxMessage{}, "id = ?", id).Error
+}
+
 func (r *Repo) GetJobByUserAndIdempotencyKey(ctx context.Context, userID uint64, key string) (*Job, error) {
 	var job Job
 	err := r.db.WithContext(ctx).
@@ -204,17 +863,18 @@ func (r *Repo) GetUserMessageByIdempotencyKey(ctx context.Context, userID uint64
 
 // InsertUserMessageOrGetExisting inserts a user message, but if the same (user_id, session_id, idempotency_key)
 // already exists, it returns the existing one instead.
-func (r *Repo) InsertUserMessageOrGetExisting(ctx context.Context, userID uint64, sessionID string, content string, key *string) (*Message, bool, error) {
+func (r *Repo) InsertUserMessageOrGetExisting(ctx context.Context, userID uint64, sessionID string, content string, key *string, attachments []Attachment) (*Message, bool, error) {
 	msg := &Message{
 		UserID:         userID,
 		SessionID:      sessionID,
 		Role:           "user",
 		Content:        content,
 		IdempotencyKey: nil,
+		Attachments:    attachments,
 	}
 
 	if key == nil || *key == "" {
-		if err := r.db.WithContext(ctx).Create(msg).Error; err != nil {
+		if err := r.InsertMessage(ctx, msg); err != nil {
 			return nil, false, err
 		}
 		return msg, true, nil
@@ -222,7 +882,7 @@ func (r *Repo) InsertUserMessageOrGetExisting(ctx context.Context, userID uint64
 
 	msg.IdempotencyKey = key
 
-	err := r.db.WithContext(ctx).Create(msg).Error
+	err := r.InsertMessage(ctx, msg)
 	if err == nil {
 		return msg, true, nil
 	}
@@ -258,3 +918,297 @@ func (r *Repo) UpdateSessionTitleIfMatch(ctx context.Context, userID uint64, ses
 		Where("session_id = ? AND user_id = ? AND title = ?", sessionID, userID, match).
 		Update("title", title).Error
 }
+
+// UsageRow is the token sum of one (session, model) pair.
+type UsageRow struct {
+	SessionID        string
+	Model            string
+	Messages         int64
+	PromptTokens     int64
+	CompletionTokens int64
+}
+
+// SumUsage sums tokens of model-generated rows grouped by session and model.
+// sessionID, from and to are optional filters (zero value = no filter); to is exclusive.
+func (r *Repo) SumUsage(ctx context.Context, userID uint64, sessionID string, from, to time.Time) ([]UsageRow, error) {
+	q := r.db.WithContext(ctx).
+		Model(&Message{}).
+		Select("session_id, model, COUNT(*) AS messages, COALESCE(SUM(prompt_tokens), 0) AS prompt_tokens, COALESCE(SUM(completion_tokens), 0) AS completion_tokens").
+		Where("user_id = ? AND role IN ?", userID, []string{RoleAssistant, RoleToolCall}).
+		Group("session_id, model")
+
+	if sessionID != "" {
+		q = q.Where("session_id = ?", sessionID)
+	}
+	if !from.IsZero() {
+		q = q.Where("created_at >= ?", from)
+	}
+	if !to.IsZero() {
+		q = q.Where("created_at < ?", to)
+	}
+
+	var rows []UsageRow
+	if err := q.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (r *Repo) GetSessionsBySessionIDs(ctx context.Context, userID uint64, sessionIDs []string) ([]Session, error) {
+	if len(sessionIDs) == 0 {
+		return nil, nil
+	}
+	var sess []Session
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ? AND session_id IN ?", userID, sessionIDs).
+		Find(&sess).Error; err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// ListSessionsAfter pages through all of a user's sessions in id order.
+func (r *Repo) ListSessionsAfter(ctx context.Context, userID, afterID uint64, limit int) ([]Session, error) {
+	var sess []Session
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ? AND id > ?", userID, afterID).
+		Order("id ASC").
+		Limit(limit).
+		Find(&sess).Error; err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// ListSessionMessagesAsc returns every message of a session, oldest first.
+func (r *Repo) ListSessionMessagesAsc(ctx context.Context, userID uint64, sessionID string) ([]Message, error) {
+	var msgs []Message
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ? AND session_id = ?", userID, sessionID).
+		Order("id ASC").
+		Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// CreateImportedSession inserts sess and its messages in one transaction. parents[i] is the
+// index of message i's parent (-1 for a root); leaf is the index of the active leaf.
+func (r *Repo) CreateImportedSession(ctx context.Context, sess *Session, msgs []Message, parents []int, leaf int) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(sess).Error; err != nil {
+			return err
+		}
+		for i := range msgs {
+			if j := parents[i]; j >= 0 {
+				msgs[i].ParentID = &msgs[j].ID
+			}
+			if err := tx.Create(&msgs[i]).Error; err != nil {
+				return err
+			}
+		}
+		sess.ActiveLeafID = &msgs[leaf].ID
+		return tx.Model(&Session{}).Where("id = ?", sess.ID).Update("active_leaf_id", msgs[leaf].ID).Error
+	})
+}
+
+func (r *Repo) CreateShare(ctx context.Context, sh *Share) error {
+	return r.db.WithContext(ctx).Create(sh).Error
+}
+
+func (r *Repo) GetShareByTokenHash(ctx context.Context, hash string) (*Share, error) {
+	var sh Share
+	if err := r.db.WithContext(ctx).
+		Where("token_hash = ?", hash).
+		First(&sh).Error; err != nil {
+		return nil, err
+	}
+	return &sh, nil
+}
+
+func (r *Repo) activeShares(ctx context.Context, userID uint64, now time.Time) *gorm.DB {
+	return r.db.WithContext(ctx).
+		Model(&Share{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Where("expires_at IS NULL OR expires_at > ?", now)
+}
+
+func (r *Repo) CountActiveShares(ctx context.Context, userID uint64, now time.Time) (int64, error) {
+	var n int64
+	err := r.activeShares(ctx, userID, now).Count(&n).Error
+	return n, err
+}
+
+// ListActiveShares returns unrevoked, unexpired shares, newest first; sessionID "" lists all.
+func (r *Repo) ListActiveShares(ctx context.Context, userID uint64, sessionID string, now time.Time) ([]Share, error) {
+	q := r.activeShares(ctx, userID, now).Order("created_at DESC").Order("id DESC")
+	if sessionID != "" {
+		q = q.Where("session_id = ?", sessionID)
+	}
+	var out []Share
+	if err := q.Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *Repo) RevokeShare(ctx context.Context, userID uint64, shareID string, now time.Time) (int64, error) {
+	res := r.db.WithContext(ctx).
+		Model(&Share{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", shareID, userID).
+		Update("revoked_at", now)
+	return res.RowsAffected, res.Error
+}
+
+// CreateWebhookDelivery inserts d unless the job already has a delivery for the event.
+func (r *Repo) CreateWebhookDelivery(ctx context.Context, d *WebhookDelivery) (bool, error) {
+	res := r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(d)
+	return res.RowsAffected > 0, res.Error
+}
+
+func (r *Repo) GetWebhookDelivery(ctx context.Context, id uint64) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	if err := r.db.WithContext(ctx).First(&d, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ListDueWebhookDeliveries returns the ids of pending deliveries whose next attempt is due.
+func (r *Repo) ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]uint64, error) {
+	var ids []uint64
+	err := r.db.WithContext(ctx).
+		Model(&WebhookDelivery{}).
+		Where("status = ? AND next_attempt_at <= ?", WebhookPending, now).
+		Order("next_attempt_at ASC").
+		Limit(limit).
+		Pluck("id", &ids).Error
+	return ids, err
+}
+
+// ClaimWebhookDelivery takes a due delivery for one attempt: it counts the attempt and pushes
+// the next one to leaseUntil, so other workers skip it while this one is sending.
+func (r *Repo) ClaimWebhookDelivery(ctx context.Context, id uint64, now, leaseUntil time.Time) (bool, error) {
+	res := r.db.WithContext(ctx).
+		Model(&WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", id, WebhookPending, now).
+		Updates(map[string]any{
+			"attempts":        gorm.Expr("attempts + 1"),
+			"next_attempt_at": leaseUntil,
+		})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (r *Repo) UpdateWebhookDelivery(ctx context.Context, id uint64, fields map[string]any) error {
+	return r.db.WithContext(ctx).
+		Model(&WebhookDelivery{}).
+		Where("id = ?", id).
+		Updates(fields).Error
+}
+
+// ListWebhookDeliveries pages the user's deliveries newest first (id < beforeID); status "" lists all.
+func (r *Repo) ListWebhookDeliveries(ctx context.Context, userID uint64, status string, limit int, beforeID uint64) ([]WebhookDelivery, error) {
+	q := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("id DESC").
+		Limit(limit)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if beforeID > 0 {
+		q = q.Where("id < ?", beforeID)
+	}
+	var out []WebhookDelivery
+	if err := q.Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RedeliverWebhook schedules a finished delivery of the user's for another round of attempts.
+func (r *Repo) RedeliverWebhook(ctx context.Context, userID, id uint64, now time.Time) (int64, error) {
+	res := r.db.WithContext(ctx).
+		Model(&WebhookDelivery{}).
+		Where("id = ? AND user_id = ? AND status <> ?", id, userID, WebhookPending).
+		Updates(map[string]any{
+			"status":          WebhookPending,
+			"attempts":        0,
+			"next_attempt_at": now,
+		})
+	return res.RowsAffected, res.Error
+}
+
+func (r *Repo) CreateAttachment(ctx context.Context, a *Attachment) error {
+	return r.db.WithContext(ctx).Create(a).Error
+}
+
+func (r *Repo) GetAttachment(ctx context.Context, userID, id uint64) (*Attachment, error) {
+	var a Attachment
+	if err := r.db.WithContext(ctx).
+		Where("id = ? AND user_id = ?", id, userID).
+		First(&a).Error; err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// DeleteUnattachedAttachment deletes an upload that no message uses yet.
+func (r *Repo) DeleteUnattachedAttachment(ctx context.Context, userID, id uint64) (int64, error) {
+	res := r.db.WithContext(ctx).
+		Where("id = ? AND user_id = ? AND message_id IS NULL", id, userID).
+		Delete(&Attachment{})
+	return res.RowsAffected, res.Error
+}
+
+// CountUnattachedAttachments counts the user's uploads that no message uses yet.
+func (r *Repo) CountUnattachedAttachments(ctx context.Context, userID uint64) (int64, error) {
+	var n int64
+	err := r.db.WithContext(ctx).Model(&Attachment{}).
+		Where("user_id = ? AND message_id IS NULL", userID).
+		Count(&n).Error
+	return n, err
+}
+
+// ListUnattachedAttachments returns uploads created before before that no message uses, oldest
+// first.
+func (r *Repo) ListUnattachedAttachments(ctx context.Context, before time.Time, limit int) ([]Attachment, error) {
+	var out []Attachment
+	if err := r.db.WithContext(ctx).
+		Select("id", "user_id", "storage_key").
+		Where("message_id IS NULL AND created_at < ?", before).
+		Order("created_at ASC").
+		Limit(limit).
+		Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListMessageAttachments returns the attachments of the given messages, ASC by id.
+func (r *Repo) ListMessageAttachments(ctx context.Context, userID uint64, messageIDs []uint64) ([]Attachment, error) {
+	var out []Attachment
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ? AND message_id IN ?", userID, messageIDs).
+		Order("id ASC").
+		Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListAttachmentKeys returns the storage keys of the user's attachments in sessionID, or in
+// all sessions when sessionID is empty.
+func (r *Repo) ListAttachmentKeys(ctx context.Context, userID uint64, sessionID string) ([]string, error) {
+	q := r.db.WithContext(ctx).Model(&Attachment{}).Where("user_id = ?", userID)
+	if sessionID != "" {
+		q = q.Where("session_id = ?", sessionID)
+	}
+	// edited messages share their original's images
+	var keys []string
+	if err := q.Distinct("storage_key").Pluck("storage_key", &keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,93 @@
+package chat
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Retriever finds excerpts relevant to query among the documents attached to a session.
+type Retriever interface {
+	Retrieve(ctx context.Context, userID uint64, sessionID, query string) ([]Citation, error)
+}
+
+// Citation is a document excerpt given to the model as [Index]. Content is sent to the model
+// but not stored with the reply.
+type Citation struct {
+	Index      int     `json:"index"`
+	DocumentID uint64  `json:"document_id"`
+	Title      string  `json:"title"`
+	Chunk      int     `json:"chunk"`
+	Score      float64 `json:"score"`
+	Content    string  `json:"-"`
+}
+
+// CitationList is stored as a JSON array.
+type CitationList []Citation
+
+func (l CitationList) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal([]Citation(l))
+	return string(b), err
+}
+
+func (l *CitationList) Scan(src any) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("CitationList: cannot scan %T", src)
+	}
+	if len(b) == 0 {
+		*l = nil
+		return nil
+	}
+	return json.Unmarshal(b, (*[]Citation)(l))
+}
+
+// SetRetriever enables document retrieval for sessions with attached documents.
+func (s *Service) SetRetriever(r Retriever) {
+	s.retriever = r
+}
+
+// retrieve looks up excerpts for the leaf message. Retrieval is best effort: a reply without
+// excerpts beats no reply when the embedding provider is down.
+func (s *Service) retrieve(ctx context.Context, sess *Session, userID, leafID uint64) CitationList {
+	if s.retriever == nil {
+		return nil
+	}
+	leaf, err := s.repo.GetMessageByID(ctx, userID, leafID)
+	if err != nil || strings.TrimSpace(leaf.Content) == "" {
+		return nil
+	}
+	cs, err := s.retriever.Retrieve(ctx, userID, sess.SessionID, leaf.Content)
+	if err != nil {
+		log.Printf("chat: retrieve for session %s: %v", sess.SessionID, err)
+		return nil
+	}
+	for i := range cs {
+		cs[i].Index = i + 1
+	}
+	return cs
+}
+
+func citationPrompt(cs []Citation) string {
+	var b strings.Builder
+	b.WriteString("Excerpts from the user's documents that may help with the next answer. ")
+	b.WriteString("Use them when relevant and cite them as [n]; if they do not contain the answer, say so rather than guessing.\n")
+	for _, c := range cs {
+		fmt.Fprintf(&b, "\n[%d] %s (part %d)\n%s\n", c.Index, c.Title, c.Chunk+1, c.Content)
+	}
+	return b.String()
+}
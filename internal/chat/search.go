@@ -0,0 +1,372 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+)
+
+// Search modes.
+const (
+	SearchKeyword  = "keyword"
+	SearchSemantic = "semantic"
+)
+
+var (
+	// ErrInvalidQuery is returned for empty or oversized search queries.
+	ErrInvalidQuery = errors.New("invalid search query")
+	// ErrSemanticSearchDisabled is returned for semantic searches when no embedding model is configured.
+	ErrSemanticSearchDisabled = errors.New("semantic search is not configured")
+)
+
+const (
+	maxQueryRunes  = 200
+	maxQueryTerms  = 8
+	snippetContext = 80 // runes of context on each side of the first match
+	// messages embedded per provider call, and at most per BackfillEmbeddings call
+	embedBatchSize   = 32
+	maxEmbedBackfill = 256
+	// vectors compared per semantic search: the user's newest messages; older ones are not searched
+	maxSemanticScan = 5000
+	// content beyond this is not embedded
+	maxEmbedRunes = 2000
+	// semantic hits below this cosine similarity are dropped
+	minSemanticScore = 0.3
+)
+
+// SearchHit is one matching message. Snippet is HTML-escaped with matches wrapped in <mark>.
+type SearchHit struct {
+	MessageID uint64    `json:"message_id"`
+	Role      string    `json:"role"`
+	Snippet   string    `json:"snippet"`
+	Score     float64   `json:"score,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SessionHits groups the hits of one session, best first.
+type SessionHits struct {
+	SessionID string      `json:"session_id"`
+	Title     string      `json:"title"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Hits      []SearchHit `json:"hits"`
+}
+
+type SearchResult struct {
+	Query    string        `json:"query"`
+	Mode     string        `json:"mode"`
+	Sessions []SessionHits `json:"sessions"`
+	// semantic mode: messages not embedded yet, hence not searched; the worker indexes them
+	// in the background (see BackfillEmbeddings)
+	Pending int64 `json:"pending,omitempty"`
+}
+
+// SetEmbeddings enables semantic search with the embedding model of provider.
+func (s *Service) SetEmbeddings(provider, model string) {
+	s.embedProvider = strings.ToLower(strings.TrimSpace(provider))
+	s.embedModel = strings.TrimSpace(model)
+}
+
+// Search finds the user's messages matching query, grouped by session. Keyword mode matches
+// messages containing every term, newest first; semantic mode ranks the newest
+// maxSemanticScan embedded messages by embedding similarity.
+func (s *Service) Search(ctx context.Context, userID uint64, query, mode string, limit int) (*SearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" || utf8.RuneCountInString(query) > maxQueryRunes {
+		return nil, ErrInvalidQuery
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	if mode == "" {
+		mode = SearchKeyword
+	}
+
+	var hits []SearchHit
+	var sessionOf map[uint64]string
+	res := &SearchResult{Query: query, Mode: mode}
+	switch mode {
+	case SearchKeyword:
+		terms := strings.Fields(query)
+		if len(terms) > maxQueryTerms {
+			terms = terms[:maxQueryTerms]
+		}
+		msgs, err := s.repo.SearchMessages(ctx, userID, terms, limit)
+		if err != nil {
+			return nil, err
+		}
+		sessionOf = make(map[uint64]string, len(msgs))
+		for _, m := range msgs {
+			sessionOf[m.ID] = m.SessionID
+			hits = append(hits, SearchHit{
+				MessageID: m.ID,
+				Role:      m.Role,
+				Snippet:   highlight(m.Content, terms),
+				CreatedAt: m.CreatedAt,
+			})
+		}
+	case SearchSemantic:
+		var err error
+		hits, sessionOf, res.Pending, err = s.semanticSearch(ctx, userID, query, limit)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrInvalidQuery
+	}
+
+	sessions, err := s.groupHits(ctx, userID, hits, sessionOf)
+	if err != nil {
+		return nil, err
+	}
+	res.Sessions = sessions
+	return res, nil
+}
+
+// groupHits keeps the order of hits: sessions appear in the order of their best hit.
+func (s *Service) groupHits(ctx context.Context, userID uint64, hits []SearchHit, sessionOf map[uint64]string) ([]SessionHits, error) {
+	out := []SessionHits{}
+	index := map[string]int{}
+	var ids []string
+	for _, h := range hits {
+		sid := sessionOf[h.MessageID]
+		i, ok := index[sid]
+		if !ok {
+			i = len(out)
+			index[sid] = i
+			out = append(out, SessionHits{SessionID: sid})
+			ids = append(ids, sid)
+		}
+		out[i].Hits = append(out[i].Hits, h)
+	}
+
+	sess, err := s.repo.GetSessionsBySessionIDs(ctx, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, ss := range sess {
+		if i, ok := index[ss.SessionID]; ok {
+			out[i].Title = ss.Title
+			out[i].UpdatedAt = ss.UpdatedAt
+		}
+	}
+	return out, nil
+}
+
+func (s *Service) semanticSearch(ctx context.Context, userID uint64, query string, limit int) ([]SearchHit, map[uint64]string, int64, error) {
+	if s.embedProvider == "" {
+		return nil, nil, 0, ErrSemanticSearchDisabled
+	}
+	emb, err := s.registry.Embedder(ctx, s.embedProvider, s.embedModel)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	model := s.embedModelKey()
+
+	pending, err := s.repo.CountUnembeddedMessages(ctx, userID, model)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	qv, err := emb.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	rows, err := s.repo.ListEmbeddings(ctx, userID, model, maxSemanticScan)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	type scored struct {
+		id    uint64
+		score float64
+	}
+	var ranked []scored
+	for _, r := range rows {
+		v := ai.DecodeVector(r.Vector)
+		if len(v) != len(qv[0]) {
+			continue
+		}
+		if sc := ai.Cosine(qv[0], v); sc >= minSemanticScore {
+			ranked = append(ranked, scored{r.MessageID, sc})
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].score > ranked[j].score })
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	ids := make([]uint64, 0, len(ranked))
+	for _, r := range ranked {
+		ids = append(ids, r.id)
+	}
+	msgs, err := s.repo.GetMessagesByIDs(ctx, userID, ids)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	byID := make(map[uint64]Message, len(msgs))
+	for _, m := range msgs {
+		byID[m.ID] = m
+	}
+
+	hits := make([]SearchHit, 0, len(ranked))
+	sessionOf := make(map[uint64]string, len(ranked))
+	for _, r := range ranked {
+		m, ok := byID[r.id]
+		if !ok {
+			continue
+		}
+		sessionOf[m.ID] = m.SessionID
+		hits = append(hits, SearchHit{
+			MessageID: m.ID,
+			Role:      m.Role,
+			Snippet:   highlight(m.Content, nil),
+			Score:     math.Round(r.score*1000) / 1000,
+			CreatedAt: m.CreatedAt,
+		})
+	}
+	return hits, sessionOf, pending, nil
+}
+
+// embedModelKey names the configured embedding model in stored vectors.
+func (s *Service) embedModelKey() string {
+	return s.embedProvider + ":" + s.embedModel
+}
+
+// BackfillEmbeddings embeds up to maxEmbedBackfill of the newest messages of all users that
+// have no vector yet, for semantic search, and returns how many it embedded. The worker calls
+// it periodically; searches only read vectors. Without an embedding model it does nothing.
+func (s *Service) BackfillEmbeddings(ctx context.Context) (int, error) {
+	if s.embedProvider == "" {
+		return 0, nil
+	}
+	emb, err := s.registry.Embedder(ctx, s.embedProvider, s.embedModel)
+	if err != nil {
+		return 0, err
+	}
+	model := s.embedModelKey()
+	msgs, err := s.repo.ListUnembeddedMessages(ctx, 0, model, maxEmbedBackfill)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for start := 0; start < len(msgs); start += embedBatchSize {
+		batch := msgs[start:min(start+embedBatchSize, len(msgs))]
+		texts := make([]string, len(batch))
+		for i, m := range batch {
+			texts[i] = truncateRunes(m.Content, maxEmbedRunes)
+			if strings.TrimSpace(texts[i]) == "" {
+				// some models reject empty input
+				texts[i] = " "
+			}
+		}
+		vecs, err := emb.Embed(ctx, texts)
+		if err != nil {
+			return n, err
+		}
+		rows := make([]MessageEmbedding, len(batch))
+		for i, m := range batch {
+			rows[i] = MessageEmbedding{
+				MessageID: m.ID,
+				Model:     model,
+				UserID:    m.UserID,
+				SessionID: m.SessionID,
+				Dim:       len(vecs[i]),
+				Vector:    ai.EncodeVector(vecs[i]),
+			}
+		}
+		if err := s.repo.InsertEmbeddings(ctx, rows); err != nil {
+			return n, err
+		}
+		n += len(rows)
+	}
+	return n, nil
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
+
+// highlight cuts a snippet around the first match of any term and wraps every match in
+// <mark>. Without terms (or a match) it returns the beginning of content. The result is
+// HTML-escaped apart from the marks.
+func highlight(content string, terms []string) string {
+	text := []rune(strings.Join(strings.Fields(content), " "))
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	// mark[i] is true for runes inside a match
+	mark := make([]bool, len(text))
+	first := -1
+	for _, t := range terms {
+		tr := []rune(t)
+		for i, r := range tr {
+			tr[i] = unicode.ToLower(r)
+		}
+		if len(tr) == 0 {
+			continue
+		}
+		for i := 0; i+len(tr) <= len(lower); i++ {
+			if !runesEqual(lower[i:i+len(tr)], tr) {
+				continue
+			}
+			for j := i; j < i+len(tr); j++ {
+				mark[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start, end := 0, min(len(text), 2*snippetContext)
+	if first >= 0 {
+		start = max(0, first-snippetContext)
+		end = min(len(text), first+snippetContext)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	open := false
+	for i := start; i < end; i++ {
+		if mark[i] && !open {
+			b.WriteString("<mark>")
+			open = true
+		} else if !mark[i] && open {
+			b.WriteString("</mark>")
+			open = false
+		}
+		b.WriteString(html.EscapeString(string(text[i])))
+	}
+	if open {
+		b.WriteString("</mark>")
+	}
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+func runesEqual(a, b []rune) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -3,10 +3,14 @@ package chat
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/suPer8Hu/ai-platform/internal/ai"
+	"github.com/suPer8Hu/ai-platform/internal/store/blob"
 	"gorm.io/gorm"
 )
 
@@ -14,31 +18,114 @@ type Service struct {
 	repo              *Repo
 	registry          *ai.Registry
 	contextWindowSize int
+	streamBuffer      StreamBuffer
+	tools             *ToolRegistry
+	prices            PriceTable
+	usageCounter      UsageCounter
+	fallbacks         []ai.Target
+	tokenizer         Tokenizer
+	budgets           TokenBudgets
+	embedProvider     string
+	embedModel        string
+	retriever         Retriever
+	jobEvents         JobEvents
+	jobPublisher      JobPublisher
+	webhookSecret     []byte
+	webhookClient     *http.Client
+	attachments       blob.Store
 }
 
+// UsageCounter receives the tokens of every stored model reply, e.g. to enforce daily quotas.
+type UsageCounter interface {
+	AddDailyTokens(ctx context.Context, userID uint64, tokens int64) error
+}
+
+// StreamBuffer persists streamed chunks outside the request so a client can
+// reconnect and replay them (see redisstore.Store).
+type StreamBuffer interface {
+	InitStream(ctx context.Context, streamID string, userID uint64, sessionID string) error
+	AppendStreamChunk(ctx context.Context, streamID string, chunk string) error
+	FinishStream(ctx context.Context, streamID string, assistantMsgID uint64, errMsg string) error
+}
+
+// how long a buffered stream may keep generating after its client went away
+const streamDetachedTimeout = 5 * time.Minute
+
 func NewService(repo *Repo, registry *ai.Registry, contextWindowSize int) *Service {
 	if contextWindowSize <= 0 || contextWindowSize > 100 {
 		contextWindowSize = 20
 	}
-	return &Service{repo: repo, registry: registry, contextWindowSize: contextWindowSize}
+	return &Service{repo: repo, registry: registry, contextWindowSize: contextWindowSize, tokenizer: EstimateTokenizer{}}
 }
 
 func (s *Service) ProviderRegistry() *ai.Registry {
 	return s.registry
 }
 
+func (s *Service) SetStreamBuffer(b StreamBuffer) {
+	s.streamBuffer = b
+}
+
+// SetPriceTable sets the per-model prices used by usage reports.
+func (s *Service) SetPriceTable(t PriceTable) {
+	s.prices = t
+}
+
+// SetFallbackChain sets the targets tried, in order, when a session's own provider fails
+// and the session has no chain of its own.
+func (s *Service) SetFallbackChain(chain []ai.Target) {
+	s.fallbacks = chain
+}
+
+// SetTokenBudgets budgets the chat history per model in tokens instead of contextWindowSize
+// messages; history beyond a model's budget is condensed into stored summaries.
+func (s *Service) SetTokenBudgets(b TokenBudgets) {
+	s.budgets = b
+}
+
+// SetTokenizer replaces the default EstimateTokenizer used for token budgets.
+func (s *Service) SetTokenizer(t Tokenizer) {
+	if t != nil {
+		s.tokenizer = t
+	}
+}
+
+func (s *Service) SetUsageCounter(c UsageCounter) {
+	s.usageCounter = c
+}
+
+// countUsage is best effort; quota accounting must not fail a reply that was already stored.
+func (s *Service) countUsage(ctx context.Context, userID uint64, u ai.Usage) {
+	if s.usageCounter == nil {
+		return
+	}
+	_ = s.usageCounter.AddDailyTokens(ctx, userID, int64(u.TotalTokens()))
+}
+
+// SetTools enables server-side tool calling for providers that implement ai.ToolProvider.
+// Streaming replies do not run tools.
+func (s *Service) SetTools(r *ToolRegistry) {
+	s.tools = r
+}
+
 const (
 	defaultProvider = "ollama"
 	defaultModel    = "llama3:latest"
 )
 
-func (s *Service) CreateSession(ctx context.Context, userID uint64, provider, model string) (*Session, error) {
+func (s *Service) CreateSession(ctx context.Context, userID uint64, provider, model string, fallbacks []ai.Target, settings GenerationSettings) (*Session, error) {
 	if provider == "" {
 		provider = defaultProvider
 	}
 	if model == "" {
 		model = defaultModel
 	}
+	if err := s.validateFallbacks(fallbacks); err != nil {
+		return nil, err
+	}
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
 
 	sid, err := NewSessionID()
 	if err != nil {
@@ -50,6 +137,9 @@ func (s *Service) CreateSession(ctx context.Context, userID uint64, provider, mo
 		UserID:    userID,
 		Provider:  provider,
 		Model:     model,
+		Fallbacks: ai.FormatTargets(fallbacks),
+
+		GenerationSettings: settings,
 	}
 
 	if err := s.repo.CreateSession(ctx, session); err != nil {
@@ -58,6 +148,14 @@ func (s *Service) CreateSession(ctx context.Context, userID uint64, provider, mo
 	return session, nil
 }
 
+// ErrInvalidFallback is returned for fallback targets naming an unknown provider.
+var ErrInvalidFallback = errors.New("invalid fallback target")
+
+// maximum number of fallback targets per session
+const maxSessionFallbacks = 4
+
+// providerForSession returns the session's provider/model followed by its fallback chain
+// (or the global one), behind per-provider circuit breakers.
 func (s *Service) providerForSession(ctx context.Context, sess *Session) (ai.Provider, error) {
 	p := sess.Provider
 	m := sess.Model
@@ -67,7 +165,68 @@ func (s *Service) providerForSession(ctx context.Context, sess *Session) (ai.Pro
 	if m == "" {
 		m = defaultModel
 	}
-	return s.registry.Get(ctx, p, m)
+	primary := ai.Target{Provider: strings.ToLower(p), Model: m}
+	if !s.registry.Has(primary.Provider) {
+		return nil, fmt.Errorf("unknown ai provider: %s", primary.Provider)
+	}
+
+	rest := s.fallbacks
+	if sess.Fallbacks != "" {
+		if ts, err := ai.ParseTargets(sess.Fallbacks); err == nil {
+			rest = ts
+		}
+	}
+	chain := []ai.Target{primary}
+	for _, t := range rest {
+		dup := false
+		for _, c := range chain {
+			if c == t {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			chain = append(chain, t)
+		}
+	}
+	return s.registry.Fallback(chain), nil
+}
+
+// SetSessionFallbacks replaces the session's fallback chain; an empty chain reverts to the global one.
+func (s *Service) SetSessionFallbacks(ctx context.Context, userID uint64, sessionID string, chain []ai.Target) error {
+	if err := s.validateFallbacks(chain); err != nil {
+		return err
+	}
+	if err := s.ValidateSessionOwner(ctx, userID, sessionID); err != nil {
+		return err
+	}
+	return s.repo.UpdateSessionFallbacks(ctx, userID, sessionID, ai.FormatTargets(chain))
+}
+
+func (s *Service) validateFallbacks(chain []ai.Target) error {
+	if len(chain) > maxSessionFallbacks {
+		return fmt.Errorf("%w: at most %d targets", ErrInvalidFallback, maxSessionFallbacks)
+	}
+	for _, t := range chain {
+		if !s.registry.Has(t.Provider) {
+			return fmt.Errorf("%w: unknown provider %q", ErrInvalidFallback, t.Provider)
+		}
+	}
+	if len(ai.FormatTargets(chain)) > 512 {
+		return fmt.Errorf("%w: chain too long", ErrInvalidFallback)
+	}
+	return nil
+}
+
+// responseModel prefers the model reported by the provider over the session's configured one.
+func responseModel(reported string, sess *Session) string {
+	if reported != "" {
+		return reported
+	}
+	if sess.Model != "" {
+		return sess.Model
+	}
+	return defaultModel
 }
 
 func (s *Service) ListSessions(ctx context.Context, userID uint64, limit int, beforeID uint64) ([]Session, error) {
@@ -88,10 +247,27 @@ func (s *Service) DeleteSession(ctx context.Context, userID uint64, sessionID st
 	if err := s.ValidateSessionOwner(ctx, userID, sessionID); err != nil {
 		return err
 	}
-	return s.repo.DeleteSessionCascade(ctx, userID, sessionID)
+	var keys []string
+	if s.attachments != nil {
+		var err error
+		if keys, err = s.repo.ListAttachmentKeys(ctx, userID, sessionID); err != nil {
+			return err
+		}
+	}
+	if err := s.repo.DeleteSessionCascade(ctx, userID, sessionID); err != nil {
+		return err
+	}
+	s.deleteBlobs(ctx, keys)
+	return nil
 }
 
-func (s *Service) SendMessage(ctx context.Context, userID uint64, sessionID string, content string) (reply string, assistantMsgID uint64, err error) {
+// SendMessage stores a user message with the given uploads attached and replies to it.
+func (s *Service) SendMessage(ctx context.Context, userID uint64, sessionID string, content string, attachmentIDs ...uint64) (reply string, assistantMsgID uint64, err error) {
+	attachments, err := s.attachmentRefs(attachmentIDs)
+	if err != nil {
+		return "", 0, err
+	}
+
 	// 1) verify session ownership
 	session, err := s.repo.GetSessionBySessionID(ctx, sessionID)
 	if err != nil {
@@ -112,148 +288,234 @@ func (s *Service) SendMessage(ctx context.Context, userID uint64, sessionID stri
 
 	// 2) store user message (strong consistency)
 	userMsg := &Message{
-		SessionID: sessionID,
-		UserID:    userID,
-		Role:      "user",
-		Content:   content,
+		SessionID:   sessionID,
+		UserID:      userID,
+		Role:        "user",
+		Content:     content,
+		Attachments: attachments,
 	}
 	if err := s.repo.InsertMessage(ctx, userMsg); err != nil {
 		return "", 0, err
 	}
 	s.maybeSetSessionTitle(ctx, userID, sessionID, content)
 
-	// 3) build provider messages from recent DB history
-	recentDesc, err := s.repo.ListRecentMessagesDesc(ctx, userID, sessionID, s.contextWindowSize)
+	// 3) generate and store the reply on the branch ending at the user message
+	assistantMsg, err := s.replyOnBranch(ctx, provider, session, userID, userMsg.ID, nil)
 	if err != nil {
 		return "", 0, err
 	}
+	return assistantMsg.Content, assistantMsg.ID, nil
+}
 
-	// reverse to ASC (oldest -> newest)
-	providerMsgs := make([]ai.Message, 0, len(recentDesc))
-	for i := len(recentDesc) - 1; i >= 0; i-- {
-		m := recentDesc[i]
-		providerMsgs = append(providerMsgs, ai.Message{
-			Role:    m.Role,
-			Content: m.Content,
-		})
+// replyOnBranch generates a reply to the branch ending at leafID (walking up through parents for
+// context) and stores it as a child of leafID, or of the last tool row the reply produced.
+//
+// With onDelta set, the reply is streamed and onDelta gets every chunk; when tools are enabled
+// the tool loop runs instead and onDelta gets the whole reply at once.
+func (s *Service) replyOnBranch(ctx context.Context, provider ai.Provider, sess *Session, userID, leafID uint64, onDelta func(string)) (*Message, error) {
+	providerMsgs, citations, err := s.buildContext(ctx, provider, sess, userID, leafID)
+	if err != nil {
+		return nil, err
 	}
 
-	// 4) call provider
-	reply, err = provider.Chat(ctx, providerMsgs)
+	// call provider (runs the tool loop when enabled) with the session's sampling parameters
+	genCtx := ai.WithGenerationParams(ctx, sess.params())
+	var resp ai.Response
+	parentID := leafID
+	if sp, ok := provider.(ai.StreamProvider); ok && onDelta != nil && !s.toolsEnabled(provider) {
+		resp, err = streamReply(genCtx, sp, providerMsgs, onDelta)
+	} else {
+		resp, parentID, err = s.generateReply(genCtx, provider, userID, sess.SessionID, leafID, providerMsgs)
+		if err == nil && onDelta != nil && resp.Content != "" {
+			onDelta(resp.Content)
+		}
+	}
 	if err != nil {
-		return "", 0, err
+		return nil, err
 	}
 
-	// 5) store assistant message (strong consistency)
 	assistantMsg := &Message{
-		SessionID: sessionID,
-		UserID:    userID,
-		Role:      "assistant",
-		Content:   reply,
-	}
-	if err := s.repo.InsertMessage(ctx, assistantMsg); err != nil {
-		return "", 0, err
+		SessionID:        sess.SessionID,
+		UserID:           userID,
+		Role:             RoleAssistant,
+		Content:          resp.Content,
+		ParentID:         &parentID,
+		Citations:        citations,
+		Model:            responseModel(resp.Model, sess),
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	}
+	if err := s.repo.InsertMessageAt(ctx, assistantMsg); err != nil {
+		return nil, err
 	}
-
-	return reply, assistantMsg.ID, nil
+	s.countUsage(ctx, userID, resp.Usage)
+	return assistantMsg, nil
 }
 
 func (s *Service) ListMessages(ctx context.Context, userID uint64, sessionID string, limit int, beforeID uint64) ([]Message, error) {
 	if limit <= 0 || limit > 100 {
 		limit = 50
 	}
-	return s.repo.ListMessages(ctx, userID, sessionID, limit, beforeID)
+	msgs, err := s.repo.ListMessages(ctx, userID, sessionID, limit, beforeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.withAttachments(ctx, userID, msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
 }
 
 // SendMessageStream stores the user message immediately, streams assistant chunks,
 // and finally stores the assistant message after streaming completes.
-func (s *Service) SendMessageStream(ctx context.Context, userID uint64, sessionID string, content string, idempoKey *string) (chunks <-chan string, done <-chan struct{}, assistantMsgID <-chan uint64, errs <-chan error) {
+//
+// When streamID is set and a StreamBuffer is configured, every chunk is also
+// buffered under streamID and generation is detached from ctx: if the client
+// disconnects, the reply is still completed and persisted, and the client can
+// resume from the buffer. buffered yields exactly once, before the first chunk
+// or error: true when the stream is buffered under streamID, false when there
+// is no buffer, it could not be started, or the request failed early. Only
+// hand streamID to the client after a true.
+func (s *Service) SendMessageStream(ctx context.Context, userID uint64, sessionID string, content string, idempoKey *string, streamID string, attachmentIDs ...uint64) (chunks <-chan string, done <-chan struct{}, assistantMsgID <-chan uint64, errs <-chan error, buffered <-chan bool) {
 	outChunks := make(chan string, 16)
 	outDone := make(chan struct{})
 	outMsgID := make(chan uint64, 1)
 	outErrs := make(chan error, 1)
+	outBuffered := make(chan bool, 1)
 
 	go func() {
 		defer close(outChunks)
 		defer close(outDone)
 		defer close(outMsgID)
 		defer close(outErrs)
+		defer close(outBuffered)
+
+		// nothing is buffered yet, so the caller can't resume these
+		failEarly := func(err error) {
+			outBuffered <- false
+			outErrs <- err
+		}
+
+		attachments, err := s.attachmentRefs(attachmentIDs)
+		if err != nil {
+			failEarly(err)
+			return
+		}
 
 		// 1) session ownership check
 		sess, err := s.repo.GetSessionBySessionID(ctx, sessionID)
 		if err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				outErrs <- gorm.ErrRecordNotFound
+				failEarly(gorm.ErrRecordNotFound)
 				return
 			}
-			outErrs <- err
+			failEarly(err)
 			return
 		}
 		if sess.UserID != userID {
-			outErrs <- gorm.ErrRecordNotFound
+			failEarly(gorm.ErrRecordNotFound)
 			return
 		}
 
+		// from here on, genCtx drives the work; it outlives ctx when buffering
+		genCtx := ctx
+		var buf StreamBuffer
+		if streamID != "" && s.streamBuffer != nil {
+			var cancel context.CancelFunc
+			genCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), streamDetachedTimeout)
+			defer cancel()
+			if err := s.streamBuffer.InitStream(genCtx, streamID, userID, sessionID); err == nil {
+				buf = s.streamBuffer
+			}
+		}
+		outBuffered <- buf != nil
+		fail := func(err error) {
+			if buf != nil {
+				_ = buf.FinishStream(genCtx, streamID, 0, err.Error())
+			}
+			outErrs <- err
+		}
+
 		// pick provider/model for this session
-		provider, err := s.providerForSession(ctx, sess)
+		provider, err := s.providerForSession(genCtx, sess)
 		if err != nil {
-			outErrs <- err
+			fail(err)
 			return
 		}
 
 		// 2) insert user message (idempotent if key provided)
+		userMsg := &Message{
+			SessionID:   sessionID,
+			UserID:      userID,
+			Role:        "user",
+			Content:     content,
+			Attachments: attachments,
+		}
 		if idempoKey != nil && *idempoKey != "" {
-			_, _, err := s.repo.InsertUserMessageOrGetExisting(ctx, userID, sessionID, content, idempoKey)
+			existing, _, err := s.repo.InsertUserMessageOrGetExisting(genCtx, userID, sessionID, content, idempoKey, attachments)
 			if err != nil {
-				outErrs <- err
+				fail(err)
 				return
 			}
+			userMsg = existing
 		} else {
-			userMsg := &Message{
-				SessionID: sessionID,
-				UserID:    userID,
-				Role:      "user",
-				Content:   content,
-			}
-			if err := s.repo.InsertMessage(ctx, userMsg); err != nil {
-				outErrs <- err
+			if err := s.repo.InsertMessage(genCtx, userMsg); err != nil {
+				fail(err)
 				return
 			}
 		}
-		s.maybeSetSessionTitle(ctx, userID, sessionID, content)
+		s.maybeSetSessionTitle(genCtx, userID, sessionID, content)
 
-		// 3) load recent messages, build provider context (ASC)
-		recentDesc, err := s.repo.ListRecentMessagesDesc(ctx, userID, sessionID, s.contextWindowSize)
+		// 3) build provider context (ASC) from the branch ending at the user message
+		providerMsgs, citations, err := s.buildContext(genCtx, provider, sess, userID, userMsg.ID)
 		if err != nil {
-			outErrs <- err
+			fail(err)
 			return
 		}
-		providerMsgs := make([]ai.Message, 0, len(recentDesc))
-		for i := len(recentDesc) - 1; i >= 0; i-- {
-			m := recentDesc[i]
-			providerMsgs = append(providerMsgs, ai.Message{Role: m.Role, Content: m.Content})
-		}
 
 		sp, ok := provider.(ai.StreamProvider)
 		if !ok {
-			outErrs <- errors.New("provider does not support streaming")
+			fail(errors.New("provider does not support streaming"))
 			return
 		}
 
 		// 4) stream from provider
-		pChunks, pErrs := sp.StreamChat(ctx, providerMsgs)
+		pChunks, pErrs := sp.StreamChat(ai.WithGenerationParams(genCtx, sess.params()), providerMsgs)
 
 		var b strings.Builder
-		for c := range pChunks {
+		var usage ai.Usage
+		model := ""
+		for pc := range pChunks {
+			if pc.Usage != nil {
+				usage = *pc.Usage
+			}
+			if pc.Model != "" {
+				model = pc.Model
+			}
+			c := pc.Delta
+			if c == "" {
+				continue
+			}
 			b.WriteString(c)
-			outChunks <- c
+			if buf != nil {
+				if err := buf.AppendStreamChunk(genCtx, streamID, c); err != nil {
+					// a gap would corrupt resumed replies; stop buffering and tell resumers
+					_ = buf.FinishStream(genCtx, streamID, 0, "stream buffer unavailable")
+					buf = nil
+				}
+			}
+			// the client may be gone; keep generating without blocking on it
+			select {
+			case outChunks <- c:
+			case <-ctx.Done():
+			}
 		}
 
 		// provider error (if any)
 		select {
 		case err := <-pErrs:
 			if err != nil {
-				outErrs <- err
+				fail(err)
 				return
 			}
 		default:
@@ -264,20 +526,86 @@ func (s *Service) SendMessageStream(ctx context.Context, userID uint64, sessionI
 
 		// 5) insert assistant message at the end
 		assistantMsg := &Message{
-			SessionID: sessionID,
-			UserID:    userID,
-			Role:      "assistant",
-			Content:   reply,
+			SessionID:        sessionID,
+			UserID:           userID,
+			Role:             "assistant",
+			Content:          reply,
+			ParentID:         &userMsg.ID,
+			Citations:        citations,
+			Model:            responseModel(model, sess),
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
 		}
-		if err := s.repo.InsertMessage(ctx, assistantMsg); err != nil {
-			outErrs <- err
+		if err := s.repo.InsertMessageAt(genCtx, assistantMsg); err != nil {
+			fail(err)
 			return
 		}
+		s.countUsage(genCtx, userID, usage)
+		if buf != nil {
+			_ = buf.FinishStream(genCtx, streamID, assistantMsg.ID, "")
+		}
 
 		outMsgID <- assistantMsg.ID
 	}()
 
-	return outChunks, outDone, outMsgID, outErrs
+	return outChunks, outDone, outMsgID, outErrs, outBuffered
+}
+
+// UserUsage reports a user's token usage and cost in [from, to), with the top sessions by tokens.
+func (s *Service) UserUsage(ctx context.Context, userID uint64, from, to time.Time, topSessions int) (*UsageReport, error) {
+	if topSessions <= 0 || topSessions > 50 {
+		topSessions = 10
+	}
+	rows, err := s.repo.SumUsage(ctx, userID, "", from, to)
+	if err != nil {
+		return nil, err
+	}
+	report, bySession := buildUsageReport(rows, s.prices)
+
+	top := make([]SessionUsage, 0, len(bySession))
+	for _, su := range bySession {
+		top = append(top, *su)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].TotalTokens != top[j].TotalTokens {
+			return top[i].TotalTokens > top[j].TotalTokens
+		}
+		return top[i].SessionID > top[j].SessionID
+	})
+	if len(top) > topSessions {
+		top = top[:topSessions]
+	}
+
+	ids := make([]string, 0, len(top))
+	for _, su := range top {
+		ids = append(ids, su.SessionID)
+	}
+	sess, err := s.repo.GetSessionsBySessionIDs(ctx, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	titles := make(map[string]string, len(sess))
+	for _, ss := range sess {
+		titles[ss.SessionID] = ss.Title
+	}
+	for i := range top {
+		top[i].Title = titles[top[i].SessionID]
+	}
+	report.TopSessions = top
+	return report, nil
+}
+
+// SessionUsage reports the token usage and cost of one session.
+func (s *Service) SessionUsage(ctx context.Context, userID uint64, sessionID string) (*UsageReport, error) {
+	if err := s.ValidateSessionOwner(ctx, userID, sessionID); err != nil {
+		return nil, err
+	}
+	rows, err := s.repo.SumUsage(ctx, userID, sessionID, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	report, _ := buildUsageReport(rows, s.prices)
+	return report, nil
 }
 
 func (s *Service) ValidateSessionOwner(ctx context.Context, userID uint64, sessionID string) error {
@@ -318,7 +646,15 @@ func (s *Service) GetJob(ctx context.Context, jobID string) (*Job, error) {
 	return s.repo.GetJobByID(ctx, jobID)
 }
 
-func (s *Service) GenerateAssistantReplyAndInsert(ctx context.Context, userID uint64, sessionID string) (string, uint64, error) {
+// GenerateAssistantReplyAndInsert generates and stores the reply to message parentID, or to
+// the end of the active branch when parentID is 0.
+func (s *Service) GenerateAssistantReplyAndInsert(ctx context.Context, userID uint64, sessionID string, parentID uint64) (string, uint64, error) {
+	return s.GenerateAssistantReplyStream(ctx, userID, sessionID, parentID, nil)
+}
+
+// GenerateAssistantReplyStream is GenerateAssistantReplyAndInsert passing every chunk of the
+// reply to onDelta as it is generated.
+func (s *Service) GenerateAssistantReplyStream(ctx context.Context, userID uint64, sessionID string, parentID uint64, onDelta func(string)) (string, uint64, error) {
 	// session ownership check + get session for provider routing
 	sess, err := s.repo.GetSessionBySessionID(ctx, sessionID)
 	if err != nil {
@@ -336,33 +672,34 @@ func (s *Service) GenerateAssistantReplyAndInsert(ctx context.Context, userID ui
 		return "", 0, err
 	}
 
-	recentDesc, err := s.repo.ListRecentMessagesDesc(ctx, userID, sessionID, s.contextWindowSize)
-	if err != nil {
-		return "", 0, err
-	}
-
-	// provider expects ASC
-	providerMsgs := make([]ai.Message, 0, len(recentDesc))
-	for i := len(recentDesc) - 1; i >= 0; i-- {
-		m := recentDesc[i]
-		providerMsgs = append(providerMsgs, ai.Message{Role: m.Role, Content: m.Content})
+	if parentID != 0 {
+		parent, err := s.repo.GetMessageByID(ctx, userID, parentID)
+		if err != nil {
+			return "", 0, err
+		}
+		if parent.SessionID != sessionID {
+			return "", 0, gorm.ErrRecordNotFound
+		}
+	} else {
+		// reply to whatever the active branch currently ends with
+		if err := s.repo.LinkLegacyMessages(ctx, userID, sessionID); err != nil {
+			return "", 0, err
+		}
+		leaf, err := s.repo.ListActiveBranchDesc(ctx, userID, sessionID, 1)
+		if err != nil {
+			return "", 0, err
+		}
+		if len(leaf) == 0 {
+			return "", 0, errors.New("session has no messages")
+		}
+		parentID = leaf[0].ID
 	}
 
-	reply, err := provider.Chat(ctx, providerMsgs)
+	assistantMsg, err := s.replyOnBranch(ctx, provider, sess, userID, parentID, onDelta)
 	if err != nil {
 		return "", 0, err
 	}
-
-	assistantMsg := &Message{
-		SessionID: sessionID,
-		UserID:    userID,
-		Role:      "assistant",
-		Content:   reply,
-	}
-	if err := s.repo.InsertMessage(ctx, assistantMsg); err != nil {
-		return "", 0, err
-	}
-	return reply, assistantMsg.ID, nil
+	return assistantMsg.Content, assistantMsg.ID, nil
 }
 
 func (s *Service) CreateJobOrGetExisting(ctx context.Context, job *Job) (*Job, bool, error) {
@@ -370,7 +707,7 @@ func (s *Service) CreateJobOrGetExisting(ctx context.Context, job *Job) (*Job, b
 }
 
 func (s *Service) InsertUserMessageOrGetExisting(ctx context.Context, userID uint64, sessionID string, content string, key *string) (*Message, bool, error) {
-	msg, created, err := s.repo.InsertUserMessageOrGetExisting(ctx, userID, sessionID, content, key)
+	msg, created, err := s.repo.InsertUserMessageOrGetExisting(ctx, userID, sessionID, content, key, nil)
 	if err == nil && created {
 		s.maybeSetSessionTitle(ctx, userID, sessionID, content)
 	}
@@ -404,12 +741,12 @@ func (s *Service) generateTitleWithAI(ctx context.Context, sess *Session, conten
 		{Role: "system", Content: prompt},
 		{Role: "user", Content: content},
 	}
-	title, err := provider.Chat(ctx, msgs)
+	resp, err := provider.Chat(ctx, msgs)
 	if err != nil {
 		return ""
 	}
 
-	title = strings.TrimSpace(title)
+	title := strings.TrimSpace(resp.Content)
 	title = strings.Trim(title, "\"'`")
 	title = strings.Join(strings.Fields(title), " ")
 	if title == "" {
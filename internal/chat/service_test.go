@@ -1,12 +1,25 @@
 package chat
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	gormsqlite "github.com/glebarez/sqlite"
 	"github.com/suPer8Hu/ai-platform/internal/ai"
+	"github.com/suPer8Hu/ai-platform/internal/store/blob"
 	"gorm.io/gorm"
 )
 
@@ -14,11 +27,15 @@ type recordingProvider struct {
 	last []ai.Message
 }
 
-func (p *recordingProvider) Chat(ctx context.Context, messages []ai.Message) (string, error) {
+func (p *recordingProvider) Chat(ctx context.Context, messages []ai.Message) (ai.Response, error) {
 	_ = ctx
 	// copy to avoid mutations
 	p.last = append([]ai.Message(nil), messages...)
-	return "ok", nil
+	return ai.Response{
+		Message: ai.Message{Role: ai.RoleAssistant, Content: "ok"},
+		Usage:   ai.Usage{PromptTokens: 10, CompletionTokens: 2},
+		Model:   "fake-model",
+	}, nil
 }
 
 func openTestDB(t *testing.T) *gorm.DB {
@@ -54,6 +71,7 @@ func TestSendMessage_WritesUserAndAssistant(t *testing.T) {
 		UserID:    1,
 		Provider:  "fake",
 		Model:     "default",
+		Title:     "t",
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -110,6 +128,7 @@ func TestSendMessage_UsesContextWindow(t *testing.T) {
 		UserID:    2,
 		Provider:  "fake",
 		Model:     "default",
+		Title:     "t",
 	}
 	if err := repo.CreateSession(context.Background(), sess); err != nil {
 		t.Fatalf("create session: %v", err)
@@ -146,3 +165,1685 @@ func TestSendMessage_UsesContextWindow(t *testing.T) {
 			prov.last[len(prov.last)-1].Role, prov.last[len(prov.last)-1].Content)
 	}
 }
+
+type streamingProvider struct {
+	recordingProvider
+	chunks []string
+}
+
+func (p *streamingProvider) StreamChat(ctx context.Context, messages []ai.Message) (<-chan ai.StreamChunk, <-chan error) {
+	out := make(chan ai.StreamChunk)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(out)
+		defer close(errs)
+		for _, c := range p.chunks {
+			select {
+			case out <- ai.StreamChunk{Delta: c}:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return out, errs
+}
+
+type memStreamBuffer struct {
+	chunks   []string
+	finished chan uint64
+}
+
+func (b *memStreamBuffer) InitStream(ctx context.Context, streamID string, userID uint64, sessionID string) error {
+	return nil
+}
+
+func (b *memStreamBuffer) AppendStreamChunk(ctx context.Context, streamID string, chunk string) error {
+	b.chunks = append(b.chunks, chunk)
+	return nil
+}
+
+func (b *memStreamBuffer) FinishStream(ctx context.Context, streamID string, assistantMsgID uint64, errMsg string) error {
+	b.finished <- assistantMsgID
+	return nil
+}
+
+func TestSendMessageStream_CompletesAfterClientDisconnect(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewRepo(db)
+
+	prov := &streamingProvider{chunks: []string{"a", "b", "c"}}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+
+	svc := NewService(repo, reg, 20)
+	buf := &memStreamBuffer{finished: make(chan uint64, 1)}
+	svc.SetStreamBuffer(buf)
+
+	sess := &Session{
+		SessionID: "01TESTSESSIONID00000000000002",
+		UserID:    3,
+		Provider:  "fake",
+		Model:     "default",
+		Title:     "t",
+	}
+	if err := repo.CreateSession(context.Background(), sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chunks, _, _, _, buffered := svc.SendMessageStream(ctx, 3, sess.SessionID, "hi", nil, "stream-1")
+	if !<-buffered {
+		t.Fatalf("expected the stream to be buffered")
+	}
+	// read one chunk, then drop the "connection"
+	<-chunks
+	cancel()
+
+	select {
+	case id := <-buf.finished:
+		if id == 0 {
+			t.Fatalf("expected assistant message id on finish")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("stream did not finish after client disconnect")
+	}
+
+	if got := len(buf.chunks); got != 3 {
+		t.Fatalf("expected 3 buffered chunks, got %d", got)
+	}
+	var assistant Message
+	if err := db.Where("session_id = ? AND role = ?", sess.SessionID, "assistant").First(&assistant).Error; err != nil {
+		t.Fatalf("query assistant: %v", err)
+	}
+	if assistant.Content != "abc" {
+		t.Fatalf("unexpected assistant content: %q", assistant.Content)
+	}
+}
+
+// toolCallingProvider asks for the calculator once, then answers with the tool result.
+type toolCallingProvider struct {
+	recordingProvider
+}
+
+func (p *toolCallingProvider) ChatWithTools(ctx context.Context, messages []ai.Message, tools []ai.Tool) (ai.Response, error) {
+	last := messages[len(messages)-1]
+	if last.Role == ai.RoleTool {
+		return ai.Response{Message: ai.Message{Role: ai.RoleAssistant, Content: "result is " + last.Content}}, nil
+	}
+	return ai.Response{Message: ai.Message{
+		Role:      ai.RoleAssistant,
+		ToolCalls: []ai.ToolCall{{ID: "call_1", Name: "calculator", Arguments: `{"expression":"(2+3)*4"}`}},
+	}}, nil
+}
+
+func TestSendMessage_RunsToolLoop(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewRepo(db)
+
+	prov := &toolCallingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+
+	svc := NewService(repo, reg, 20)
+	tools := NewToolRegistry()
+	RegisterBuiltinTools(tools, db)
+	svc.SetTools(tools)
+
+	sess := &Session{
+		SessionID: "01TESTSESSIONID00000000000003",
+		UserID:    4,
+		Provider:  "fake",
+		Model:     "default",
+		Title:     "t",
+	}
+	if err := repo.CreateSession(context.Background(), sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	reply, _, err := svc.SendMessage(context.Background(), 4, sess.SessionID, "what is (2+3)*4?")
+	if err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	if reply != "result is 20" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+
+	var msgs []Message
+	if err := db.Where("session_id = ?", sess.SessionID).Order("id ASC").Find(&msgs).Error; err != nil {
+		t.Fatalf("query messages: %v", err)
+	}
+	roles := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		roles = append(roles, m.Role)
+	}
+	want := []string{RoleUser, RoleToolCall, RoleToolResult, RoleAssistant}
+	if len(roles) != len(want) {
+		t.Fatalf("unexpected roles: %v", roles)
+	}
+	for i := range want {
+		if roles[i] != want[i] {
+			t.Fatalf("unexpected roles: %v", roles)
+		}
+	}
+	if msgs[2].ToolCallID != "call_1" || msgs[2].Content != "20" {
+		t.Fatalf("unexpected tool result row: %+v", msgs[2])
+	}
+
+	// history replay maps tool rows back to provider tool messages
+	pm := toProviderMessages([]Message{msgs[3], msgs[2], msgs[1], msgs[0]})
+	if pm[1].Role != ai.RoleAssistant || len(pm[1].ToolCalls) != 1 || pm[2].Role != ai.RoleTool {
+		t.Fatalf("unexpected provider messages: %+v", pm)
+	}
+}
+
+func TestSessionUsage_SumsTokensAndCost(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewRepo(db)
+
+	prov := &recordingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+
+	svc := NewService(repo, reg, 20)
+	svc.SetPriceTable(PriceTable{"fake-model": {PromptPerMTok: 1, CompletionPerMTok: 2}})
+
+	sess := &Session{
+		SessionID: "01TESTSESSIONID00000000000004",
+		UserID:    5,
+		Provider:  "fake",
+		Model:     "default",
+		Title:     "t",
+	}
+	if err := repo.CreateSession(context.Background(), sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := svc.SendMessage(context.Background(), 5, sess.SessionID, "hi"); err != nil {
+			t.Fatalf("send message: %v", err)
+		}
+	}
+
+	report, err := svc.SessionUsage(context.Background(), 5, sess.SessionID)
+	if err != nil {
+		t.Fatalf("session usage: %v", err)
+	}
+	if report.PromptTokens != 20 || report.CompletionTokens != 4 || report.TotalTokens != 24 {
+		t.Fatalf("unexpected token totals: %+v", report)
+	}
+	if want := (20*1.0 + 4*2.0) / 1e6; report.CostUSD != want {
+		t.Fatalf("unexpected cost: got %v want %v", report.CostUSD, want)
+	}
+	if len(report.ByModel) != 1 || report.ByModel[0].Model != "fake-model" || report.ByModel[0].Messages != 2 {
+		t.Fatalf("unexpected by-model: %+v", report.ByModel)
+	}
+
+	if _, err := svc.SessionUsage(context.Background(), 6, sess.SessionID); err != gorm.ErrRecordNotFound {
+		t.Fatalf("expected not found for other user, got %v", err)
+	}
+}
+
+type failingProvider struct {
+	calls int
+}
+
+func (p *failingProvider) Chat(ctx context.Context, messages []ai.Message) (ai.Response, error) {
+	p.calls++
+	return ai.Response{}, &ai.StatusError{Provider: "down", StatusCode: 503}
+}
+
+func TestSendMessage_FallsBackAndOpensCircuit(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewRepo(db)
+
+	down := &failingProvider{}
+	backup := &recordingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("down", func(ctx context.Context, model string) (ai.Provider, error) {
+		return down, nil
+	})
+	reg.Register("backup", func(ctx context.Context, model string) (ai.Provider, error) {
+		return backup, nil
+	})
+	reg.SetBreakerConfig(ai.BreakerConfig{FailureThreshold: 2, OpenTimeout: time.Hour})
+
+	svc := NewService(repo, reg, 20)
+	svc.SetFallbackChain([]ai.Target{{Provider: "backup", Model: "backup-model"}})
+
+	sess := &Session{
+		SessionID: "01TESTSESSIONID00000000000005",
+		UserID:    7,
+		Provider:  "down",
+		Model:     "primary-model",
+		// titled, so no background title call races the assertions
+		Title: "t",
+	}
+	if err := repo.CreateSession(context.Background(), sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		reply, _, err := svc.SendMessage(context.Background(), 7, sess.SessionID, "hi")
+		if err != nil {
+			t.Fatalf("send message %d: %v", i, err)
+		}
+		if reply != "ok" {
+			t.Fatalf("unexpected reply: %q", reply)
+		}
+	}
+	// two faults open the circuit; the third request skips the primary
+	if down.calls != 2 {
+		t.Fatalf("expected primary to be called twice, got %d", down.calls)
+	}
+
+	var last Message
+	if err := db.Where("session_id = ? AND role = ?", sess.SessionID, RoleAssistant).
+		Order("id DESC").First(&last).Error; err != nil {
+		t.Fatalf("query assistant: %v", err)
+	}
+	if last.Model != "fake-model" {
+		t.Fatalf("expected the answering model to be recorded, got %q", last.Model)
+	}
+}
+
+func TestEditAndRegenerate_CreateSiblingBranches(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewRepo(db)
+
+	prov := &recordingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+
+	sess := &Session{
+		SessionID: "01TESTSESSIONID00000000000006",
+		UserID:    8,
+		Provider:  "fake",
+		Model:     "default",
+		Title:     "t",
+	}
+	if err := repo.CreateSession(context.Background(), sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	ctx := context.Background()
+	if _, _, err := svc.SendMessage(ctx, 8, sess.SessionID, "first"); err != nil {
+		t.Fatalf("send first: %v", err)
+	}
+	if _, _, err := svc.SendMessage(ctx, 8, sess.SessionID, "second"); err != nil {
+		t.Fatalf("send second: %v", err)
+	}
+	var second Message
+	if err := db.Where("session_id = ? AND content = ?", sess.SessionID, "second").First(&second).Error; err != nil {
+		t.Fatalf("query second: %v", err)
+	}
+
+	edited, reply, err := svc.EditMessage(ctx, 8, second.ID, "second v2")
+	if err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if edited.ParentID == nil || second.ParentID == nil || *edited.ParentID != *second.ParentID {
+		t.Fatalf("expected edit to be a sibling of the original")
+	}
+	// the provider sees the edited branch only
+	if len(prov.last) != 3 || prov.last[2].Content != "second v2" {
+		t.Fatalf("unexpected provider context: %+v", prov.last)
+	}
+
+	branch, err := svc.ListActiveBranch(ctx, 8, sess.SessionID, 50, 0)
+	if err != nil {
+		t.Fatalf("list branch: %v", err)
+	}
+	if len(branch) != 4 || branch[0].ID != reply.ID || branch[1].ID != edited.ID {
+		t.Fatalf("unexpected active branch: %+v", branch)
+	}
+	if len(branch[1].SiblingIDs) != 2 || branch[1].SiblingIDs[0] != second.ID {
+		t.Fatalf("expected original and edit as siblings, got %v", branch[1].SiblingIDs)
+	}
+
+	regen, err := svc.RegenerateMessage(ctx, 8, reply.ID)
+	if err != nil {
+		t.Fatalf("regenerate: %v", err)
+	}
+	if regen.ParentID == nil || *regen.ParentID != edited.ID {
+		t.Fatalf("expected regenerated reply under the edited message")
+	}
+
+	if _, _, err := svc.EditMessage(ctx, 8, regen.ID, "nope"); err != ErrMessageNotEditable {
+		t.Fatalf("expected ErrMessageNotEditable, got %v", err)
+	}
+	if _, err := svc.ActivateMessage(ctx, 9, second.ID); err != ErrMessageNotFound {
+		t.Fatalf("expected not found for other user, got %v", err)
+	}
+
+	// switching back follows the original branch down to its reply
+	leaf, err := svc.ActivateMessage(ctx, 8, second.ID)
+	if err != nil {
+		t.Fatalf("activate: %v", err)
+	}
+	branch, err = svc.ListActiveBranch(ctx, 8, sess.SessionID, 50, 0)
+	if err != nil {
+		t.Fatalf("list branch: %v", err)
+	}
+	if branch[0].ID != leaf || branch[1].ID != second.ID {
+		t.Fatalf("expected original branch to be active, got %+v", branch)
+	}
+}
+
+// fixedTokenizer makes every non-empty text cost 6 tokens (10 with the per-message overhead).
+type fixedTokenizer struct{}
+
+func (fixedTokenizer) CountTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	return 6
+}
+
+func TestSendMessage_SummarizesHistoryOverTokenBudget(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&Summary{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+
+	prov := &recordingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+	svc.SetTokenizer(fixedTokenizer{})
+	svc.SetTokenBudgets(TokenBudgets{"budgeted": 50})
+
+	sess := &Session{
+		SessionID: "01TESTSESSIONID00000000000007",
+		UserID:    10,
+		Provider:  "fake",
+		Model:     "budgeted",
+		Title:     "t",
+	}
+	if err := repo.CreateSession(context.Background(), sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	ctx := context.Background()
+	var seeded []uint64
+	for i := 0; i < 6; i++ {
+		role := RoleUser
+		if i%2 == 1 {
+			role = RoleAssistant
+		}
+		m := &Message{SessionID: sess.SessionID, UserID: 10, Role: role, Content: "seed"}
+		if err := repo.InsertMessage(ctx, m); err != nil {
+			t.Fatalf("seed msg %d: %v", i, err)
+		}
+		seeded = append(seeded, m.ID)
+	}
+
+	// 7 messages * 10 tokens > 50: the newest 25 tokens (2 messages) stay, the rest is condensed
+	if _, _, err := svc.SendMessage(ctx, 10, sess.SessionID, "new"); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	var sums []Summary
+	if err := db.Where("session_id = ?", sess.SessionID).Find(&sums).Error; err != nil {
+		t.Fatalf("query summaries: %v", err)
+	}
+	if len(sums) != 1 || sums[0].UptoMessageID != seeded[4] || sums[0].Content != "ok" {
+		t.Fatalf("unexpected summaries: %+v", sums)
+	}
+	if len(prov.last) != 3 || prov.last[0].Role != ai.RoleSystem || prov.last[2].Content != "new" {
+		t.Fatalf("unexpected provider context: %+v", prov.last)
+	}
+
+	// the stored summary is reused while the newer history fits
+	if _, _, err := svc.SendMessage(ctx, 10, sess.SessionID, "again"); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	var n int64
+	db.Model(&Summary{}).Where("session_id = ?", sess.SessionID).Count(&n)
+	if n != 1 {
+		t.Fatalf("expected the summary to be reused, got %d summaries", n)
+	}
+	if len(prov.last) != 5 || prov.last[0].Role != ai.RoleSystem || prov.last[4].Content != "again" {
+		t.Fatalf("unexpected provider context: %+v", prov.last)
+	}
+
+	// regenerating the reply to the summary's cut-off message still sends that message
+	if _, err := svc.RegenerateMessage(ctx, 10, seeded[5]); err != nil {
+		t.Fatalf("regenerate: %v", err)
+	}
+	if len(prov.last) != 5 || prov.last[0].Role != ai.RoleUser || prov.last[4].Role != ai.RoleUser || prov.last[4].Content != "seed" {
+		t.Fatalf("unexpected provider context: %+v", prov.last)
+	}
+}
+
+func TestSendMessage_SummarizesLongHistoryInPasses(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&Summary{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+
+	prov := &recordingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+	svc.SetTokenBudgets(TokenBudgets{"budgeted": 12000})
+
+	sess := &Session{
+		SessionID: "01TESTSESSIONID00000000000020",
+		UserID:    30,
+		Provider:  "fake",
+		Model:     "budgeted",
+		Title:     "t",
+	}
+	if err := repo.CreateSession(context.Background(), sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	ctx := context.Background()
+	var seeded []uint64
+	for i := 0; i < 8; i++ {
+		role := RoleUser
+		if i%2 == 1 {
+			role = RoleAssistant
+		}
+		// ~5000 tokens each, so three fit one summarizer transcript
+		m := &Message{SessionID: sess.SessionID, UserID: 30, Role: role, Content: strings.Repeat("a", 20000)}
+		if err := repo.InsertMessage(ctx, m); err != nil {
+			t.Fatalf("seed msg %d: %v", i, err)
+		}
+		seeded = append(seeded, m.ID)
+	}
+
+	// the newest seed stays verbatim, the 7 older ones are condensed oldest first
+	if _, _, err := svc.SendMessage(ctx, 30, sess.SessionID, "new"); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	var sums []Summary
+	if err := db.Where("session_id = ?", sess.SessionID).Order("id ASC").Find(&sums).Error; err != nil {
+		t.Fatalf("query summaries: %v", err)
+	}
+	if len(sums) != 3 || sums[0].UptoMessageID != seeded[2] || sums[1].UptoMessageID != seeded[5] || sums[2].UptoMessageID != seeded[6] {
+		t.Fatalf("unexpected summaries: %+v", sums)
+	}
+	if len(prov.last) != 3 || prov.last[0].Role != ai.RoleSystem || prov.last[2].Content != "new" {
+		t.Fatalf("unexpected provider context: %+v", prov.last)
+	}
+}
+
+type paramsProvider struct {
+	recordingProvider
+	params ai.GenerationParams
+}
+
+func (p *paramsProvider) Chat(ctx context.Context, messages []ai.Message) (ai.Response, error) {
+	p.params = ai.GenerationParamsFrom(ctx)
+	return p.recordingProvider.Chat(ctx, messages)
+}
+
+func TestSendMessage_AppliesPersonaSettings(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&Persona{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+
+	prov := &paramsProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+	ctx := context.Background()
+
+	temp, maxTokens := 0.2, 64
+	persona := &Persona{
+		Name:     "pirate",
+		Provider: "fake",
+		GenerationSettings: GenerationSettings{
+			SystemPrompt: "Talk like a pirate.",
+			Temperature:  &temp,
+			Stop:         StringList{"###"},
+		},
+	}
+	if err := svc.CreatePersona(ctx, 11, persona); err != nil {
+		t.Fatalf("create persona: %v", err)
+	}
+	if err := svc.CreatePersona(ctx, 11, &Persona{Name: "pirate"}); err != ErrPersonaExists {
+		t.Fatalf("expected ErrPersonaExists, got %v", err)
+	}
+	if _, err := svc.GetPersona(ctx, 12, persona.ID); err != ErrPersonaNotFound {
+		t.Fatalf("expected not found for other user, got %v", err)
+	}
+
+	loaded, err := svc.GetPersona(ctx, 11, persona.ID)
+	if err != nil {
+		t.Fatalf("get persona: %v", err)
+	}
+	settings := loaded.GenerationSettings.Merge(GenerationSettings{MaxTokens: &maxTokens})
+	sess, err := svc.CreateSession(ctx, 11, loaded.Provider, "default", nil, settings)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if err := svc.UpdateSessionTitle(ctx, 11, sess.SessionID, "t"); err != nil {
+		t.Fatalf("set title: %v", err)
+	}
+
+	if _, _, err := svc.SendMessage(ctx, 11, sess.SessionID, "hello"); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	if len(prov.last) != 2 || prov.last[0].Role != ai.RoleSystem || prov.last[0].Content != "Talk like a pirate." {
+		t.Fatalf("expected the system prompt first, got %+v", prov.last)
+	}
+	p := prov.params
+	if p.Temperature == nil || *p.Temperature != 0.2 || p.MaxTokens == nil || *p.MaxTokens != 64 ||
+		len(p.Stop) != 1 || p.Stop[0] != "###" {
+		t.Fatalf("unexpected generation params: %+v", p)
+	}
+
+	bad := 3.0
+	if err := svc.SetSessionSettings(ctx, 11, sess.SessionID, GenerationSettings{Temperature: &bad}); !errors.Is(err, ErrInvalidSettings) {
+		t.Fatalf("expected ErrInvalidSettings, got %v", err)
+	}
+	// clearing the settings stops sending them
+	if err := svc.SetSessionSettings(ctx, 11, sess.SessionID, GenerationSettings{}); err != nil {
+		t.Fatalf("set settings: %v", err)
+	}
+	if _, _, err := svc.SendMessage(ctx, 11, sess.SessionID, "again"); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	if prov.last[0].Role == ai.RoleSystem || !prov.params.IsZero() {
+		t.Fatalf("expected no system prompt or params, got %+v %+v", prov.last, prov.params)
+	}
+}
+
+// embeddingProvider embeds texts on two axes: mentions of cats and of dogs.
+type embeddingProvider struct {
+	recordingProvider
+	embedded int
+}
+
+func (p *embeddingProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	out := make([][]float32, len(texts))
+	for i, t := range texts {
+		t = strings.ToLower(t)
+		v := []float32{0.1, 0.1}
+		if strings.Contains(t, "cat") || strings.Contains(t, "kitten") {
+			v[0] = 1
+		}
+		if strings.Contains(t, "dog") || strings.Contains(t, "puppy") {
+			v[1] = 1
+		}
+		out[i] = v
+	}
+	p.embedded += len(texts)
+	return out, nil
+}
+
+func TestSearch_KeywordAndSemantic(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&MessageEmbedding{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+
+	prov := &embeddingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+	ctx := context.Background()
+
+	pets := &Session{SessionID: "01TESTSESSIONID00000000000008", UserID: 13, Provider: "fake", Model: "m", Title: "pets"}
+	other := &Session{SessionID: "01TESTSESSIONID00000000000009", UserID: 13, Provider: "fake", Model: "m", Title: "other"}
+	for _, s := range []*Session{pets, other} {
+		if err := repo.CreateSession(ctx, s); err != nil {
+			t.Fatalf("create session: %v", err)
+		}
+	}
+	seed := []struct {
+		sess    *Session
+		content string
+	}{
+		{pets, "My kitten knocked a glass <off> the Table again"},
+		{pets, "Should I get a puppy?"},
+		{other, "Quarterly table of revenue"},
+		{other, "Deploy the new build on friday"},
+	}
+	for _, m := range seed {
+		if err := repo.InsertMessage(ctx, &Message{SessionID: m.sess.SessionID, UserID: 13, Role: RoleUser, Content: m.content}); err != nil {
+			t.Fatalf("seed: %v", err)
+		}
+	}
+
+	res, err := svc.Search(ctx, 13, "table", "", 10)
+	if err != nil {
+		t.Fatalf("keyword search: %v", err)
+	}
+	if len(res.Sessions) != 2 || res.Sessions[0].SessionID != other.SessionID || res.Sessions[1].Title != "pets" {
+		t.Fatalf("unexpected sessions: %+v", res.Sessions)
+	}
+	if got := res.Sessions[1].Hits[0].Snippet; got != "My kitten knocked a glass &lt;off&gt; the <mark>Table</mark> again" {
+		t.Fatalf("unexpected snippet: %q", got)
+	}
+	if res, _ := svc.Search(ctx, 14, "table", "", 10); len(res.Sessions) != 0 {
+		t.Fatalf("expected no hits for another user, got %+v", res.Sessions)
+	}
+
+	if _, err := svc.Search(ctx, 13, "cats", SearchSemantic, 10); !errors.Is(err, ErrSemanticSearchDisabled) {
+		t.Fatalf("expected ErrSemanticSearchDisabled, got %v", err)
+	}
+	svc.SetEmbeddings("fake", "embed-model")
+
+	// searches only read vectors: nothing is embedded until the backfill runs
+	res, err = svc.Search(ctx, 13, "cat pictures", SearchSemantic, 10)
+	if err != nil {
+		t.Fatalf("semantic search: %v", err)
+	}
+	if len(res.Sessions) != 0 || res.Pending != 4 || prov.embedded != 1 {
+		t.Fatalf("expected 4 pending messages and no hits, got %+v pending=%d embedded=%d", res.Sessions, res.Pending, prov.embedded)
+	}
+	// other tests' messages share the database
+	if n, err := svc.BackfillEmbeddings(ctx); err != nil || n < 4 {
+		t.Fatalf("backfill: n=%d err=%v", n, err)
+	}
+	if n, err := svc.BackfillEmbeddings(ctx); err != nil || n != 0 {
+		t.Fatalf("second backfill: n=%d err=%v", n, err)
+	}
+
+	res, err = svc.Search(ctx, 13, "cat pictures", SearchSemantic, 10)
+	if err != nil {
+		t.Fatalf("semantic search: %v", err)
+	}
+	if res.Pending != 0 || len(res.Sessions) == 0 || res.Sessions[0].SessionID != pets.SessionID ||
+		!strings.Contains(res.Sessions[0].Hits[0].Snippet, "kitten") {
+		t.Fatalf("unexpected semantic result: %+v", res.Sessions)
+	}
+	// the scan is bounded to the newest messages
+	newest, err := repo.ListEmbeddings(ctx, 13, "fake:embed-model", 2)
+	if err != nil || len(newest) != 2 || newest[0].MessageID <= newest[1].MessageID {
+		t.Fatalf("expected the 2 newest vectors, got %+v err=%v", newest, err)
+	}
+	if msgs, _ := repo.ListMessages(ctx, 13, other.SessionID, 1, 0); len(msgs) != 1 || msgs[0].ID != newest[0].MessageID {
+		t.Fatalf("newest vector is not of the newest message: %+v", newest)
+	}
+
+	// only the query is embedded; vectors are stored and reused
+	embedded := prov.embedded
+	if _, err := svc.Search(ctx, 13, "dogs", SearchSemantic, 10); err != nil {
+		t.Fatalf("semantic search: %v", err)
+	}
+	if prov.embedded != embedded+1 {
+		t.Fatalf("expected stored vectors to be reused, embedded %d texts", prov.embedded-embedded)
+	}
+}
+
+type fakeRetriever struct {
+	queries []string
+	err     error
+}
+
+func (r *fakeRetriever) Retrieve(ctx context.Context, userID uint64, sessionID, query string) ([]Citation, error) {
+	r.queries = append(r.queries, query)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return []Citation{
+		{DocumentID: 7, Title: "Handbook", Chunk: 2, Score: 0.91, Content: "Refunds are issued within 14 days."},
+		{DocumentID: 8, Title: "FAQ", Chunk: 0, Score: 0.55, Content: "Contact support by email."},
+	}, nil
+}
+
+func TestSendMessage_InjectsRetrievedExcerptsWithCitations(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewRepo(db)
+
+	prov := &recordingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+	retriever := &fakeRetriever{}
+	svc.SetRetriever(retriever)
+	ctx := context.Background()
+
+	sess := &Session{SessionID: "01TESTSESSIONID00000000000010", UserID: 15, Provider: "fake", Model: "m", Title: "docs"}
+	if err := repo.CreateSession(ctx, sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	_, replyID, err := svc.SendMessage(ctx, 15, sess.SessionID, "How long do refunds take?")
+	if err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	if len(retriever.queries) != 1 || retriever.queries[0] != "How long do refunds take?" {
+		t.Fatalf("expected the user message as query, got %q", retriever.queries)
+	}
+	if len(prov.last) != 2 || prov.last[0].Role != ai.RoleSystem {
+		t.Fatalf("expected excerpts before the history, got %+v", prov.last)
+	}
+	excerpts := prov.last[0].Content
+	if !strings.Contains(excerpts, "[1] Handbook (part 3)\nRefunds are issued within 14 days.") ||
+		!strings.Contains(excerpts, "[2] FAQ (part 1)") {
+		t.Fatalf("unexpected excerpts: %q", excerpts)
+	}
+
+	stored, err := repo.GetMessageByID(ctx, 15, replyID)
+	if err != nil {
+		t.Fatalf("get reply: %v", err)
+	}
+	cs := stored.Citations
+	if len(cs) != 2 || cs[0].Index != 1 || cs[1].Index != 2 || cs[0].DocumentID != 7 || cs[0].Chunk != 2 ||
+		cs[0].Content != "" {
+		t.Fatalf("expected numbered citations stored without excerpt text, got %+v", cs)
+	}
+
+	// retrieval failures do not block the reply
+	retriever.err = errors.New("embedder down")
+	if _, replyID, err = svc.SendMessage(ctx, 15, sess.SessionID, "And exchanges?"); err != nil {
+		t.Fatalf("send message with failing retriever: %v", err)
+	}
+	if stored, err = repo.GetMessageByID(ctx, 15, replyID); err != nil {
+		t.Fatalf("get reply: %v", err)
+	}
+	if len(stored.Citations) != 0 || prov.last[0].Role != ai.RoleUser {
+		t.Fatalf("expected a plain reply, got citations %+v and %+v", stored.Citations, prov.last[0])
+	}
+}
+
+func TestExportImport_RoundTripsFormats(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewRepo(db)
+
+	prov := &recordingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+	ctx := context.Background()
+
+	sess := &Session{
+		SessionID:          "01TESTSESSIONID00000000000011",
+		UserID:             16,
+		Provider:           "fake",
+		Model:              "m",
+		Title:              "export me",
+		GenerationSettings: GenerationSettings{SystemPrompt: "Be brief."},
+	}
+	if err := repo.CreateSession(ctx, sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if _, _, err := svc.SendMessage(ctx, 16, sess.SessionID, "first question"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	userMsg, _, err := svc.EditMessage(ctx, 16, firstUserMessageID(t, repo, sess.SessionID), "## user · 2020-01-01T00:00:00Z\nedited question")
+	if err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+
+	exp, err := svc.ExportSession(ctx, 16, sess.SessionID)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if len(exp.Messages) != 4 {
+		t.Fatalf("expected both branches in the export, got %d messages", len(exp.Messages))
+	}
+	if _, err := svc.ExportSession(ctx, 17, sess.SessionID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected not found for another user, got %v", err)
+	}
+
+	for _, format := range []string{ExportJSON, ExportMarkdown, ExportOpenAI} {
+		var buf strings.Builder
+		if err := exp.Write(&buf, format); err != nil {
+			t.Fatalf("%s: write: %v", format, err)
+		}
+		imported, err := svc.ImportSessions(ctx, 18, format, strings.NewReader(buf.String()))
+		if err != nil {
+			t.Fatalf("%s: import: %v", format, err)
+		}
+		if len(imported) != 1 || imported[0].SessionID == sess.SessionID || imported[0].SystemPrompt != "Be brief." {
+			t.Fatalf("%s: unexpected import %+v", format, imported)
+		}
+
+		branch, err := repo.ListActiveBranchDesc(ctx, 18, imported[0].SessionID, 10)
+		if err != nil {
+			t.Fatalf("%s: list: %v", format, err)
+		}
+		if len(branch) != 2 || branch[1].Role != RoleUser || branch[1].Content != userMsg.Content ||
+			branch[0].Role != RoleAssistant || branch[0].Content != "ok" {
+			t.Fatalf("%s: unexpected active branch %+v", format, branch)
+		}
+		if format != ExportOpenAI && !branch[1].CreatedAt.Equal(userMsg.CreatedAt.Truncate(time.Second)) &&
+			!branch[1].CreatedAt.Equal(userMsg.CreatedAt) {
+			t.Fatalf("%s: timestamp not preserved: %v vs %v", format, branch[1].CreatedAt, userMsg.CreatedAt)
+		}
+		if format == ExportJSON && imported[0].Messages != 4 {
+			t.Fatalf("json import should keep the other branch, got %d messages", imported[0].Messages)
+		}
+	}
+
+	// imported replies don't count as usage of the importing user
+	usage, err := repo.SumUsage(ctx, 18, "", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("sum usage: %v", err)
+	}
+	for _, u := range usage {
+		if u.Model != "" || u.PromptTokens != 0 || u.CompletionTokens != 0 {
+			t.Fatalf("imported usage counted: %+v", u)
+		}
+	}
+
+	if _, err := svc.ImportSessions(ctx, 18, ExportJSON, strings.NewReader(`{"messages":[{"role":"wizard","content":"hi"}]}`)); !errors.Is(err, ErrInvalidImport) {
+		t.Fatalf("expected ErrInvalidImport, got %v", err)
+	}
+}
+
+func firstUserMessageID(t *testing.T, repo *Repo, sessionID string) uint64 {
+	t.Helper()
+	var m Message
+	if err := repo.db.Where("session_id = ? AND role = ?", sessionID, RoleUser).Order("id ASC").First(&m).Error; err != nil {
+		t.Fatalf("first user message: %v", err)
+	}
+	return m.ID
+}
+
+func TestShare_SnapshotRevokeAndExpiry(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&Share{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+
+	prov := &recordingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+	ctx := context.Background()
+
+	sess := &Session{SessionID: "01TESTSESSIONID00000000000012", UserID: 19, Provider: "fake", Model: "m", Title: "shared"}
+	if err := repo.CreateSession(ctx, sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if _, _, err := svc.CreateShare(ctx, 19, sess.SessionID, 0); !errors.Is(err, ErrNothingToShare) {
+		t.Fatalf("expected ErrNothingToShare, got %v", err)
+	}
+	if _, _, err := svc.SendMessage(ctx, 19, sess.SessionID, "what is a goroutine?"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if _, _, err := svc.CreateShare(ctx, 20, sess.SessionID, 0); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected not found for another user, got %v", err)
+	}
+
+	sh, token, err := svc.CreateShare(ctx, 19, sess.SessionID, 0)
+	if err != nil {
+		t.Fatalf("create share: %v", err)
+	}
+	if len(token) <= len(sh.ID) || !strings.HasPrefix(token, sh.ID) || sh.TokenHash == token {
+		t.Fatalf("unexpected token %q for share %q", token, sh.ID)
+	}
+
+	// messages after sharing are not part of the snapshot
+	if _, _, err := svc.SendMessage(ctx, 19, sess.SessionID, "private follow-up"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	shared, err := svc.GetSharedSession(ctx, token)
+	if err != nil {
+		t.Fatalf("get shared: %v", err)
+	}
+	if shared.Title != "shared" || len(shared.Messages) != 2 ||
+		shared.Messages[0].Content != "what is a goroutine?" || shared.Messages[1].Role != RoleAssistant {
+		t.Fatalf("unexpected snapshot %+v", shared)
+	}
+	if _, err := svc.GetSharedSession(ctx, sh.ID); !errors.Is(err, ErrShareNotFound) {
+		t.Fatalf("the share id alone must not resolve, got %v", err)
+	}
+
+	expiring, expToken, err := svc.CreateShare(ctx, 19, sess.SessionID, time.Hour)
+	if err != nil {
+		t.Fatalf("create expiring share: %v", err)
+	}
+	shares, err := svc.ListShares(ctx, 19, sess.SessionID)
+	if err != nil || len(shares) != 2 {
+		t.Fatalf("expected 2 active shares, got %d (%v)", len(shares), err)
+	}
+	past := time.Now().Add(-time.Minute)
+	if err := db.Model(&Share{}).Where("id = ?", expiring.ID).Update("expires_at", past).Error; err != nil {
+		t.Fatalf("expire share: %v", err)
+	}
+	if _, err := svc.GetSharedSession(ctx, expToken); !errors.Is(err, ErrShareNotFound) {
+		t.Fatalf("expected expired share to be gone, got %v", err)
+	}
+
+	if err := svc.RevokeShare(ctx, 20, sh.ID); !errors.Is(err, ErrShareNotFound) {
+		t.Fatalf("expected another user's revoke to fail, got %v", err)
+	}
+	if err := svc.RevokeShare(ctx, 19, sh.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := svc.GetSharedSession(ctx, token); !errors.Is(err, ErrShareNotFound) {
+		t.Fatalf("expected revoked share to be gone, got %v", err)
+	}
+	if shares, _ := svc.ListShares(ctx, 19, ""); len(shares) != 0 {
+		t.Fatalf("expected no active shares, got %+v", shares)
+	}
+}
+
+type memJobEvents struct {
+	mu   sync.Mutex
+	subs map[string][]chan string
+}
+
+func (b *memJobEvents) PublishJobEvent(ctx context.Context, jobID string, payload string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs[jobID] {
+		select {
+		case ch <- payload:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *memJobEvents) SubscribeJobEvents(ctx context.Context, jobID string) (<-chan string, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = map[string][]chan string{}
+	}
+	ch := make(chan string, 64)
+	b.subs[jobID] = append(b.subs[jobID], ch)
+	return ch, func() {}, nil
+}
+
+// blockingProvider streams one chunk, then hangs until the call is cancelled and stops
+// without an error, like the HTTP providers do.
+type blockingProvider struct {
+	recordingProvider
+}
+
+func (p *blockingProvider) StreamChat(ctx context.Context, messages []ai.Message) (<-chan ai.StreamChunk, <-chan error) {
+	out := make(chan ai.StreamChunk, 1)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(out)
+		defer close(errs)
+		out <- ai.StreamChunk{Delta: "partial"}
+		<-ctx.Done()
+	}()
+	return out, errs
+}
+
+func TestJobs_CancelQueuedAndRunning(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&Job{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+
+	prov := &blockingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+	bus := &memJobEvents{}
+	svc.SetJobEvents(bus)
+	ctx := context.Background()
+
+	sess := &Session{SessionID: "01TESTSESSIONID00000000000013", UserID: 21, Provider: "fake", Model: "m", Title: "t"}
+	if err := repo.CreateSession(ctx, sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if err := svc.InsertUserMessage(ctx, 21, sess.SessionID, "write a long story"); err != nil {
+		t.Fatalf("insert user message: %v", err)
+	}
+
+	// a queued job is never started once cancelled
+	queued := &Job{ID: "01TESTJOB0000000000000000Q1", UserID: 21, SessionID: sess.SessionID, Prompt: "p", Status: JobQueued}
+	if err := svc.CreateJob(ctx, queued); err != nil {
+		t.Fatalf("create job: %v", err)
+	}
+	if _, err := svc.CancelJob(ctx, 22, queued.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected not found for another user, got %v", err)
+	}
+	if j, err := svc.CancelJob(ctx, 21, queued.ID); err != nil || j.Status != JobCancelled {
+		t.Fatalf("cancel queued: job=%+v err=%v", j, err)
+	}
+	if j, err := svc.StartJob(ctx, queued.ID); err != nil || j.Status != JobCancelled {
+		t.Fatalf("cancelled job must not start: job=%+v err=%v", j, err)
+	}
+
+	// a running job cancelled mid-reply stops generating and its partial reply is dropped
+	running := &Job{ID: "01TESTJOB0000000000000000R1", UserID: 21, SessionID: sess.SessionID, Prompt: "p", Status: JobQueued}
+	if err := svc.CreateJob(ctx, running); err != nil {
+		t.Fatalf("create job: %v", err)
+	}
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	events, err := svc.WatchJob(watchCtx, 21, running.ID)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	j, err := svc.StartJob(ctx, running.ID)
+	if err != nil || j.Status != JobRunning {
+		t.Fatalf("start: job=%+v err=%v", j, err)
+	}
+
+	res := make(chan error, 1)
+	go func() {
+		_, err := svc.RunJob(ctx, j)
+		res <- err
+	}()
+
+	var seen []string
+	record := func(ev JobEvent) {
+		if ev.Type == JobEventChunk {
+			seen = append(seen, "chunk:"+ev.Delta)
+		} else {
+			seen = append(seen, string(ev.Status))
+		}
+	}
+	// cancel once the first chunk is out
+	for ev := range events {
+		record(ev)
+		if ev.Type == JobEventChunk {
+			break
+		}
+	}
+	if _, err := svc.CancelJob(ctx, 21, running.ID); err != nil {
+		t.Fatalf("cancel running: %v", err)
+	}
+	select {
+	case err := <-res:
+		if !errors.Is(err, ErrJobCancelled) {
+			t.Fatalf("expected ErrJobCancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("job kept running after cancel")
+	}
+	if err := svc.FailJob(ctx, running.ID, "late failure"); err != nil {
+		t.Fatalf("fail job: %v", err)
+	}
+	if got, _ := svc.GetJob(ctx, running.ID); got.Status != JobCancelled {
+		t.Fatalf("cancel must win, got status %q", got.Status)
+	}
+	if _, err := svc.CancelJob(ctx, 21, running.ID); err != nil {
+		t.Fatalf("cancelling twice should be a no-op, got %v", err)
+	}
+
+	var n int64
+	db.Model(&Message{}).Where("session_id = ? AND role = ?", sess.SessionID, RoleAssistant).Count(&n)
+	if n != 0 {
+		t.Fatalf("expected the partial reply dropped, got %d assistant messages", n)
+	}
+
+	for ev := range events {
+		record(ev)
+	}
+	if strings.Join(seen, ",") != "queued,running,chunk:partial,cancelled" {
+		t.Fatalf("unexpected events %v", seen)
+	}
+}
+
+func TestWebhooks_SignedDeliveryRetryAndRedeliver(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&Job{}, &WebhookDelivery{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+
+	var mu sync.Mutex
+	var calls int
+	var got []byte
+	secret := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if r.Header.Get("X-Webhook-Signature") != SignWebhook(secret, ts, body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		if calls == 1 {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		got = body
+	}))
+	defer srv.Close()
+
+	prov := &recordingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+	if err := svc.ValidateCallbackURL(srv.URL); !errors.Is(err, ErrWebhooksDisabled) {
+		t.Fatalf("expected ErrWebhooksDisabled, got %v", err)
+	}
+	svc.SetWebhooks("s3cret", true)
+	secret, _ = svc.WebhookSecret(23)
+	if other, _ := svc.WebhookSecret(24); other == secret {
+		t.Fatalf("users must not share a signing key")
+	}
+	if err := svc.ValidateCallbackURL("ftp://example.com/hook"); !errors.Is(err, ErrInvalidCallbackURL) {
+		t.Fatalf("expected ErrInvalidCallbackURL, got %v", err)
+	}
+	ctx := context.Background()
+
+	sess := &Session{SessionID: "01TESTSESSIONID00000000000014", UserID: 23, Provider: "fake", Model: "m", Title: "t"}
+	if err := repo.CreateSession(ctx, sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if err := svc.InsertUserMessage(ctx, 23, sess.SessionID, "hello"); err != nil {
+		t.Fatalf("insert user message: %v", err)
+	}
+	url := srv.URL + "/hook"
+	job := &Job{ID: "01TESTJOB0000000000000000W1", UserID: 23, SessionID: sess.SessionID, Prompt: "hello", CallbackURL: &url, Status: JobQueued}
+	if err := svc.CreateJob(ctx, job); err != nil {
+		t.Fatalf("create job: %v", err)
+	}
+	j, err := svc.StartJob(ctx, job.ID)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	msgID, err := svc.RunJob(ctx, j)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if err := svc.FinishJob(ctx, job.ID, msgID); err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+
+	// the first attempt is made right away and is refused
+	var d WebhookDelivery
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := db.Where("job_id = ?", job.ID).First(&d).Error; err == nil && d.LastStatusCode != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first attempt not recorded: %+v", d)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d.Status != WebhookPending || d.Attempts != 1 || d.LastStatusCode != http.StatusServiceUnavailable || !d.NextAttemptAt.After(time.Now()) {
+		t.Fatalf("unexpected delivery after refusal: %+v", d)
+	}
+
+	// nothing is due until the backoff is over
+	if n, err := svc.DeliverDueWebhooks(ctx); err != nil || n != 0 {
+		t.Fatalf("expected nothing due, got n=%d err=%v", n, err)
+	}
+	db.Model(&WebhookDelivery{}).Where("id = ?", d.ID).Update("next_attempt_at", time.Now().Add(-time.Second))
+	if n, err := svc.DeliverDueWebhooks(ctx); err != nil || n != 1 {
+		t.Fatalf("expected one delivery, got n=%d err=%v", n, err)
+	}
+
+	var p struct {
+		Event string `json:"event"`
+		Job   struct {
+			ID              string  `json:"id"`
+			Status          string  `json:"status"`
+			ResultMessageID *uint64 `json:"result_message_id"`
+		} `json:"job"`
+		Reply string `json:"reply"`
+	}
+	mu.Lock()
+	err = json.Unmarshal(got, &p)
+	mu.Unlock()
+	if err != nil || p.Event != WebhookJobSucceeded || p.Job.ID != job.ID || p.Job.Status != "succeeded" ||
+		p.Job.ResultMessageID == nil || *p.Job.ResultMessageID != msgID || p.Reply != "ok" {
+		t.Fatalf("unexpected payload %s (err=%v)", got, err)
+	}
+
+	if _, err := svc.RedeliverWebhook(ctx, 24, d.ID); !errors.Is(err, ErrDeliveryNotFound) {
+		t.Fatalf("expected ErrDeliveryNotFound for another user, got %v", err)
+	}
+	re, err := svc.RedeliverWebhook(ctx, 23, d.ID)
+	if err != nil || re.Status != WebhookPending || re.Attempts != 0 {
+		t.Fatalf("redeliver: %+v err=%v", re, err)
+	}
+	if _, err := svc.RedeliverWebhook(ctx, 23, d.ID); !errors.Is(err, ErrDeliveryPending) {
+		t.Fatalf("expected ErrDeliveryPending, got %v", err)
+	}
+	list, err := svc.ListWebhookDeliveries(ctx, 23, WebhookPending, 0, 0)
+	if err != nil || len(list) != 1 || list[0].ID != d.ID {
+		t.Fatalf("list pending: %+v err=%v", list, err)
+	}
+}
+
+type flakyPublisher struct {
+	mu        sync.Mutex
+	fail      bool
+	published []string
+}
+
+func (p *flakyPublisher) PublishJob(ctx context.Context, jobID string, userID uint64, priority uint8) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, jobID)
+	return nil
+}
+
+func TestOutbox_EnqueueRelayAndSweepStuckJobs(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&Job{}, &OutboxMessage{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return &recordingProvider{}, nil
+	})
+	svc := NewService(repo, reg, 10)
+	pub := &flakyPublisher{fail: true}
+	svc.SetJobPublisher(pub)
+	ctx := context.Background()
+
+	sess := &Session{SessionID: "01TESTSESSIONID00000000000015", UserID: 25, Provider: "fake", Model: "m", Title: "t"}
+	if err := repo.CreateSession(ctx, sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	outbox := func() []OutboxMessage {
+		var rows []OutboxMessage
+		if err := db.Where("session_id = ?", sess.SessionID).Find(&rows).Error; err != nil {
+			t.Fatalf("list outbox: %v", err)
+		}
+		return rows
+	}
+
+	// the broker is down: the job is stored and stays in the outbox
+	key := "outbox-key"
+	job := &Job{ID: "01TESTJOB0000000000000000O1", UserID: 25, SessionID: sess.SessionID, Prompt: "hello", IdempotencyKey: &key, Status: JobQueued}
+	j, created, err := svc.EnqueueJob(ctx, job)
+	if err != nil || !created || j.ID != job.ID {
+		t.Fatalf("enqueue: job=%+v created=%v err=%v", j, created, err)
+	}
+	rows := outbox()
+	if len(rows) != 1 || rows[0].JobID != job.ID || rows[0].Attempts != 1 || rows[0].LastError == nil {
+		t.Fatalf("expected one failed outbox entry, got %+v", rows)
+	}
+
+	// a retried request gets the same job and stores nothing new
+	again := &Job{ID: "01TESTJOB0000000000000000O2", UserID: 25, SessionID: sess.SessionID, Prompt: "hello", IdempotencyKey: &key, Status: JobQueued}
+	j, created, err = svc.EnqueueJob(ctx, again)
+	if err != nil || created || j.ID != job.ID {
+		t.Fatalf("idempotent enqueue: job=%+v created=%v err=%v", j, created, err)
+	}
+	msgs, err := repo.ListMessages(ctx, 25, sess.SessionID, 10, 0)
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "hello" {
+		t.Fatalf("expected one user message, got %+v err=%v", msgs, err)
+	}
+	if len(outbox()) != 1 {
+		t.Fatalf("expected a single outbox entry")
+	}
+
+	// nothing is due before the backoff ends
+	pub.fail = false
+	if n, err := svc.RelayOutbox(ctx); err != nil || n != 0 {
+		t.Fatalf("relay before backoff: n=%d err=%v", n, err)
+	}
+	if err := repo.UpdateOutboxMessage(ctx, rows[0].ID, map[string]any{"next_attempt_at": time.Now().Add(-time.Second)}); err != nil {
+		t.Fatalf("update outbox: %v", err)
+	}
+	if n, err := svc.RelayOutbox(ctx); err != nil || n != 1 {
+		t.Fatalf("relay: n=%d err=%v", n, err)
+	}
+	if len(outbox()) != 0 || len(pub.published) != 1 || pub.published[0] != job.ID {
+		t.Fatalf("expected job published and outbox emptied, published=%v", pub.published)
+	}
+
+	// a duplicate delivery must not run the job twice
+	if _, err := svc.StartJob(ctx, job.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if _, err := svc.StartJob(ctx, job.ID); !errors.Is(err, ErrJobTaken) {
+		t.Fatalf("expected ErrJobTaken, got %v", err)
+	}
+
+	// a long job whose worker is alive is left alone
+	cutoff := time.Now().Add(-10 * time.Minute)
+	if err := db.Model(&Job{}).Where("id = ?", job.ID).UpdateColumn("updated_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatalf("age job: %v", err)
+	}
+	if n, err := svc.SweepStuckJobs(ctx, cutoff, cutoff); err != nil || n != 0 {
+		t.Fatalf("job with a fresh heartbeat swept: n=%d err=%v", n, err)
+	}
+
+	// its worker died: the sweeper requeues it once
+	if err := db.Model(&Job{}).Where("id = ?", job.ID).UpdateColumn("heartbeat_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatalf("age heartbeat: %v", err)
+	}
+	if n, err := svc.SweepStuckJobs(ctx, cutoff, time.Time{}); err != nil || n != 0 {
+		t.Fatalf("running check disabled: n=%d err=%v", n, err)
+	}
+	if n, err := svc.SweepStuckJobs(ctx, cutoff, cutoff); err != nil || n != 1 {
+		t.Fatalf("sweep: n=%d err=%v", n, err)
+	}
+	j, err = repo.GetJobByID(ctx, job.ID)
+	if err != nil || j.Status != JobQueued || j.RequeuedAt == nil || j.HeartbeatAt != nil || !j.UpdatedAt.After(cutoff) {
+		t.Fatalf("expected job requeued, got %+v err=%v", j, err)
+	}
+	if n, err := svc.SweepStuckJobs(ctx, time.Now().Add(time.Minute), cutoff); err != nil || n != 0 {
+		t.Fatalf("a job waiting in the outbox is not swept again: n=%d err=%v", n, err)
+	}
+	if n, err := svc.RelayOutbox(ctx); err != nil || n != 1 || len(pub.published) != 2 {
+		t.Fatalf("relay requeued: n=%d published=%v err=%v", n, pub.published, err)
+	}
+
+	// published again but not delivered yet: a job requeued after the cutoff is not swept
+	if err := db.Model(&Job{}).Where("id = ?", job.ID).UpdateColumn("updated_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatalf("age job: %v", err)
+	}
+	if n, err := svc.SweepStuckJobs(ctx, cutoff, cutoff); err != nil || n != 0 {
+		t.Fatalf("recently requeued job swept: n=%d err=%v", n, err)
+	}
+	if j, err := svc.StartJob(ctx, job.ID); err != nil || j.Status != JobRunning {
+		t.Fatalf("restart: job=%+v err=%v", j, err)
+	}
+}
+
+func TestJob_RepliesToItsOwnMessage(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&Job{}, &OutboxMessage{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return &recordingProvider{}, nil
+	})
+	svc := NewService(repo, reg, 10)
+	svc.SetJobPublisher(&flakyPublisher{})
+	ctx := context.Background()
+
+	sess := &Session{SessionID: "01TESTSESSIONID00000000000018", UserID: 28, Provider: "fake", Model: "m", Title: "t"}
+	if err := repo.CreateSession(ctx, sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	job := &Job{ID: "01TESTJOB0000000000000000P1", UserID: 28, SessionID: sess.SessionID, Prompt: "first", Status: JobQueued}
+	if _, _, err := svc.EnqueueJob(ctx, job); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if job.MessageID == nil {
+		t.Fatalf("expected the job to record its user message")
+	}
+
+	// another message is sent before the worker picks the job up
+	if err := svc.InsertUserMessage(ctx, 28, sess.SessionID, "second"); err != nil {
+		t.Fatalf("insert user message: %v", err)
+	}
+	j, err := svc.StartJob(ctx, job.ID)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	msgID, err := svc.RunJob(ctx, j)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	reply, err := repo.GetMessageByID(ctx, 28, msgID)
+	if err != nil || reply.ParentID == nil || *reply.ParentID != *job.MessageID {
+		t.Fatalf("expected the reply under message %d, got %+v err=%v", *job.MessageID, reply, err)
+	}
+}
+
+func TestJobPriority_FollowsPlan(t *testing.T) {
+	cases := []struct {
+		plan, requested string
+		want            uint8
+		err             error
+	}{
+		{"free", "", JobPriorityNormal, nil},
+		{"", "low", JobPriorityLow, nil},
+		{"free", "high", 0, ErrJobPriorityNotAllowed},
+		{"pro", "", JobPriorityHigh, nil},
+		{"pro", "normal", JobPriorityNormal, nil},
+		{"pro", "urgent", 0, ErrInvalidJobPriority},
+	}
+	for _, tc := range cases {
+		got, err := JobPriority(tc.plan, tc.requested)
+		if got != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("JobPriority(%q, %q) = %d, %v; want %d, %v", tc.plan, tc.requested, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestAttachments_SentWithFollowUps(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&Attachment{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+	prov := &recordingProvider{}
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return prov, nil
+	})
+	svc := NewService(repo, reg, 20)
+	ctx := context.Background()
+
+	sess := &Session{SessionID: "01TESTSESSIONID00000000000016", UserID: 26, Provider: "fake", Model: "m", Title: "t"}
+	if err := repo.CreateSession(ctx, sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+
+	if _, err := svc.UploadAttachment(ctx, 26, sess.SessionID, img.Bytes()); !errors.Is(err, ErrAttachmentsDisabled) {
+		t.Fatalf("expected ErrAttachmentsDisabled, got %v", err)
+	}
+	store, err := blob.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("local store: %v", err)
+	}
+	svc.SetAttachmentStore(store)
+
+	if _, err := svc.UploadAttachment(ctx, 26, sess.SessionID, []byte("not an image")); !errors.Is(err, ErrUnsupportedImage) {
+		t.Fatalf("expected ErrUnsupportedImage, got %v", err)
+	}
+	if _, err := svc.UploadAttachment(ctx, 27, sess.SessionID, img.Bytes()); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected not found for another user, got %v", err)
+	}
+	a, err := svc.UploadAttachment(ctx, 26, sess.SessionID, img.Bytes())
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if a.MimeType != "image/png" || a.Width != 3 || a.Height != 2 || a.MessageID != nil {
+		t.Fatalf("unexpected attachment %+v", a)
+	}
+
+	if _, _, err := svc.SendMessage(ctx, 26, sess.SessionID, "what is this?", a.ID); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	last := prov.last[len(prov.last)-1]
+	if imgs := last.Images(); len(imgs) != 1 || imgs[0].MimeType != "image/png" || !bytes.Equal(imgs[0].Data, img.Bytes()) {
+		t.Fatalf("image not sent with the message: %+v", last)
+	}
+
+	// follow-ups carry the image along in the history
+	if _, _, err := svc.SendMessage(ctx, 26, sess.SessionID, "what color is it?"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(prov.last) != 3 || len(prov.last[0].Images()) != 1 || len(prov.last[2].Images()) != 0 {
+		t.Fatalf("unexpected follow-up context %+v", prov.last)
+	}
+
+	// an attachment belongs to one message; nothing is stored when linking fails
+	if _, _, err := svc.SendMessage(ctx, 26, sess.SessionID, "again", a.ID); !errors.Is(err, ErrAttachmentNotFound) {
+		t.Fatalf("expected ErrAttachmentNotFound, got %v", err)
+	}
+	msgs, err := svc.ListMessages(ctx, 26, sess.SessionID, 10, 0)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(msgs))
+	}
+	first := msgs[len(msgs)-1]
+	if first.Content != "what is this?" || len(first.Attachments) != 1 || first.Attachments[0].ID != a.ID {
+		t.Fatalf("attachment not listed with its message: %+v", first)
+	}
+
+	// an edited message keeps the original's image
+	edited, _, err := svc.EditMessage(ctx, 26, first.ID, "what is in this picture?")
+	if err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if len(edited.Attachments) != 1 || edited.Attachments[0].ID == a.ID || edited.Attachments[0].StorageKey != a.StorageKey {
+		t.Fatalf("attachment not carried over: %+v", edited.Attachments)
+	}
+	last = prov.last[len(prov.last)-1]
+	if imgs := last.Images(); last.Content != "what is in this picture?" || len(imgs) != 1 || !bytes.Equal(imgs[0].Data, img.Bytes()) {
+		t.Fatalf("image not sent with the edited message: %+v", last)
+	}
+
+	if err := svc.DeleteSession(ctx, 26, sess.SessionID); err != nil {
+		t.Fatalf("delete session: %v", err)
+	}
+	if _, err := store.Get(ctx, a.StorageKey); !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("expected image deleted with the session, got %v", err)
+	}
+}
+
+func TestAttachments_PendingCapAndSweep(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&Attachment{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	repo := NewRepo(db)
+	reg := ai.NewRegistry()
+	reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+		return &recordingProvider{}, nil
+	})
+	svc := NewService(repo, reg, 20)
+	ctx := context.Background()
+	store, err := blob.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("local store: %v", err)
+	}
+	svc.SetAttachmentStore(store)
+
+	sess := &Session{SessionID: "01TESTSESSIONID00000000000019", UserID: 29, Provider: "fake", Model: "m", Title: "t"}
+	if err := repo.CreateSession(ctx, sess); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+
+	var uploads []*Attachment
+	for i := 0; i < maxPendingAttachments; i++ {
+		a, err := svc.UploadAttachment(ctx, 29, sess.SessionID, img.Bytes())
+		if err != nil {
+			t.Fatalf("upload %d: %v", i, err)
+		}
+		uploads = append(uploads, a)
+	}
+	if _, err := svc.UploadAttachment(ctx, 29, sess.SessionID, img.Bytes()); !errors.Is(err, ErrTooManyPendingAttachments) {
+		t.Fatalf("expected ErrTooManyPendingAttachments, got %v", err)
+	}
+
+	// sending one frees its slot
+	sent := uploads[0]
+	if _, _, err := svc.SendMessage(ctx, 29, sess.SessionID, "look", sent.ID); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if _, err := svc.UploadAttachment(ctx, 29, sess.SessionID, img.Bytes()); err != nil {
+		t.Fatalf("upload after sending: %v", err)
+	}
+
+	// the sweep removes old unattached uploads only, rows and images
+	old := time.Now().Add(-48 * time.Hour)
+	if err := db.Model(&Attachment{}).Where("user_id = ?", 29).UpdateColumn("created_at", old).Error; err != nil {
+		t.Fatalf("age uploads: %v", err)
+	}
+	fresh, err := svc.UploadAttachment(ctx, 29, sess.SessionID, img.Bytes())
+	if !errors.Is(err, ErrTooManyPendingAttachments) || fresh != nil {
+		t.Fatalf("expected the cap to hold before the sweep, got %+v %v", fresh, err)
+	}
+	n, err := svc.SweepUnattachedAttachments(ctx, time.Now().Add(-24*time.Hour))
+	if err != nil || n != maxPendingAttachments {
+		t.Fatalf("sweep: n=%d err=%v", n, err)
+	}
+	var left []Attachment
+	if err := db.Where("user_id = ?", 29).Find(&left).Error; err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(left) != 1 || left[0].ID != sent.ID {
+		t.Fatalf("expected only the sent attachment left, got %+v", left)
+	}
+	if _, err := store.Get(ctx, sent.StorageKey); err != nil {
+		t.Fatalf("sent image removed: %v", err)
+	}
+	if _, err := store.Get(ctx, uploads[1].StorageKey); !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("expected swept image deleted, got %v", err)
+	}
+	if n, err := svc.SweepUnattachedAttachments(ctx, time.Now().Add(-24*time.Hour)); err != nil || n != 0 {
+		t.Fatalf("second sweep: n=%d err=%v", n, err)
+	}
+}
+
+func TestTruncateBytes(t *testing.T) {
+	cases := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 3, "hel"},
+		{"héllo", 2, "h"}, // é is 2 bytes: not split
+		{"héllo", 3, "hé"},
+		{"日本", 4, "日"},
+		{"日本", 2, ""},
+	}
+	for _, tc := range cases {
+		got := truncateBytes(tc.in, tc.n)
+		if got != tc.want || !utf8.ValidString(got) {
+			t.Fatalf("truncateBytes(%q, %d) = %q, want %q", tc.in, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestToProviderMessages_DropsOrphanToolResults(t *testing.T) {
+	// DESC, as loaded: an orphan result first in the window, a matched round, and an
+	// orphan in the middle whose call row was lost
+	desc := []Message{
+		{Role: RoleAssistant, Content: "done"},
+		{Role: RoleToolResult, Content: "lost", ToolCallID: "call_9", ToolName: "clock"},
+		{Role: RoleToolResult, Content: "12:00", ToolCallID: "call_1", ToolName: "clock"},
+		{Role: RoleToolCall, ToolCalls: `[{"id":"call_1","name":"clock","arguments":"{}"}]`},
+		{Role: RoleUser, Content: "time?"},
+		{Role: RoleToolResult, Content: "cut off", ToolCallID: "call_0", ToolName: "clock"},
+	}
+	got := toProviderMessages(desc)
+	if len(got) != 4 || got[0].Role != ai.RoleUser || len(got[1].ToolCalls) != 1 ||
+		got[2].Role != ai.RoleTool || got[2].ToolCallID != "call_1" || got[3].Content != "done" {
+		t.Fatalf("unexpected messages: %+v", got)
+	}
+}
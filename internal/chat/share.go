@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrShareNotFound is returned for unknown, revoked and expired share links alike.
+	ErrShareNotFound = errors.New("share not found")
+	// ErrNothingToShare is returned when sharing a session without messages.
+	ErrNothingToShare = errors.New("session has no messages to share")
+	// ErrInvalidShare is returned for out-of-range expiries and when the share limit is hit.
+	ErrInvalidShare = errors.New("invalid share")
+)
+
+// MaxShareTTL is the longest expiry a share link can be given.
+const MaxShareTTL = 365 * 24 * time.Hour
+
+const (
+	maxActiveSharesPerUser = 100
+	// messages returned for a shared branch
+	maxSharedMessages = 1000
+)
+
+// SharedSession is the public view of a share: titles and turn texts only, no ids, tool
+// payloads, settings or usage.
+type SharedSession struct {
+	Title     string          `json:"title"`
+	Model     string          `json:"model"`
+	SharedAt  time.Time       `json:"shared_at"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+	Messages  []SharedMessage `json:"messages"`
+}
+
+type SharedMessage struct {
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateShare creates a link to the session's active branch as it is now; later messages
+// are not shared. ttl 0 means the link does not expire. The token is only returned here.
+func (s *Service) CreateShare(ctx context.Context, userID uint64, sessionID string, ttl time.Duration) (*Share, string, error) {
+	if ttl < 0 || ttl > MaxShareTTL {
+		return nil, "", fmt.Errorf("%w: expiry must be within %d days", ErrInvalidShare, int(MaxShareTTL.Hours()/24))
+	}
+	if err := s.ValidateSessionOwner(ctx, userID, sessionID); err != nil {
+		return nil, "", err
+	}
+	if err := s.repo.LinkLegacyMessages(ctx, userID, sessionID); err != nil {
+		return nil, "", err
+	}
+	sess, err := s.repo.GetSessionBySessionID(ctx, sessionID)
+	if err != nil {
+		return nil, "", err
+	}
+	if sess.ActiveLeafID == nil {
+		return nil, "", ErrNothingToShare
+	}
+
+	now := time.Now()
+	n, err := s.repo.CountActiveShares(ctx, userID, now)
+	if err != nil {
+		return nil, "", err
+	}
+	if n >= maxActiveSharesPerUser {
+		return nil, "", fmt.Errorf("%w: at most %d active shares", ErrInvalidShare, maxActiveSharesPerUser)
+	}
+
+	id, token, err := NewShareToken()
+	if err != nil {
+		return nil, "", err
+	}
+	sh := &Share{
+		ID:        id,
+		UserID:    userID,
+		SessionID: sessionID,
+		TokenHash: hashShareToken(token),
+		LeafID:    *sess.ActiveLeafID,
+	}
+	if ttl > 0 {
+		exp := now.Add(ttl)
+		sh.ExpiresAt = &exp
+	}
+	if err := s.repo.CreateShare(ctx, sh); err != nil {
+		return nil, "", err
+	}
+	return sh, token, nil
+}
+
+// ListShares returns the user's unrevoked, unexpired shares, newest first, optionally only
+// those of one session.
+func (s *Service) ListShares(ctx context.Context, userID uint64, sessionID string) ([]Share, error) {
+	return s.repo.ListActiveShares(ctx, userID, sessionID, time.Now())
+}
+
+func (s *Service) RevokeShare(ctx context.Context, userID uint64, shareID string) error {
+	n, err := s.repo.RevokeShare(ctx, userID, shareID, time.Now())
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+// GetSharedSession resolves a share token to the shared branch, oldest first.
+func (s *Service) GetSharedSession(ctx context.Context, token string) (*SharedSession, error) {
+	sh, err := s.repo.GetShareByTokenHash(ctx, hashShareToken(token))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
+	if sh.RevokedAt != nil || (sh.ExpiresAt != nil && !time.Now().Before(*sh.ExpiresAt)) {
+		return nil, ErrShareNotFound
+	}
+	sess, err := s.repo.GetSessionBySessionID(ctx, sh.SessionID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
+	if sess.UserID != sh.UserID {
+		return nil, ErrShareNotFound
+	}
+
+	branchDesc, err := s.repo.ListBranchDesc(ctx, sh.UserID, sh.SessionID, sh.LeafID, maxSharedMessages)
+	if err != nil {
+		return nil, err
+	}
+	out := &SharedSession{
+		Title:     sess.Title,
+		Model:     sess.Model,
+		SharedAt:  sh.CreatedAt,
+		ExpiresAt: sh.ExpiresAt,
+		Messages:  []SharedMessage{},
+	}
+	for i := len(branchDesc) - 1; i >= 0; i-- {
+		m := branchDesc[i]
+		if (m.Role != RoleUser && m.Role != RoleAssistant) || m.Content == "" {
+			continue
+		}
+		out.Messages = append(out.Messages, SharedMessage{Role: m.Role, Content: m.Content, CreatedAt: m.CreatedAt})
+	}
+	return out, nil
+}
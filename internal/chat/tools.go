@@ -0,0 +1,234 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+)
+
+// ToolFunc executes a tool call on behalf of userID. args is the raw JSON object from the model.
+type ToolFunc func(ctx context.Context, userID uint64, args json.RawMessage) (string, error)
+
+// ToolRegistry holds the server-side tools offered to models that support tool calling.
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	defs  []ai.Tool
+	funcs map[string]ToolFunc
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{funcs: make(map[string]ToolFunc)}
+}
+
+// Register adds or replaces a tool.
+func (r *ToolRegistry) Register(def ai.Tool, fn ToolFunc) {
+	def.Name = strings.TrimSpace(def.Name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.funcs[def.Name]; exists {
+		for i := range r.defs {
+			if r.defs[i].Name == def.Name {
+				r.defs[i] = def
+			}
+		}
+	} else {
+		r.defs = append(r.defs, def)
+	}
+	r.funcs[def.Name] = fn
+}
+
+func (r *ToolRegistry) Definitions() []ai.Tool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]ai.Tool(nil), r.defs...)
+}
+
+func (r *ToolRegistry) Call(ctx context.Context, userID uint64, name string, args json.RawMessage) (string, error) {
+	r.mu.RLock()
+	fn, ok := r.funcs[name]
+	r.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown tool: %s", name)
+	}
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	return fn(ctx, userID, args)
+}
+
+const (
+	// upper bound of model <-> tool round trips for one assistant turn
+	maxToolRounds = 5
+	// keep tool output from blowing up the context window
+	maxToolResultBytes = 16 * 1024
+)
+
+// truncateBytes cuts s to at most n bytes without splitting a UTF-8 sequence.
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// toolsEnabled reports whether replies from provider run the tool loop.
+func (s *Service) toolsEnabled(provider ai.Provider) bool {
+	if _, ok := provider.(ai.ToolProvider); !ok || s.tools == nil {
+		return false
+	}
+	return len(s.tools.Definitions()) > 0
+}
+
+// streamReply collects a streamed reply into a Response, passing every chunk to onDelta.
+func streamReply(ctx context.Context, sp ai.StreamProvider, msgs []ai.Message, onDelta func(string)) (ai.Response, error) {
+	chunks, errs := sp.StreamChat(ctx, msgs)
+	var b strings.Builder
+	var resp ai.Response
+	for c := range chunks {
+		if c.Usage != nil {
+			resp.Usage = *c.Usage
+		}
+		if c.Model != "" {
+			resp.Model = c.Model
+		}
+		if c.Delta == "" {
+			continue
+		}
+		b.WriteString(c.Delta)
+		onDelta(c.Delta)
+	}
+	if err := <-errs; err != nil {
+		return ai.Response{}, err
+	}
+	// providers stop quietly when ctx ends; a cut-off reply must not be stored
+	if err := ctx.Err(); err != nil {
+		return ai.Response{}, err
+	}
+	resp.Content = b.String()
+	return resp, nil
+}
+
+// generateReply asks the provider for the next assistant reply. When tools are configured and the
+// provider supports them, requested tools are executed and their calls/results are stored as
+// tool_call/tool_result messages, looping until the model returns a final answer.
+// The returned usage covers only the final call; earlier rounds are recorded on their tool_call rows.
+//
+// Tool rows are chained below parentID; the returned id is the message the reply should hang off
+// (parentID itself when no tools ran).
+func (s *Service) generateReply(ctx context.Context, provider ai.Provider, userID uint64, sessionID string, parentID uint64, msgs []ai.Message) (ai.Response, uint64, error) {
+	if !s.toolsEnabled(provider) {
+		resp, err := provider.Chat(ctx, msgs)
+		return resp, parentID, err
+	}
+	tp := provider.(ai.ToolProvider)
+	defs := s.tools.Definitions()
+
+	for round := 0; round < maxToolRounds; round++ {
+		resp, err := tp.ChatWithTools(ctx, msgs, defs)
+		if err != nil {
+			return ai.Response{}, 0, err
+		}
+		if len(resp.ToolCalls) == 0 {
+			return resp, parentID, nil
+		}
+
+		callsJSON, err := json.Marshal(resp.ToolCalls)
+		if err != nil {
+			return ai.Response{}, 0, err
+		}
+		callMsg := &Message{
+			SessionID:        sessionID,
+			UserID:           userID,
+			Role:             RoleToolCall,
+			Content:          resp.Content,
+			ParentID:         &parentID,
+			ToolCalls:        string(callsJSON),
+			Model:            resp.Model,
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+		}
+		if err := s.repo.InsertMessageAt(ctx, callMsg); err != nil {
+			return ai.Response{}, 0, err
+		}
+		parentID = callMsg.ID
+		s.countUsage(ctx, userID, resp.Usage)
+		msgs = append(msgs, resp.Message)
+
+		for _, call := range resp.ToolCalls {
+			result, err := s.tools.Call(ctx, userID, call.Name, json.RawMessage(call.Arguments))
+			if err != nil {
+				// let the model see the failure and recover
+				result = "error: " + err.Error()
+			}
+			result = truncateBytes(result, maxToolResultBytes)
+			resultMsg := &Message{
+				SessionID:  sessionID,
+				UserID:     userID,
+				Role:       RoleToolResult,
+				Content:    result,
+				ParentID:   &parentID,
+				ToolCallID: call.ID,
+				ToolName:   call.Name,
+			}
+			if err := s.repo.InsertMessageAt(ctx, resultMsg); err != nil {
+				return ai.Response{}, 0, err
+			}
+			parentID = resultMsg.ID
+			msgs = append(msgs, ai.Message{
+				Role:       ai.RoleTool,
+				Content:    result,
+				ToolCallID: call.ID,
+				ToolName:   call.Name,
+			})
+		}
+	}
+
+	// out of rounds: ask for a final answer without offering tools again
+	resp, err := provider.Chat(ctx, msgs)
+	if err != nil {
+		return ai.Response{}, 0, err
+	}
+	if strings.TrimSpace(resp.Content) == "" {
+		return ai.Response{}, 0, errors.New("tool call limit exceeded")
+	}
+	return resp, parentID, nil
+}
+
+// toProviderMessages converts DESC-ordered history rows into ASC provider messages.
+func toProviderMessages(recentDesc []Message) []ai.Message {
+	out := make([]ai.Message, 0, len(recentDesc))
+	called := make(map[string]bool)
+	for i := len(recentDesc) - 1; i >= 0; i-- {
+		m := recentDesc[i]
+		switch m.Role {
+		case RoleToolCall:
+			var calls []ai.ToolCall
+			if err := json.Unmarshal([]byte(m.ToolCalls), &calls); err != nil || len(calls) == 0 {
+				continue
+			}
+			for _, c := range calls {
+				called[c.ID] = true
+			}
+			out = append(out, ai.Message{Role: ai.RoleAssistant, Content: m.Content, ToolCalls: calls})
+		case RoleToolResult:
+			// the window may have cut off, or the row may have lost, the call this result
+			// answers; providers reject results without one
+			if !called[m.ToolCallID] {
+				continue
+			}
+			out = append(out, ai.Message{Role: ai.RoleTool, Content: m.Content, ToolCallID: m.ToolCallID, ToolName: m.ToolName})
+		default:
+			out = append(out, ai.Message{Role: m.Role, Content: m.Content, Parts: imageParts(m)})
+		}
+	}
+	return out
+}
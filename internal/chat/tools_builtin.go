@@ -0,0 +1,246 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+	"github.com/suPer8Hu/ai-platform/internal/models"
+	"gorm.io/gorm"
+)
+
+// RegisterBuiltinTools registers calculator, current_time and user_profile.
+func RegisterBuiltinTools(r *ToolRegistry, db *gorm.DB) {
+	r.Register(ai.Tool{
+		Name:        "calculator",
+		Description: "Evaluate an arithmetic expression with + - * / % ^ and parentheses.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"expression":{"type":"string","description":"e.g. (2+3)*4.5"}},"required":["expression"]}`),
+	}, calculatorTool)
+
+	r.Register(ai.Tool{
+		Name:        "current_time",
+		Description: "Get the current date and time, optionally in an IANA timezone such as Asia/Shanghai.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"timezone":{"type":"string"}}}`),
+	}, currentTimeTool)
+
+	r.Register(ai.Tool{
+		Name:        "user_profile",
+		Description: "Get the profile (id, email, username, created_at) of the user you are talking to.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+	}, func(ctx context.Context, userID uint64, args json.RawMessage) (string, error) {
+		var u models.User
+		if err := db.WithContext(ctx).First(&u, userID).Error; err != nil {
+			return "", err
+		}
+		b, err := json.Marshal(map[string]any{
+			"id":         u.ID,
+			"email":      u.Email,
+			"username":   u.Username,
+			"created_at": u.CreatedAt.UTC().Format(time.RFC3339),
+		})
+		return string(b), err
+	})
+}
+
+func calculatorTool(ctx context.Context, userID uint64, args json.RawMessage) (string, error) {
+	var in struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(args, &in); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	v, err := evalExpr(in.Expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64), nil
+}
+
+func currentTimeTool(ctx context.Context, userID uint64, args json.RawMessage) (string, error) {
+	var in struct {
+		Timezone string `json:"timezone"`
+	}
+	_ = json.Unmarshal(args, &in)
+	loc := time.UTC
+	if tz := strings.TrimSpace(in.Timezone); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return "", fmt.Errorf("unknown timezone: %s", tz)
+		}
+		loc = l
+	}
+	now := time.Now().In(loc)
+	return now.Format(time.RFC3339) + " (" + now.Weekday().String() + ")", nil
+}
+
+// evalExpr is a small recursive-descent evaluator:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = unary { ("*" | "/" | "%") unary }
+//	unary  = ("+" | "-") unary | power
+//	power  = atom [ "^" unary ]
+//	atom   = number | "(" expr ")"
+func evalExpr(s string) (float64, error) {
+	p := &exprParser{src: strings.TrimSpace(s)}
+	if p.src == "" {
+		return 0, errors.New("empty expression")
+	}
+	v, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.src) {
+		return 0, fmt.Errorf("unexpected %q at %d", p.src[p.pos], p.pos)
+	}
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, errors.New("result is not a finite number")
+	}
+	return v, nil
+}
+
+type exprParser struct {
+	src   string
+	pos   int
+	depth int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *exprParser) expr() (float64, error) {
+	v, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.peek() {
+		case '+':
+			p.pos++
+			r, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			v += r
+		case '-':
+			p.pos++
+			r, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			v -= r
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *exprParser) term() (float64, error) {
+	v, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return v, nil
+		}
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			v *= r
+		case '/':
+			if r == 0 {
+				return 0, errors.New("division by zero")
+			}
+			v /= r
+		case '%':
+			if r == 0 {
+				return 0, errors.New("division by zero")
+			}
+			v = math.Mod(v, r)
+		}
+	}
+}
+
+func (p *exprParser) unary() (float64, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > 64 {
+		return 0, errors.New("expression too deeply nested")
+	}
+	switch p.peek() {
+	case '+':
+		p.pos++
+		return p.unary()
+	case '-':
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+	}
+	return p.power()
+}
+
+func (p *exprParser) power() (float64, error) {
+	base, err := p.atom()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	exp, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exp), nil
+}
+
+func (p *exprParser) atom() (float64, error) {
+	c := p.peek()
+	if c == '(' {
+		p.pos++
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, errors.New("missing )")
+		}
+		p.pos++
+		return v, nil
+	}
+	start := p.pos
+	for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if c == 0 {
+			return 0, errors.New("unexpected end of expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at %d", c, start)
+	}
+	return strconv.ParseFloat(p.src[start:p.pos], 64)
+}
@@ -2,6 +2,8 @@ package chat
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"time"
 
 	"github.com/oklog/ulid/v2"
@@ -11,3 +13,23 @@ func NewSessionID() (string, error) {
 	entropy := ulid.Monotonic(rand.Reader, 0)
 	return ulid.MustNew(ulid.Timestamp(time.Now()), entropy).String(), nil
 }
+
+// NewShareToken returns a share id (a ULID) and the token handed out for it: the id followed
+// by 128 random bits, so knowing a share's id or creation time does not help guess its token.
+func NewShareToken() (id, token string, err error) {
+	id, err = NewSessionID()
+	if err != nil {
+		return "", "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	return id, id + hex.EncodeToString(b), nil
+}
+
+// hashShareToken is a plain SHA-256: tokens are high-entropy, unlike passwords.
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ModelPrice is USD per one million tokens.
+type ModelPrice struct {
+	PromptPerMTok     float64 `json:"prompt_per_mtok"`
+	CompletionPerMTok float64 `json:"completion_per_mtok"`
+}
+
+// PriceTable maps a model name to its price. The "*" entry, if present, applies to unlisted models.
+type PriceTable map[string]ModelPrice
+
+// LoadPriceTable reads a JSON object of model -> ModelPrice.
+func LoadPriceTable(path string) (PriceTable, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read price table: %w", err)
+	}
+	var t PriceTable
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("parse price table: %w", err)
+	}
+	return t, nil
+}
+
+func (t PriceTable) Cost(model string, promptTokens, completionTokens int64) float64 {
+	p, ok := t[model]
+	if !ok {
+		p, ok = t["*"]
+		if !ok {
+			return 0
+		}
+	}
+	return (float64(promptTokens)*p.PromptPerMTok + float64(completionTokens)*p.CompletionPerMTok) / 1e6
+}
+
+type ModelUsage struct {
+	Model            string  `json:"model"`
+	Messages         int64   `json:"messages"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+type SessionUsage struct {
+	SessionID        string  `json:"session_id"`
+	Title            string  `json:"title"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+type UsageReport struct {
+	PromptTokens     int64          `json:"prompt_tokens"`
+	CompletionTokens int64          `json:"completion_tokens"`
+	TotalTokens      int64          `json:"total_tokens"`
+	CostUSD          float64        `json:"cost_usd"`
+	ByModel          []ModelUsage   `json:"by_model"`
+	TopSessions      []SessionUsage `json:"top_sessions,omitempty"`
+}
+
+// buildUsageReport prices per-(session, model) sums. Cost is computed at read time,
+// so price table changes apply retroactively.
+func buildUsageReport(rows []UsageRow, prices PriceTable) (*UsageReport, map[string]*SessionUsage) {
+	report := &UsageReport{ByModel: []ModelUsage{}}
+	byModel := map[string]*ModelUsage{}
+	bySession := map[string]*SessionUsage{}
+
+	for _, r := range rows {
+		cost := prices.Cost(r.Model, r.PromptTokens, r.CompletionTokens)
+		total := r.PromptTokens + r.CompletionTokens
+
+		report.PromptTokens += r.PromptTokens
+		report.CompletionTokens += r.CompletionTokens
+		report.TotalTokens += total
+		report.CostUSD += cost
+
+		mu, ok := byModel[r.Model]
+		if !ok {
+			mu = &ModelUsage{Model: r.Model}
+			byModel[r.Model] = mu
+		}
+		mu.Messages += r.Messages
+		mu.PromptTokens += r.PromptTokens
+		mu.CompletionTokens += r.CompletionTokens
+		mu.TotalTokens += total
+		mu.CostUSD += cost
+
+		su, ok := bySession[r.SessionID]
+		if !ok {
+			su = &SessionUsage{SessionID: r.SessionID}
+			bySession[r.SessionID] = su
+		}
+		su.PromptTokens += r.PromptTokens
+		su.CompletionTokens += r.CompletionTokens
+		su.TotalTokens += total
+		su.CostUSD += cost
+	}
+
+	for _, mu := range byModel {
+		report.ByModel = append(report.ByModel, *mu)
+	}
+	sort.Slice(report.ByModel, func(i, j int) bool {
+		if report.ByModel[i].TotalTokens != report.ByModel[j].TotalTokens {
+			return report.ByModel[i].TotalTokens > report.ByModel[j].TotalTokens
+		}
+		return strings.Compare(report.ByModel[i].Model, report.ByModel[j].Model) < 0
+	})
+	return report, bySession
+}
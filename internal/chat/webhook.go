@@ -0,0 +1,344 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Webhook delivery statuses.
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+// Webhook events.
+const (
+	WebhookJobSucceeded = "job.succeeded"
+	WebhookJobFailed    = "job.failed"
+)
+
+var (
+	// ErrWebhooksDisabled is returned for callback URLs when no signing secret is configured.
+	ErrWebhooksDisabled = errors.New("webhooks are not configured")
+	// ErrInvalidCallbackURL is returned for callback URLs that are not absolute http(s) URLs.
+	ErrInvalidCallbackURL = errors.New("callback_url must be an absolute http or https URL")
+	// ErrDeliveryNotFound is returned for delivery ids that do not exist or belong to another user.
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	// ErrDeliveryPending is returned for redelivering a delivery that is still being attempted.
+	ErrDeliveryPending = errors.New("webhook delivery is still pending")
+
+	errPrivateAddress = errors.New("webhook: refusing to connect to a private address")
+)
+
+const (
+	maxCallbackURLLen   = 2048
+	maxWebhookAttempts  = 8
+	webhookTimeout      = 10 * time.Second
+	webhookRetryBase    = 30 * time.Second
+	webhookRetryMax     = time.Hour
+	webhookDueBatchSize = 20
+	// response bodies kept in the delivery log when an attempt fails
+	maxWebhookErrorBody = 512
+)
+
+// SetWebhooks enables job webhooks signed with secret. Callbacks to loopback, private and
+// link-local addresses are refused unless allowPrivate is set.
+func (s *Service) SetWebhooks(secret string, allowPrivate bool) {
+	s.webhookSecret = []byte(secret)
+	s.webhookClient = newWebhookClient(allowPrivate)
+}
+
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		// checked on the resolved address, so DNS tricks cannot reach internal hosts
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 5 * time.Second},
+		// a redirect is a failed delivery: following it would leave the checked host
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+func (s *Service) webhooksEnabled() bool {
+	return len(s.webhookSecret) > 0
+}
+
+// WebhookSecret returns the key the user's webhooks are signed with. It is derived from the
+// configured secret, so rotating that rotates every user's key.
+func (s *Service) WebhookSecret(userID uint64) (string, error) {
+	if !s.webhooksEnabled() {
+		return "", ErrWebhooksDisabled
+	}
+	mac := hmac.New(sha256.New, s.webhookSecret)
+	fmt.Fprintf(mac, "webhook:%d", userID)
+	return "whsec_" + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// SignWebhook returns the X-Webhook-Signature value of a payload sent at ts.
+func SignWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidateCallbackURL checks a callback URL before it is stored on a job.
+func (s *Service) ValidateCallbackURL(raw string) error {
+	if !s.webhooksEnabled() {
+		return ErrWebhooksDisabled
+	}
+	if len(raw) > maxCallbackURLLen {
+		return ErrInvalidCallbackURL
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return ErrInvalidCallbackURL
+	}
+	return nil
+}
+
+type webhookJob struct {
+	ID              string    `json:"id"`
+	SessionID       string    `json:"session_id"`
+	Status          JobStatus `json:"status"`
+	ResultMessageID *uint64   `json:"result_message_id"`
+	Error           *string   `json:"error"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type webhookPayload struct {
+	Event string     `json:"event"`
+	Job   webhookJob `json:"job"`
+	// the assistant reply of succeeded jobs, so receivers need not fetch it
+	Reply *string `json:"reply,omitempty"`
+}
+
+// enqueueWebhook logs the webhook of a finished job and makes a first attempt right away;
+// DeliverDueWebhooks retries it. Errors are logged: the job itself is done either way.
+func (s *Service) enqueueWebhook(ctx context.Context, j *Job) {
+	if j.CallbackURL == nil || !s.webhooksEnabled() {
+		return
+	}
+	var event string
+	switch j.Status {
+	case JobSucceeded:
+		event = WebhookJobSucceeded
+	case JobFailed:
+		event = WebhookJobFailed
+	default:
+		return
+	}
+
+	p := webhookPayload{
+		Event: event,
+		Job: webhookJob{
+			ID:              j.ID,
+			SessionID:       j.SessionID,
+			Status:          j.Status,
+			ResultMessageID: j.ResultMessageID,
+			Error:           j.Error,
+			CreatedAt:       j.CreatedAt,
+			UpdatedAt:       j.UpdatedAt,
+		},
+	}
+	if j.ResultMessageID != nil {
+		if m, err := s.repo.GetMessageByID(ctx, j.UserID, *j.ResultMessageID); err == nil {
+			p.Reply = &m.Content
+		}
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("chat: webhook payload job=%s: %v", j.ID, err)
+		return
+	}
+
+	d := &WebhookDelivery{
+		UserID:        j.UserID,
+		SessionID:     j.SessionID,
+		JobID:         j.ID,
+		Event:         event,
+		URL:           *j.CallbackURL,
+		Payload:       string(body),
+		Status:        WebhookPending,
+		NextAttemptAt: time.Now(),
+	}
+	created, err := s.repo.CreateWebhookDelivery(ctx, d)
+	if err != nil {
+		log.Printf("chat: log webhook job=%s: %v", j.ID, err)
+		return
+	}
+	if created {
+		go s.deliverWebhook(context.WithoutCancel(ctx), d.ID)
+	}
+}
+
+// DeliverDueWebhooks attempts the pending deliveries that are due and returns how many it sent.
+func (s *Service) DeliverDueWebhooks(ctx context.Context) (int, error) {
+	if !s.webhooksEnabled() {
+		return 0, nil
+	}
+	ids, err := s.repo.ListDueWebhookDeliveries(ctx, time.Now(), webhookDueBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		if s.deliverWebhook(ctx, id) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// deliverWebhook makes one attempt at a due delivery, unless another worker claimed it first,
+// and records the outcome. It reports whether the receiver accepted the webhook.
+func (s *Service) deliverWebhook(ctx context.Context, id uint64) bool {
+	now := time.Now()
+	claimed, err := s.repo.ClaimWebhookDelivery(ctx, id, now, now.Add(2*webhookTimeout))
+	if err != nil || !claimed {
+		if err != nil {
+			log.Printf("chat: claim webhook delivery=%d: %v", id, err)
+		}
+		return false
+	}
+	d, err := s.repo.GetWebhookDelivery(ctx, id)
+	if err != nil {
+		log.Printf("chat: load webhook delivery=%d: %v", id, err)
+		return false
+	}
+
+	code, sendErr := s.sendWebhook(ctx, d)
+	fields := map[string]any{"last_status_code": code}
+	if sendErr == nil {
+		fields["status"] = WebhookDelivered
+		fields["delivered_at"] = time.Now()
+		fields["last_error"] = nil
+	} else {
+		fields["last_error"] = sendErr.Error()
+		if d.Attempts >= maxWebhookAttempts {
+			fields["status"] = WebhookFailed
+		} else {
+			fields["next_attempt_at"] = time.Now().Add(webhookRetryDelay(d.Attempts))
+		}
+		log.Printf("chat: webhook delivery=%d job=%s attempt=%d failed: %v", d.ID, d.JobID, d.Attempts, sendErr)
+	}
+	if err := s.repo.UpdateWebhookDelivery(ctx, id, fields); err != nil {
+		log.Printf("chat: record webhook delivery=%d: %v", id, err)
+	}
+	return sendErr == nil
+}
+
+// webhookRetryDelay is the wait after the given number of failed attempts: 30s, 1m, 2m ... 1h.
+func webhookRetryDelay(attempts int) time.Duration {
+	d := webhookRetryBase << max(0, attempts-1)
+	if d <= 0 || d > webhookRetryMax {
+		return webhookRetryMax
+	}
+	return d
+}
+
+// sendWebhook POSTs the payload signed with the user's key; any 2xx response accepts it.
+func (s *Service) sendWebhook(ctx context.Context, d *WebhookDelivery) (int, error) {
+	secret, err := s.WebhookSecret(d.UserID)
+	if err != nil {
+		return 0, err
+	}
+	body := []byte(d.Payload)
+	ts := time.Now().Unix()
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GopherChat-Webhook/1.0")
+	req.Header.Set("X-Webhook-Id", strconv.FormatUint(d.ID, 10))
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Webhook-Signature", SignWebhook(secret, ts, body))
+
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookErrorBody))
+		msg := fmt.Sprintf("receiver returned %d", resp.StatusCode)
+		if t := strings.TrimSpace(string(b)); t != "" {
+			msg += ": " + t
+		}
+		return resp.StatusCode, errors.New(msg)
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	return resp.StatusCode, nil
+}
+
+// ListWebhookDeliveries pages the user's webhook deliveries newest first; status "" lists all.
+func (s *Service) ListWebhookDeliveries(ctx context.Context, userID uint64, status string, limit int, beforeID uint64) ([]WebhookDelivery, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	return s.repo.ListWebhookDeliveries(ctx, userID, status, limit, beforeID)
+}
+
+// RedeliverWebhook gives a finished delivery a fresh round of attempts, starting with the
+// next dispatcher run. The payload is sent as it was first logged.
+func (s *Service) RedeliverWebhook(ctx context.Context, userID, id uint64) (*WebhookDelivery, error) {
+	if !s.webhooksEnabled() {
+		return nil, ErrWebhooksDisabled
+	}
+	n, err := s.repo.RedeliverWebhook(ctx, userID, id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	d, err := s.repo.GetWebhookDelivery(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && d.UserID != userID) {
+		return nil, ErrDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrDeliveryPending
+	}
+	return d, nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -13,28 +15,94 @@ type Config struct {
 	RedisPassword string
 	RedisDB       int
 
+	// access tokens are short-lived; refresh tokens rotate on every use
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
 	SMTPHost              string
 	SMTPPort              int
 	SMTPUser              string
 	SMTPPass              string
 	SMTPFrom              string
 	ChatContextWindowSize int
+	ChatToolsEnabled      bool
+	ChatPriceTablePath    string
+	// token budget for the chat history (0 = count messages instead) and per-model overrides
+	ChatContextTokens    int
+	ChatTokenBudgetsPath string
+	// embedding model for semantic search (provider empty = keyword search only)
+	ChatEmbedProvider string
+	ChatEmbedModel    string
+	// uploaded documents (chunks are embedded with the model above) and chunks retrieved per message
+	DocsMaxBytes int64
+	DocsTopK     int
+	// signs async job webhooks (empty disables callback_url); private callback hosts are refused unless allowed
+	WebhookSecret       string
+	WebhookAllowPrivate bool
+	// images attached to chat messages: "local" (under AttachmentsDir) or "s3"
+	AttachmentsStore    string
+	AttachmentsDir      string
+	AttachmentsMaxBytes int64
+	// uploads not sent with a message within this long are removed by the worker (0 keeps them)
+	AttachmentsUnattachedTTL time.Duration
+	S3Endpoint               string
+	S3Bucket                 string
+	S3Region                 string
+	S3AccessKey              string
+	S3SecretKey              string
+	S3PathStyle              bool
 
 	// AI provider
-	AIProvider         string
-	OllamaBaseURL      string
-	OllamaModel        string
-	OpenRouterBaseURL  string
-	OpenRouterAPIKey   string
-	OpenRouterModel    string
-	OpenRouterSiteURL  string
-	OpenRouterAppName  string
+	AIProvider        string
+	OllamaBaseURL     string
+	OllamaModel       string
+	OpenRouterBaseURL string
+	OpenRouterAPIKey  string
+	OpenRouterModel   string
+	OpenRouterSiteURL string
+	OpenRouterAppName string
+	// comma-separated provider:model targets tried when a session's provider fails
+	AIFallbackChain string
+	// consecutive provider faults that open a provider's circuit (0 disables) and its cooldown
+	AIBreakerFailures int
+	AIBreakerCooldown time.Duration
+	// comma-separated models reported by name in provider metrics besides the configured
+	// defaults and fallback targets; any other model a session names is reported as "other"
+	MetricsModels string
+
+	// rate limits (requests per minute; 0 disables) and daily LLM token quota per user
+	RateLimitChatPerMin   int
+	RateLimitVisionPerMin int
+	RateLimitSharePerMin  int
+	RateLimitAuthPerMin   int
+	RateLimitDemoPerMin   int
+	RateLimitDemoPerDay   int
+	DailyTokenQuota       int64
+	// comma-separated IPs/CIDRs of the reverse proxies in front of the API. Required behind a
+	// proxy or load balancer: by default no forwarding header is trusted, so every request
+	// seems to come from the proxy and all clients share one per-IP rate limit bucket
+	TrustedProxies string
+	// "cloudflare" takes the client IP from CF-Connecting-IP instead
+	TrustedPlatform string
 
 	// rabbitMQ
 	RabbitURL   string
 	RabbitQueue string
+	// x-max-priority of the job queue; 0 (the default) keeps it FIFO. RabbitMQ refuses to
+	// redeclare an existing queue with another value (PRECONDITION_FAILED), so turning this on
+	// for a deployed queue needs the queue deleted first, or a new RABBIT_QUEUE name
+	RabbitMaxPriority int
+	// async jobs left queued/running longer than this are published again by the worker's sweeper;
+	// chat jobs count running time from their worker's last heartbeat
+	JobStuckQueuedAfter  time.Duration
+	JobStuckRunningAfter time.Duration
+
+	// comma-separated user ids allowed on /admin (DLQ tooling); empty disables /admin
+	AdminUserIDs string
 
-	// vision
+	// vision: a JSON manifest of classifier models (see vision.LoadManifest); without one the
+	// single model of VISION_MODEL_PATH/VISION_LABELS_PATH is served
+	VisionModelsPath    string
 	VisionModelPath     string
 	VisionLabelsPath    string
 	VisionInputH        int
@@ -50,6 +118,17 @@ type Config struct {
 	VisionGeminiAPIKey  string
 	VisionGeminiModel   string
 	VisionGeminiBaseURL string
+	// object detection: a YOLO-style ONNX model; disabled without a model path
+	VisionDetectModelPath  string
+	VisionDetectLabelsPath string
+	VisionDetectInputSize  int
+	VisionDetectInputName  string
+	VisionDetectOutputName string
+	// batch recognition: jobs go through their own queue (with retry queue and DLQ) to the
+	// worker; images wait in the attachment store until it gets to them
+	VisionQueue          string
+	VisionBatchMaxImages int
+	VisionBatchMaxBytes  int64
 }
 
 func Load() Config {
@@ -98,6 +177,14 @@ func Load() Config {
 		}
 	}
 
+	// server-side tool calling (only for models that support tools)
+	toolsEnabled := false
+	if v := os.Getenv("CHAT_TOOLS_ENABLED"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			toolsEnabled = b
+		}
+	}
+
 	// AI provider config
 	aiProvider := os.Getenv("AI_PROVIDER")
 	if aiProvider == "" {
@@ -123,6 +210,14 @@ func Load() Config {
 		openRouterModel = "openrouter/auto"
 	}
 
+	// rate limit config
+	dailyTokenQuota := int64(0)
+	if v := os.Getenv("DAILY_TOKEN_QUOTA"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			dailyTokenQuota = n
+		}
+	}
+
 	// rabbitMQ config
 	rabbitURL := os.Getenv("RABBIT_URL")
 	if rabbitURL == "" {
@@ -168,16 +263,39 @@ func Load() Config {
 		DBDSN:     dsn,
 		JWTSecret: secret,
 
+		AccessTokenTTL:  durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL: durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+
 		RedisAddr:     redisAddr,
 		RedisPassword: os.Getenv("REDIS_PASSWORD"),
 		RedisDB:       redisDB,
 
-		SMTPHost:              smtpHost,
-		SMTPPort:              smtpPort,
-		SMTPUser:              os.Getenv("SMTP_USER"),
-		SMTPPass:              os.Getenv("SMTP_PASS"),
-		SMTPFrom:              smtpFrom,
-		ChatContextWindowSize: windowSize,
+		SMTPHost:                 smtpHost,
+		SMTPPort:                 smtpPort,
+		SMTPUser:                 os.Getenv("SMTP_USER"),
+		SMTPPass:                 os.Getenv("SMTP_PASS"),
+		SMTPFrom:                 smtpFrom,
+		ChatContextWindowSize:    windowSize,
+		ChatToolsEnabled:         toolsEnabled,
+		ChatPriceTablePath:       os.Getenv("CHAT_PRICE_TABLE"),
+		ChatContextTokens:        intFromEnv("CHAT_CONTEXT_TOKENS", 0),
+		ChatTokenBudgetsPath:     os.Getenv("CHAT_TOKEN_BUDGETS"),
+		ChatEmbedProvider:        os.Getenv("CHAT_EMBED_PROVIDER"),
+		ChatEmbedModel:           os.Getenv("CHAT_EMBED_MODEL"),
+		DocsMaxBytes:             int64(intFromEnv("DOCS_MAX_BYTES", 10*1024*1024)),
+		DocsTopK:                 intFromEnv("DOCS_TOP_K", 4),
+		WebhookSecret:            os.Getenv("WEBHOOK_SECRET"),
+		WebhookAllowPrivate:      boolFromEnv("WEBHOOK_ALLOW_PRIVATE", false),
+		AttachmentsStore:         os.Getenv("ATTACHMENTS_STORE"),
+		AttachmentsDir:           stringFromEnv("ATTACHMENTS_DIR", "data/attachments"),
+		AttachmentsMaxBytes:      int64(intFromEnv("ATTACHMENTS_MAX_BYTES", 10*1024*1024)),
+		AttachmentsUnattachedTTL: durationFromEnv("ATTACHMENTS_UNATTACHED_TTL", 24*time.Hour),
+		S3Endpoint:               os.Getenv("S3_ENDPOINT"),
+		S3Bucket:                 os.Getenv("S3_BUCKET"),
+		S3Region:                 os.Getenv("S3_REGION"),
+		S3AccessKey:              os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey:              os.Getenv("S3_SECRET_KEY"),
+		S3PathStyle:              boolFromEnv("S3_PATH_STYLE", true),
 
 		AIProvider:        aiProvider,
 		OllamaBaseURL:     ollamaBaseURL,
@@ -187,10 +305,30 @@ func Load() Config {
 		OpenRouterModel:   openRouterModel,
 		OpenRouterSiteURL: os.Getenv("OPENROUTER_SITE_URL"),
 		OpenRouterAppName: os.Getenv("OPENROUTER_APP_NAME"),
+		AIFallbackChain:   os.Getenv("AI_FALLBACK_CHAIN"),
+		AIBreakerFailures: intFromEnv("AI_BREAKER_FAILURES", 5),
+		AIBreakerCooldown: durationFromEnv("AI_BREAKER_COOLDOWN", 30*time.Second),
+		MetricsModels:     os.Getenv("METRICS_MODELS"),
+
+		RateLimitChatPerMin:   intFromEnv("RATE_LIMIT_CHAT_PER_MIN", 30),
+		RateLimitVisionPerMin: intFromEnv("RATE_LIMIT_VISION_PER_MIN", 10),
+		RateLimitSharePerMin:  intFromEnv("RATE_LIMIT_SHARE_PER_MIN", 60),
+		RateLimitAuthPerMin:   intFromEnv("RATE_LIMIT_AUTH_PER_MIN", 20),
+		RateLimitDemoPerMin:   intFromEnv("RATE_LIMIT_DEMO_PER_MIN", 5),
+		RateLimitDemoPerDay:   intFromEnv("RATE_LIMIT_DEMO_PER_DAY", 50),
+		DailyTokenQuota:       dailyTokenQuota,
+		TrustedProxies:        os.Getenv("TRUSTED_PROXIES"),
+		TrustedPlatform:       os.Getenv("TRUSTED_PLATFORM"),
+
+		RabbitURL:            rabbitURL,
+		RabbitQueue:          rabbitQueue,
+		RabbitMaxPriority:    intFromEnv("RABBIT_MAX_PRIORITY", 0),
+		JobStuckQueuedAfter:  durationFromEnv("JOB_STUCK_QUEUED_AFTER", 10*time.Minute),
+		JobStuckRunningAfter: durationFromEnv("JOB_STUCK_RUNNING_AFTER", 15*time.Minute),
 
-		RabbitURL:   rabbitURL,
-		RabbitQueue: rabbitQueue,
+		AdminUserIDs: os.Getenv("ADMIN_USER_IDS"),
 
+		VisionModelsPath:    os.Getenv("VISION_MODELS"),
 		VisionModelPath:     os.Getenv("VISION_MODEL_PATH"),
 		VisionLabelsPath:    os.Getenv("VISION_LABELS_PATH"),
 		VisionInputH:        visionInputH,
@@ -206,5 +344,68 @@ func Load() Config {
 		VisionGeminiAPIKey:  os.Getenv("VISION_GEMINI_API_KEY"),
 		VisionGeminiModel:   os.Getenv("VISION_GEMINI_MODEL"),
 		VisionGeminiBaseURL: os.Getenv("VISION_GEMINI_BASE_URL"),
+
+		VisionDetectModelPath:  os.Getenv("VISION_DETECT_MODEL_PATH"),
+		VisionDetectLabelsPath: os.Getenv("VISION_DETECT_LABELS_PATH"),
+		VisionDetectInputSize:  intFromEnv("VISION_DETECT_INPUT_SIZE", 640),
+		VisionDetectInputName:  os.Getenv("VISION_DETECT_INPUT_NAME"),
+		VisionDetectOutputName: os.Getenv("VISION_DETECT_OUTPUT_NAME"),
+
+		VisionQueue:          stringFromEnv("VISION_QUEUE", "vision_jobs"),
+		VisionBatchMaxImages: intFromEnv("VISION_BATCH_MAX_IMAGES", 500),
+		VisionBatchMaxBytes:  int64(intFromEnv("VISION_BATCH_MAX_BYTES", 500*1024*1024)),
+	}
+}
+
+// KnownModels lists the models provider metrics report by name: the configured defaults,
+// the fallback targets and MetricsModels.
+func (c Config) KnownModels() []string {
+	models := []string{c.OllamaModel, c.OpenRouterModel, c.ChatEmbedModel, c.VisionVLMModel, c.VisionGeminiModel}
+	for _, part := range strings.Split(c.AIFallbackChain, ",") {
+		if _, model, ok := strings.Cut(part, ":"); ok {
+			models = append(models, model)
+		}
+	}
+	models = append(models, strings.Split(c.MetricsModels, ",")...)
+	out := models[:0]
+	for _, m := range models {
+		if m = strings.TrimSpace(m); m != "" {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func stringFromEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func intFromEnv(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func boolFromEnv(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
 	}
+	return def
 }
@@ -0,0 +1,381 @@
+// Package dlq inspects and drains the dead-letter queue of the chat worker: jobs that
+// exhausted their retries (see cmd/worker) wait there until someone replays, purges or
+// archives them.
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/suPer8Hu/ai-platform/internal/chat"
+	"github.com/suPer8Hu/ai-platform/internal/store/rabbitmq"
+	"gorm.io/gorm"
+)
+
+// Headers set by the worker.
+const (
+	RetryHeader  = "x-retry-count"
+	ErrorHeader  = "x-last-error"
+	ReplayHeader = "x-replay-count"
+)
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+	// messages taken off the queue at most by one replay/purge/archive
+	maxBatch = 10000
+)
+
+// ErrNoSelection is returned for replay, purge and archive calls naming no jobs without all.
+var ErrNoSelection = errors.New("name job ids or select all")
+
+// JobInfo is the chat.Job row of a dead-lettered message.
+type JobInfo struct {
+	UserID    uint64         `json:"user_id"`
+	SessionID string         `json:"session_id"`
+	Status    chat.JobStatus `json:"status"`
+	Error     *string        `json:"error"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// Message is one dead-lettered job delivery.
+type Message struct {
+	JobID      string    `json:"job_id"`
+	RetryCount int       `json:"retry_count"`
+	LastError  string    `json:"last_error"`
+	Reason     string    `json:"reason"`
+	Provider   string    `json:"provider,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	// nil when the job row is gone, e.g. its session was deleted
+	Job *JobInfo `json:"job"`
+}
+
+// Report is a look at the head of the DLQ. Groups cover the scanned messages only; Depth
+// tells whether that is all of them.
+type Report struct {
+	Queue    string    `json:"queue"`
+	Depth    int       `json:"depth"`
+	Scanned  int       `json:"scanned"`
+	Groups   []Group   `json:"groups"`
+	Messages []Message `json:"messages"`
+}
+
+// Selection names the dead-lettered jobs an operation applies to.
+type Selection struct {
+	JobIDs []string `json:"job_ids"`
+	All    bool     `json:"all"`
+}
+
+func (s Selection) validate() error {
+	if !s.All && len(s.JobIDs) == 0 {
+		return ErrNoSelection
+	}
+	return nil
+}
+
+func (s Selection) matches(jobID string) bool {
+	if s.All {
+		return true
+	}
+	for _, id := range s.JobIDs {
+		if id == jobID {
+			return true
+		}
+	}
+	return false
+}
+
+// Skip is a selected message that was left in the DLQ.
+type Skip struct {
+	JobID  string `json:"job_id"`
+	Reason string `json:"reason"`
+}
+
+// Result sums up a replay, purge or archive.
+type Result struct {
+	Matched   int    `json:"matched"`
+	Processed int    `json:"processed"`
+	Skipped   []Skip `json:"skipped,omitempty"`
+}
+
+type Inspector struct {
+	url   string
+	queue string
+	db    *gorm.DB
+	jobs  *chat.Repo
+}
+
+// NewInspector works on the DLQ of the worker queue queue. Every call uses its own
+// connection: these are rare operator actions.
+func NewInspector(url, queue string, db *gorm.DB) *Inspector {
+	return &Inspector{url: url, queue: queue, db: db, jobs: chat.NewRepo(db)}
+}
+
+func (in *Inspector) DLQName() string {
+	return rabbitmq.DeadLetterQueue(in.queue)
+}
+
+// take gets up to max messages off the DLQ without acking them and passes them to fn.
+// Messages fn leaves unacked return to the queue when the channel closes.
+func (in *Inspector) take(ctx context.Context, max int, fn func(ch *amqp.Channel, ds []amqp.Delivery) error) (int, error) {
+	conn, err := amqp.Dial(in.url)
+	if err != nil {
+		return 0, fmt.Errorf("dlq: dial: %w", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, fmt.Errorf("dlq: channel: %w", err)
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(in.DLQName(), true, false, false, false, nil)
+	if err != nil {
+		return 0, fmt.Errorf("dlq: inspect %s: %w", in.DLQName(), err)
+	}
+	var ds []amqp.Delivery
+	for len(ds) < max && ctx.Err() == nil {
+		d, ok, err := ch.Get(in.DLQName(), false)
+		if err != nil {
+			return q.Messages, fmt.Errorf("dlq: get: %w", err)
+		}
+		if !ok {
+			break
+		}
+		ds = append(ds, d)
+	}
+	if err := ctx.Err(); err != nil {
+		return q.Messages, err
+	}
+	return q.Messages, fn(ch, ds)
+}
+
+func (in *Inspector) messages(ctx context.Context, ds []amqp.Delivery) ([]Message, error) {
+	out := make([]Message, len(ds))
+	ids := make([]string, 0, len(ds))
+	for i, d := range ds {
+		out[i] = parse(d)
+		if out[i].JobID != "" {
+			ids = append(ids, out[i].JobID)
+		}
+	}
+	jobs, err := in.jobs.GetJobsByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*JobInfo, len(jobs))
+	for _, j := range jobs {
+		byID[j.ID] = &JobInfo{
+			UserID:    j.UserID,
+			SessionID: j.SessionID,
+			Status:    j.Status,
+			Error:     j.Error,
+			CreatedAt: j.CreatedAt,
+			UpdatedAt: j.UpdatedAt,
+		}
+	}
+	for i := range out {
+		out[i].Job = byID[out[i].JobID]
+	}
+	return out, nil
+}
+
+func parse(d amqp.Delivery) Message {
+	var body struct {
+		JobID string `json:"job_id"`
+	}
+	_ = json.Unmarshal(d.Body, &body)
+	lastErr, _ := d.Headers[ErrorHeader].(string)
+	return Message{
+		JobID:      body.JobID,
+		RetryCount: headerInt(d.Headers, RetryHeader),
+		LastError:  lastErr,
+		Reason:     Reason(lastErr),
+		Provider:   Provider(lastErr),
+		Timestamp:  d.Timestamp,
+	}
+}
+
+func headerInt(h amqp.Table, key string) int {
+	switch t := h[key].(type) {
+	case int32:
+		return int(t)
+	case int64:
+		return int(t)
+	case int:
+		return t
+	case string:
+		n, _ := strconv.Atoi(t)
+		return n
+	}
+	return 0
+}
+
+// List returns the first limit messages of the DLQ with their jobs, grouped by failure reason.
+// The messages stay in the queue.
+func (in *Inspector) List(ctx context.Context, limit int) (*Report, error) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	limit = min(limit, MaxListLimit)
+	rep := &Report{Queue: in.DLQName()}
+	depth, err := in.take(ctx, limit, func(_ *amqp.Channel, ds []amqp.Delivery) error {
+		msgs, err := in.messages(ctx, ds)
+		if err != nil {
+			return err
+		}
+		rep.Messages = msgs
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rep.Depth = depth
+	rep.Scanned = len(rep.Messages)
+	rep.Groups = GroupMessages(rep.Messages)
+	if rep.Messages == nil {
+		rep.Messages = []Message{}
+	}
+	return rep, nil
+}
+
+// each runs fn on every selected message and acks the ones it handled.
+func (in *Inspector) each(ctx context.Context, sel Selection, fn func(ch *amqp.Channel, d amqp.Delivery, m Message) (string, error)) (*Result, error) {
+	if err := sel.validate(); err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	_, err := in.take(ctx, maxBatch, func(ch *amqp.Channel, ds []amqp.Delivery) error {
+		msgs, err := in.messages(ctx, ds)
+		if err != nil {
+			return err
+		}
+		for i, d := range ds {
+			m := msgs[i]
+			if !sel.matches(m.JobID) {
+				continue
+			}
+			res.Matched++
+			skip, err := fn(ch, d, m)
+			if err != nil {
+				return err
+			}
+			if skip != "" {
+				res.Skipped = append(res.Skipped, Skip{JobID: m.JobID, Reason: skip})
+				continue
+			}
+			if err := d.Ack(false); err != nil {
+				return fmt.Errorf("dlq: ack: %w", err)
+			}
+			res.Processed++
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// Replay puts the selected messages back on the main queue with a reset retry count and
+// resets their jobs to queued. Jobs that finished otherwise in the meantime, or whose row is
+// gone, are skipped and stay in the DLQ.
+//
+// The row is reset before the publish, so a worker taking the replay at once finds the job
+// queued; if the broker does not confirm the publish the row is put back as it was.
+func (in *Inspector) Replay(ctx context.Context, sel Selection) (*Result, error) {
+	confirmed := false
+	return in.each(ctx, sel, func(ch *amqp.Channel, d amqp.Delivery, m Message) (string, error) {
+		if m.Job == nil {
+			return "job not found", nil
+		}
+		if !confirmed {
+			if err := ch.Confirm(false); err != nil {
+				return "", fmt.Errorf("dlq: confirm mode: %w", err)
+			}
+			confirmed = true
+		}
+
+		n, err := in.jobs.ReplayJob(ctx, m.JobID)
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			return "job " + string(m.Job.Status), nil
+		}
+		if err := in.republish(ctx, ch, d, m.JobID); err != nil {
+			// the caller's context may be what ended the wait
+			if undoErr := in.jobs.UndoReplayJob(context.WithoutCancel(ctx), m.JobID, m.Job.Status, m.Job.Error); undoErr != nil {
+				return "", fmt.Errorf("%w; restoring job status: %v", err, undoErr)
+			}
+			return "", err
+		}
+		return "", nil
+	})
+}
+
+// republish publishes a dead letter to the main queue again and waits for the broker's
+// confirm. ch must be in confirm mode.
+func (in *Inspector) republish(ctx context.Context, ch *amqp.Channel, d amqp.Delivery, jobID string) error {
+	h := amqp.Table{}
+	for k, v := range d.Headers {
+		h[k] = v
+	}
+	h[RetryHeader] = int32(0)
+	delete(h, ErrorHeader)
+	h[ReplayHeader] = int32(headerInt(d.Headers, ReplayHeader) + 1)
+	dc, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", in.queue, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         d.Body,
+		Headers:      h,
+		DeliveryMode: amqp.Persistent,
+		Priority:     d.Priority,
+		Timestamp:    time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("dlq: publish: %w", err)
+	}
+	// only drop the dead letter once the broker has the replay
+	if ok, err := dc.WaitContext(ctx); err != nil || !ok {
+		return fmt.Errorf("dlq: replay of job %s not confirmed: %v", jobID, err)
+	}
+	return nil
+}
+
+// Purge drops the selected messages. Their jobs stay failed.
+func (in *Inspector) Purge(ctx context.Context, sel Selection) (*Result, error) {
+	return in.each(ctx, sel, func(*amqp.Channel, amqp.Delivery, Message) (string, error) {
+		return "", nil
+	})
+}
+
+// Archive moves the selected messages into the dlq_archive table.
+func (in *Inspector) Archive(ctx context.Context, sel Selection) (*Result, error) {
+	return in.each(ctx, sel, func(_ *amqp.Channel, d amqp.Delivery, m Message) (string, error) {
+		headers, _ := json.Marshal(d.Headers)
+		a := &ArchivedMessage{
+			Queue:      in.DLQName(),
+			JobID:      m.JobID,
+			RetryCount: m.RetryCount,
+			LastError:  m.LastError,
+			Reason:     m.Reason,
+			Provider:   m.Provider,
+			Body:       string(d.Body),
+			Headers:    string(headers),
+			DeadAt:     m.Timestamp,
+		}
+		if m.Job != nil {
+			a.UserID = m.Job.UserID
+		}
+		if err := in.db.WithContext(ctx).Create(a).Error; err != nil {
+			return "", fmt.Errorf("dlq: archive job %s: %w", m.JobID, err)
+		}
+		return "", nil
+	})
+}
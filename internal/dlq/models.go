@@ -0,0 +1,21 @@
+package dlq
+
+import "time"
+
+// ArchivedMessage is a dead letter kept for later analysis instead of being replayed.
+type ArchivedMessage struct {
+	ID         uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	Queue      string    `gorm:"type:varchar(255);not null" json:"queue"`
+	JobID      string    `gorm:"type:varchar(26);not null;index" json:"job_id"`
+	UserID     uint64    `gorm:"not null;index" json:"user_id"`
+	RetryCount int       `gorm:"not null" json:"retry_count"`
+	LastError  string    `gorm:"type:text" json:"last_error"`
+	Reason     string    `gorm:"type:varchar(255);index" json:"reason"`
+	Provider   string    `gorm:"type:varchar(64)" json:"provider,omitempty"`
+	Body       string    `gorm:"type:text;not null" json:"body"`
+	Headers    string    `gorm:"type:text" json:"headers"`
+	DeadAt     time.Time `json:"dead_at"`
+	CreatedAt  time.Time `json:"archived_at"`
+}
+
+func (ArchivedMessage) TableName() string { return "dlq_archive" }
@@ -0,0 +1,103 @@
+package dlq
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ulidRe   = regexp.MustCompile(`\b[0-9A-HJKMNP-TV-Z]{26}\b`)
+	uuidRe   = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	hexRe    = regexp.MustCompile(`(?i)\b[0-9a-f]{16,}\b`)
+	urlRe    = regexp.MustCompile(`https?://[^\s"']+`)
+	numberRe = regexp.MustCompile(`\b\d{4,}\b`)
+	spaceRe  = regexp.MustCompile(`\s+`)
+	// a leading "provider:" as written by ai.StatusError and the fallback wrapper
+	providerRe = regexp.MustCompile(`^([a-z][a-z0-9_-]*): `)
+)
+
+const (
+	maxReasonLen    = 160
+	maxGroupSamples = 5
+	multiProvider   = "multiple"
+)
+
+// Reason reduces a worker error to what failures with the same cause share: ids, URLs and
+// long numbers are masked (HTTP status codes are kept) and the text is cut to a fixed length.
+func Reason(lastError string) string {
+	s := strings.TrimSpace(lastError)
+	if s == "" {
+		return "unknown"
+	}
+	s = urlRe.ReplaceAllString(s, "<url>")
+	s = ulidRe.ReplaceAllString(s, "<id>")
+	s = uuidRe.ReplaceAllString(s, "<id>")
+	s = hexRe.ReplaceAllString(s, "<id>")
+	s = numberRe.ReplaceAllString(s, "<n>")
+	s = spaceRe.ReplaceAllString(s, " ")
+	if r := []rune(s); len(r) > maxReasonLen {
+		s = string(r[:maxReasonLen]) + "…"
+	}
+	return s
+}
+
+// Provider returns the AI provider a worker error names, "multiple" when a fallback chain
+// failed on several providers, or "" when it does not come from a provider.
+func Provider(lastError string) string {
+	s := strings.TrimSpace(lastError)
+	if rest, ok := strings.CutPrefix(s, "all ai providers failed: "); ok {
+		// one error per target of the chain, see truncateErr in cmd/worker
+		name := ""
+		for _, part := range strings.Split(rest, "; ") {
+			m := providerRe.FindStringSubmatch(part)
+			if m == nil || (name != "" && m[1] != name) {
+				return multiProvider
+			}
+			name = m[1]
+		}
+		return name
+	}
+	if m := providerRe.FindStringSubmatch(s); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// Group is one failure reason and the messages that died of it.
+type Group struct {
+	Reason    string    `json:"reason"`
+	Provider  string    `json:"provider,omitempty"`
+	Count     int       `json:"count"`
+	JobIDs    []string  `json:"job_ids"` // the first few only
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// GroupMessages groups msgs by reason, largest group first.
+func GroupMessages(msgs []Message) []Group {
+	index := map[string]int{}
+	var out []Group
+	for _, m := range msgs {
+		i, ok := index[m.Reason]
+		if !ok {
+			i = len(out)
+			index[m.Reason] = i
+			out = append(out, Group{Reason: m.Reason, Provider: m.Provider, FirstSeen: m.Timestamp, LastSeen: m.Timestamp})
+		}
+		g := &out[i]
+		g.Count++
+		if len(g.JobIDs) < maxGroupSamples {
+			g.JobIDs = append(g.JobIDs, m.JobID)
+		}
+		if m.Timestamp.Before(g.FirstSeen) {
+			g.FirstSeen = m.Timestamp
+		}
+		if m.Timestamp.After(g.LastSeen) {
+			g.LastSeen = m.Timestamp
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	return out
+}
@@ -0,0 +1,100 @@
+package dlq
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReason(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"", "unknown"},
+		{"   ", "unknown"},
+		{"openrouter: status 429: rate limited", "openrouter: status 429: rate limited"},
+		{"job 01HZX3K4M5N6P7Q8R9S0T1V2W3 failed", "job <id> failed"},
+		{"request 123e4567-e89b-12d3-a456-426614174000 timed out", "request <id> timed out"},
+		{"trace deadbeefdeadbeef0123 lost", "trace <id> lost"},
+		{`Post "https://api.example.com/v1/chat?key=abc": dial tcp: i/o timeout`, `Post "<url>": dial tcp: i/o timeout`},
+		{"context length 131072 exceeded by 20000 tokens", "context length <n> exceeded by <n> tokens"},
+		{"ollama:  status 500\n\tinternal   error", "ollama: status 500 internal error"},
+	}
+	for _, tc := range cases {
+		if got := Reason(tc.in); got != tc.want {
+			t.Fatalf("Reason(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	// the same cause with different ids groups together
+	a := Reason("ollama: session 01HZX3K4M5N6P7Q8R9S0T1V2W3 not found")
+	b := Reason("ollama: session 01HZX3K4M5N6P7Q8R9S0T1V2W4 not found")
+	if a != b {
+		t.Fatalf("%q != %q", a, b)
+	}
+
+	long := Reason(strings.Repeat("é", 500))
+	if r := []rune(long); len(r) != maxReasonLen+1 || r[maxReasonLen] != '…' {
+		t.Fatalf("long reason has %d runes: %q", len(r), long)
+	}
+}
+
+func TestProvider(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"ollama: status 500", "ollama"},
+		{"open_router-2: boom", "open_router-2"},
+		{"Ollama: status 500", ""},
+		{"context deadline exceeded", ""},
+		{"all ai providers failed: ollama: down", "ollama"},
+		{"all ai providers failed: ollama: down; ollama: still down", "ollama"},
+		{"all ai providers failed: ollama: down; openrouter: status 429", multiProvider},
+		{"all ai providers failed: ollama: down; circuit open", multiProvider},
+	}
+	for _, tc := range cases {
+		if got := Provider(tc.in); got != tc.want {
+			t.Fatalf("Provider(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestGroupMessages(t *testing.T) {
+	if g := GroupMessages(nil); len(g) != 0 {
+		t.Fatalf("groups of nothing = %+v", g)
+	}
+
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var msgs []Message
+	for i := 0; i < 7; i++ {
+		msgs = append(msgs, Message{JobID: string(rune('a' + i)), Reason: "timeout", Provider: "ollama", Timestamp: t0.Add(time.Duration(i%3) * time.Hour)})
+	}
+	msgs = append(msgs,
+		Message{JobID: "x", Reason: "rate limited", Provider: "openrouter", Timestamp: t0.Add(5 * time.Hour)},
+		Message{JobID: "y", Reason: "rate limited", Provider: "openrouter", Timestamp: t0.Add(-time.Hour)},
+		Message{JobID: "z", Reason: "unknown", Timestamp: t0},
+	)
+	// the smaller groups come first in the input but sort after the big one
+	msgs = append(msgs[7:], msgs[:7]...)
+
+	groups := GroupMessages(msgs)
+	if len(groups) != 3 {
+		t.Fatalf("groups = %+v", groups)
+	}
+	g := groups[0]
+	if g.Reason != "timeout" || g.Provider != "ollama" || g.Count != 7 || len(g.JobIDs) != maxGroupSamples || g.JobIDs[0] != "a" {
+		t.Fatalf("largest group = %+v", g)
+	}
+	if !g.FirstSeen.Equal(t0) || !g.LastSeen.Equal(t0.Add(2*time.Hour)) {
+		t.Fatalf("timeout seen %v..%v", g.FirstSeen, g.LastSeen)
+	}
+	// equal counts keep their input order
+	g = groups[1]
+	if g.Reason != "rate limited" || g.Count != 2 || !g.FirstSeen.Equal(t0.Add(-time.Hour)) || !g.LastSeen.Equal(t0.Add(5*time.Hour)) {
+		t.Fatalf("second group = %+v", g)
+	}
+	if groups[2].Reason != "unknown" || groups[2].Provider != "" || groups[2].Count != 1 {
+		t.Fatalf("third group = %+v", groups[2])
+	}
+}
@@ -0,0 +1,118 @@
+package docs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// Supported document types.
+const (
+	TypePDF      = "application/pdf"
+	TypeMarkdown = "text/markdown"
+	TypeText     = "text/plain"
+)
+
+// detectType picks the document type from the file extension, falling back to sniffing.
+func detectType(filename string, data []byte) (string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".pdf":
+		return TypePDF, nil
+	case ".md", ".markdown":
+		return TypeMarkdown, nil
+	case ".txt", ".text":
+		return TypeText, nil
+	}
+	if bytes.HasPrefix(data, []byte("%PDF-")) {
+		return TypePDF, nil
+	}
+	if utf8.Valid(data) {
+		return TypeText, nil
+	}
+	return "", ErrUnsupportedType
+}
+
+func extractText(mimeType string, data []byte) (string, error) {
+	var text string
+	switch mimeType {
+	case TypePDF:
+		t, err := extractPDF(data)
+		if err != nil {
+			return "", err
+		}
+		text = t
+	case TypeMarkdown, TypeText:
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("%w: text is not valid UTF-8", ErrUnsupportedType)
+		}
+		text = string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	default:
+		return "", ErrUnsupportedType
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if strings.TrimSpace(text) == "" {
+		return "", ErrEmptyDocument
+	}
+	return text, nil
+}
+
+func extractPDF(data []byte) (text string, err error) {
+	// the parser panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("%w: unreadable pdf", ErrUnsupportedType)
+		}
+	}()
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("%w: unreadable pdf: %v", ErrUnsupportedType, err)
+	}
+	plain, err := r.GetPlainText()
+	if err != nil {
+		return "", fmt.Errorf("%w: unreadable pdf: %v", ErrUnsupportedType, err)
+	}
+	b, err := io.ReadAll(plain)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// chunkText splits text into pieces of at most size runes that overlap by about overlap
+// runes, preferring to cut at paragraph, line, sentence and word boundaries.
+func chunkText(text string, size, overlap int) []string {
+	r := []rune(text)
+	var out []string
+	for start := 0; start < len(r); {
+		end := min(start+size, len(r))
+		if end < len(r) {
+			end = breakPoint(r, start+size*3/4, end)
+		}
+		if c := strings.TrimSpace(string(r[start:end])); c != "" {
+			out = append(out, c)
+		}
+		if end == len(r) {
+			break
+		}
+		start = max(end-overlap, start+1)
+	}
+	return out
+}
+
+// breakPoint returns the end of the last paragraph, line, sentence or word boundary in
+// r[lo:hi], or hi if there is none.
+func breakPoint(r []rune, lo, hi int) int {
+	for _, sep := range [][]rune{[]rune("\n\n"), []rune("\n"), []rune(". "), []rune(" ")} {
+		for i := hi; i-len(sep) >= lo; i-- {
+			if string(r[i-len(sep):i]) == string(sep) {
+				return i
+			}
+		}
+	}
+	return hi
+}
@@ -0,0 +1,42 @@
+package docs
+
+import "time"
+
+// Document is an uploaded file whose text was split into embedded chunks.
+type Document struct {
+	ID       uint64 `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID   uint64 `gorm:"not null;index" json:"-"`
+	Title    string `gorm:"type:varchar(255);not null" json:"title"`
+	Filename string `gorm:"type:varchar(255);not null" json:"filename"`
+	MimeType string `gorm:"type:varchar(64);not null" json:"mime_type"`
+	Bytes    int64  `gorm:"not null" json:"bytes"`
+	Chunks   int    `gorm:"not null" json:"chunks"`
+	// "provider:model" the chunks were embedded with
+	EmbedModel string    `gorm:"type:varchar(128);not null" json:"embed_model"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (Document) TableName() string { return "documents" }
+
+// Chunk is a slice of a document's text and its embedding.
+type Chunk struct {
+	ID         uint64 `gorm:"primaryKey;autoIncrement"`
+	DocumentID uint64 `gorm:"not null;index"`
+	UserID     uint64 `gorm:"not null;index"`
+	Ord        int    `gorm:"not null"`
+	Content    string `gorm:"type:text;not null"`
+	Dim        int    `gorm:"not null"`
+	Vector     []byte `gorm:"not null"`
+}
+
+func (Chunk) TableName() string { return "document_chunks" }
+
+// SessionDocument attaches a document to a chat session.
+type SessionDocument struct {
+	SessionID  string `gorm:"primaryKey;type:varchar(26)"`
+	DocumentID uint64 `gorm:"primaryKey;autoIncrement:false;index"`
+	UserID     uint64 `gorm:"not null;index"`
+	CreatedAt  time.Time
+}
+
+func (SessionDocument) TableName() string { return "session_documents" }
@@ -0,0 +1,116 @@
+package docs
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Repo struct {
+	db *gorm.DB
+}
+
+func NewRepo(db *gorm.DB) *Repo {
+	return &Repo{db: db}
+}
+
+// CreateDocument inserts d and its chunks, filling in their document id.
+func (r *Repo) CreateDocument(ctx context.Context, d *Document, chunks []Chunk) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(d).Error; err != nil {
+			return err
+		}
+		for i := range chunks {
+			chunks[i].DocumentID = d.ID
+		}
+		return tx.CreateInBatches(chunks, 100).Error
+	})
+}
+
+func (r *Repo) CountDocuments(ctx context.Context, userID uint64) (int64, error) {
+	var n int64
+	err := r.db.WithContext(ctx).Model(&Document{}).Where("user_id = ?", userID).Count(&n).Error
+	return n, err
+}
+
+func (r *Repo) ListDocuments(ctx context.Context, userID uint64) ([]Document, error) {
+	var out []Document
+	err := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("id DESC").
+		Find(&out).Error
+	return out, err
+}
+
+func (r *Repo) GetDocument(ctx context.Context, userID, id uint64) (*Document, error) {
+	var d Document
+	if err := r.db.WithContext(ctx).
+		Where("id = ? AND user_id = ?", id, userID).
+		First(&d).Error; err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// DeleteDocument removes the document, its chunks and its session links; it returns the
+// number of documents deleted.
+func (r *Repo) DeleteDocument(ctx context.Context, userID, id uint64) (int64, error) {
+	var n int64
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND user_id = ?", id, userID).Delete(&Document{})
+		if res.Error != nil {
+			return res.Error
+		}
+		n = res.RowsAffected
+		if n == 0 {
+			return nil
+		}
+		if err := tx.Where("document_id = ? AND user_id = ?", id, userID).Delete(&Chunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("document_id = ? AND user_id = ?", id, userID).Delete(&SessionDocument{}).Error
+	})
+	return n, err
+}
+
+func (r *Repo) Attach(ctx context.Context, link *SessionDocument) error {
+	return r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(link).Error
+}
+
+func (r *Repo) Detach(ctx context.Context, userID uint64, sessionID string, documentID uint64) (int64, error) {
+	res := r.db.WithContext(ctx).
+		Where("session_id = ? AND document_id = ? AND user_id = ?", sessionID, documentID, userID).
+		Delete(&SessionDocument{})
+	return res.RowsAffected, res.Error
+}
+
+func (r *Repo) DetachSession(ctx context.Context, userID uint64, sessionID string) error {
+	return r.db.WithContext(ctx).
+		Where("session_id = ? AND user_id = ?", sessionID, userID).
+		Delete(&SessionDocument{}).Error
+}
+
+func (r *Repo) ListSessionDocuments(ctx context.Context, userID uint64, sessionID string) ([]Document, error) {
+	var out []Document
+	err := r.db.WithContext(ctx).
+		Model(&Document{}).
+		Joins("JOIN session_documents sd ON sd.document_id = documents.id").
+		Where("sd.session_id = ? AND sd.user_id = ? AND documents.user_id = ?", sessionID, userID, userID).
+		Order("sd.created_at ASC").
+		Find(&out).Error
+	return out, err
+}
+
+func (r *Repo) ListChunks(ctx context.Context, userID uint64, documentIDs []uint64) ([]Chunk, error) {
+	if len(documentIDs) == 0 {
+		return nil, nil
+	}
+	var out []Chunk
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND document_id IN ?", userID, documentIDs).
+		Find(&out).Error
+	return out, err
+}
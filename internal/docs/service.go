@@ -0,0 +1,295 @@
+package docs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+	"github.com/suPer8Hu/ai-platform/internal/chat"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrDocumentNotFound is returned for document ids that do not exist or belong to another user.
+	ErrDocumentNotFound = errors.New("document not found")
+	// ErrUnsupportedType is returned for files that are not PDF, Markdown or UTF-8 text.
+	ErrUnsupportedType = errors.New("unsupported document type")
+	// ErrEmptyDocument is returned for files without extractable text.
+	ErrEmptyDocument = errors.New("document has no extractable text")
+	// ErrLimitExceeded is returned when a per-user, per-session or per-document limit is hit.
+	ErrLimitExceeded = errors.New("document limit exceeded")
+)
+
+const (
+	chunkRunes   = 800
+	chunkOverlap = 100
+	// chunks embedded per provider call
+	embedBatchSize = 32
+
+	maxChunksPerDocument = 1000
+	maxDocumentsPerUser  = 100
+	maxDocumentsAttached = 10
+	maxTitleRunes        = 255
+
+	defaultTopK = 4
+	// chunks below this cosine similarity are not worth the prompt tokens
+	minChunkScore = 0.25
+	// query text beyond this is not embedded
+	maxQueryRunes = 2000
+)
+
+// Service indexes uploaded documents and retrieves their most relevant chunks for chat
+// sessions they are attached to. It implements chat.Retriever.
+type Service struct {
+	repo          *Repo
+	registry      *ai.Registry
+	embedProvider string
+	embedModel    string
+	topK          int
+}
+
+// NewService embeds chunks with the embedding model of provider.
+func NewService(repo *Repo, registry *ai.Registry, provider, model string) *Service {
+	return &Service{
+		repo:          repo,
+		registry:      registry,
+		embedProvider: strings.ToLower(strings.TrimSpace(provider)),
+		embedModel:    strings.TrimSpace(model),
+		topK:          defaultTopK,
+	}
+}
+
+// SetTopK sets how many chunks are retrieved per message.
+func (s *Service) SetTopK(k int) {
+	if k > 0 {
+		s.topK = k
+	}
+}
+
+func (s *Service) modelKey() string {
+	return s.embedProvider + ":" + s.embedModel
+}
+
+// Upload extracts, chunks and embeds data and stores the document.
+func (s *Service) Upload(ctx context.Context, userID uint64, title, filename string, data []byte) (*Document, error) {
+	filename = strings.TrimSpace(baseName(filename))
+	title = strings.TrimSpace(title)
+	if title == "" {
+		title = filename
+	}
+	if title == "" {
+		title = "Untitled"
+	}
+	if utf8.RuneCountInString(title) > maxTitleRunes {
+		title = string([]rune(title)[:maxTitleRunes])
+	}
+
+	mimeType, err := detectType(filename, data)
+	if err != nil {
+		return nil, err
+	}
+	text, err := extractText(mimeType, data)
+	if err != nil {
+		return nil, err
+	}
+	pieces := chunkText(text, chunkRunes, chunkOverlap)
+	if len(pieces) == 0 {
+		return nil, ErrEmptyDocument
+	}
+	if len(pieces) > maxChunksPerDocument {
+		return nil, fmt.Errorf("%w: document longer than %d chunks", ErrLimitExceeded, maxChunksPerDocument)
+	}
+
+	n, err := s.repo.CountDocuments(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n >= maxDocumentsPerUser {
+		return nil, fmt.Errorf("%w: at most %d documents", ErrLimitExceeded, maxDocumentsPerUser)
+	}
+
+	emb, err := s.registry.Embedder(ctx, s.embedProvider, s.embedModel)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]Chunk, len(pieces))
+	for start := 0; start < len(pieces); start += embedBatchSize {
+		batch := pieces[start:min(start+embedBatchSize, len(pieces))]
+		vecs, err := emb.Embed(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		if len(vecs) != len(batch) {
+			return nil, fmt.Errorf("embedder returned %d vectors for %d chunks", len(vecs), len(batch))
+		}
+		for i, v := range vecs {
+			chunks[start+i] = Chunk{
+				UserID:  userID,
+				Ord:     start + i,
+				Content: batch[i],
+				Dim:     len(v),
+				Vector:  ai.EncodeVector(v),
+			}
+		}
+	}
+
+	d := &Document{
+		UserID:     userID,
+		Title:      title,
+		Filename:   filename,
+		MimeType:   mimeType,
+		Bytes:      int64(len(data)),
+		Chunks:     len(chunks),
+		EmbedModel: s.modelKey(),
+	}
+	if err := s.repo.CreateDocument(ctx, d, chunks); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// baseName keeps the base name of an uploaded file name, whichever separator the client used.
+func baseName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	if utf8.RuneCountInString(name) > 255 {
+		name = string([]rune(name)[:255])
+	}
+	return name
+}
+
+func (s *Service) List(ctx context.Context, userID uint64) ([]Document, error) {
+	return s.repo.ListDocuments(ctx, userID)
+}
+
+func (s *Service) Get(ctx context.Context, userID, id uint64) (*Document, error) {
+	d, err := s.repo.GetDocument(ctx, userID, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDocumentNotFound
+	}
+	return d, err
+}
+
+// Delete removes the document and detaches it from every session.
+func (s *Service) Delete(ctx context.Context, userID, id uint64) error {
+	n, err := s.repo.DeleteDocument(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDocumentNotFound
+	}
+	return nil
+}
+
+// Attach makes the document's chunks available to the session's replies. The caller checks
+// that the session belongs to userID. Attaching twice is a no-op.
+func (s *Service) Attach(ctx context.Context, userID uint64, sessionID string, documentID uint64) error {
+	if _, err := s.Get(ctx, userID, documentID); err != nil {
+		return err
+	}
+	attached, err := s.repo.ListSessionDocuments(ctx, userID, sessionID)
+	if err != nil {
+		return err
+	}
+	for _, d := range attached {
+		if d.ID == documentID {
+			return nil
+		}
+	}
+	if len(attached) >= maxDocumentsAttached {
+		return fmt.Errorf("%w: at most %d documents per session", ErrLimitExceeded, maxDocumentsAttached)
+	}
+	return s.repo.Attach(ctx, &SessionDocument{SessionID: sessionID, DocumentID: documentID, UserID: userID})
+}
+
+func (s *Service) Detach(ctx context.Context, userID uint64, sessionID string, documentID uint64) error {
+	n, err := s.repo.Detach(ctx, userID, sessionID, documentID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDocumentNotFound
+	}
+	return nil
+}
+
+// DetachSession drops every attachment of a deleted session.
+func (s *Service) DetachSession(ctx context.Context, userID uint64, sessionID string) error {
+	return s.repo.DetachSession(ctx, userID, sessionID)
+}
+
+func (s *Service) ListAttached(ctx context.Context, userID uint64, sessionID string) ([]Document, error) {
+	return s.repo.ListSessionDocuments(ctx, userID, sessionID)
+}
+
+// Retrieve returns the topK chunks of the session's documents most similar to query, by
+// brute-force cosine similarity. Sessions without documents cost no embedding call.
+func (s *Service) Retrieve(ctx context.Context, userID uint64, sessionID, query string) ([]chat.Citation, error) {
+	attached, err := s.repo.ListSessionDocuments(ctx, userID, sessionID)
+	if err != nil || len(attached) == 0 {
+		return nil, err
+	}
+	byID := make(map[uint64]Document, len(attached))
+	ids := make([]uint64, 0, len(attached))
+	for _, d := range attached {
+		byID[d.ID] = d
+		ids = append(ids, d.ID)
+	}
+
+	emb, err := s.registry.Embedder(ctx, s.embedProvider, s.embedModel)
+	if err != nil {
+		return nil, err
+	}
+	if utf8.RuneCountInString(query) > maxQueryRunes {
+		query = string([]rune(query)[:maxQueryRunes])
+	}
+	qv, err := emb.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	if len(qv) != 1 {
+		return nil, fmt.Errorf("embedder returned %d vectors for 1 query", len(qv))
+	}
+
+	chunks, err := s.repo.ListChunks(ctx, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	type scored struct {
+		chunk *Chunk
+		score float64
+	}
+	var ranked []scored
+	for i := range chunks {
+		// documents embedded with another model are skipped until re-uploaded
+		if chunks[i].Dim != len(qv[0]) {
+			continue
+		}
+		if sc := ai.Cosine(qv[0], ai.DecodeVector(chunks[i].Vector)); sc >= minChunkScore {
+			ranked = append(ranked, scored{&chunks[i], sc})
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].score > ranked[j].score })
+	if len(ranked) > s.topK {
+		ranked = ranked[:s.topK]
+	}
+
+	out := make([]chat.Citation, 0, len(ranked))
+	for _, r := range ranked {
+		out = append(out, chat.Citation{
+			DocumentID: r.chunk.DocumentID,
+			Title:      byID[r.chunk.DocumentID].Title,
+			Chunk:      r.chunk.Ord,
+			Score:      math.Round(r.score*1000) / 1000,
+			Content:    r.chunk.Content,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/dlq"
+)
+
+// AdminListDLQ: GET /admin/dlq?limit= shows the head of the worker's dead-letter queue with the
+// jobs of its messages, grouped by failure reason. Messages stay in the queue.
+func (h *Handler) AdminListDLQ(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	rep, err := h.DLQ.List(c.Request.Context(), limit)
+	if err != nil {
+		log.Printf("[AdminListDLQ] err=%v", err)
+		fail(c, http.StatusBadGateway, 50011, "dlq unavailable")
+		return
+	}
+	ok(c, rep)
+}
+
+// AdminReplayDLQ: POST /admin/dlq/replay {"job_ids":[...]} or {"all":true} puts messages back
+// on the main queue with a reset retry count.
+func (h *Handler) AdminReplayDLQ(c *gin.Context) {
+	h.adminDLQ(c, "replay", h.DLQ.Replay)
+}
+
+// AdminPurgeDLQ: POST /admin/dlq/purge {"job_ids":[...]} or {"all":true} drops messages.
+func (h *Handler) AdminPurgeDLQ(c *gin.Context) {
+	h.adminDLQ(c, "purge", h.DLQ.Purge)
+}
+
+// AdminArchiveDLQ: POST /admin/dlq/archive {"job_ids":[...]} or {"all":true} moves messages
+// into the dlq_archive table.
+func (h *Handler) AdminArchiveDLQ(c *gin.Context) {
+	h.adminDLQ(c, "archive", h.DLQ.Archive)
+}
+
+func (h *Handler) adminDLQ(c *gin.Context, op string, run func(ctx context.Context, sel dlq.Selection) (*dlq.Result, error)) {
+	var sel dlq.Selection
+	if err := c.ShouldBindJSON(&sel); err != nil {
+		fail(c, http.StatusBadRequest, 10001, "invalid json")
+		return
+	}
+	uid, _ := userIDFromContext(c)
+	res, err := run(c.Request.Context(), sel)
+	if err != nil {
+		if errors.Is(err, dlq.ErrNoSelection) {
+			fail(c, http.StatusBadRequest, 10002, err.Error())
+			return
+		}
+		log.Printf("[AdminDLQ] op=%s admin=%d err=%v", op, uid, err)
+		fail(c, http.StatusBadGateway, 50011, "dlq "+op+" failed")
+		return
+	}
+	log.Printf("[AdminDLQ] op=%s admin=%d all=%t jobs=%d matched=%d processed=%d skipped=%d",
+		op, uid, sel.All, len(sel.JobIDs), res.Matched, res.Processed, len(res.Skipped))
+	ok(c, res)
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/chat"
+	"gorm.io/gorm"
+)
+
+// failAttachment writes the response for attachment errors and reports whether err was one.
+func failAttachment(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, chat.ErrAttachmentsDisabled):
+		fail(c, http.StatusServiceUnavailable, 50306, err.Error())
+	case errors.Is(err, chat.ErrAttachmentNotFound):
+		fail(c, http.StatusNotFound, 40409, "attachment not found")
+	case errors.Is(err, chat.ErrUnsupportedImage):
+		fail(c, http.StatusBadRequest, 10006, err.Error())
+	case errors.Is(err, chat.ErrTooManyAttachments):
+		fail(c, http.StatusBadRequest, 10002, err.Error())
+	case errors.Is(err, chat.ErrTooManyPendingAttachments):
+		fail(c, http.StatusTooManyRequests, 42903, err.Error())
+	default:
+		return false
+	}
+	return true
+}
+
+func attachmentIDParam(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		fail(c, http.StatusBadRequest, 10002, "invalid attachment id")
+		return 0, false
+	}
+	return id, true
+}
+
+// UploadChatAttachment: POST /chat/sessions/:session_id/attachments (multipart: image). The
+// returned id goes into attachment_ids of the next message sent to the session.
+func (h *Handler) UploadChatAttachment(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+
+	maxBytes := h.Cfg.AttachmentsMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = 10 * 1024 * 1024
+	}
+	// room for the multipart envelope
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+64*1024)
+
+	file, err := c.FormFile("image")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			fail(c, http.StatusRequestEntityTooLarge, 10004, "image too large")
+			return
+		}
+		fail(c, http.StatusBadRequest, 10002, "image file required")
+		return
+	}
+	if file.Size > maxBytes {
+		fail(c, http.StatusRequestEntityTooLarge, 10004, "image too large")
+		return
+	}
+	src, err := file.Open()
+	if err != nil {
+		fail(c, http.StatusBadRequest, 10005, "failed to read image")
+		return
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		fail(c, http.StatusBadRequest, 10005, "failed to read image")
+		return
+	}
+
+	a, err := h.ChatSvc.UploadAttachment(c.Request.Context(), uid, c.Param("session_id"), data)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			fail(c, http.StatusNotFound, 40401, "session not found")
+			return
+		}
+		if failAttachment(c, err) {
+			return
+		}
+		log.Printf("[UploadChatAttachment] uid=%d session_id=%s err=%v", uid, c.Param("session_id"), err)
+		fail(c, http.StatusInternalServerError, 50001, "internal error")
+		return
+	}
+	ok(c, a)
+}
+
+// GetChatAttachment: GET /chat/attachments/:id returns the image itself.
+func (h *Handler) GetChatAttachment(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	id, okk := attachmentIDParam(c)
+	if !okk {
+		return
+	}
+
+	a, err := h.ChatSvc.GetAttachment(c.Request.Context(), uid, id)
+	if err != nil {
+		if failAttachment(c, err) {
+			return
+		}
+		log.Printf("[GetChatAttachment] uid=%d id=%d err=%v", uid, id, err)
+		fail(c, http.StatusInternalServerError, 50001, "internal error")
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("ETag", `"`+a.SHA256+`"`)
+	c.Data(http.StatusOK, a.MimeType, a.Data)
+}
+
+// DeleteChatAttachment: DELETE /chat/attachments/:id, only for uploads not yet sent with a message.
+func (h *Handler) DeleteChatAttachment(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	id, okk := attachmentIDParam(c)
+	if !okk {
+		return
+	}
+
+	if err := h.ChatSvc.DeleteAttachment(c.Request.Context(), uid, id); err != nil {
+		if failAttachment(c, err) {
+			return
+		}
+		fail(c, http.StatusInternalServerError, 20001, "db error")
+		return
+	}
+	ok(c, gin.H{"id": id, "deleted": true})
+}
@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
@@ -11,9 +13,13 @@ import (
 	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/suPer8Hu/ai-platform/internal/ai"
 	"github.com/suPer8Hu/ai-platform/internal/chat"
 	"github.com/suPer8Hu/ai-platform/internal/common"
 	"github.com/suPer8Hu/ai-platform/internal/httpapi/middleware"
+	"github.com/suPer8Hu/ai-platform/internal/models"
+	"github.com/suPer8Hu/ai-platform/internal/store/redisstore"
 	"gorm.io/gorm"
 )
 
@@ -45,6 +51,11 @@ func userIDFromContext(c *gin.Context) (uint64, bool) {
 type createSessionReq struct {
 	Provider string `json:"provider"`
 	Model    string `json:"model"`
+	// optional provider:model entries tried in order when the primary fails
+	Fallbacks []string `json:"fallbacks"`
+	// optional preset; provider, model and settings given here override the persona's
+	PersonaID uint64 `json:"persona_id"`
+	chat.GenerationSettings
 }
 
 func (h *Handler) CreateChatSession(c *gin.Context) {
@@ -59,6 +70,26 @@ func (h *Handler) CreateChatSession(c *gin.Context) {
 
 	provider := strings.TrimSpace(req.Provider)
 	model := strings.TrimSpace(req.Model)
+	settings := req.GenerationSettings
+	if req.PersonaID > 0 {
+		persona, err := h.ChatSvc.GetPersona(c.Request.Context(), uid, req.PersonaID)
+		if err != nil {
+			if errors.Is(err, chat.ErrPersonaNotFound) {
+				fail(c, http.StatusNotFound, 40405, "persona not found")
+				return
+			}
+			fail(c, http.StatusInternalServerError, 50001, "failed to create session")
+			return
+		}
+		// the persona's model only applies to the persona's provider
+		if provider == "" || strings.EqualFold(provider, persona.Provider) {
+			provider = persona.Provider
+			if model == "" {
+				model = persona.Model
+			}
+		}
+		settings = persona.GenerationSettings.Merge(req.GenerationSettings)
+	}
 	if provider == "" {
 		provider = h.Cfg.AIProvider
 	}
@@ -71,8 +102,18 @@ func (h *Handler) CreateChatSession(c *gin.Context) {
 		}
 	}
 
-	sess, err := h.ChatSvc.CreateSession(c.Request.Context(), uid, provider, model)
+	fallbacks, err := ai.ParseTargets(strings.Join(req.Fallbacks, ","))
+	if err != nil {
+		fail(c, http.StatusBadRequest, 10002, err.Error())
+		return
+	}
+
+	sess, err := h.ChatSvc.CreateSession(c.Request.Context(), uid, provider, model, fallbacks, settings)
 	if err != nil {
+		if errors.Is(err, chat.ErrInvalidFallback) || errors.Is(err, chat.ErrInvalidSettings) {
+			fail(c, http.StatusBadRequest, 10002, err.Error())
+			return
+		}
 		fail(c, http.StatusInternalServerError, 50001, "failed to create session")
 		return
 	}
@@ -158,6 +199,88 @@ func (h *Handler) UpdateChatSessionTitle(c *gin.Context) {
 	ok(c, gin.H{"session_id": sessionID, "title": title})
 }
 
+type updateSessionFallbacksReq struct {
+	Fallbacks []string `json:"fallbacks"`
+}
+
+// UpdateChatSessionFallbacks replaces the session's fallback chain; an empty list reverts to the global chain.
+func (h *Handler) UpdateChatSessionFallbacks(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+
+	sessionID := c.Param("session_id")
+	if sessionID == "" {
+		fail(c, http.StatusBadRequest, 10002, "session_id required")
+		return
+	}
+
+	var req updateSessionFallbacksReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, 10001, "invalid json")
+		return
+	}
+	fallbacks, err := ai.ParseTargets(strings.Join(req.Fallbacks, ","))
+	if err != nil {
+		fail(c, http.StatusBadRequest, 10002, err.Error())
+		return
+	}
+
+	if err := h.ChatSvc.SetSessionFallbacks(c.Request.Context(), uid, sessionID, fallbacks); err != nil {
+		if errors.Is(err, chat.ErrInvalidFallback) {
+			fail(c, http.StatusBadRequest, 10002, err.Error())
+			return
+		}
+		if err == gorm.ErrRecordNotFound {
+			fail(c, http.StatusNotFound, 40401, "session not found")
+			return
+		}
+		fail(c, http.StatusInternalServerError, 50007, "failed to update session fallbacks")
+		return
+	}
+
+	ok(c, gin.H{"session_id": sessionID, "fallbacks": ai.FormatTargets(fallbacks)})
+}
+
+// UpdateChatSessionSettings replaces the session's system prompt and sampling parameters;
+// omitted fields are cleared.
+func (h *Handler) UpdateChatSessionSettings(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+
+	sessionID := c.Param("session_id")
+	if sessionID == "" {
+		fail(c, http.StatusBadRequest, 10002, "session_id required")
+		return
+	}
+
+	var req chat.GenerationSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, 10001, "invalid json")
+		return
+	}
+
+	if err := h.ChatSvc.SetSessionSettings(c.Request.Context(), uid, sessionID, req); err != nil {
+		if errors.Is(err, chat.ErrInvalidSettings) {
+			fail(c, http.StatusBadRequest, 10002, err.Error())
+			return
+		}
+		if err == gorm.ErrRecordNotFound {
+			fail(c, http.StatusNotFound, 40401, "session not found")
+			return
+		}
+		fail(c, http.StatusInternalServerError, 50008, "failed to update session settings")
+		return
+	}
+
+	ok(c, gin.H{"session_id": sessionID, "settings": req})
+}
+
 func (h *Handler) DeleteChatSession(c *gin.Context) {
 	uid, okk := userIDFromContext(c)
 	if !okk {
@@ -179,6 +302,11 @@ func (h *Handler) DeleteChatSession(c *gin.Context) {
 		fail(c, http.StatusInternalServerError, 50005, "failed to delete session")
 		return
 	}
+	if h.DocSvc != nil {
+		if err := h.DocSvc.DetachSession(c.Request.Context(), uid, sessionID); err != nil {
+			log.Printf("delete session %s: failed to detach documents: %v", sessionID, err)
+		}
+	}
 
 	ok(c, gin.H{"session_id": sessionID, "deleted": true})
 }
@@ -186,6 +314,8 @@ func (h *Handler) DeleteChatSession(c *gin.Context) {
 type sendMessageReq struct {
 	SessionID string `json:"session_id" binding:"required"`
 	Message   string `json:"message" binding:"required"`
+	// optional: images uploaded to the session beforehand
+	AttachmentIDs []uint64 `json:"attachment_ids"`
 }
 
 func (h *Handler) SendChatMessage(c *gin.Context) {
@@ -201,12 +331,15 @@ func (h *Handler) SendChatMessage(c *gin.Context) {
 		return
 	}
 
-	reply, msgID, err := h.ChatSvc.SendMessage(c.Request.Context(), uid, req.SessionID, req.Message)
+	reply, msgID, err := h.ChatSvc.SendMessage(c.Request.Context(), uid, req.SessionID, req.Message, req.AttachmentIDs...)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			fail(c, http.StatusNotFound, 40004, "session not found")
 			return
 		}
+		if failAttachment(c, err) {
+			return
+		}
 		fail(c, http.StatusBadRequest, 40001, "failed to send message")
 		return
 	}
@@ -236,6 +369,11 @@ func (h *Handler) ListChatMessages(c *gin.Context) {
 		}
 	}
 
+	if c.Query("branch") == "active" {
+		h.listActiveBranch(c, uid, sessionID, limit, beforeID)
+		return
+	}
+
 	msgs, err := h.ChatSvc.ListMessages(c.Request.Context(), uid, sessionID, limit, beforeID)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
@@ -257,10 +395,148 @@ func (h *Handler) ListChatMessages(c *gin.Context) {
 	})
 }
 
+// listActiveBranch serves ?branch=active: only the messages on the session's active branch,
+// each with the ids of its siblings.
+func (h *Handler) listActiveBranch(c *gin.Context, uid uint64, sessionID string, limit int, beforeID uint64) {
+	msgs, err := h.ChatSvc.ListActiveBranch(c.Request.Context(), uid, sessionID, limit, beforeID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			fail(c, http.StatusNotFound, 40004, "session not found")
+			return
+		}
+		if errors.Is(err, chat.ErrMessageNotFound) {
+			fail(c, http.StatusNotFound, 40404, "message not found")
+			return
+		}
+		fail(c, http.StatusInternalServerError, 50002, "failed to list messages")
+		return
+	}
+
+	var nextBeforeID uint64
+	if len(msgs) > 0 && msgs[len(msgs)-1].ParentID != nil {
+		nextBeforeID = msgs[len(msgs)-1].ID
+	}
+
+	ok(c, gin.H{
+		"messages":       msgs,
+		"next_before_id": nextBeforeID,
+	})
+}
+
+func messageIDParam(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		fail(c, http.StatusBadRequest, 10002, "invalid message id")
+		return 0, false
+	}
+	return id, true
+}
+
+func failBranch(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, chat.ErrMessageNotFound):
+		fail(c, http.StatusNotFound, 40404, "message not found")
+	case errors.Is(err, chat.ErrMessageNotEditable), errors.Is(err, chat.ErrNothingToRegenerate):
+		fail(c, http.StatusBadRequest, 10002, err.Error())
+	default:
+		fail(c, http.StatusBadRequest, 40001, "failed to generate reply")
+	}
+}
+
+type editMessageReq struct {
+	Content string `json:"content" binding:"required"`
+}
+
+// EditChatMessage stores an edited copy of a user message as a new branch and replies to it.
+func (h *Handler) EditChatMessage(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	id, okk := messageIDParam(c)
+	if !okk {
+		return
+	}
+
+	var req editMessageReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, 10001, "invalid json")
+		return
+	}
+
+	userMsg, reply, err := h.ChatSvc.EditMessage(c.Request.Context(), uid, id, req.Content)
+	if err != nil {
+		failBranch(c, err)
+		return
+	}
+
+	ok(c, gin.H{
+		"session_id":      userMsg.SessionID,
+		"user_message_id": userMsg.ID,
+		"parent_id":       userMsg.ParentID,
+		"reply":           reply.Content,
+		"message_id":      reply.ID,
+	})
+}
+
+// RegenerateChatMessage generates another reply, as a sibling of the existing ones, to the
+// user message the given message answers.
+func (h *Handler) RegenerateChatMessage(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	id, okk := messageIDParam(c)
+	if !okk {
+		return
+	}
+
+	reply, err := h.ChatSvc.RegenerateMessage(c.Request.Context(), uid, id)
+	if err != nil {
+		failBranch(c, err)
+		return
+	}
+
+	ok(c, gin.H{
+		"session_id": reply.SessionID,
+		"parent_id":  reply.ParentID,
+		"reply":      reply.Content,
+		"message_id": reply.ID,
+	})
+}
+
+// ActivateChatMessage switches the session to the branch containing the given message.
+func (h *Handler) ActivateChatMessage(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	id, okk := messageIDParam(c)
+	if !okk {
+		return
+	}
+
+	leaf, err := h.ChatSvc.ActivateMessage(c.Request.Context(), uid, id)
+	if err != nil {
+		if errors.Is(err, chat.ErrMessageNotFound) {
+			fail(c, http.StatusNotFound, 40404, "message not found")
+			return
+		}
+		fail(c, http.StatusInternalServerError, 50001, "internal error")
+		return
+	}
+
+	ok(c, gin.H{"message_id": id, "active_leaf_id": leaf})
+}
+
 func (h *Handler) SendChatMessageStream(c *gin.Context) {
 	type reqBody struct {
-		SessionID string `json:"session_id" binding:"required"`
-		Message   string `json:"message" binding:"required"`
+		SessionID     string   `json:"session_id" binding:"required"`
+		Message       string   `json:"message" binding:"required"`
+		AttachmentIDs []uint64 `json:"attachment_ids"`
 	}
 
 	uid, okk := userIDFromContext(c)
@@ -286,6 +562,13 @@ func (h *Handler) SendChatMessageStream(c *gin.Context) {
 		idempoKeyPtr = &idempoKey
 	}
 
+	// stream id lets the client resume via GET /chat/messages/stream/:stream_id
+	streamID, err := common.NewULID()
+	if err != nil {
+		fail(c, http.StatusInternalServerError, 50001, "internal error")
+		return
+	}
+
 	// SSE headers
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
@@ -296,7 +579,7 @@ func (h *Handler) SendChatMessageStream(c *gin.Context) {
 	c.Status(http.StatusOK)
 
 	ctx := c.Request.Context()
-	chunks, done, msgIDCh, errs := h.ChatSvc.SendMessageStream(ctx, uid, req.SessionID, req.Message, idempoKeyPtr)
+	chunks, done, msgIDCh, errs, buffered := h.ChatSvc.SendMessageStream(ctx, uid, req.SessionID, req.Message, idempoKeyPtr, streamID, req.AttachmentIDs...)
 
 	// heartbeat ticker (keeps connections alive)
 	ticker := time.NewTicker(15 * time.Second)
@@ -310,31 +593,44 @@ func (h *Handler) SendChatMessageStream(c *gin.Context) {
 	}
 
 	writeJSON := func(event string, payload any) {
-		b, err := json.Marshal(payload)
-		if err != nil {
-			// last-resort: send a simple error that won't break SSE framing
-			fmt.Fprintf(c.Writer, "event: error\ndata: {\"message\":\"json marshal failed\"}\n\n")
-			flusher.Flush()
-			return
-		}
-		if event != "" {
-			fmt.Fprintf(c.Writer, "event: %s\n", event)
+		writeSSE(c.Writer, flusher, 0, event, payload)
+	}
+
+	// the service reports buffering before any chunk or error, so meta still
+	// goes out first; stream_id is only advertised when the reply is actually
+	// buffered, since resuming an unbuffered stream would just 404
+	writeMeta := func(isBuffered bool) {
+		buffered = nil
+		meta := gin.H{"type": "meta"}
+		if isBuffered {
+			meta["stream_id"] = streamID
 		}
-		fmt.Fprintf(c.Writer, "data: %s\n\n", string(b))
-		flusher.Flush()
+		writeJSON("meta", meta)
 	}
 
+	// SSE id == chunk sequence number, matching the server-side buffer
+	var seq int64
+	writeChunk := func(delta string) {
+		seq++
+		writeSSE(c.Writer, flusher, seq, "chunk", gin.H{
+			"type":  "chunk",
+			"delta": delta,
+		})
+	}
 	for {
 		select {
+		case b := <-buffered:
+			writeMeta(b)
+
 		case ch, ok := <-chunks:
 			if !ok {
 				chunks = nil
 				continue
 			}
-			writeJSON("chunk", gin.H{
-				"type":  "chunk",
-				"delta": ch,
-			})
+			if buffered != nil {
+				writeMeta(<-buffered)
+			}
+			writeChunk(ch)
 
 		case <-ticker.C:
 			writeJSON("ping", gin.H{
@@ -346,6 +642,9 @@ func (h *Handler) SendChatMessageStream(c *gin.Context) {
 			if err == nil {
 				continue
 			}
+			if buffered != nil {
+				writeMeta(<-buffered)
+			}
 			if err == gorm.ErrRecordNotFound {
 				writeJSON("error", gin.H{
 					"type":    "error",
@@ -360,6 +659,15 @@ func (h *Handler) SendChatMessageStream(c *gin.Context) {
 			return
 
 		case <-done:
+			if buffered != nil {
+				writeMeta(<-buffered)
+			}
+			// done can win the select while the last chunks are still queued
+			if chunks != nil {
+				for ch := range chunks {
+					writeChunk(ch)
+				}
+			}
 			var mid uint64
 			select {
 			case mid = <-msgIDCh:
@@ -377,10 +685,153 @@ func (h *Handler) SendChatMessageStream(c *gin.Context) {
 	}
 }
 
+// writeSSE writes one SSE frame; id > 0 adds an "id:" line so clients can resume with Last-Event-ID.
+func writeSSE(w io.Writer, flusher http.Flusher, id int64, event string, payload any) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		// last-resort: send a simple error that won't break SSE framing
+		fmt.Fprintf(w, "event: error\ndata: {\"message\":\"json marshal failed\"}\n\n")
+		flusher.Flush()
+		return
+	}
+	if id > 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	if event != "" {
+		fmt.Fprintf(w, "event: %s\n", event)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", string(b))
+	flusher.Flush()
+}
+
+// ResumeChatMessageStream replays the chunks of a buffered stream after Last-Event-ID
+// (header or last_event_id query), then follows it live until it finishes.
+func (h *Handler) ResumeChatMessageStream(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+
+	streamID := c.Param("stream_id")
+	if streamID == "" {
+		fail(c, http.StatusBadRequest, 10002, "stream_id required")
+		return
+	}
+
+	lastID := strings.TrimSpace(c.GetHeader("Last-Event-ID"))
+	if lastID == "" {
+		lastID = strings.TrimSpace(c.Query("last_event_id"))
+	}
+	var cursor int64
+	if lastID != "" {
+		n, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil || n < 0 {
+			fail(c, http.StatusBadRequest, 10002, "invalid last event id")
+			return
+		}
+		cursor = n
+	}
+
+	ctx := c.Request.Context()
+	state, err := h.Redis.GetStreamState(ctx, streamID)
+	if err != nil {
+		if err == redis.Nil {
+			fail(c, http.StatusNotFound, 40403, "stream not found")
+			return
+		}
+		fail(c, http.StatusInternalServerError, 50001, "internal error")
+		return
+	}
+	if state.UserID != uid {
+		// hide existence
+		fail(c, http.StatusNotFound, 40403, "stream not found")
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		fmt.Fprintf(c.Writer, "event: error\ndata: flusher not supported\n\n")
+		return
+	}
+
+	poll := time.NewTicker(250 * time.Millisecond)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	// state is always read before chunks: once a stream is finished nothing is appended to it,
+	// so seeing a finished state guarantees the following read drains the buffer.
+	for {
+		chunks, err := h.Redis.ReadStreamChunks(ctx, streamID, cursor)
+		if err != nil {
+			writeSSE(c.Writer, flusher, 0, "error", gin.H{
+				"type":    "error",
+				"message": "stream read failed",
+			})
+			return
+		}
+		for _, ch := range chunks {
+			cursor++
+			writeSSE(c.Writer, flusher, cursor, "chunk", gin.H{
+				"type":  "chunk",
+				"delta": ch,
+			})
+		}
+
+		switch state.Status {
+		case redisstore.StreamDone:
+			writeSSE(c.Writer, flusher, 0, "done", gin.H{
+				"type":       "done",
+				"message_id": state.AssistantMsgID,
+			})
+			return
+		case redisstore.StreamFailed:
+			writeSSE(c.Writer, flusher, 0, "error", gin.H{
+				"type":    "error",
+				"message": state.Error,
+			})
+			return
+		}
+
+		select {
+		case <-poll.C:
+		case <-heartbeat.C:
+			writeSSE(c.Writer, flusher, 0, "ping", gin.H{
+				"type": "ping",
+				"ts":   time.Now().Unix(),
+			})
+		case <-ctx.Done():
+			return
+		}
+
+		state, err = h.Redis.GetStreamState(ctx, streamID)
+		if err != nil {
+			writeSSE(c.Writer, flusher, 0, "error", gin.H{
+				"type":    "error",
+				"message": "stream expired",
+			})
+			return
+		}
+	}
+}
+
 func (h *Handler) SendChatMessageAsync(c *gin.Context) {
 	type reqBody struct {
 		SessionID string `json:"session_id" binding:"required"`
 		Message   string `json:"message" binding:"required"`
+		// optional: POSTed a signed JSON payload once the job succeeds or fails
+		CallbackURL string `json:"callback_url"`
+		// optional: low|normal|high, defaults to the user's plan
+		Priority string `json:"priority"`
+		// optional: images uploaded to the session beforehand
+		AttachmentIDs []uint64 `json:"attachment_ids"`
 	}
 	var req reqBody
 
@@ -406,6 +857,19 @@ func (h *Handler) SendChatMessageAsync(c *gin.Context) {
 		idempoKeyPtr = &idempoKey
 	}
 
+	var callbackURL *string
+	if u := strings.TrimSpace(req.CallbackURL); u != "" {
+		if err := h.ChatSvc.ValidateCallbackURL(u); err != nil {
+			if errors.Is(err, chat.ErrWebhooksDisabled) {
+				fail(c, http.StatusServiceUnavailable, 50305, err.Error())
+				return
+			}
+			fail(c, http.StatusBadRequest, 10002, err.Error())
+			return
+		}
+		callbackURL = &u
+	}
+
 	// Validate session belongs to user
 	if err := h.ChatSvc.ValidateSessionOwner(c.Request.Context(), uid, req.SessionID); err != nil {
 		if err == gorm.ErrRecordNotFound {
@@ -417,6 +881,22 @@ func (h *Handler) SendChatMessageAsync(c *gin.Context) {
 		return
 	}
 
+	var user models.User
+	if err := h.DB.WithContext(c.Request.Context()).Select("id", "plan").First(&user, uid).Error; err != nil {
+		log.Printf("[SendChatMessageAsync] load plan failed uid=%d err=%v", uid, err)
+		fail(c, http.StatusInternalServerError, 20001, "db error")
+		return
+	}
+	priority, err := chat.JobPriority(user.Plan, strings.TrimSpace(req.Priority))
+	if err != nil {
+		if errors.Is(err, chat.ErrJobPriorityNotAllowed) {
+			fail(c, http.StatusForbidden, 40302, err.Error())
+			return
+		}
+		fail(c, http.StatusBadRequest, 10002, err.Error())
+		return
+	}
+
 	// Build job (ID only matters if we end up creating a new row)
 	jobID, err := common.NewULID()
 	if err != nil {
@@ -431,55 +911,25 @@ func (h *Handler) SendChatMessageAsync(c *gin.Context) {
 		SessionID:      req.SessionID,
 		Prompt:         req.Message,
 		IdempotencyKey: idempoKeyPtr,
+		CallbackURL:    callbackURL,
+		Priority:       priority,
 		Status:         chat.JobQueued,
 	}
 
-	created := true
-	if idempoKeyPtr == nil {
-		// no idempotency -> always new job
-		if err := h.ChatSvc.CreateJob(c.Request.Context(), j); err != nil {
-			log.Printf("[SendChatMessageAsync] CreateJob failed uid=%d session_id=%s job_id=%s err=%v", uid, req.SessionID, jobID, err)
-			fail(c, http.StatusInternalServerError, 50001, "internal error")
-			return
-		}
-	} else {
-		var job *chat.Job
-		job, created, err = h.ChatSvc.CreateJobOrGetExisting(c.Request.Context(), j)
-		if err != nil {
-			log.Printf("[SendChatMessageAsync] CreateJobOrGetExisting failed uid=%d session_id=%s job_id=%s key=%s err=%v", uid, req.SessionID, jobID, idempoKey, err)
-			fail(c, http.StatusInternalServerError, 50001, "internal error")
+	// job, user message and outbox entry are stored together; the job is published right
+	// after, or by the worker's outbox relay if the broker is unavailable
+	j, _, err = h.ChatSvc.EnqueueJob(c.Request.Context(), j, req.AttachmentIDs...)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			fail(c, http.StatusNotFound, 40401, "session not found")
 			return
 		}
-		j = job
-	}
-
-	// Only the creator should insert the user message and enqueue the job.
-	if created {
-		// Insert user message (idempotent when key is present)
-		if idempoKeyPtr == nil {
-			if err := h.ChatSvc.InsertUserMessage(c.Request.Context(), uid, req.SessionID, req.Message); err != nil {
-				if err == gorm.ErrRecordNotFound {
-					fail(c, http.StatusNotFound, 40401, "session not found")
-					return
-				}
-				log.Printf("[SendChatMessageAsync] InsertUserMessage failed uid=%d session_id=%s err=%v", uid, req.SessionID, err)
-				fail(c, http.StatusInternalServerError, 50001, "internal error")
-				return
-			}
-		} else {
-			if _, _, err := h.ChatSvc.InsertUserMessageOrGetExisting(c.Request.Context(), uid, req.SessionID, req.Message, idempoKeyPtr); err != nil {
-				log.Printf("[SendChatMessageAsync] InsertUserMessageOrGetExisting failed uid=%d session_id=%s key=%s err=%v", uid, req.SessionID, idempoKey, err)
-				fail(c, http.StatusInternalServerError, 50001, "internal error")
-				return
-			}
-		}
-
-		// Enqueue
-		if err := h.Rabbit.PublishJob(c.Request.Context(), j.ID); err != nil {
-			log.Printf("[SendChatMessageAsync] PublishJob failed uid=%d session_id=%s job_id=%s err=%v", uid, req.SessionID, j.ID, err)
-			fail(c, http.StatusInternalServerError, 50002, "enqueue failed")
+		if failAttachment(c, err) {
 			return
 		}
+		log.Printf("[SendChatMessageAsync] EnqueueJob failed uid=%d session_id=%s job_id=%s err=%v", uid, req.SessionID, jobID, err)
+		fail(c, http.StatusInternalServerError, 50001, "internal error")
+		return
 	}
 
 	ok(c, gin.H{"job_id": j.ID})
@@ -512,15 +962,134 @@ func (h *Handler) GetChatJob(c *gin.Context) {
 		return
 	}
 
-	ok(c, gin.H{
-		"job": gin.H{
-			"id":                j.ID,
-			"session_id":        j.SessionID,
-			"status":            j.Status,
-			"result_message_id": j.ResultMessageID,
-			"error":             j.Error,
-			"created_at":        j.CreatedAt,
-			"updated_at":        j.UpdatedAt,
-		},
-	})
+	ok(c, gin.H{"job": jobJSON(j)})
+}
+
+func jobJSON(j *chat.Job) gin.H {
+	return gin.H{
+		"id":                j.ID,
+		"session_id":        j.SessionID,
+		"status":            j.Status,
+		"result_message_id": j.ResultMessageID,
+		"error":             j.Error,
+		"callback_url":      j.CallbackURL,
+		"priority":          j.Priority,
+		"created_at":        j.CreatedAt,
+		"updated_at":        j.UpdatedAt,
+	}
+}
+
+// CancelChatJob: POST /chat/jobs/:job_id/cancel. A running job stops generating and its reply
+// is dropped, unless the reply was stored before the cancel landed: then it is kept. Tool call
+// messages stored while generating stay either way.
+func (h *Handler) CancelChatJob(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	jobID := c.Param("job_id")
+	if jobID == "" {
+		fail(c, http.StatusBadRequest, 10002, "job_id required")
+		return
+	}
+
+	j, err := h.ChatSvc.CancelJob(c.Request.Context(), uid, jobID)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			fail(c, http.StatusNotFound, 40402, "job not found")
+		case errors.Is(err, chat.ErrJobNotCancellable):
+			fail(c, http.StatusConflict, 40902, "job already "+string(j.Status))
+		default:
+			fail(c, http.StatusInternalServerError, 50001, "internal error")
+		}
+		return
+	}
+	ok(c, gin.H{"job": jobJSON(j)})
+}
+
+// ChatJobEvents: GET /chat/jobs/:job_id/events streams the job's status changes and reply
+// chunks as SSE, starting with its current status, until the job finishes.
+func (h *Handler) ChatJobEvents(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	jobID := c.Param("job_id")
+	if jobID == "" {
+		fail(c, http.StatusBadRequest, 10002, "job_id required")
+		return
+	}
+
+	ctx := c.Request.Context()
+	events, err := h.ChatSvc.WatchJob(ctx, uid, jobID)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			fail(c, http.StatusNotFound, 40402, "job not found")
+		case errors.Is(err, chat.ErrJobEventsDisabled):
+			fail(c, http.StatusServiceUnavailable, 50304, err.Error())
+		default:
+			fail(c, http.StatusInternalServerError, 50001, "internal error")
+		}
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		fmt.Fprintf(c.Writer, "event: error\ndata: flusher not supported\n\n")
+		return
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev, more := <-events:
+			if !more {
+				return
+			}
+			writeSSE(c.Writer, flusher, 0, ev.Type, ev)
+		case <-heartbeat.C:
+			writeSSE(c.Writer, flusher, 0, "ping", gin.H{
+				"type": "ping",
+				"ts":   time.Now().Unix(),
+			})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SearchChat: GET /chat/search?q=&mode=keyword|semantic&limit=
+func (h *Handler) SearchChat(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	res, err := h.ChatSvc.Search(c.Request.Context(), uid, c.Query("q"), strings.TrimSpace(c.Query("mode")), limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, chat.ErrInvalidQuery):
+			fail(c, http.StatusBadRequest, 10002, "q required (max 200 characters), mode must be keyword or semantic")
+		case errors.Is(err, chat.ErrSemanticSearchDisabled):
+			fail(c, http.StatusBadRequest, 10002, err.Error())
+		default:
+			fail(c, http.StatusInternalServerError, 50009, "search failed")
+		}
+		return
+	}
+	ok(c, res)
 }
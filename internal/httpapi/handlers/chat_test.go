@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gormsqlite "github.com/glebarez/sqlite"
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+	"github.com/suPer8Hu/ai-platform/internal/chat"
+	"github.com/suPer8Hu/ai-platform/internal/httpapi/middleware"
+	"gorm.io/gorm"
+)
+
+// chunkProvider streams n one-letter chunks, more than the service buffers
+// ahead, so a handler that stops reading stalls the generator.
+type chunkProvider struct {
+	n int
+}
+
+func (p chunkProvider) Chat(ctx context.Context, messages []ai.Message) (ai.Response, error) {
+	return ai.Response{Message: ai.Message{Role: ai.RoleAssistant, Content: "ok"}}, nil
+}
+
+func (p chunkProvider) StreamChat(ctx context.Context, messages []ai.Message) (<-chan ai.StreamChunk, <-chan error) {
+	out := make(chan ai.StreamChunk)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(out)
+		defer close(errs)
+		for i := 0; i < p.n; i++ {
+			select {
+			case out <- ai.StreamChunk{Delta: "x"}:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return out, errs
+}
+
+type failingStreamBuffer struct{}
+
+func (failingStreamBuffer) InitStream(ctx context.Context, streamID string, userID uint64, sessionID string) error {
+	return errors.New("redis down")
+}
+
+func (failingStreamBuffer) AppendStreamChunk(ctx context.Context, streamID string, chunk string) error {
+	return errors.New("redis down")
+}
+
+func (failingStreamBuffer) FinishStream(ctx context.Context, streamID string, assistantMsgID uint64, errMsg string) error {
+	return errors.New("redis down")
+}
+
+type sseEvent struct {
+	event string
+	data  map[string]any
+}
+
+func parseSSE(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	for _, frame := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var ev sseEvent
+		for _, line := range strings.Split(frame, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				ev.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.data); err != nil {
+					t.Fatalf("decode %q: %v", line, err)
+				}
+			}
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestSendChatMessageStream_Unbuffered(t *testing.T) {
+	cases := []struct {
+		name string
+		buf  chat.StreamBuffer
+	}{
+		{"no buffer", nil},
+		{"init fails", failingStreamBuffer{}},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			db, err := gorm.Open(gormsqlite.Open("file::memory:"), &gorm.Config{})
+			if err != nil {
+				t.Fatalf("open db: %v", err)
+			}
+			sqlDB, err := db.DB()
+			if err != nil {
+				t.Fatalf("db: %v", err)
+			}
+			sqlDB.SetMaxOpenConns(1)
+			t.Cleanup(func() { sqlDB.Close() })
+			if err := db.AutoMigrate(&chat.Session{}, &chat.Message{}); err != nil {
+				t.Fatalf("automigrate: %v", err)
+			}
+
+			const chunks = 40
+			reg := ai.NewRegistry()
+			reg.Register("fake", func(ctx context.Context, model string) (ai.Provider, error) {
+				return chunkProvider{n: chunks}, nil
+			})
+			repo := chat.NewRepo(db)
+			svc := chat.NewService(repo, reg, 20)
+			if tc.buf != nil {
+				svc.SetStreamBuffer(tc.buf)
+			}
+
+			sess := &chat.Session{
+				SessionID: fmt.Sprintf("01TESTSTREAMSESSION000000%04d", i),
+				UserID:    7,
+				Provider:  "fake",
+				Model:     "default",
+				Title:     "t",
+			}
+			if err := repo.CreateSession(context.Background(), sess); err != nil {
+				t.Fatalf("create session: %v", err)
+			}
+
+			h := &Handler{DB: db, ChatSvc: svc}
+			r := gin.New()
+			r.POST("/chat/messages/stream", func(c *gin.Context) {
+				c.Set(middleware.UserIDKey, uint64(7))
+				h.SendChatMessageStream(c)
+			})
+
+			body, _ := json.Marshal(gin.H{"session_id": sess.SessionID, "message": "hi"})
+			req := httptest.NewRequest(http.MethodPost, "/chat/messages/stream", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			served := make(chan struct{})
+			go func() {
+				defer close(served)
+				r.ServeHTTP(w, req)
+			}()
+			select {
+			case <-served:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("stream did not finish")
+			}
+
+			events := parseSSE(t, w.Body.String())
+			if len(events) == 0 || events[0].event != "meta" {
+				t.Fatalf("expected meta first, got %+v", events)
+			}
+			if _, ok := events[0].data["stream_id"]; ok {
+				t.Fatalf("unbuffered stream advertised a stream_id: %+v", events[0].data)
+			}
+			var got int
+			for _, ev := range events {
+				if ev.event == "chunk" {
+					got++
+				}
+			}
+			if got != chunks {
+				t.Fatalf("expected %d chunks, got %d", chunks, got)
+			}
+			if last := events[len(events)-1]; last.event != "done" {
+				t.Fatalf("expected done last, got %+v", last)
+			}
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package handlers
 
 import (
-	"context"
 	"encoding/json"
 	"net/http"
 	"strings"
@@ -45,17 +44,13 @@ func (h *Handler) DemoChat(c *gin.Context) {
 		return
 	}
 
-	reply, err := provider.Chat(c.Request.Context(), messages)
+	resp, err := provider.Chat(c.Request.Context(), messages)
 	if err != nil {
 		common.Fail(c, http.StatusInternalServerError, 50011, "demo chat failed")
 		return
 	}
 
-	common.OK(c, gin.H{"reply": reply})
-}
-
-type streamProvider interface {
-	StreamChat(ctx context.Context, messages []ai.Message) (<-chan string, <-chan error)
+	common.OK(c, gin.H{"reply": resp.Content})
 }
 
 func (h *Handler) DemoChatStream(c *gin.Context) {
@@ -82,7 +77,7 @@ func (h *Handler) DemoChatStream(c *gin.Context) {
 		return
 	}
 
-	sp, ok := provider.(streamProvider)
+	sp, ok := provider.(ai.StreamProvider)
 	if !ok {
 		common.Fail(c, http.StatusInternalServerError, 50012, "demo stream not supported")
 		return
@@ -115,8 +110,8 @@ func (h *Handler) DemoChatStream(c *gin.Context) {
 				writeEvent("done", gin.H{"type": "done"})
 				return
 			}
-			if chunk != "" {
-				writeEvent("chunk", gin.H{"type": "chunk", "delta": chunk})
+			if chunk.Delta != "" {
+				writeEvent("chunk", gin.H{"type": "chunk", "delta": chunk.Delta})
 			}
 		case err, ok := <-errs:
 			if ok && err != nil {
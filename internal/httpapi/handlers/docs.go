@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/docs"
+	"gorm.io/gorm"
+)
+
+func documentIDParam(c *gin.Context, name string) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 64)
+	if err != nil || id == 0 {
+		fail(c, http.StatusBadRequest, 10002, "invalid document id")
+		return 0, false
+	}
+	return id, true
+}
+
+func failDocument(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, docs.ErrDocumentNotFound):
+		fail(c, http.StatusNotFound, 40406, "document not found")
+	case errors.Is(err, docs.ErrUnsupportedType), errors.Is(err, docs.ErrEmptyDocument), errors.Is(err, docs.ErrLimitExceeded):
+		fail(c, http.StatusBadRequest, 10002, err.Error())
+	default:
+		fail(c, http.StatusInternalServerError, 20001, "db error")
+	}
+}
+
+// docsEnabled fails the request when no embedding model is configured.
+func (h *Handler) docsEnabled(c *gin.Context) bool {
+	if h.DocSvc == nil {
+		fail(c, http.StatusServiceUnavailable, 50303, "documents are not configured")
+		return false
+	}
+	return true
+}
+
+// sessionOwned fails the request unless the session in the path belongs to uid.
+func (h *Handler) sessionOwned(c *gin.Context, uid uint64) (string, bool) {
+	sessionID := c.Param("session_id")
+	if err := h.ChatSvc.ValidateSessionOwner(c.Request.Context(), uid, sessionID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			fail(c, http.StatusNotFound, 40401, "session not found")
+			return "", false
+		}
+		fail(c, http.StatusInternalServerError, 50001, "internal error")
+		return "", false
+	}
+	return sessionID, true
+}
+
+// UploadDocument: POST /documents (multipart: file, optional title). The text is chunked and
+// embedded before the response, so large files take a while.
+func (h *Handler) UploadDocument(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	if !h.docsEnabled(c) {
+		return
+	}
+
+	maxBytes := h.Cfg.DocsMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = 10 * 1024 * 1024
+	}
+	// room for the multipart envelope
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+64*1024)
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			fail(c, http.StatusRequestEntityTooLarge, 10004, "document too large")
+			return
+		}
+		fail(c, http.StatusBadRequest, 10002, "file required")
+		return
+	}
+	if file.Size > maxBytes {
+		fail(c, http.StatusRequestEntityTooLarge, 10004, "document too large")
+		return
+	}
+	src, err := file.Open()
+	if err != nil {
+		fail(c, http.StatusBadRequest, 10005, "failed to read document")
+		return
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		fail(c, http.StatusBadRequest, 10005, "failed to read document")
+		return
+	}
+
+	d, err := h.DocSvc.Upload(c.Request.Context(), uid, c.PostForm("title"), file.Filename, data)
+	if err != nil {
+		switch {
+		case errors.Is(err, docs.ErrUnsupportedType), errors.Is(err, docs.ErrEmptyDocument), errors.Is(err, docs.ErrLimitExceeded):
+			failDocument(c, err)
+		default:
+			log.Printf("[UploadDocument] uid=%d file=%q err=%v", uid, file.Filename, err)
+			fail(c, http.StatusBadGateway, 50010, "failed to index document")
+		}
+		return
+	}
+	ok(c, d)
+}
+
+// ListDocuments: GET /documents
+func (h *Handler) ListDocuments(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	if !h.docsEnabled(c) {
+		return
+	}
+	list, err := h.DocSvc.List(c.Request.Context(), uid)
+	if err != nil {
+		failDocument(c, err)
+		return
+	}
+	ok(c, gin.H{"documents": list})
+}
+
+// GetDocument: GET /documents/:id
+func (h *Handler) GetDocument(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	if !h.docsEnabled(c) {
+		return
+	}
+	id, okk := documentIDParam(c, "id")
+	if !okk {
+		return
+	}
+	d, err := h.DocSvc.Get(c.Request.Context(), uid, id)
+	if err != nil {
+		failDocument(c, err)
+		return
+	}
+	ok(c, d)
+}
+
+// DeleteDocument: DELETE /documents/:id also detaches it from every session. Replies that
+// cited it keep their citations.
+func (h *Handler) DeleteDocument(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	if !h.docsEnabled(c) {
+		return
+	}
+	id, okk := documentIDParam(c, "id")
+	if !okk {
+		return
+	}
+	if err := h.DocSvc.Delete(c.Request.Context(), uid, id); err != nil {
+		failDocument(c, err)
+		return
+	}
+	ok(c, gin.H{"id": id, "deleted": true})
+}
+
+// ListSessionDocuments: GET /chat/sessions/:session_id/documents
+func (h *Handler) ListSessionDocuments(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	if !h.docsEnabled(c) {
+		return
+	}
+	sessionID, okk := h.sessionOwned(c, uid)
+	if !okk {
+		return
+	}
+	list, err := h.DocSvc.ListAttached(c.Request.Context(), uid, sessionID)
+	if err != nil {
+		failDocument(c, err)
+		return
+	}
+	ok(c, gin.H{"session_id": sessionID, "documents": list})
+}
+
+type attachDocumentReq struct {
+	DocumentID uint64 `json:"document_id" binding:"required"`
+}
+
+// AttachSessionDocument: POST /chat/sessions/:session_id/documents
+func (h *Handler) AttachSessionDocument(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	if !h.docsEnabled(c) {
+		return
+	}
+	var req attachDocumentReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, 10001, "invalid json")
+		return
+	}
+	sessionID, okk := h.sessionOwned(c, uid)
+	if !okk {
+		return
+	}
+	if err := h.DocSvc.Attach(c.Request.Context(), uid, sessionID, req.DocumentID); err != nil {
+		failDocument(c, err)
+		return
+	}
+	ok(c, gin.H{"session_id": sessionID, "document_id": req.DocumentID, "attached": true})
+}
+
+// DetachSessionDocument: DELETE /chat/sessions/:session_id/documents/:document_id
+func (h *Handler) DetachSessionDocument(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	if !h.docsEnabled(c) {
+		return
+	}
+	id, okk := documentIDParam(c, "document_id")
+	if !okk {
+		return
+	}
+	sessionID, okk := h.sessionOwned(c, uid)
+	if !okk {
+		return
+	}
+	if err := h.DocSvc.Detach(c.Request.Context(), uid, sessionID, id); err != nil {
+		failDocument(c, err)
+		return
+	}
+	ok(c, gin.H{"session_id": sessionID, "document_id": id, "detached": true})
+}
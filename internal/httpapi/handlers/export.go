@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/chat"
+	"gorm.io/gorm"
+)
+
+// upper bound of an import upload
+const maxImportBytes = 20 * 1024 * 1024
+
+func exportFormatParam(c *gin.Context) (format, ext, contentType string, okk bool) {
+	format = strings.ToLower(strings.TrimSpace(c.DefaultQuery("format", chat.ExportJSON)))
+	ext, contentType, err := chat.ExportFileInfo(format)
+	if err != nil {
+		fail(c, http.StatusBadRequest, 10002, "format must be json, markdown or openai-jsonl")
+		return "", "", "", false
+	}
+	return format, ext, contentType, true
+}
+
+// ExportChatSession: GET /chat/sessions/:session_id/export?format=json|markdown|openai-jsonl
+func (h *Handler) ExportChatSession(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	format, ext, contentType, okk := exportFormatParam(c)
+	if !okk {
+		return
+	}
+	sessionID := c.Param("session_id")
+
+	e, err := h.ChatSvc.ExportSession(c.Request.Context(), uid, sessionID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			fail(c, http.StatusNotFound, 40401, "session not found")
+			return
+		}
+		fail(c, http.StatusInternalServerError, 20001, "db error")
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, sessionID, ext))
+	c.Status(http.StatusOK)
+	if err := e.Write(c.Writer, format); err != nil {
+		log.Printf("[ExportChatSession] uid=%d session_id=%s err=%v", uid, sessionID, err)
+	}
+}
+
+// ExportMyData: GET /me/export?format=... streams a zip with every session of the user.
+func (h *Handler) ExportMyData(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	format, _, _, okk := exportFormatParam(c)
+	if !okk {
+		return
+	}
+
+	name := fmt.Sprintf("gopherchat-export-%s.zip", time.Now().UTC().Format("20060102-150405"))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	c.Status(http.StatusOK)
+	// the status is out once streaming starts; a failure leaves a truncated zip
+	if err := h.ChatSvc.ExportAll(c.Request.Context(), uid, format, c.Writer); err != nil {
+		log.Printf("[ExportMyData] uid=%d err=%v", uid, err)
+	}
+}
+
+// importFormat takes ?format=, else guesses from the file name, else assumes JSON.
+func importFormat(c *gin.Context, filename string) string {
+	if f := strings.ToLower(strings.TrimSpace(c.Query("format"))); f != "" {
+		return f
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".md", ".markdown":
+		return chat.ExportMarkdown
+	case ".jsonl":
+		return chat.ExportOpenAI
+	}
+	return chat.ExportJSON
+}
+
+// ImportChatSessions: POST /chat/sessions/import?format=... takes the file as the raw body or
+// as multipart field "file", and creates one session per conversation in it.
+func (h *Handler) ImportChatSessions(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+
+	var body io.Reader = c.Request.Body
+	filename := ""
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, err := c.FormFile("file")
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				fail(c, http.StatusRequestEntityTooLarge, 10004, "import too large")
+				return
+			}
+			fail(c, http.StatusBadRequest, 10002, "file required")
+			return
+		}
+		src, err := file.Open()
+		if err != nil {
+			fail(c, http.StatusBadRequest, 10005, "failed to read file")
+			return
+		}
+		defer src.Close()
+		body, filename = src, file.Filename
+	}
+
+	format := importFormat(c, filename)
+	if _, _, err := chat.ExportFileInfo(format); err != nil {
+		fail(c, http.StatusBadRequest, 10002, "format must be json, markdown or openai-jsonl")
+		return
+	}
+
+	sessions, err := h.ChatSvc.ImportSessions(c.Request.Context(), uid, format, body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			fail(c, http.StatusRequestEntityTooLarge, 10004, "import too large")
+		case errors.Is(err, chat.ErrInvalidImport):
+			fail(c, http.StatusBadRequest, 10002, err.Error())
+		default:
+			log.Printf("[ImportChatSessions] uid=%d format=%s err=%v", uid, format, err)
+			fail(c, http.StatusInternalServerError, 20001, "db error")
+		}
+		return
+	}
+	ok(c, gin.H{"sessions": sessions})
+}
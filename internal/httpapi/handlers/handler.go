@@ -8,7 +8,11 @@ import (
 	"github.com/suPer8Hu/ai-platform/internal/ai"
 	"github.com/suPer8Hu/ai-platform/internal/chat"
 	"github.com/suPer8Hu/ai-platform/internal/config"
+	"github.com/suPer8Hu/ai-platform/internal/dlq"
+	"github.com/suPer8Hu/ai-platform/internal/docs"
 	"github.com/suPer8Hu/ai-platform/internal/email"
+	"github.com/suPer8Hu/ai-platform/internal/metrics"
+	"github.com/suPer8Hu/ai-platform/internal/store/blob"
 	"github.com/suPer8Hu/ai-platform/internal/store/rabbitmq"
 	"github.com/suPer8Hu/ai-platform/internal/store/redisstore"
 	"github.com/suPer8Hu/ai-platform/internal/vision"
@@ -21,9 +25,16 @@ type Handler struct {
 	Redis       *redisstore.Store
 	SMTPSetting email.SMTPConfig
 	ChatSvc     *chat.Service
+	DocSvc      *docs.Service
 	Rabbit      *rabbitmq.Publisher
-	VisionSvc   *vision.Service
-	VisionVLM   vision.VLM
+	DLQ         *dlq.Inspector
+	// nil when no model loaded
+	VisionModels *vision.Registry
+	VisionVLM    vision.VLM
+	// nil without VISION_DETECT_MODEL_PATH
+	VisionDetector vision.Detector
+	// nil without a classifier or blob store
+	VisionBatches *vision.Batches
 }
 
 func NewHandler(db *gorm.DB, cfg config.Config, r *redisstore.Store) *Handler {
@@ -40,6 +51,7 @@ func NewHandler(db *gorm.DB, cfg config.Config, r *redisstore.Store) *Handler {
 
 	// Provider registry (route by session.Provider + session.Model)
 	reg := ai.NewRegistry()
+	reg.SetObserver(metrics.NewProviderObserver(cfg.KnownModels()...))
 
 	// Register Ollama (default)
 	reg.Register("ollama", func(ctx context.Context, model string) (ai.Provider, error) {
@@ -66,35 +78,111 @@ func NewHandler(db *gorm.DB, cfg config.Config, r *redisstore.Store) *Handler {
 		), nil
 	})
 
+	// per-provider circuit breakers and the global fallback chain
+	reg.SetBreakerConfig(ai.BreakerConfig{FailureThreshold: cfg.AIBreakerFailures, OpenTimeout: cfg.AIBreakerCooldown})
+
 	chatSvc := chat.NewService(repo, reg, cfg.ChatContextWindowSize)
+	if chain, err := ai.ParseTargets(cfg.AIFallbackChain); err != nil {
+		log.Printf("AI_FALLBACK_CHAIN ignored: %v", err)
+	} else {
+		chatSvc.SetFallbackChain(chain)
+	}
+	if r != nil {
+		// buffer streamed replies so clients can resume after a disconnect
+		chatSvc.SetStreamBuffer(r)
+		// feeds the daily token quota
+		chatSvc.SetUsageCounter(r)
+		// live status and output of async jobs, published by the worker
+		chatSvc.SetJobEvents(r)
+	}
+	if path := strings.TrimSpace(cfg.ChatPriceTablePath); path != "" {
+		prices, err := chat.LoadPriceTable(path)
+		if err != nil {
+			log.Printf("price table disabled: %v", err)
+		} else {
+			chatSvc.SetPriceTable(prices)
+		}
+	}
+	if budgets, err := chat.ResolveTokenBudgets(strings.TrimSpace(cfg.ChatTokenBudgetsPath), cfg.ChatContextTokens); err != nil {
+		log.Printf("token budgets disabled: %v", err)
+	} else {
+		chatSvc.SetTokenBudgets(budgets)
+	}
+	var docSvc *docs.Service
+	if p := strings.TrimSpace(cfg.ChatEmbedProvider); p != "" {
+		// semantic search; vectors are computed lazily on search
+		chatSvc.SetEmbeddings(p, cfg.ChatEmbedModel)
+		// documents attached to sessions are searched with the same model
+		docSvc = docs.NewService(docs.NewRepo(db), reg, p, cfg.ChatEmbedModel)
+		docSvc.SetTopK(cfg.DocsTopK)
+		chatSvc.SetRetriever(docSvc)
+	}
+	if cfg.ChatToolsEnabled {
+		tools := chat.NewToolRegistry()
+		chat.RegisterBuiltinTools(tools, db)
+		chatSvc.SetTools(tools)
+	}
+	if cfg.WebhookSecret != "" {
+		// the worker sends them; the API validates callback URLs and schedules redeliveries
+		chatSvc.SetWebhooks(cfg.WebhookSecret, cfg.WebhookAllowPrivate)
+	}
+	// images attached to messages and batch recognition uploads; the worker reads them
+	store, err := blob.Open(cfg.AttachmentsStore, cfg.AttachmentsDir, blob.S3Config{
+		Endpoint:  cfg.S3Endpoint,
+		Bucket:    cfg.S3Bucket,
+		Region:    cfg.S3Region,
+		AccessKey: cfg.S3AccessKey,
+		SecretKey: cfg.S3SecretKey,
+		PathStyle: cfg.S3PathStyle,
+	})
+	if err != nil {
+		log.Printf("image attachments and batch recognition disabled: %v", err)
+	} else {
+		chatSvc.SetAttachmentStore(store)
+	}
 
-	// rabbitmq
-	pub, err := rabbitmq.NewPublisher(cfg.RabbitURL, cfg.RabbitQueue)
+	// rabbitmq: reconnects on its own once up; new jobs wait in the outbox meanwhile
+	rc, err := rabbitmq.Dial(cfg.RabbitURL, cfg.RabbitQueue, rabbitmq.Options{
+		MaxPriority: uint8(min(max(cfg.RabbitMaxPriority, 0), 255)),
+		Queues:      []string{cfg.VisionQueue},
+	})
 	if err != nil {
 		panic(err)
 	}
+	pub := rabbitmq.NewPublisher(rc)
+	chatSvc.SetJobPublisher(pub)
 
-	var visionSvc *vision.Service
-	if strings.TrimSpace(cfg.VisionModelPath) != "" && strings.TrimSpace(cfg.VisionLabelsPath) != "" {
-		classifier, err := vision.NewONNXClassifier(vision.Config{
-			ModelPath:      cfg.VisionModelPath,
-			LabelsPath:     cfg.VisionLabelsPath,
-			InputH:         cfg.VisionInputH,
-			InputW:         cfg.VisionInputW,
-			InputName:      cfg.VisionInputName,
-			OutputName:     cfg.VisionOutputName,
+	visionModels, err := vision.LoadRegistry(cfg.VisionModelsPath, vision.Config{
+		ModelPath:      cfg.VisionModelPath,
+		LabelsPath:     cfg.VisionLabelsPath,
+		InputH:         cfg.VisionInputH,
+		InputW:         cfg.VisionInputW,
+		InputName:      cfg.VisionInputName,
+		OutputName:     cfg.VisionOutputName,
+		OrtLibraryPath: cfg.VisionOrtLibPath,
+	}, cfg.VisionTopK, cfg.VisionTopKMax)
+	if err != nil {
+		log.Printf("vision disabled: %v", err)
+	}
+	var visionDetector vision.Detector
+	if strings.TrimSpace(cfg.VisionDetectModelPath) != "" {
+		visionDetector, err = vision.NewONNXDetector(vision.DetectorConfig{
+			ModelPath:      cfg.VisionDetectModelPath,
+			LabelsPath:     cfg.VisionDetectLabelsPath,
+			InputSize:      cfg.VisionDetectInputSize,
+			InputName:      cfg.VisionDetectInputName,
+			OutputName:     cfg.VisionDetectOutputName,
 			OrtLibraryPath: cfg.VisionOrtLibPath,
 		})
 		if err != nil {
-			log.Printf("vision init failed: %v", err)
-		} else {
-			visionSvc, err = vision.NewService(classifier, cfg.VisionTopK, cfg.VisionTopKMax)
-			if err != nil {
-				log.Printf("vision service init failed: %v", err)
-			}
+			log.Printf("object detection disabled: %v", err)
 		}
-	} else {
-		log.Printf("vision disabled: missing VISION_MODEL_PATH or VISION_LABELS_PATH")
+	}
+	var visionBatches *vision.Batches
+	if visionModels != nil && store != nil {
+		// classified by the worker; the API only uploads and reports
+		visionBatches = vision.NewBatches(db, store, visionModels)
+		visionBatches.SetPublisher(rabbitmq.NewQueuePublisher(rc, cfg.VisionQueue))
 	}
 
 	visionVLMProvider := strings.ToLower(strings.TrimSpace(cfg.VisionVLMProvider))
@@ -130,9 +218,13 @@ func NewHandler(db *gorm.DB, cfg config.Config, r *redisstore.Store) *Handler {
 		User: cfg.SMTPUser,
 		Pass: cfg.SMTPPass,
 		From: cfg.SMTPFrom},
-		ChatSvc:   chatSvc,
-		Rabbit:    pub,
-		VisionSvc: visionSvc,
-		VisionVLM: visionVLM,
+		ChatSvc:        chatSvc,
+		DocSvc:         docSvc,
+		Rabbit:         pub,
+		DLQ:            dlq.NewInspector(cfg.RabbitURL, cfg.RabbitQueue, db),
+		VisionModels:   visionModels,
+		VisionVLM:      visionVLM,
+		VisionDetector: visionDetector,
+		VisionBatches:  visionBatches,
 	}
 }
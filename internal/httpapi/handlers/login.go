@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"net/http"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/suPer8Hu/ai-platform/internal/auth"
@@ -43,11 +42,11 @@ func (h *Handler) Login(c *gin.Context) {
 		return
 	}
 
-	token, err := auth.SignJWT(user.ID, h.Cfg.JWTSecret, 24*time.Hour)
+	tokens, err := h.issueTokens(c.Request.Context(), user.ID)
 	if err != nil {
 		common.Fail(c, http.StatusInternalServerError, 20002, "failed to sign token")
 		return
 	}
 
-	common.OK(c, gin.H{"token": token})
+	common.OK(c, tokens)
 }
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
 	"unicode/utf8"
 
@@ -8,8 +9,11 @@ import (
 	"github.com/suPer8Hu/ai-platform/internal/auth"
 	"github.com/suPer8Hu/ai-platform/internal/chat"
 	"github.com/suPer8Hu/ai-platform/internal/common"
+	"github.com/suPer8Hu/ai-platform/internal/dlq"
+	"github.com/suPer8Hu/ai-platform/internal/docs"
 	"github.com/suPer8Hu/ai-platform/internal/httpapi/middleware"
 	"github.com/suPer8Hu/ai-platform/internal/models"
+	"github.com/suPer8Hu/ai-platform/internal/vision"
 	"gorm.io/gorm"
 )
 
@@ -40,6 +44,7 @@ func (h *Handler) Me(c *gin.Context) {
 		"id":       user.ID,
 		"email":    user.Email,
 		"username": user.Username,
+		"plan":     user.Plan,
 	})
 }
 
@@ -104,7 +109,19 @@ func (h *Handler) UpdateMyPassword(c *gin.Context) {
 		return
 	}
 
-	common.OK(c, gin.H{"updated": true})
+	// sign out every other device, then hand this client a fresh pair
+	ctx := c.Request.Context()
+	if err := h.revokeAllTokens(ctx, userID); err != nil {
+		common.Fail(c, http.StatusInternalServerError, 20001, "failed to revoke tokens")
+		return
+	}
+	tokens, err := h.issueTokens(ctx, userID)
+	if err != nil {
+		common.Fail(c, http.StatusInternalServerError, 20002, "failed to sign token")
+		return
+	}
+	tokens["updated"] = true
+	common.OK(c, tokens)
 }
 
 type deleteAccountReq struct {
@@ -150,16 +167,72 @@ func (h *Handler) DeleteMyAccount(c *gin.Context) {
 		return
 	}
 
+	// the images outlive their rows only until the transaction commits
+	attachmentKeys, err := h.ChatSvc.UserAttachmentKeys(c.Request.Context(), userID)
+	if err != nil {
+		common.Fail(c, http.StatusInternalServerError, 20001, "db error")
+		return
+	}
+	var visionKeys []string
+	if h.VisionBatches != nil {
+		if visionKeys, err = h.VisionBatches.UserImageKeys(c.Request.Context(), userID); err != nil {
+			common.Fail(c, http.StatusInternalServerError, 20001, "db error")
+			return
+		}
+	}
+
 	if err := h.DB.Transaction(func(tx *gorm.DB) error {
 		if err := tx.Where("user_id = ?", userID).Delete(&chat.Message{}).Error; err != nil {
 			return err
 		}
+		if err := tx.Where("user_id = ?", userID).Delete(&chat.Persona{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&chat.MessageEmbedding{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&chat.Summary{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&chat.Share{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&chat.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&chat.OutboxMessage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&chat.Attachment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&docs.SessionDocument{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&docs.Chunk{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&docs.Document{}).Error; err != nil {
+			return err
+		}
 		if err := tx.Where("user_id = ?", userID).Delete(&chat.Job{}).Error; err != nil {
 			return err
 		}
+		if err := tx.Where("user_id = ?", userID).Delete(&dlq.ArchivedMessage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&vision.BatchItem{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&vision.BatchJob{}).Error; err != nil {
+			return err
+		}
 		if err := tx.Where("user_id = ?", userID).Delete(&chat.Session{}).Error; err != nil {
 			return err
 		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RefreshToken{}).Error; err != nil {
+			return err
+		}
 		if err := tx.Where("id = ?", userID).Delete(&models.User{}).Error; err != nil {
 			return err
 		}
@@ -168,6 +241,15 @@ func (h *Handler) DeleteMyAccount(c *gin.Context) {
 		common.Fail(c, http.StatusInternalServerError, 20001, "db error")
 		return
 	}
+	h.ChatSvc.DeleteAttachmentBlobs(c.Request.Context(), attachmentKeys)
+	if h.VisionBatches != nil {
+		h.VisionBatches.DeleteImages(c.Request.Context(), visionKeys)
+	}
+
+	// refresh tokens went with the account; outstanding access tokens must die too
+	if _, err := h.Redis.BumpTokenVersion(c.Request.Context(), userID); err != nil {
+		log.Printf("delete account %d: failed to revoke access tokens: %v", userID, err)
+	}
 
 	common.OK(c, gin.H{"deleted": true})
 }
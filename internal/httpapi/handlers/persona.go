@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/chat"
+)
+
+type personaReq struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	Provider    string `json:"provider"`
+	Model       string `json:"model"`
+	chat.GenerationSettings
+}
+
+func (r personaReq) persona() *chat.Persona {
+	return &chat.Persona{
+		Name:               r.Name,
+		Description:        r.Description,
+		Provider:           r.Provider,
+		Model:              r.Model,
+		GenerationSettings: r.GenerationSettings,
+	}
+}
+
+func personaIDParam(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		fail(c, http.StatusBadRequest, 10002, "invalid persona id")
+		return 0, false
+	}
+	return id, true
+}
+
+func failPersona(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, chat.ErrPersonaNotFound):
+		fail(c, http.StatusNotFound, 40405, "persona not found")
+	case errors.Is(err, chat.ErrPersonaExists):
+		fail(c, http.StatusConflict, 40901, err.Error())
+	case errors.Is(err, chat.ErrInvalidSettings):
+		fail(c, http.StatusBadRequest, 10002, err.Error())
+	default:
+		fail(c, http.StatusInternalServerError, 20001, "db error")
+	}
+}
+
+// ListPersonas: GET /chat/personas
+func (h *Handler) ListPersonas(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	personas, err := h.ChatSvc.ListPersonas(c.Request.Context(), uid)
+	if err != nil {
+		failPersona(c, err)
+		return
+	}
+	ok(c, gin.H{"personas": personas})
+}
+
+// GetPersona: GET /chat/personas/:id
+func (h *Handler) GetPersona(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	id, okk := personaIDParam(c)
+	if !okk {
+		return
+	}
+	p, err := h.ChatSvc.GetPersona(c.Request.Context(), uid, id)
+	if err != nil {
+		failPersona(c, err)
+		return
+	}
+	ok(c, p)
+}
+
+// CreatePersona: POST /chat/personas
+func (h *Handler) CreatePersona(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	var req personaReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, 10001, "invalid json")
+		return
+	}
+	p := req.persona()
+	if err := h.ChatSvc.CreatePersona(c.Request.Context(), uid, p); err != nil {
+		failPersona(c, err)
+		return
+	}
+	ok(c, p)
+}
+
+// UpdatePersona: PUT /chat/personas/:id replaces the whole persona.
+func (h *Handler) UpdatePersona(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	id, okk := personaIDParam(c)
+	if !okk {
+		return
+	}
+	var req personaReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, 10001, "invalid json")
+		return
+	}
+	p := req.persona()
+	if err := h.ChatSvc.UpdatePersona(c.Request.Context(), uid, id, p); err != nil {
+		failPersona(c, err)
+		return
+	}
+	// reload for the timestamps
+	updated, err := h.ChatSvc.GetPersona(c.Request.Context(), uid, id)
+	if err != nil {
+		failPersona(c, err)
+		return
+	}
+	ok(c, updated)
+}
+
+// DeletePersona: DELETE /chat/personas/:id. Sessions created from it are not affected.
+func (h *Handler) DeletePersona(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	id, okk := personaIDParam(c)
+	if !okk {
+		return
+	}
+	if err := h.ChatSvc.DeletePersona(c.Request.Context(), uid, id); err != nil {
+		failPersona(c, err)
+		return
+	}
+	ok(c, gin.H{"id": id, "deleted": true})
+}
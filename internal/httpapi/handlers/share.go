@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/chat"
+	"gorm.io/gorm"
+)
+
+type createShareReq struct {
+	// seconds until the link expires; 0 or absent keeps it valid until revoked
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+func failShare(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		fail(c, http.StatusNotFound, 40401, "session not found")
+	case errors.Is(err, chat.ErrShareNotFound):
+		fail(c, http.StatusNotFound, 40407, "share not found")
+	case errors.Is(err, chat.ErrNothingToShare), errors.Is(err, chat.ErrInvalidShare):
+		fail(c, http.StatusBadRequest, 10002, err.Error())
+	default:
+		fail(c, http.StatusInternalServerError, 20001, "db error")
+	}
+}
+
+// CreateChatShare: POST /chat/sessions/:session_id/share. The token is only shown in this
+// response; the link is /share/:token.
+func (h *Handler) CreateChatShare(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	var req createShareReq
+	// the body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			fail(c, http.StatusBadRequest, 10001, "invalid json")
+			return
+		}
+	}
+	if req.ExpiresIn < 0 {
+		fail(c, http.StatusBadRequest, 10002, "expires_in must not be negative")
+		return
+	}
+	// checked in seconds, before the conversion to a Duration can overflow
+	if req.ExpiresIn > int64(chat.MaxShareTTL/time.Second) {
+		fail(c, http.StatusBadRequest, 10002, fmt.Sprintf("expires_in must be at most %d seconds", int64(chat.MaxShareTTL/time.Second)))
+		return
+	}
+
+	sh, token, err := h.ChatSvc.CreateShare(c.Request.Context(), uid, c.Param("session_id"), time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		failShare(c, err)
+		return
+	}
+	ok(c, gin.H{"share": sh, "token": token, "path": "/share/" + token})
+}
+
+// ListChatShares: GET /chat/shares?session_id= lists active shares.
+func (h *Handler) ListChatShares(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	shares, err := h.ChatSvc.ListShares(c.Request.Context(), uid, c.Query("session_id"))
+	if err != nil {
+		failShare(c, err)
+		return
+	}
+	ok(c, gin.H{"shares": shares})
+}
+
+// RevokeChatShare: DELETE /chat/shares/:id
+func (h *Handler) RevokeChatShare(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	id := c.Param("id")
+	if err := h.ChatSvc.RevokeShare(c.Request.Context(), uid, id); err != nil {
+		failShare(c, err)
+		return
+	}
+	ok(c, gin.H{"id": id, "revoked": true})
+}
+
+// GetSharedSession: GET /share/:token (no auth)
+func (h *Handler) GetSharedSession(c *gin.Context) {
+	// shared pages must not linger in caches or search indexes after revocation
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Robots-Tag", "noindex")
+
+	shared, err := h.ChatSvc.GetSharedSession(c.Request.Context(), c.Param("token"))
+	if err != nil {
+		failShare(c, err)
+		return
+	}
+	ok(c, shared)
+}
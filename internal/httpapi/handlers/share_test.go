@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/httpapi/middleware"
+)
+
+func TestCreateChatShare_RejectsOutOfRangeExpiry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &Handler{}
+	r := gin.New()
+	r.POST("/chat/sessions/:session_id/share", func(c *gin.Context) {
+		c.Set(middleware.UserIDKey, uint64(1))
+		h.CreateChatShare(c)
+	})
+
+	// 9300000000000 * time.Second wraps around to a negative Duration
+	for _, body := range []string{`{"expires_in":-1}`, `{"expires_in":31536001}`, `{"expires_in":9300000000000}`} {
+		req := httptest.NewRequest(http.MethodPost, "/chat/sessions/s/share", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d: %s", body, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/suPer8Hu/ai-platform/internal/auth"
+	"github.com/suPer8Hu/ai-platform/internal/common"
+	"github.com/suPer8Hu/ai-platform/internal/httpapi/middleware"
+	"github.com/suPer8Hu/ai-platform/internal/models"
+	"gorm.io/gorm"
+)
+
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+// signAccessToken signs a short-lived access token at the user's current token version.
+func (h *Handler) signAccessToken(ctx context.Context, userID uint64) (string, error) {
+	var version int64
+	if h.Redis != nil {
+		v, err := h.Redis.GetTokenVersion(ctx, userID)
+		if err != nil {
+			return "", err
+		}
+		version = v
+	}
+	return auth.SignJWT(userID, version, h.Cfg.JWTSecret, h.Cfg.AccessTokenTTL)
+}
+
+func createRefreshToken(tx *gorm.DB, userID uint64, familyID string, ttl time.Duration) (string, *models.RefreshToken, error) {
+	raw, hash, err := auth.NewRefreshToken()
+	if err != nil {
+		return "", nil, err
+	}
+	rt := &models.RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := tx.Create(rt).Error; err != nil {
+		return "", nil, err
+	}
+	return raw, rt, nil
+}
+
+func (h *Handler) tokenResponse(access, refresh string) gin.H {
+	return gin.H{
+		"token":         access, // kept for older clients
+		"access_token":  access,
+		"refresh_token": refresh,
+		"token_type":    "Bearer",
+		"expires_in":    int64(h.Cfg.AccessTokenTTL.Seconds()),
+	}
+}
+
+// issueTokens starts a new refresh token family, as on login or registration.
+func (h *Handler) issueTokens(ctx context.Context, userID uint64) (gin.H, error) {
+	access, err := h.signAccessToken(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	db := h.DB.WithContext(ctx)
+	// housekeeping: the user's expired tokens are useless even for reuse detection
+	_ = db.Where("user_id = ? AND expires_at < ?", userID, time.Now()).Delete(&models.RefreshToken{}).Error
+
+	refresh, _, err := createRefreshToken(db, userID, uuid.NewString(), h.Cfg.RefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return h.tokenResponse(access, refresh), nil
+}
+
+// revokeAllTokens invalidates every access and refresh token the user holds.
+func (h *Handler) revokeAllTokens(ctx context.Context, userID uint64) error {
+	if err := h.DB.WithContext(ctx).Model(&models.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return err
+	}
+	_, err := h.Redis.BumpTokenVersion(ctx, userID)
+	return err
+}
+
+func revokeRefreshFamily(db *gorm.DB, familyID string) error {
+	return db.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+type refreshTokenReq struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken rotates a refresh token: the presented token is revoked and a new one
+// from the same family is returned. Presenting an already rotated token means it
+// leaked, so the whole family is revoked.
+func (h *Handler) RefreshToken(c *gin.Context) {
+	var req refreshTokenReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.Fail(c, http.StatusBadRequest, 10001, "invalid json")
+		return
+	}
+	req.RefreshToken = strings.TrimSpace(req.RefreshToken)
+	if req.RefreshToken == "" {
+		common.Fail(c, http.StatusBadRequest, 10002, "refresh_token required")
+		return
+	}
+
+	ctx := c.Request.Context()
+	db := h.DB.WithContext(ctx)
+
+	var old models.RefreshToken
+	if err := db.Where("token_hash = ?", auth.HashRefreshToken(req.RefreshToken)).First(&old).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			common.Fail(c, http.StatusUnauthorized, 40105, "invalid refresh token")
+			return
+		}
+		common.Fail(c, http.StatusInternalServerError, 20001, "db error")
+		return
+	}
+	if old.RevokedAt != nil {
+		_ = revokeRefreshFamily(db, old.FamilyID)
+		common.Fail(c, http.StatusUnauthorized, 40105, "invalid refresh token")
+		return
+	}
+	if time.Now().After(old.ExpiresAt) {
+		common.Fail(c, http.StatusUnauthorized, 40105, "refresh token expired")
+		return
+	}
+
+	var refresh string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// conditional update so two concurrent refreshes cannot both rotate the same token
+		res := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", old.ID).
+			Update("revoked_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errRefreshTokenReused
+		}
+		raw, next, err := createRefreshToken(tx, old.UserID, old.FamilyID, h.Cfg.RefreshTokenTTL)
+		if err != nil {
+			return err
+		}
+		refresh = raw
+		return tx.Model(&models.RefreshToken{}).Where("id = ?", old.ID).Update("replaced_by", next.ID).Error
+	})
+	if err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			_ = revokeRefreshFamily(db, old.FamilyID)
+			common.Fail(c, http.StatusUnauthorized, 40105, "invalid refresh token")
+			return
+		}
+		common.Fail(c, http.StatusInternalServerError, 20001, "db error")
+		return
+	}
+
+	access, err := h.signAccessToken(ctx, old.UserID)
+	if err != nil {
+		common.Fail(c, http.StatusInternalServerError, 20002, "failed to sign token")
+		return
+	}
+	common.OK(c, h.tokenResponse(access, refresh))
+}
+
+// Logout revokes the calling access token and, if given, the refresh token family it came with.
+func (h *Handler) Logout(c *gin.Context) {
+	v, ok := c.Get(middleware.UserIDKey)
+	if !ok {
+		common.Fail(c, http.StatusUnauthorized, 40102, "invalid token")
+		return
+	}
+	userID, ok := v.(uint64)
+	if !ok {
+		common.Fail(c, http.StatusUnauthorized, 40102, "invalid token")
+		return
+	}
+	cv, _ := c.Get(middleware.TokenClaimsKey)
+	claims, ok := cv.(*auth.Claims)
+	if !ok {
+		common.Fail(c, http.StatusUnauthorized, 40102, "invalid token")
+		return
+	}
+
+	// the body is optional
+	var req refreshTokenReq
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		common.Fail(c, http.StatusBadRequest, 10001, "invalid json")
+		return
+	}
+
+	ctx := c.Request.Context()
+	if raw := strings.TrimSpace(req.RefreshToken); raw != "" {
+		var rt models.RefreshToken
+		err := h.DB.WithContext(ctx).
+			Where("token_hash = ? AND user_id = ?", auth.HashRefreshToken(raw), userID).
+			First(&rt).Error
+		if err == nil {
+			err = revokeRefreshFamily(h.DB.WithContext(ctx), rt.FamilyID)
+		}
+		if err != nil && err != gorm.ErrRecordNotFound {
+			common.Fail(c, http.StatusInternalServerError, 20001, "db error")
+			return
+		}
+	}
+
+	var ttl time.Duration
+	if claims.ExpiresAt != nil {
+		ttl = time.Until(claims.ExpiresAt.Time)
+	}
+	if err := h.Redis.DenyJTI(ctx, claims.ID, ttl); err != nil {
+		common.Fail(c, http.StatusInternalServerError, 20001, "redis error")
+		return
+	}
+
+	common.OK(c, gin.H{"logged_out": true})
+}
+
+// LogoutAll revokes every session of the calling user on every device.
+func (h *Handler) LogoutAll(c *gin.Context) {
+	v, ok := c.Get(middleware.UserIDKey)
+	if !ok {
+		common.Fail(c, http.StatusUnauthorized, 40102, "invalid token")
+		return
+	}
+	userID, ok := v.(uint64)
+	if !ok {
+		common.Fail(c, http.StatusUnauthorized, 40102, "invalid token")
+		return
+	}
+
+	if err := h.revokeAllTokens(c.Request.Context(), userID); err != nil {
+		common.Fail(c, http.StatusInternalServerError, 20001, "failed to revoke tokens")
+		return
+	}
+
+	common.OK(c, gin.H{"logged_out": true})
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gormsqlite "github.com/glebarez/sqlite"
+	"github.com/suPer8Hu/ai-platform/internal/auth"
+	"github.com/suPer8Hu/ai-platform/internal/config"
+	"github.com/suPer8Hu/ai-platform/internal/httpapi/middleware"
+	"github.com/suPer8Hu/ai-platform/internal/models"
+	"github.com/suPer8Hu/ai-platform/internal/store/redisstore/redistest"
+	"gorm.io/gorm"
+)
+
+type tokenEnv struct {
+	t      *testing.T
+	db     *gorm.DB
+	h      *Handler
+	router *gin.Engine
+}
+
+func newTokenEnv(t *testing.T) *tokenEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(gormsqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	// every connection to file::memory: is a database of its own
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("db: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&models.User{}, &models.RefreshToken{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	h := &Handler{
+		DB:    db,
+		Cfg:   config.Config{JWTSecret: "test-secret", AccessTokenTTL: time.Minute, RefreshTokenTTL: time.Hour},
+		Redis: redistest.New(t),
+	}
+	r := gin.New()
+	r.POST("/token/refresh", h.RefreshToken)
+	authGroup := r.Group("/")
+	authGroup.Use(middleware.AuthRequired(h.Cfg.JWTSecret, h.Redis))
+	authGroup.POST("/logout", h.Logout)
+	authGroup.POST("/logout/all", h.LogoutAll)
+	authGroup.GET("/whoami", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"code": 0}) })
+	return &tokenEnv{t: t, db: db, h: h, router: r}
+}
+
+// do sends a JSON request and returns the status and the envelope's data.
+func (e *tokenEnv) do(method, path, access string, body any) (int, map[string]any) {
+	e.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			e.t.Fatalf("encode: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if access != "" {
+		req.Header.Set("Authorization", "Bearer "+access)
+	}
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	var env struct {
+		Data map[string]any `json:"data"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &env)
+	return w.Code, env.Data
+}
+
+// login issues a fresh token pair the way Login does.
+func (e *tokenEnv) login(userID uint64) (access, refresh string) {
+	e.t.Helper()
+	tokens, err := e.h.issueTokens(e.t.Context(), userID)
+	if err != nil {
+		e.t.Fatalf("issue tokens: %v", err)
+	}
+	return tokens["access_token"].(string), tokens["refresh_token"].(string)
+}
+
+func (e *tokenEnv) refresh(raw string) (int, string, string) {
+	e.t.Helper()
+	code, data := e.do(http.MethodPost, "/token/refresh", "", gin.H{"refresh_token": raw})
+	access, _ := data["access_token"].(string)
+	refresh, _ := data["refresh_token"].(string)
+	return code, access, refresh
+}
+
+func (e *tokenEnv) liveRefreshTokens(userID uint64) int64 {
+	e.t.Helper()
+	var n int64
+	if err := e.db.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Count(&n).Error; err != nil {
+		e.t.Fatalf("count tokens: %v", err)
+	}
+	return n
+}
+
+func TestRefreshToken_Rotates(t *testing.T) {
+	e := newTokenEnv(t)
+	_, first := e.login(1)
+
+	code, access, second := e.refresh(first)
+	if code != http.StatusOK || access == "" || second == "" || second == first {
+		t.Fatalf("refresh: code=%d access=%q refresh=%q", code, access, second)
+	}
+	if code, _ := e.do(http.MethodGet, "/whoami", access, nil); code != http.StatusOK {
+		t.Fatalf("rotated access token refused: %d", code)
+	}
+
+	var old, next models.RefreshToken
+	if err := e.db.Where("token_hash = ?", auth.HashRefreshToken(first)).First(&old).Error; err != nil {
+		t.Fatalf("load old token: %v", err)
+	}
+	if err := e.db.Where("token_hash = ?", auth.HashRefreshToken(second)).First(&next).Error; err != nil {
+		t.Fatalf("load new token: %v", err)
+	}
+	if old.RevokedAt == nil || old.ReplacedBy == nil || *old.ReplacedBy != next.ID || next.FamilyID != old.FamilyID {
+		t.Fatalf("expected the old token revoked and replaced within its family: old=%+v next=%+v", old, next)
+	}
+
+	// the new token rotates in turn
+	if code, _, third := e.refresh(second); code != http.StatusOK || third == "" {
+		t.Fatalf("second refresh: code=%d", code)
+	}
+	if n := e.liveRefreshTokens(1); n != 1 {
+		t.Fatalf("expected one live refresh token, got %d", n)
+	}
+
+	if code, _, _ := e.refresh("not-a-token"); code != http.StatusUnauthorized {
+		t.Fatalf("unknown token: code=%d", code)
+	}
+}
+
+func TestRefreshToken_ReuseRevokesFamily(t *testing.T) {
+	e := newTokenEnv(t)
+	_, stolen := e.login(2)
+	_, other := e.login(2) // another device, another family
+
+	_, _, current := e.refresh(stolen)
+	if current == "" {
+		t.Fatalf("first refresh failed")
+	}
+
+	// the rotated token is presented again: the whole family goes, including current
+	if code, _, _ := e.refresh(stolen); code != http.StatusUnauthorized {
+		t.Fatalf("reused token: code=%d", code)
+	}
+	if code, _, _ := e.refresh(current); code != http.StatusUnauthorized {
+		t.Fatalf("token from a revoked family: code=%d", code)
+	}
+	if code, _, next := e.refresh(other); code != http.StatusOK || next == "" {
+		t.Fatalf("other family must survive: code=%d", code)
+	}
+}
+
+func TestLogout_DeniesAccessTokenAndRevokesFamily(t *testing.T) {
+	e := newTokenEnv(t)
+	access, refresh := e.login(3)
+	otherAccess, _ := e.login(3)
+
+	if code, _ := e.do(http.MethodPost, "/logout", access, gin.H{"refresh_token": refresh}); code != http.StatusOK {
+		t.Fatalf("logout: code=%d", code)
+	}
+	if code, _ := e.do(http.MethodGet, "/whoami", access, nil); code != http.StatusUnauthorized {
+		t.Fatalf("logged out access token still accepted: %d", code)
+	}
+	if code, _, _ := e.refresh(refresh); code != http.StatusUnauthorized {
+		t.Fatalf("logged out refresh token still accepted: %d", code)
+	}
+	// only the calling token's jti is denied
+	if code, _ := e.do(http.MethodGet, "/whoami", otherAccess, nil); code != http.StatusOK {
+		t.Fatalf("other session logged out too: %d", code)
+	}
+}
+
+func TestLogoutAll_BumpsTokenVersion(t *testing.T) {
+	e := newTokenEnv(t)
+	access, refresh := e.login(4)
+	otherAccess, otherRefresh := e.login(4)
+	bystander, _ := e.login(5)
+
+	if code, _ := e.do(http.MethodPost, "/logout/all", access, nil); code != http.StatusOK {
+		t.Fatalf("logout all: code=%d", code)
+	}
+	for _, tok := range []string{access, otherAccess} {
+		if code, _ := e.do(http.MethodGet, "/whoami", tok, nil); code != http.StatusUnauthorized {
+			t.Fatalf("access token of an older version accepted: %d", code)
+		}
+	}
+	for _, tok := range []string{refresh, otherRefresh} {
+		if code, _, _ := e.refresh(tok); code != http.StatusUnauthorized {
+			t.Fatalf("refresh token survived logout all: %d", code)
+		}
+	}
+	if code, _ := e.do(http.MethodGet, "/whoami", bystander, nil); code != http.StatusOK {
+		t.Fatalf("another user's token revoked: %d", code)
+	}
+
+	// tokens signed afterwards carry the new version
+	fresh, _ := e.login(4)
+	if code, _ := e.do(http.MethodGet, "/whoami", fresh, nil); code != http.StatusOK {
+		t.Fatalf("token of the new version refused: %d", code)
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// parseUsageTime accepts RFC3339 or YYYY-MM-DD (UTC). A bare date used as an upper
+// bound covers that whole day.
+func parseUsageTime(raw string, upper bool) (time.Time, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}, true
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, true
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if upper {
+		t = t.Add(24 * time.Hour)
+	}
+	return t, true
+}
+
+// GetMyUsage: GET /me/usage?from=&to=&top=
+// Defaults to the current calendar month (UTC).
+func (h *Handler) GetMyUsage(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+
+	from, ok1 := parseUsageTime(c.Query("from"), false)
+	to, ok2 := parseUsageTime(c.Query("to"), true)
+	if !ok1 || !ok2 {
+		fail(c, http.StatusBadRequest, 10002, "invalid from/to, use RFC3339 or YYYY-MM-DD")
+		return
+	}
+	if from.IsZero() && to.IsZero() {
+		now := time.Now().UTC()
+		from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	top, _ := strconv.Atoi(c.Query("top"))
+
+	report, err := h.ChatSvc.UserUsage(c.Request.Context(), uid, from, to, top)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, 50006, "failed to load usage")
+		return
+	}
+
+	ok(c, gin.H{
+		"from":  nullableTime(from),
+		"to":    nullableTime(to),
+		"usage": report,
+	})
+}
+
+// GetChatSessionUsage: GET /chat/sessions/:session_id/usage
+func (h *Handler) GetChatSessionUsage(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+
+	sessionID := c.Param("session_id")
+	report, err := h.ChatSvc.SessionUsage(c.Request.Context(), uid, sessionID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			fail(c, http.StatusNotFound, 40401, "session not found")
+			return
+		}
+		fail(c, http.StatusInternalServerError, 50006, "failed to load usage")
+		return
+	}
+
+	ok(c, gin.H{
+		"session_id": sessionID,
+		"usage":      report,
+	})
+}
+
+func nullableTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
@@ -108,7 +107,7 @@ func (h *Handler) CreateUser(c *gin.Context) {
 	}
 
 	// sign token
-	token, err := auth.SignJWT(user.ID, h.Cfg.JWTSecret, 24*time.Hour)
+	tokens, err := h.issueTokens(c.Request.Context(), user.ID)
 	if err != nil {
 		common.Fail(c, http.StatusInternalServerError, 20003, "failed to sign token")
 		return
@@ -126,12 +125,10 @@ func (h *Handler) CreateUser(c *gin.Context) {
 		_ = email.SendText(h.SMTPSetting, to, subject, body)
 	}(user.Email, user.Username)
 
-	common.OK(c, gin.H{
-		"id":       user.ID,
-		"email":    user.Email,
-		"username": user.Username,
-		"token":    token,
-	})
+	tokens["id"] = user.ID
+	tokens["email"] = user.Email
+	tokens["username"] = user.Username
+	common.OK(c, tokens)
 }
 
 type resetPasswordReq struct {
@@ -196,6 +193,12 @@ func (h *Handler) ResetPassword(c *gin.Context) {
 		return
 	}
 
+	// whoever knew the old password may still hold tokens
+	if err := h.revokeAllTokens(c.Request.Context(), user.ID); err != nil {
+		common.Fail(c, http.StatusInternalServerError, 20001, "failed to revoke tokens")
+		return
+	}
+
 	common.OK(c, gin.H{"updated": true})
 }
 
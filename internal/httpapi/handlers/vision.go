@@ -19,10 +19,13 @@ import (
 type visionJSONRequest struct {
 	ImageBase64 string `json:"image_base64"`
 	TopK        int    `json:"top_k"`
+	Model       string `json:"model"`
 }
 
+// RecognizeImage classifies one image with the model named by ?model= (or "model" in JSON),
+// the default model without one.
 func (h *Handler) RecognizeImage(c *gin.Context) {
-	if h.VisionSvc == nil {
+	if h.VisionModels == nil {
 		common.Fail(c, http.StatusServiceUnavailable, 50301, "vision service not configured")
 		return
 	}
@@ -34,6 +37,7 @@ func (h *Handler) RecognizeImage(c *gin.Context) {
 	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
 
 	topK := parseTopK(c.Query("top_k"))
+	model := c.Query("model")
 
 	var imgBytes []byte
 	contentType := c.GetHeader("Content-Type")
@@ -46,6 +50,9 @@ func (h *Handler) RecognizeImage(c *gin.Context) {
 		if req.TopK > 0 {
 			topK = req.TopK
 		}
+		if req.Model != "" {
+			model = req.Model
+		}
 		if strings.TrimSpace(req.ImageBase64) == "" {
 			common.Fail(c, http.StatusBadRequest, 10002, "image_base64 required")
 			return
@@ -80,25 +87,44 @@ func (h *Handler) RecognizeImage(c *gin.Context) {
 		imgBytes = buf.Bytes()
 	}
 
+	svc, err := h.VisionModels.Get(model)
+	if err != nil {
+		common.Fail(c, http.StatusBadRequest, 10002, "unknown model")
+		return
+	}
+
 	img, _, err := vision.DecodeImage(bytes.NewReader(imgBytes))
 	if err != nil {
 		common.Fail(c, http.StatusBadRequest, 10006, "unsupported image format")
 		return
 	}
 
-	normalizedTopK := h.VisionSvc.ResolveTopK(topK)
-	preds, err := h.VisionSvc.Recognize(c.Request.Context(), img, normalizedTopK)
+	normalizedTopK := svc.ResolveTopK(topK)
+	preds, err := svc.Recognize(c.Request.Context(), img, normalizedTopK)
 	if err != nil {
 		common.Fail(c, http.StatusInternalServerError, 50001, "failed to recognize image")
 		return
 	}
 
 	common.OK(c, gin.H{
-		"top_k":      normalizedTopK,
+		"model":       svc.Name(),
+		"top_k":       normalizedTopK,
 		"predictions": preds,
 	})
 }
 
+// ListVisionModels: GET /vision/models lists the classifiers that can be picked with ?model=.
+func (h *Handler) ListVisionModels(c *gin.Context) {
+	if h.VisionModels == nil {
+		common.Fail(c, http.StatusServiceUnavailable, 50301, "vision service not configured")
+		return
+	}
+	common.OK(c, gin.H{
+		"default": h.VisionModels.Default(),
+		"models":  h.VisionModels.Models(),
+	})
+}
+
 type visionAskReq struct {
 	Question    string `json:"question"`
 	ImageBase64 string `json:"image_base64"`
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/common"
+	"github.com/suPer8Hu/ai-platform/internal/vision"
+)
+
+var (
+	errBatchTooManyImages = errors.New("too many images")
+	errBatchImageTooLarge = errors.New("image too large")
+	errBatchStore         = errors.New("store image")
+)
+
+// batchReader feeds the files of a batch request into an upload, enforcing the limits.
+type batchReader struct {
+	ctx       context.Context
+	up        *vision.BatchUpload
+	maxImages int
+	maxImage  int64
+}
+
+func (r *batchReader) add(name string, src io.Reader) error {
+	if r.up.Len() >= r.maxImages {
+		return errBatchTooManyImages
+	}
+	data, err := io.ReadAll(io.LimitReader(src, r.maxImage+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > r.maxImage {
+		return errBatchImageTooLarge
+	}
+	if err := r.up.Add(r.ctx, name, data); err != nil {
+		return fmt.Errorf("%w: %v", errBatchStore, err)
+	}
+	return nil
+}
+
+// addZip adds every file of a zip archive, skipping directories and the metadata macOS and
+// others leave behind.
+func (r *batchReader) addZip(ra io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		base := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		if f.UncompressedSize64 > uint64(r.maxImage) {
+			return errBatchImageTooLarge
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = r.add(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addZipBody adds a zip archive sent as the request body. It is spooled to a temp file since
+// reading a zip needs random access.
+func (r *batchReader) addZipBody(body io.Reader) error {
+	tmp, err := os.CreateTemp("", "vision-batch-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		return err
+	}
+	return r.addZip(tmp, size)
+}
+
+func isZipUpload(filename, contentType string) bool {
+	switch contentType {
+	case "application/zip", "application/x-zip-compressed":
+		return true
+	}
+	return strings.EqualFold(path.Ext(filename), ".zip")
+}
+
+// RecognizeImageBatch: POST /vision/recognize/batch?model=&top_k= queues images for classification
+// by the worker. It takes multipart "images" files, zip archives among them being expanded,
+// or a zip archive as the body. Poll GET /vision/jobs/:job_id for the results.
+func (h *Handler) RecognizeImageBatch(c *gin.Context) {
+	if h.VisionBatches == nil {
+		common.Fail(c, http.StatusServiceUnavailable, 50301, "vision batch recognition not configured")
+		return
+	}
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		common.Fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+
+	maxBytes := h.Cfg.VisionBatchMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = int64(500 * 1024 * 1024)
+	}
+	maxImages := h.Cfg.VisionBatchMaxImages
+	if maxImages <= 0 {
+		maxImages = 500
+	}
+	maxImage := h.Cfg.VisionMaxImageBytes
+	if maxImage <= 0 || maxImage > maxBytes {
+		maxImage = maxBytes
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+
+	ctx := c.Request.Context()
+	up, err := h.VisionBatches.NewUpload(uid, c.Query("model"), parseTopK(c.Query("top_k")))
+	if errors.Is(err, vision.ErrUnknownModel) {
+		common.Fail(c, http.StatusBadRequest, 10002, "unknown model")
+		return
+	}
+	if err != nil {
+		common.Fail(c, http.StatusInternalServerError, 50001, "internal error")
+		return
+	}
+	r := &batchReader{ctx: ctx, up: up, maxImages: maxImages, maxImage: maxImage}
+
+	if isZipUpload("", c.ContentType()) {
+		err = r.addZipBody(c.Request.Body)
+	} else {
+		err = readBatchForm(c, r)
+	}
+	if err != nil {
+		up.Abort(ctx)
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			common.Fail(c, http.StatusRequestEntityTooLarge, 10004, "batch too large")
+		case errors.Is(err, errBatchImageTooLarge):
+			common.Fail(c, http.StatusRequestEntityTooLarge, 10004, "image too large")
+		case errors.Is(err, errBatchTooManyImages):
+			common.Fail(c, http.StatusBadRequest, 10002, fmt.Sprintf("too many images (max %d)", maxImages))
+		case errors.Is(err, zip.ErrFormat), errors.Is(err, zip.ErrAlgorithm), errors.Is(err, zip.ErrChecksum):
+			common.Fail(c, http.StatusBadRequest, 10006, "invalid zip archive")
+		case errors.Is(err, http.ErrNotMultipart), errors.Is(err, http.ErrMissingFile):
+			common.Fail(c, http.StatusBadRequest, 10002, "images required")
+		case errors.Is(err, errBatchStore):
+			log.Printf("[RecognizeImageBatch] uid=%d err=%v", uid, err)
+			common.Fail(c, http.StatusInternalServerError, 50001, "failed to store images")
+		default:
+			log.Printf("[RecognizeImageBatch] uid=%d err=%v", uid, err)
+			common.Fail(c, http.StatusBadRequest, 10005, "failed to read images")
+		}
+		return
+	}
+
+	job, err := up.Submit(ctx)
+	if errors.Is(err, vision.ErrEmptyBatch) {
+		common.Fail(c, http.StatusBadRequest, 10002, "images required")
+		return
+	}
+	if err != nil {
+		log.Printf("[RecognizeImageBatch] uid=%d submit err=%v", uid, err)
+		common.Fail(c, http.StatusInternalServerError, 20001, "db error")
+		return
+	}
+	common.OK(c, job)
+}
+
+func readBatchForm(c *gin.Context, r *batchReader) error {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return err
+	}
+	files := form.File["images"]
+	if len(files) == 0 {
+		return http.ErrMissingFile
+	}
+	for _, fh := range files {
+		if err := func() error {
+			f, err := fh.Open()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if isZipUpload(fh.Filename, fh.Header.Get("Content-Type")) {
+				return r.addZip(f, fh.Size)
+			}
+			if fh.Size > r.maxImage {
+				return errBatchImageTooLarge
+			}
+			return r.add(fh.Filename, f)
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetVisionJob: GET /vision/jobs/:job_id?after=&limit= returns a batch job with a page of
+// its per-image results in upload order. Pass next_after as after for the next page.
+func (h *Handler) GetVisionJob(c *gin.Context) {
+	if h.VisionBatches == nil {
+		common.Fail(c, http.StatusServiceUnavailable, 50301, "vision batch recognition not configured")
+		return
+	}
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		common.Fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+
+	job, err := h.VisionBatches.Get(c.Request.Context(), uid, c.Param("job_id"))
+	if errors.Is(err, vision.ErrBatchNotFound) {
+		common.Fail(c, http.StatusNotFound, 40410, "vision job not found")
+		return
+	}
+	if err != nil {
+		common.Fail(c, http.StatusInternalServerError, 20001, "db error")
+		return
+	}
+
+	after := -1
+	if s := c.Query("after"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			after = n
+		}
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	items, err := h.VisionBatches.ListItems(c.Request.Context(), job.ID, after, limit)
+	if err != nil {
+		common.Fail(c, http.StatusInternalServerError, 20001, "db error")
+		return
+	}
+	if items == nil {
+		items = []vision.BatchItem{}
+	}
+
+	var nextAfter *int
+	if len(items) > 0 && items[len(items)-1].Seq < job.Total-1 {
+		v := items[len(items)-1].Seq
+		nextAfter = &v
+	}
+	common.OK(c, gin.H{
+		"job":        job,
+		"items":      items,
+		"next_after": nextAfter,
+	})
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	gormsqlite "github.com/glebarez/sqlite"
+	"github.com/suPer8Hu/ai-platform/internal/config"
+	"github.com/suPer8Hu/ai-platform/internal/httpapi/middleware"
+	"github.com/suPer8Hu/ai-platform/internal/store/blob"
+	"github.com/suPer8Hu/ai-platform/internal/vision"
+	"gorm.io/gorm"
+)
+
+type stubClassifier struct{}
+
+func (stubClassifier) Predict(ctx context.Context, img image.Image, topK int) ([]vision.Prediction, error) {
+	return []vision.Prediction{{Label: "cat", Score: 1}}, nil
+}
+
+func (stubClassifier) Close() error { return nil }
+
+type batchHandlerEnv struct {
+	db       *gorm.DB
+	blobDir  string
+	router   *gin.Engine
+	maxImage int64
+}
+
+func newBatchHandlerEnv(t *testing.T) *batchHandlerEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(gormsqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("db: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&vision.BatchJob{}, &vision.BatchItem{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	dir := t.TempDir()
+	store, err := blob.NewLocalStore(dir)
+	if err != nil {
+		t.Fatalf("blob store: %v", err)
+	}
+	svc, err := vision.NewService(stubClassifier{}, 3, 5)
+	if err != nil {
+		t.Fatalf("service: %v", err)
+	}
+	models := vision.NewRegistry()
+	models.Add("tiny", svc, vision.ModelInfo{})
+
+	e := &batchHandlerEnv{db: db, blobDir: dir, maxImage: 4096}
+	h := &Handler{
+		DB:            db,
+		Cfg:           config.Config{VisionMaxImageBytes: e.maxImage, VisionBatchMaxImages: 10, VisionBatchMaxBytes: 1 << 20},
+		VisionBatches: vision.NewBatches(db, store, models),
+	}
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(middleware.UserIDKey, uint64(7)) })
+	r.POST("/vision/recognize/batch", h.RecognizeImageBatch)
+	e.router = r
+	return e
+}
+
+func (e *batchHandlerEnv) post(t *testing.T, contentType string, body []byte) (int, *vision.BatchJob) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/vision/recognize/batch", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	var env struct {
+		Data *vision.BatchJob `json:"data"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &env)
+	return w.Code, env.Data
+}
+
+// storedImages counts the files in the blob store.
+func (e *batchHandlerEnv) storedImages(t *testing.T) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(e.blobDir, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("walk blob dir: %v", err)
+	}
+	return n
+}
+
+func (e *batchHandlerEnv) jobCount(t *testing.T) int64 {
+	t.Helper()
+	var n int64
+	if err := e.db.Model(&vision.BatchJob{}).Count(&n).Error; err != nil {
+		t.Fatalf("count jobs: %v", err)
+	}
+	return n
+}
+
+func pngBytes(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func multipartBody(t *testing.T, files map[string][]byte) (string, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, data := range files {
+		fw, err := mw.CreateFormFile("images", name)
+		if err != nil {
+			t.Fatalf("form file: %v", err)
+		}
+		fw.Write(data)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close form: %v", err)
+	}
+	return mw.FormDataContentType(), buf.Bytes()
+}
+
+func TestRecognizeImageBatch_AllFilesInvalid(t *testing.T) {
+	e := newBatchHandlerEnv(t)
+	ct, body := multipartBody(t, map[string][]byte{"a.txt": []byte("hello"), "b.bin": {0, 1, 2}})
+
+	code, job := e.post(t, ct, body)
+	if code != http.StatusOK || job == nil {
+		t.Fatalf("code=%d job=%+v", code, job)
+	}
+	if job.Status != vision.BatchSucceeded || job.Total != 2 || job.Failed != 2 {
+		t.Fatalf("job = %+v", job)
+	}
+	if n := e.storedImages(t); n != 0 {
+		t.Fatalf("%d invalid files stored", n)
+	}
+}
+
+func TestRecognizeImageBatch_Zip(t *testing.T) {
+	img := pngBytes(t)
+
+	t.Run("expanded", func(t *testing.T) {
+		e := newBatchHandlerEnv(t)
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, name := range []string{"one.png", "dir/two.png", "__MACOSX/dir/._two.png", ".DS_Store"} {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatalf("zip create: %v", err)
+			}
+			w.Write(img)
+		}
+		zw.Close()
+
+		code, job := e.post(t, "application/zip", buf.Bytes())
+		if code != http.StatusOK || job == nil || job.Total != 2 || job.Status != vision.BatchQueued {
+			t.Fatalf("code=%d job=%+v", code, job)
+		}
+		if n := e.storedImages(t); n != 2 {
+			t.Fatalf("%d images stored, want 2", n)
+		}
+	})
+
+	t.Run("header understates size", func(t *testing.T) {
+		e := newBatchHandlerEnv(t)
+		big := append(append([]byte(nil), img...), make([]byte, 2*e.maxImage)...)
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		// a first, honest image is stored before the lying entry is reached
+		w, _ := zw.Create("ok.png")
+		w.Write(img)
+		raw, err := zw.CreateRaw(&zip.FileHeader{
+			Name:               "bomb.png",
+			Method:             zip.Store,
+			CRC32:              crc32.ChecksumIEEE(big),
+			CompressedSize64:   uint64(len(big)),
+			UncompressedSize64: 16,
+		})
+		if err != nil {
+			t.Fatalf("zip create raw: %v", err)
+		}
+		raw.Write(big)
+		zw.Close()
+
+		code, job := e.post(t, "application/zip", buf.Bytes())
+		if code != http.StatusBadRequest && code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("code=%d job=%+v, want the archive refused", code, job)
+		}
+		if n := e.jobCount(t); n != 0 {
+			t.Fatalf("%d jobs stored", n)
+		}
+		if n := e.storedImages(t); n != 0 {
+			t.Fatalf("%d images left behind", n)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/common"
+	"github.com/suPer8Hu/ai-platform/internal/vision"
+)
+
+type visionDetectReq struct {
+	ImageBase64    string  `json:"image_base64"`
+	ScoreThreshold float32 `json:"score_threshold"`
+	IOUThreshold   float32 `json:"iou_threshold"`
+	MaxDetections  int     `json:"max_detections"`
+	Annotate       bool    `json:"annotate"`
+}
+
+// DetectObjects: POST /vision/detect finds objects in an image (multipart "image", or JSON
+// image_base64) and returns their boxes in image pixels with a count per label.
+// score_threshold, iou_threshold and max_detections tune the filtering, as query
+// parameters or JSON fields; annotate=true adds the image with the boxes drawn on it as a
+// base64 PNG.
+func (h *Handler) DetectObjects(c *gin.Context) {
+	if h.VisionDetector == nil {
+		common.Fail(c, http.StatusServiceUnavailable, 50307, "object detection not configured")
+		return
+	}
+
+	maxBytes := h.Cfg.VisionMaxImageBytes
+	if maxBytes <= 0 {
+		maxBytes = int64(200 * 1024 * 1024)
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+
+	req := visionDetectReq{
+		ScoreThreshold: parseFloat32(c.Query("score_threshold")),
+		IOUThreshold:   parseFloat32(c.Query("iou_threshold")),
+		MaxDetections:  parseTopK(c.Query("max_detections")),
+		Annotate:       c.Query("annotate") == "true" || c.Query("annotate") == "1",
+	}
+
+	var imgBytes []byte
+	if strings.HasPrefix(c.GetHeader("Content-Type"), "application/json") {
+		// fields left out keep the query parameters
+		if err := c.ShouldBindJSON(&req); err != nil {
+			common.Fail(c, http.StatusBadRequest, 10001, "invalid json")
+			return
+		}
+		if strings.TrimSpace(req.ImageBase64) == "" {
+			common.Fail(c, http.StatusBadRequest, 10002, "image_base64 required")
+			return
+		}
+		b, err := decodeBase64Image(req.ImageBase64)
+		if err != nil {
+			common.Fail(c, http.StatusBadRequest, 10003, "invalid base64 image")
+			return
+		}
+		imgBytes = b
+	} else {
+		file, err := c.FormFile("image")
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				common.Fail(c, http.StatusRequestEntityTooLarge, 10004, "image too large")
+				return
+			}
+			common.Fail(c, http.StatusBadRequest, 10002, "image file required")
+			return
+		}
+		src, err := file.Open()
+		if err != nil {
+			common.Fail(c, http.StatusBadRequest, 10005, "failed to read image")
+			return
+		}
+		defer src.Close()
+		if imgBytes, err = io.ReadAll(src); err != nil {
+			common.Fail(c, http.StatusBadRequest, 10005, "failed to read image")
+			return
+		}
+	}
+
+	img, _, err := vision.DecodeImage(bytes.NewReader(imgBytes))
+	if err != nil {
+		common.Fail(c, http.StatusBadRequest, 10006, "unsupported image format")
+		return
+	}
+
+	dets, err := h.VisionDetector.Detect(c.Request.Context(), img, vision.DetectOptions{
+		ScoreThreshold: req.ScoreThreshold,
+		IOUThreshold:   req.IOUThreshold,
+		MaxDetections:  req.MaxDetections,
+	})
+	if err != nil {
+		log.Printf("vision detect failed: %v", err)
+		common.Fail(c, http.StatusInternalServerError, 50001, "failed to detect objects")
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, d := range dets {
+		counts[d.Label]++
+	}
+	resp := gin.H{
+		"width":      img.Bounds().Dx(),
+		"height":     img.Bounds().Dy(),
+		"count":      len(dets),
+		"counts":     counts,
+		"detections": dets,
+	}
+	if req.Annotate {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, vision.Annotate(img, dets)); err != nil {
+			common.Fail(c, http.StatusInternalServerError, 50001, "failed to draw detections")
+			return
+		}
+		resp["annotated_png"] = base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	common.OK(c, resp)
+}
+
+func parseFloat32(raw string) float32 {
+	if raw == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(raw, 32)
+	if err != nil {
+		return 0
+	}
+	return float32(f)
+}
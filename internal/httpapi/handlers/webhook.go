@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/chat"
+)
+
+func failWebhook(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, chat.ErrDeliveryNotFound):
+		fail(c, http.StatusNotFound, 40408, "delivery not found")
+	case errors.Is(err, chat.ErrDeliveryPending):
+		fail(c, http.StatusConflict, 40903, err.Error())
+	case errors.Is(err, chat.ErrWebhooksDisabled):
+		fail(c, http.StatusServiceUnavailable, 50305, err.Error())
+	default:
+		fail(c, http.StatusInternalServerError, 20001, "db error")
+	}
+}
+
+// GetWebhookSecret: GET /chat/webhooks/secret returns the key webhooks to the user are signed
+// with: X-Webhook-Signature is "sha256=" + hex HMAC-SHA256 of "<X-Webhook-Timestamp>.<body>".
+func (h *Handler) GetWebhookSecret(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	secret, err := h.ChatSvc.WebhookSecret(uid)
+	if err != nil {
+		failWebhook(c, err)
+		return
+	}
+	ok(c, gin.H{"secret": secret})
+}
+
+// ListWebhookDeliveries: GET /chat/webhooks/deliveries?status=failed|pending|delivered|all&limit=&before_id=
+// lists failed deliveries unless another status is asked for.
+func (h *Handler) ListWebhookDeliveries(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+
+	status := c.DefaultQuery("status", chat.WebhookFailed)
+	switch status {
+	case chat.WebhookFailed, chat.WebhookPending, chat.WebhookDelivered:
+	case "all":
+		status = ""
+	default:
+		fail(c, http.StatusBadRequest, 10002, "status must be failed, pending, delivered or all")
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	var beforeID uint64
+	if s := c.Query("before_id"); s != "" {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			beforeID = n
+		}
+	}
+
+	deliveries, err := h.ChatSvc.ListWebhookDeliveries(c.Request.Context(), uid, status, limit, beforeID)
+	if err != nil {
+		failWebhook(c, err)
+		return
+	}
+
+	var nextBeforeID *uint64
+	if len(deliveries) > 0 {
+		v := deliveries[len(deliveries)-1].ID
+		nextBeforeID = &v
+	}
+	ok(c, gin.H{
+		"deliveries":     deliveries,
+		"next_before_id": nextBeforeID,
+	})
+}
+
+// RedeliverWebhook: POST /chat/webhooks/deliveries/:id/redeliver queues a finished delivery
+// for another round of attempts.
+func (h *Handler) RedeliverWebhook(c *gin.Context) {
+	uid, okk := userIDFromContext(c)
+	if !okk {
+		fail(c, http.StatusUnauthorized, 40101, "unauthorized")
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		fail(c, http.StatusBadRequest, 10002, "invalid delivery id")
+		return
+	}
+	d, err := h.ChatSvc.RedeliverWebhook(c.Request.Context(), uid, id)
+	if err != nil {
+		failWebhook(c, err)
+		return
+	}
+	ok(c, gin.H{"delivery": d})
+}
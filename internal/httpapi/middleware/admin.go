@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/common"
+)
+
+// AdminOnly lets through the users listed in ids (comma-separated). It must run after
+// AuthRequired; with no ids configured every request is refused.
+func AdminOnly(ids string) gin.HandlerFunc {
+	admins := map[uint64]bool{}
+	for _, v := range strings.Split(ids, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			log.Printf("ADMIN_USER_IDS: ignoring %q", v)
+			continue
+		}
+		admins[id] = true
+	}
+
+	return func(c *gin.Context) {
+		v, _ := c.Get(UserIDKey)
+		if uid, ok := v.(uint64); !ok || !admins[uid] {
+			common.Fail(c, http.StatusForbidden, 40301, "admin only")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -7,11 +7,18 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/suPer8Hu/ai-platform/internal/auth"
 	"github.com/suPer8Hu/ai-platform/internal/common"
+	"github.com/suPer8Hu/ai-platform/internal/store/redisstore"
 )
 
-const UserIDKey = "user_id"
+const (
+	UserIDKey = "user_id"
+	// the current access token's claims, used by logout to revoke it
+	TokenClaimsKey = "token_claims"
+)
 
-func AuthRequired(jwtSecret string) gin.HandlerFunc {
+// AuthRequired validates the bearer token and, when store is set, rejects tokens
+// revoked by logout (jti denylist) or by logout-all/password change (token version).
+func AuthRequired(jwtSecret string, store *redisstore.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		h := c.GetHeader("Authorization")
 		if h == "" {
@@ -34,7 +41,30 @@ func AuthRequired(jwtSecret string) gin.HandlerFunc {
 			return
 		}
 
+		if store != nil {
+			// fail closed: a revoked token must not slip through while redis is down
+			ctx := c.Request.Context()
+			denied, err := store.IsJTIDenied(ctx, claims.ID)
+			if err != nil {
+				common.Fail(c, http.StatusInternalServerError, 20001, "redis error")
+				c.Abort()
+				return
+			}
+			version, err := store.GetTokenVersion(ctx, claims.UserID)
+			if err != nil {
+				common.Fail(c, http.StatusInternalServerError, 20001, "redis error")
+				c.Abort()
+				return
+			}
+			if denied || claims.TokenVersion < version {
+				common.Fail(c, http.StatusUnauthorized, 40104, "token revoked")
+				c.Abort()
+				return
+			}
+		}
+
 		c.Set(UserIDKey, claims.UserID) // store and pass it to handler
+		c.Set(TokenClaimsKey, claims)
 		c.Next()
 	}
 }
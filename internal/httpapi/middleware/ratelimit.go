@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/common"
+	"github.com/suPer8Hu/ai-platform/internal/store/redisstore"
+)
+
+// RateLimitRule allows Limit requests per Window. A zero Limit disables the rule.
+type RateLimitRule struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// RateLimit enforces rule per user (when AuthRequired ran before it) or per client IP.
+// Redis errors fail open: throttling must not take the API down.
+func RateLimit(store *redisstore.Store, rule RateLimitRule) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if store == nil || rule.Limit <= 0 {
+			c.Next()
+			return
+		}
+
+		subject := "ip:" + c.ClientIP()
+		if v, ok := c.Get(UserIDKey); ok {
+			if uid, ok := v.(uint64); ok {
+				subject = "user:" + strconv.FormatUint(uid, 10)
+			}
+		}
+
+		res, err := store.AllowRate(c.Request.Context(), rule.Name, subject, rule.Limit, rule.Window)
+		if err != nil {
+			log.Printf("ratelimit %s: redis error, allowing request: %v", rule.Name, err)
+			c.Next()
+			return
+		}
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.ResetAfter)))
+
+		if !res.Allowed {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+			common.Fail(c, http.StatusTooManyRequests, 42900, "rate limit exceeded")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// DailyTokenQuota rejects requests once the authenticated user has consumed quota
+// LLM tokens today (UTC). Usage is recorded by chat.Service after each reply, so the
+// request that crosses the limit still completes. quota <= 0 disables the check.
+func DailyTokenQuota(store *redisstore.Store, quota int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if store == nil || quota <= 0 {
+			c.Next()
+			return
+		}
+		v, ok := c.Get(UserIDKey)
+		if !ok {
+			c.Next()
+			return
+		}
+		uid, ok := v.(uint64)
+		if !ok {
+			c.Next()
+			return
+		}
+
+		used, err := store.GetDailyTokens(c.Request.Context(), uid)
+		if err != nil {
+			log.Printf("token quota: redis error, allowing request: %v", err)
+			c.Next()
+			return
+		}
+
+		remaining := quota - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		c.Header("X-TokenQuota-Limit", strconv.FormatInt(quota, 10))
+		c.Header("X-TokenQuota-Remaining", strconv.FormatInt(remaining, 10))
+
+		if remaining == 0 {
+			now := time.Now().UTC()
+			midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(midnight.Sub(now))))
+			common.Fail(c, http.StatusTooManyRequests, 42902, "daily token quota exceeded")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
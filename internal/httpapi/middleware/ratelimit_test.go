@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/suPer8Hu/ai-platform/internal/store/redisstore"
+	"github.com/suPer8Hu/ai-platform/internal/store/redisstore/redistest"
+)
+
+// quotaRouter serves GET /x behind mw, as the user named by the X-User header if any.
+func quotaRouter(mw gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if v := c.GetHeader("X-User"); v != "" {
+			uid, _ := strconv.ParseUint(v, 10, 64)
+			c.Set(UserIDKey, uid)
+		}
+	})
+	r.GET("/x", mw, func(c *gin.Context) { c.Status(http.StatusOK) })
+	return r
+}
+
+func get(r *gin.Engine, user string) *httptest.ResponseRecorder {
+	return getCtx(context.Background(), r, user)
+}
+
+func getCtx(ctx context.Context, r *gin.Engine, user string) *httptest.ResponseRecorder {
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/x", nil)
+	if user != "" {
+		req.Header.Set("X-User", user)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// downRedis returns a Store whose server is gone.
+func downRedis(t *testing.T) *redisstore.Store {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return redisstore.New(addr, "", 0)
+}
+
+func TestDailyTokenQuota(t *testing.T) {
+	store := redistest.New(t)
+	ctx := context.Background()
+	r := quotaRouter(DailyTokenQuota(store, 100))
+
+	w := get(r, "7")
+	if w.Code != http.StatusOK || w.Header().Get("X-TokenQuota-Limit") != "100" || w.Header().Get("X-TokenQuota-Remaining") != "100" {
+		t.Fatalf("fresh user: code=%d headers=%v", w.Code, w.Header())
+	}
+
+	// usage is added after each reply; nothing and negative counts are ignored
+	for _, n := range []int64{60, 0, -5} {
+		if err := store.AddDailyTokens(ctx, 7, n); err != nil {
+			t.Fatalf("add tokens: %v", err)
+		}
+	}
+	if w := get(r, "7"); w.Code != http.StatusOK || w.Header().Get("X-TokenQuota-Remaining") != "40" {
+		t.Fatalf("after 60 tokens: code=%d remaining=%s", w.Code, w.Header().Get("X-TokenQuota-Remaining"))
+	}
+
+	// the reply that crossed the limit went through; the next request does not
+	if err := store.AddDailyTokens(ctx, 7, 45); err != nil {
+		t.Fatalf("add tokens: %v", err)
+	}
+	w = get(r, "7")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("X-TokenQuota-Remaining") != "0" {
+		t.Fatalf("over quota: code=%d headers=%v", w.Code, w.Header())
+	}
+	var env struct {
+		Code int `json:"code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil || env.Code != 42902 {
+		t.Fatalf("over quota body %s", w.Body.String())
+	}
+	// retried at the next UTC midnight
+	if secs, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || secs < 1 || secs > int((24*time.Hour).Seconds()) {
+		t.Fatalf("Retry-After %q", w.Header().Get("Retry-After"))
+	}
+
+	// quotas are per user, and anonymous requests are not counted
+	if w := get(r, "8"); w.Code != http.StatusOK || w.Header().Get("X-TokenQuota-Remaining") != "100" {
+		t.Fatalf("other user: code=%d headers=%v", w.Code, w.Header())
+	}
+	if w := get(r, ""); w.Code != http.StatusOK || w.Header().Get("X-TokenQuota-Limit") != "" {
+		t.Fatalf("anonymous: code=%d headers=%v", w.Code, w.Header())
+	}
+
+	// a zero quota disables the check
+	if w := get(quotaRouter(DailyTokenQuota(store, 0)), "7"); w.Code != http.StatusOK {
+		t.Fatalf("quota 0: code=%d", w.Code)
+	}
+}
+
+func TestRedisDown_FailsOpen(t *testing.T) {
+	store := downRedis(t)
+	rule := RateLimitRule{Name: "test", Limit: 1, Window: time.Minute}
+	for name, mw := range map[string]gin.HandlerFunc{
+		"rate limit":  RateLimit(store, rule),
+		"token quota": DailyTokenQuota(store, 1),
+	} {
+		r := quotaRouter(mw)
+		for i := 0; i < 2; i++ {
+			// go-redis keeps retrying a refused connection until the request ends
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			w := getCtx(ctx, r, "7")
+			cancel()
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: request %d code=%d", name, i+1, w.Code)
+			}
+		}
+	}
+}
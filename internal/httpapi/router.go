@@ -1,6 +1,7 @@
 package httpapi
 
 import (
+	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -19,7 +20,28 @@ import (
 func NewRouter(db *gorm.DB, cfg config.Config, rds *redisstore.Store) *gin.Engine {
 	r := gin.New()
 	r.HandleMethodNotAllowed = true
+
+	// ClientIP feeds per-IP rate limits, so only trust forwarding headers from known proxies.
+	var trusted []string
+	for _, v := range strings.Split(cfg.TrustedProxies, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			trusted = append(trusted, v)
+		}
+	}
+	if err := r.SetTrustedProxies(trusted); err != nil {
+		log.Printf("invalid TRUSTED_PROXIES, trusting none: %v", err)
+		_ = r.SetTrustedProxies(nil)
+	}
+	cloudflare := strings.EqualFold(strings.TrimSpace(cfg.TrustedPlatform), "cloudflare")
+	if cloudflare {
+		r.TrustedPlatform = gin.PlatformCloudflare
+	}
+	if len(trusted) == 0 && !cloudflare {
+		log.Printf("TRUSTED_PROXIES is empty: client IPs are taken from the connection; set it when the API runs behind a proxy")
+	}
 	r.Use(gin.Logger())
+	// outside Recovery so panics are counted as 500s
+	r.Use(middleware.Metrics())
 	// r.Use(gin.Recovery())
 	r.Use(middleware.Recovery())
 
@@ -61,12 +83,18 @@ func NewRouter(db *gorm.DB, cfg config.Config, rds *redisstore.Store) *gin.Engin
 	}
 
 	r.Use(cors.New(cors.Config{
-		AllowOrigins:     allowedOrigins,
+		AllowOrigins:    allowedOrigins,
 		AllowOriginFunc: isAllowedOrigin,
 		AllowMethods:    []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:    []string{"Origin", "Content-Type", "Accept", "Authorization", "Idempotency-Key"},
+		AllowHeaders:    []string{"Origin", "Content-Type", "Accept", "Authorization", "Idempotency-Key", "Last-Event-ID"},
 		ExposeHeaders: []string{
 			"X-Request-Id",
+			"Retry-After",
+			"X-RateLimit-Limit",
+			"X-RateLimit-Remaining",
+			"X-RateLimit-Reset",
+			"X-TokenQuota-Limit",
+			"X-TokenQuota-Remaining",
 		},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
@@ -76,39 +104,101 @@ func NewRouter(db *gorm.DB, cfg config.Config, rds *redisstore.Store) *gin.Engin
 
 	r.GET("/ping", h.Ping)
 
+	// rate limits
+	authLimit := middleware.RateLimit(rds, middleware.RateLimitRule{Name: "auth", Limit: cfg.RateLimitAuthPerMin, Window: time.Minute})
+	demoLimit := middleware.RateLimit(rds, middleware.RateLimitRule{Name: "demo", Limit: cfg.RateLimitDemoPerMin, Window: time.Minute})
+	demoDailyLimit := middleware.RateLimit(rds, middleware.RateLimitRule{Name: "demo_daily", Limit: cfg.RateLimitDemoPerDay, Window: 24 * time.Hour})
+	chatLimit := middleware.RateLimit(rds, middleware.RateLimitRule{Name: "chat", Limit: cfg.RateLimitChatPerMin, Window: time.Minute})
+	shareLimit := middleware.RateLimit(rds, middleware.RateLimitRule{Name: "share", Limit: cfg.RateLimitSharePerMin, Window: time.Minute})
+	visionLimit := middleware.RateLimit(rds, middleware.RateLimitRule{Name: "vision", Limit: cfg.RateLimitVisionPerMin, Window: time.Minute})
+	tokenQuota := middleware.DailyTokenQuota(rds, cfg.DailyTokenQuota)
+
 	// captcha
-	r.POST("/captcha", h.SendCaptcha)
+	r.POST("/captcha", authLimit, h.SendCaptcha)
 
 	// CRUD users register
-	r.POST("/users", h.CreateUser)
+	r.POST("/users", authLimit, h.CreateUser)
 	r.GET("/users/:id", h.GetUserByID)
 
 	// auth
-	r.POST("/login", h.Login)
-	r.POST("/password/reset", h.ResetPassword)
+	r.POST("/login", authLimit, h.Login)
+	r.POST("/password/reset", authLimit, h.ResetPassword)
+	r.POST("/token/refresh", authLimit, h.RefreshToken)
 	// demo (no auth)
-	r.POST("/demo/chat", h.DemoChat)
-	r.POST("/demo/chat/stream", h.DemoChatStream)
+	r.POST("/demo/chat", demoLimit, demoDailyLimit, h.DemoChat)
+	r.POST("/demo/chat/stream", demoLimit, demoDailyLimit, h.DemoChatStream)
+	// shared sessions (no auth; the token is the credential)
+	r.GET("/share/:token", shareLimit, h.GetSharedSession)
 	authGroup := r.Group("/")
-	authGroup.Use(middleware.AuthRequired(cfg.JWTSecret))
+	authGroup.Use(middleware.AuthRequired(cfg.JWTSecret, rds))
+	authGroup.POST("/logout", h.Logout)
+	authGroup.POST("/logout/all", h.LogoutAll)
 	authGroup.GET("/me", h.Me)
 	authGroup.PATCH("/me/password", h.UpdateMyPassword)
 	authGroup.DELETE("/me", h.DeleteMyAccount)
+	authGroup.GET("/me/usage", h.GetMyUsage)
+	authGroup.GET("/me/export", h.ExportMyData)
 	// Chat (JWT required)
 	authGroup.POST("/chat/sessions", h.CreateChatSession)
 	authGroup.GET("/chat/sessions", h.ListChatSessions)
+	authGroup.POST("/chat/sessions/import", chatLimit, h.ImportChatSessions)
+	authGroup.GET("/chat/sessions/:session_id/export", h.ExportChatSession)
+	authGroup.POST("/chat/sessions/:session_id/share", h.CreateChatShare)
+	authGroup.GET("/chat/shares", h.ListChatShares)
+	authGroup.DELETE("/chat/shares/:id", h.RevokeChatShare)
 	authGroup.PATCH("/chat/sessions/:session_id", h.UpdateChatSessionTitle)
+	authGroup.PUT("/chat/sessions/:session_id/fallbacks", h.UpdateChatSessionFallbacks)
+	authGroup.PUT("/chat/sessions/:session_id/settings", h.UpdateChatSessionSettings)
 	authGroup.DELETE("/chat/sessions/:session_id", h.DeleteChatSession)
-	authGroup.POST("/chat/messages", h.SendChatMessage)
-	authGroup.POST("/chat/messages/stream", h.SendChatMessageStream)
-	authGroup.POST("/chat/messages/async", h.SendChatMessageAsync)
+	authGroup.GET("/chat/personas", h.ListPersonas)
+	authGroup.POST("/chat/personas", h.CreatePersona)
+	authGroup.GET("/chat/personas/:id", h.GetPersona)
+	authGroup.PUT("/chat/personas/:id", h.UpdatePersona)
+	authGroup.DELETE("/chat/personas/:id", h.DeletePersona)
+	authGroup.POST("/chat/messages", chatLimit, tokenQuota, h.SendChatMessage)
+	authGroup.POST("/chat/messages/stream", chatLimit, tokenQuota, h.SendChatMessageStream)
+	authGroup.GET("/chat/messages/stream/:stream_id", h.ResumeChatMessageStream)
+	authGroup.POST("/chat/messages/async", chatLimit, tokenQuota, h.SendChatMessageAsync)
+	authGroup.POST("/chat/messages/:id/edit", chatLimit, tokenQuota, h.EditChatMessage)
+	authGroup.POST("/chat/messages/:id/regenerate", chatLimit, tokenQuota, h.RegenerateChatMessage)
+	authGroup.POST("/chat/messages/:id/activate", h.ActivateChatMessage)
 	authGroup.GET("/chat/sessions/:session_id/messages", h.ListChatMessages)
+	authGroup.GET("/chat/sessions/:session_id/usage", h.GetChatSessionUsage)
 	authGroup.GET("/chat/jobs/:job_id", h.GetChatJob)
+	authGroup.POST("/chat/jobs/:job_id/cancel", h.CancelChatJob)
+	authGroup.GET("/chat/jobs/:job_id/events", h.ChatJobEvents)
+	authGroup.GET("/chat/webhooks/secret", h.GetWebhookSecret)
+	authGroup.GET("/chat/webhooks/deliveries", h.ListWebhookDeliveries)
+	authGroup.POST("/chat/webhooks/deliveries/:id/redeliver", h.RedeliverWebhook)
+	authGroup.GET("/chat/search", chatLimit, h.SearchChat)
+	// Documents (JWT required; retrieval for attached sessions)
+	authGroup.POST("/documents", chatLimit, h.UploadDocument)
+	authGroup.GET("/documents", h.ListDocuments)
+	authGroup.GET("/documents/:id", h.GetDocument)
+	authGroup.DELETE("/documents/:id", h.DeleteDocument)
+	authGroup.GET("/chat/sessions/:session_id/documents", h.ListSessionDocuments)
+	authGroup.POST("/chat/sessions/:session_id/documents", h.AttachSessionDocument)
+	authGroup.DELETE("/chat/sessions/:session_id/documents/:document_id", h.DetachSessionDocument)
+	// Image attachments for chat messages
+	authGroup.POST("/chat/sessions/:session_id/attachments", chatLimit, h.UploadChatAttachment)
+	authGroup.GET("/chat/attachments/:id", h.GetChatAttachment)
+	authGroup.DELETE("/chat/attachments/:id", h.DeleteChatAttachment)
 	// Vision (JWT required)
-	authGroup.POST("/vision/recognize", h.RecognizeImage)
-	authGroup.POST("/image/recognize", h.RecognizeImage)
-	authGroup.POST("/vision/ask", h.AskImage)
-	authGroup.POST("/image/ask", h.AskImage)
+	authGroup.POST("/vision/recognize", visionLimit, h.RecognizeImage)
+	authGroup.POST("/image/recognize", visionLimit, h.RecognizeImage)
+	authGroup.GET("/vision/models", h.ListVisionModels)
+	authGroup.POST("/vision/detect", visionLimit, h.DetectObjects)
+	authGroup.POST("/vision/recognize/batch", visionLimit, h.RecognizeImageBatch)
+	authGroup.GET("/vision/jobs/:job_id", h.GetVisionJob)
+	authGroup.POST("/vision/ask", visionLimit, h.AskImage)
+	authGroup.POST("/image/ask", visionLimit, h.AskImage)
+	// Admin (JWT required; users listed in ADMIN_USER_IDS)
+	adminGroup := authGroup.Group("/admin")
+	adminGroup.Use(middleware.AdminOnly(cfg.AdminUserIDs))
+	adminGroup.GET("/dlq", h.AdminListDLQ)
+	adminGroup.POST("/dlq/replay", h.AdminReplayDLQ)
+	adminGroup.POST("/dlq/purge", h.AdminPurgeDLQ)
+	adminGroup.POST("/dlq/archive", h.AdminArchiveDLQ)
 
 	return r
 }
@@ -0,0 +1,168 @@
+// Package metrics holds the Prometheus collectors shared by cmd/api and cmd/worker.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+)
+
+const namespace = "gopherchat"
+
+// LLM calls are slow; the default buckets top out at 10s.
+var llmBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 30, 60, 120}
+
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template. SSE routes measure the whole stream.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	HTTPInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "HTTP requests currently being served.",
+	})
+
+	ProviderRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provider_requests_total",
+		Help:      "LLM provider calls by provider, model, operation and outcome (ok|error).",
+	}, []string{"provider", "model", "op", "outcome"})
+
+	ProviderDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "provider_request_duration_seconds",
+		Help:      "LLM provider call latency. For streams this is the time until the stream ends.",
+		Buckets:   llmBuckets,
+	}, []string{"provider", "model", "op"})
+
+	StreamTTFT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_time_to_first_token_seconds",
+		Help:      "Time from starting a provider stream to its first content delta.",
+		Buckets:   llmBuckets,
+	}, []string{"provider", "model"})
+
+	ProviderFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provider_fallbacks_total",
+		Help:      "Replies served by a fallback target instead of the first in the chain, by the target that answered.",
+	}, []string{"provider", "model"})
+
+	ProviderCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "provider_circuit_state",
+		Help:      "Circuit breaker state per provider and model: 0 closed, 1 half-open, 2 open. Models outside the known list share \"other\", the last transition winning.",
+	}, []string{"provider", "model"})
+
+	JobsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_processed_total",
+		Help:      "Async chat job deliveries by outcome (succeeded|retried|deferred|dead_lettered|rejected|cancelled).",
+	}, []string{"outcome"})
+
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Async chat job processing time by outcome.",
+		Buckets:   llmBuckets,
+	}, []string{"outcome"})
+
+	JobStageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_stage_duration_seconds",
+		Help:      "Time spent in each step of an async chat job (mark_running|generate|mark_done).",
+		Buckets:   llmBuckets,
+	}, []string{"stage"})
+
+	VisionJobsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vision_jobs_processed_total",
+		Help:      "Batch image recognition job deliveries by outcome (succeeded|retried|dead_lettered|rejected).",
+	}, []string{"outcome"})
+
+	WorkerConcurrency = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_concurrency",
+		Help:      "Configured number of worker goroutines.",
+	})
+
+	WorkerBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_busy",
+		Help:      "Worker goroutines currently processing a delivery.",
+	})
+
+	WorkerBacklog = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_backlog",
+		Help:      "Deliveries received from RabbitMQ and waiting for a free worker.",
+	})
+)
+
+// Handler serves the default registry in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// otherModel labels calls to models outside the observer's list.
+const otherModel = "other"
+
+// ProviderObserver feeds ai.Registry measurements into the provider collectors. Sessions
+// name their own model, so only known models get a label of their own; the rest share
+// "other" to keep the series count bounded.
+type ProviderObserver struct {
+	known map[string]bool
+}
+
+// NewProviderObserver returns an observer that labels models by name only when listed.
+func NewProviderObserver(models ...string) ProviderObserver {
+	known := make(map[string]bool, len(models))
+	for _, m := range models {
+		known[m] = true
+	}
+	return ProviderObserver{known: known}
+}
+
+// modelLabel is model if known (or empty, meaning the provider's default) and "other" otherwise.
+func (o ProviderObserver) modelLabel(model string) string {
+	if model == "" || o.known[model] {
+		return model
+	}
+	return otherModel
+}
+
+func (o ProviderObserver) ObserveCall(provider, model, op string, d time.Duration, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	model = o.modelLabel(model)
+	ProviderRequests.WithLabelValues(provider, model, op, outcome).Inc()
+	ProviderDuration.WithLabelValues(provider, model, op).Observe(d.Seconds())
+}
+
+func (o ProviderObserver) ObserveFirstToken(provider, model string, d time.Duration) {
+	StreamTTFT.WithLabelValues(provider, o.modelLabel(model)).Observe(d.Seconds())
+}
+
+func (o ProviderObserver) ObserveBreakerState(provider, model string, state ai.BreakerState) {
+	ProviderCircuitState.WithLabelValues(provider, o.modelLabel(model)).Set(float64(state))
+}
+
+func (o ProviderObserver) ObserveFallback(provider, model string) {
+	ProviderFallbacks.WithLabelValues(provider, o.modelLabel(model)).Inc()
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/suPer8Hu/ai-platform/internal/ai"
+)
+
+func TestProviderObserver_LabelsUnknownModelsOther(t *testing.T) {
+	obs := NewProviderObserver("llama3:latest")
+	for _, model := range []string{"llama3:latest", "user-picked-1", "user-picked-2", ""} {
+		obs.ObserveCall("ollama", model, "chat", time.Millisecond, nil)
+	}
+
+	cases := []struct {
+		model string
+		want  float64
+	}{
+		{"llama3:latest", 1},
+		{"other", 2},
+		{"", 1},
+		{"user-picked-1", 0},
+	}
+	for _, tc := range cases {
+		got := testutil.ToFloat64(ProviderRequests.WithLabelValues("ollama", tc.model, "chat", "ok"))
+		if got != tc.want {
+			t.Fatalf("model %q: %v calls, want %v", tc.model, got, tc.want)
+		}
+	}
+}
+
+func TestProviderObserver_BreakerStatePerModel(t *testing.T) {
+	obs := NewProviderObserver("llama3:latest", "qwen2:7b")
+	obs.ObserveBreakerState("ollama", "llama3:latest", ai.BreakerOpen)
+	obs.ObserveBreakerState("ollama", "qwen2:7b", ai.BreakerHalfOpen)
+	obs.ObserveBreakerState("ollama", "user-picked", ai.BreakerOpen)
+
+	cases := []struct {
+		model string
+		want  ai.BreakerState
+	}{
+		{"llama3:latest", ai.BreakerOpen},
+		{"qwen2:7b", ai.BreakerHalfOpen},
+		{"other", ai.BreakerOpen},
+	}
+	for _, tc := range cases {
+		if got := testutil.ToFloat64(ProviderCircuitState.WithLabelValues("ollama", tc.model)); got != float64(tc.want) {
+			t.Fatalf("model %q: state %v, want %v", tc.model, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// RefreshToken is stored hashed. Tokens rotate on every use; all tokens issued from
+// one login share a FamilyID so reuse of a rotated token can revoke the whole chain.
+type RefreshToken struct {
+	ID         uint64     `gorm:"primaryKey" json:"id"`
+	UserID     uint64     `gorm:"index;not null" json:"-"`
+	FamilyID   string     `gorm:"size:36;index;not null" json:"-"`
+	TokenHash  string     `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	ExpiresAt  time.Time  `gorm:"not null" json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	ReplacedBy *uint64    `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
@@ -2,11 +2,19 @@ package models
 
 import "time"
 
+// User plans.
+const (
+	PlanFree = "free"
+	PlanPro  = "pro"
+)
+
 type User struct {
-	ID           uint64    `gorm:"primaryKey" json:"id"`
-	Email        string    `gorm:"size:255;uniqueIndex;not null" json:"email"`
-	Username     string    `gorm:"size:32;uniqueIndex;not null" json:"username"`
-	PasswordHash string    `gorm:"size:255;not null" json:"-"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID           uint64 `gorm:"primaryKey" json:"id"`
+	Email        string `gorm:"size:255;uniqueIndex;not null" json:"email"`
+	Username     string `gorm:"size:32;uniqueIndex;not null" json:"username"`
+	PasswordHash string `gorm:"size:255;not null" json:"-"`
+	// billing plan; sets the priority of the user's async jobs
+	Plan      string    `gorm:"size:16;not null;default:free" json:"plan"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
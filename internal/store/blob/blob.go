@@ -0,0 +1,52 @@
+// Package blob stores binary objects such as chat attachments, on local disk or in an
+// S3-compatible bucket.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrNotFound = errors.New("blob: not found")
+
+// Store keeps objects under slash-separated keys.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete succeeds for missing keys.
+	Delete(ctx context.Context, key string) error
+}
+
+// Open returns the store of the given kind: "local" (default) under dir, or "s3".
+func Open(kind, dir string, s3 S3Config) (Store, error) {
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "", "local":
+		st, err := NewLocalStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	case "s3":
+		st, err := NewS3Store(s3)
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	default:
+		return nil, fmt.Errorf("blob: unknown store %q", kind)
+	}
+}
+
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return fmt.Errorf("blob: invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("blob: invalid key %q", key)
+		}
+	}
+	return nil
+}
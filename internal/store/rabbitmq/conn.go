@@ -0,0 +1,421 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrClosed is returned by a Conn after Close.
+var ErrClosed = errors.New("rabbitmq: connection closed")
+
+// ErrNotConfirmed is returned when the broker nacks a published message, or the channel
+// closes before confirming it.
+var ErrNotConfirmed = errors.New("rabbitmq: publish not confirmed")
+
+// Options tune a Conn; zero values take the defaults.
+type Options struct {
+	// unconfirmed publishes allowed at once; further publishes wait (default 256)
+	MaxInFlight int
+	// wait between reconnect attempts, doubling from MinBackoff up to MaxBackoff (default 500ms..30s)
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// x-max-priority of the job queue (0 = plain FIFO). RabbitMQ cannot change it on an
+	// existing queue: the queue has to be deleted and redeclared.
+	MaxPriority uint8
+	// further job queues declared next to the main one, each with its own retry queue and
+	// DLQ and without priorities
+	Queues []string
+}
+
+// RetryQueue and DeadLetterQueue name the queues declared next to a job queue: failed jobs
+// wait in the retry queue until their TTL sends them back, and end up in the DLQ once they
+// run out of retries.
+func RetryQueue(queue string) string      { return queue + ".retry" }
+func DeadLetterQueue(queue string) string { return queue + ".dlq" }
+
+// declareTopology declares the job queue with its retry queue and DLQ.
+func declareTopology(ch *amqp.Channel, queue string, maxPriority uint8) error {
+	// DLQ
+	if _, err := ch.QueueDeclare(
+		DeadLetterQueue(queue),
+		true,  // durable
+		false, // auto-delete
+		false, // exclusive
+		false,
+		nil,
+	); err != nil {
+		return fmt.Errorf("declare dlq: %w", err)
+	}
+
+	// Retry queue: message TTL -> dead-letter back to main queue
+	if _, err := ch.QueueDeclare(RetryQueue(queue), true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queue,
+		// NOTE: x-message-ttl is per-queue; publishers set a per-message "expiration"
+	}); err != nil {
+		return fmt.Errorf("declare retry queue: %w", err)
+	}
+
+	// Main queue: dead-letter to DLQ on reject/nack(requeue=false)
+	args := amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": DeadLetterQueue(queue),
+	}
+	if maxPriority > 0 {
+		args["x-max-priority"] = int32(maxPriority)
+	}
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, args); err != nil {
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+			return fmt.Errorf("declare queue: %s exists with other arguments (e.g. x-max-priority); delete it or match its settings: %w", queue, err)
+		}
+		return fmt.Errorf("declare queue: %w", err)
+	}
+	return nil
+}
+
+// Conn is a RabbitMQ connection for one job queue that survives broker restarts: it redials
+// in the background whenever the connection is lost and declares the queue topology again.
+// Publishes go through a shared channel in confirm mode; consumers get their own channels.
+type Conn struct {
+	url   string
+	queue string
+	opts  Options
+
+	mu  sync.Mutex
+	pub *amqp.Channel
+
+	connected *gate
+	// closed while the broker blocks publishers (memory or disk alarm)
+	unblocked *gate
+	inflight  chan struct{}
+
+	conn      *amqp.Connection
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// session is one live connection and what the supervisor watches on it.
+type session struct {
+	conn      *amqp.Connection
+	pub       *amqp.Channel
+	closed    chan *amqp.Error
+	pubClosed chan *amqp.Error
+	blocked   chan amqp.Blocking
+}
+
+// Dial connects to url and declares the topology of queue. The first connection must succeed;
+// after that the Conn reconnects on its own until Close.
+func Dial(url, queue string, opts Options) (*Conn, error) {
+	c := newConn(url, queue, opts)
+	s, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	go c.supervise(s)
+	return c, nil
+}
+
+// newConn returns a Conn that is not connected yet, with opts defaulted.
+func newConn(url, queue string, opts Options) *Conn {
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = 256
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+	return &Conn{
+		url:       url,
+		queue:     queue,
+		opts:      opts,
+		connected: newGate(false),
+		unblocked: newGate(true),
+		inflight:  make(chan struct{}, opts.MaxInFlight),
+		done:      make(chan struct{}),
+	}
+}
+
+// Queue is the job queue the Conn was dialed for.
+func (c *Conn) Queue() string {
+	return c.queue
+}
+
+func (c *Conn) connect() (*session, error) {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return nil, fmt.Errorf("rabbitmq: dial: %w", err)
+	}
+	s := &session{
+		conn:    conn,
+		closed:  conn.NotifyClose(make(chan *amqp.Error, 1)),
+		blocked: conn.NotifyBlocked(make(chan amqp.Blocking, 1)),
+	}
+	fail := func(err error) (*session, error) {
+		_ = conn.Close()
+		return nil, fmt.Errorf("rabbitmq: %w", err)
+	}
+	if s.pub, err = conn.Channel(); err != nil {
+		return fail(err)
+	}
+	if err := declareTopology(s.pub, c.queue, c.opts.MaxPriority); err != nil {
+		return fail(err)
+	}
+	for _, q := range c.opts.Queues {
+		if err := declareTopology(s.pub, q, 0); err != nil {
+			return fail(err)
+		}
+	}
+	if err := s.pub.Confirm(false); err != nil {
+		return fail(err)
+	}
+	s.pubClosed = s.pub.NotifyClose(make(chan *amqp.Error, 1))
+	return s, nil
+}
+
+// supervise serves s until it is lost, then redials until Close.
+func (c *Conn) supervise(s *session) {
+	for s != nil {
+		c.serve(s)
+		c.connected.set(false)
+		_ = s.conn.Close()
+		s = c.redial()
+	}
+}
+
+func (c *Conn) serve(s *session) {
+	c.mu.Lock()
+	c.conn, c.pub = s.conn, s.pub
+	c.mu.Unlock()
+	c.unblocked.set(true)
+	c.connected.set(true)
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case err := <-s.closed:
+			log.Printf("rabbitmq: connection lost: %v", err)
+			return
+		case err := <-s.pubClosed:
+			// the connection is reopened as a whole; consumers resubscribe
+			log.Printf("rabbitmq: publish channel closed: %v", err)
+			return
+		case b, ok := <-s.blocked:
+			if !ok {
+				s.blocked = nil
+				continue
+			}
+			if b.Active {
+				log.Printf("rabbitmq: broker blocked publishing: %s", b.Reason)
+			} else {
+				log.Printf("rabbitmq: broker unblocked publishing")
+			}
+			c.unblocked.set(!b.Active)
+		}
+	}
+}
+
+// redial returns a new session, or nil once the Conn is closed.
+func (c *Conn) redial() *session {
+	backoff := c.opts.MinBackoff
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(backoff):
+		}
+		s, err := c.connect()
+		if err == nil {
+			log.Printf("rabbitmq: reconnected")
+			return s
+		}
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+		log.Printf("rabbitmq: reconnect failed, next try in %s: %v", backoff, err)
+	}
+}
+
+// wait blocks until g is open, ctx ends or the Conn is closed.
+func (c *Conn) wait(ctx context.Context, g *gate) error {
+	select {
+	case <-g.opened():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// Publish sends msg to queue through the default exchange and returns once the broker has
+// confirmed it. It waits while the connection is down, while the broker blocks publishers and
+// while MaxInFlight publishes are unconfirmed, for as long as ctx allows.
+func (c *Conn) Publish(ctx context.Context, queue string, msg amqp.Publishing) error {
+	select {
+	case c.inflight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrClosed
+	}
+	defer func() { <-c.inflight }()
+
+	if err := c.wait(ctx, c.connected); err != nil {
+		return err
+	}
+	if err := c.wait(ctx, c.unblocked); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	ch := c.pub
+	c.mu.Unlock()
+
+	dc, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", queue, false, false, msg)
+	if err != nil {
+		return fmt.Errorf("rabbitmq: publish: %w", err)
+	}
+	acked, err := dc.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return ErrNotConfirmed
+	}
+	return nil
+}
+
+// Channel opens a channel on the current connection, waiting for one if it is down. The
+// channel dies with the connection.
+func (c *Conn) Channel(ctx context.Context) (*amqp.Channel, error) {
+	if err := c.wait(ctx, c.connected); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("rabbitmq: channel: %w", err)
+	}
+	return ch, nil
+}
+
+// Consume delivers the messages of queue, at most prefetch unacked at a time, until ctx ends
+// or the Conn is closed; then the returned channel is closed. It subscribes again after every
+// reconnect. Deliveries from a lost connection can no longer be acked: the broker redelivers
+// them. When ctx ends the subscription is cancelled but its channel stays open, so deliveries
+// in progress can still be acked until Close.
+func (c *Conn) Consume(ctx context.Context, queue string, prefetch int) <-chan amqp.Delivery {
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		for {
+			err := c.consume(ctx, queue, prefetch, out)
+			if ctx.Err() != nil || errors.Is(err, ErrClosed) {
+				return
+			}
+			log.Printf("rabbitmq: consumer of %s stopped, resubscribing: %v", queue, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.done:
+				return
+			case <-time.After(c.opts.MinBackoff):
+			}
+		}
+	}()
+	return out
+}
+
+func (c *Conn) consume(ctx context.Context, queue string, prefetch int, out chan<- amqp.Delivery) error {
+	ch, err := c.Channel(ctx)
+	if err != nil {
+		return err
+	}
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		_ = ch.Close()
+		return fmt.Errorf("rabbitmq: qos: %w", err)
+	}
+	tag := fmt.Sprintf("%s-%d", queue, time.Now().UnixNano())
+	msgs, err := ch.Consume(queue, tag, false, false, false, false, nil)
+	if err != nil {
+		_ = ch.Close()
+		return fmt.Errorf("rabbitmq: consume: %w", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			_ = ch.Cancel(tag, false)
+			return nil
+		case d, ok := <-msgs:
+			if !ok {
+				return errors.New("delivery channel closed")
+			}
+			select {
+			case out <- d:
+			case <-ctx.Done():
+				// not handed out: back to the queue
+				_ = d.Nack(false, true)
+				_ = ch.Cancel(tag, false)
+				return nil
+			}
+		}
+	}
+}
+
+// Close stops reconnecting and closes the connection.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	err := conn.Close()
+	if errors.Is(err, amqp.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// gate is a condition goroutines can wait for.
+type gate struct {
+	mu   sync.Mutex
+	open bool
+	ch   chan struct{} // closed while open
+}
+
+func newGate(open bool) *gate {
+	g := &gate{ch: make(chan struct{})}
+	g.set(open)
+	return g
+}
+
+func (g *gate) set(open bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if open == g.open {
+		return
+	}
+	g.open = open
+	if open {
+		close(g.ch)
+	} else {
+		g.ch = make(chan struct{})
+	}
+}
+
+func (g *gate) opened() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.ch
+}
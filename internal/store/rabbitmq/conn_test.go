@@ -0,0 +1,138 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func isOpen(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestGate(t *testing.T) {
+	g := newGate(false)
+	waiting := g.opened()
+	if isOpen(waiting) {
+		t.Fatalf("new closed gate is open")
+	}
+
+	g.set(true)
+	if !isOpen(waiting) || !isOpen(g.opened()) {
+		t.Fatalf("opening the gate did not release its waiters")
+	}
+	g.set(true) // no double close
+
+	g.set(false)
+	if isOpen(g.opened()) {
+		t.Fatalf("gate still open after closing")
+	}
+	if !isOpen(waiting) {
+		t.Fatalf("closing the gate re-armed a channel already handed out")
+	}
+	g.set(false)
+	again := g.opened()
+	g.set(true)
+	if !isOpen(again) {
+		t.Fatalf("reopened gate did not release its waiters")
+	}
+
+	if !isOpen(newGate(true).opened()) {
+		t.Fatalf("new open gate is closed")
+	}
+}
+
+func TestPublish_Waits(t *testing.T) {
+	// each case leaves Publish waiting at one of its stages; none gets to a channel
+	stages := []struct {
+		name  string
+		setup func(c *Conn)
+	}{
+		{"for a connection", func(c *Conn) {}},
+		{"while the broker blocks publishers", func(c *Conn) {
+			c.connected.set(true)
+			c.unblocked.set(false)
+		}},
+		{"for an in-flight slot", func(c *Conn) {
+			c.connected.set(true)
+			c.inflight <- struct{}{}
+		}},
+	}
+	stops := []struct {
+		name string
+		stop func(c *Conn, cancel context.CancelFunc)
+		want error
+	}{
+		{"cancelled", func(c *Conn, cancel context.CancelFunc) { cancel() }, context.Canceled},
+		{"closed", func(c *Conn, cancel context.CancelFunc) { c.Close() }, ErrClosed},
+	}
+	for _, st := range stages {
+		for _, sp := range stops {
+			t.Run(st.name+"/"+sp.name, func(t *testing.T) {
+				c := newConn("", "jobs", Options{MaxInFlight: 1})
+				st.setup(c)
+				held := len(c.inflight)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				errc := make(chan error, 1)
+				go func() { errc <- c.Publish(ctx, "jobs", amqp.Publishing{Body: []byte("x")}) }()
+
+				select {
+				case err := <-errc:
+					t.Fatalf("Publish returned %v instead of waiting", err)
+				case <-time.After(20 * time.Millisecond):
+				}
+				sp.stop(c, cancel)
+				select {
+				case err := <-errc:
+					if !errors.Is(err, sp.want) {
+						t.Fatalf("err = %v, want %v", err, sp.want)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Publish still waiting")
+				}
+				// the slot taken while waiting is given back
+				if n := len(c.inflight); n != held {
+					t.Fatalf("%d in-flight slots taken, want %d", n, held)
+				}
+			})
+		}
+	}
+
+	t.Run("deadline", func(t *testing.T) {
+		c := newConn("", "jobs", Options{})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := c.Publish(ctx, "jobs", amqp.Publishing{}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("channel waits too", func(t *testing.T) {
+		c := newConn("", "jobs", Options{})
+		c.Close()
+		if _, err := c.Channel(context.Background()); !errors.Is(err, ErrClosed) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+}
+
+func TestNewConn_Defaults(t *testing.T) {
+	c := newConn("", "jobs", Options{MinBackoff: time.Minute})
+	if cap(c.inflight) != 256 || c.opts.MinBackoff != time.Minute || c.opts.MaxBackoff != time.Minute {
+		t.Fatalf("opts = %+v, in flight %d", c.opts, cap(c.inflight))
+	}
+	c = newConn("", "jobs", Options{})
+	if c.opts.MinBackoff != 500*time.Millisecond || c.opts.MaxBackoff != 30*time.Second {
+		t.Fatalf("opts = %+v", c.opts)
+	}
+}
@@ -8,95 +8,32 @@ import (
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// Publisher publishes async jobs to one job queue of a Conn.
 type Publisher struct {
-	conn  *amqp.Connection
-	ch    *amqp.Channel
+	conn  *Conn
 	queue string
 }
 
+// JobMessage is the body of a job message. UserID lets the worker apply per-user limits
+// before loading the job; older messages carry only the job id.
 type JobMessage struct {
-	JobID string `json:"job_id"`
+	JobID  string `json:"job_id"`
+	UserID uint64 `json:"user_id,omitempty"`
 }
 
-func NewPublisher(url, queue string) (*Publisher, error) {
-	conn, err := amqp.Dial(url)
-	if err != nil {
-		return nil, err
-	}
-	ch, err := conn.Channel()
-	if err != nil {
-		_ = conn.Close()
-		return nil, err
-	}
-
-	// match worker
-	mainQ := queue
-	retryQ := queue + ".retry"
-	dlqQ := queue + ".dlq"
-
-	// DLQ
-	if _, err := ch.QueueDeclare(
-		dlqQ,
-		true,  // durable
-		false, // auto-delete
-		false, // exclusive
-		false,
-		nil,
-	); err != nil {
-		_ = ch.Close()
-		_ = conn.Close()
-		return nil, err
-	}
-
-	// Retry queue: message TTL -> dead-letter back to main queue
-	if _, err := ch.QueueDeclare(
-		retryQ,
-		true,
-		false,
-		false,
-		false,
-		amqp.Table{
-			"x-dead-letter-exchange":    "",
-			"x-dead-letter-routing-key": mainQ,
-		},
-	); err != nil {
-		_ = ch.Close()
-		_ = conn.Close()
-		return nil, err
-	}
-
-	// Main queue: dead-letter to DLQ on reject/nack(requeue=false)
-	if _, err := ch.QueueDeclare(
-		mainQ,
-		true,
-		false,
-		false,
-		false,
-		amqp.Table{
-			"x-dead-letter-exchange":    "",
-			"x-dead-letter-routing-key": dlqQ,
-		},
-	); err != nil {
-		_ = ch.Close()
-		_ = conn.Close()
-		return nil, err
-	}
-
-	return &Publisher{conn: conn, ch: ch, queue: queue}, nil
+func NewPublisher(conn *Conn) *Publisher {
+	return &Publisher{conn: conn, queue: conn.Queue()}
 }
 
-func (p *Publisher) Close() error {
-	if p.ch != nil {
-		_ = p.ch.Close()
-	}
-	if p.conn != nil {
-		return p.conn.Close()
-	}
-	return nil
+// NewQueuePublisher publishes to queue instead, one of the Options.Queues of conn.
+func NewQueuePublisher(conn *Conn, queue string) *Publisher {
+	return &Publisher{conn: conn, queue: queue}
 }
 
-func (p *Publisher) PublishJob(ctx context.Context, jobID string) error {
-	body, err := json.Marshal(JobMessage{JobID: jobID})
+// PublishJob publishes a job message and returns once the broker has taken it. While the
+// broker is unreachable it waits up to 5s for the connection to come back.
+func (p *Publisher) PublishJob(ctx context.Context, jobID string, userID uint64, priority uint8) error {
+	body, err := json.Marshal(JobMessage{JobID: jobID, UserID: userID})
 	if err != nil {
 		return err
 	}
@@ -104,16 +41,11 @@ func (p *Publisher) PublishJob(ctx context.Context, jobID string) error {
 	cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	return p.ch.PublishWithContext(cctx,
-		"",      // default exchange
-		p.queue, // routing key = queue
-		false,
-		false,
-		amqp.Publishing{
-			ContentType:  "application/json",
-			DeliveryMode: amqp.Persistent,
-			Body:         body,
-			Timestamp:    time.Now(),
-		},
-	)
+	return p.conn.Publish(cctx, p.queue, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Priority:     priority,
+		Body:         body,
+		Timestamp:    time.Now(),
+	})
 }
@@ -0,0 +1,50 @@
+package redisstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func deniedJTIKey(jti string) string {
+	return fmt.Sprintf("auth:denied_jti:%s", jti)
+}
+
+func tokenVersionKey(userID uint64) string {
+	return fmt.Sprintf("auth:token_version:%d", userID)
+}
+
+// DenyJTI revokes a single access token until it would have expired anyway.
+func (s *Store) DenyJTI(ctx context.Context, jti string, ttl time.Duration) error {
+	if jti == "" || ttl <= 0 {
+		return nil
+	}
+	return s.rdb.Set(ctx, deniedJTIKey(jti), 1, ttl).Err()
+}
+
+func (s *Store) IsJTIDenied(ctx context.Context, jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+	n, err := s.rdb.Exists(ctx, deniedJTIKey(jti)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetTokenVersion returns the user's current token generation (0 if never bumped).
+func (s *Store) GetTokenVersion(ctx context.Context, userID uint64) (int64, error) {
+	n, err := s.rdb.Get(ctx, tokenVersionKey(userID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// BumpTokenVersion revokes every access token issued to the user so far and returns the new generation.
+func (s *Store) BumpTokenVersion(ctx context.Context, userID uint64) (int64, error) {
+	return s.rdb.Incr(ctx, tokenVersionKey(userID)).Result()
+}
@@ -0,0 +1,64 @@
+package redisstore
+
+import (
+	"context"
+	"fmt"
+)
+
+// Job events are fire-and-forget pub/sub messages: subscribers that are not
+// listening miss them and fall back to the job row for the current status.
+func jobEventsChannel(jobID string) string {
+	return fmt.Sprintf("chat:job:%s:events", jobID)
+}
+
+func (s *Store) PublishJobEvent(ctx context.Context, jobID string, payload string) error {
+	return s.rdb.Publish(ctx, jobEventsChannel(jobID), payload).Err()
+}
+
+// SubscribeJobEvents returns the payloads published for the job from now on. The channel is
+// closed after stop is called or ctx ends.
+func (s *Store) SubscribeJobEvents(ctx context.Context, jobID string) (<-chan string, func(), error) {
+	sub := s.rdb.Subscribe(ctx, jobEventsChannel(jobID))
+	// wait for the subscription so events published right after this returns are not lost
+	if _, err := sub.Receive(ctx); err != nil {
+		_ = sub.Close()
+		return nil, nil, err
+	}
+
+	out := make(chan string, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(out)
+		in := sub.Channel()
+		for {
+			select {
+			case m, ok := <-in:
+				if !ok {
+					return
+				}
+				select {
+				case out <- m.Payload:
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				}
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		close(done)
+		_ = sub.Close()
+	}
+	return out, stop, nil
+}
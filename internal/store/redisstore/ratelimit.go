@@ -0,0 +1,110 @@
+package redisstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Token bucket: capacity tokens, refilled continuously at capacity/window.
+// Uses the Redis clock so every API instance sees the same time.
+var tokenBucketScript = redis.NewScript(`
+local key = KEYS[1]
+local capacity = tonumber(ARGV[1])
+local window_ms = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local refill = capacity / window_ms
+
+local b = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens = tonumber(b[1])
+local ts = tonumber(b[2])
+if tokens == nil or ts == nil then
+  tokens = capacity
+  ts = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * refill)
+
+local allowed = 0
+local retry_ms = 0
+if tokens >= cost then
+  tokens = tokens - cost
+  allowed = 1
+else
+  retry_ms = math.ceil((cost - tokens) / refill)
+end
+
+redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', key, window_ms * 2)
+
+local reset_ms = math.ceil((capacity - tokens) / refill)
+return {allowed, math.floor(tokens), retry_ms, reset_ms}
+`)
+
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until the request would be allowed (0 when allowed).
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again.
+	ResetAfter time.Duration
+}
+
+func rateLimitKey(name, subject string) string {
+	return fmt.Sprintf("ratelimit:%s:%s", name, subject)
+}
+
+// AllowRate takes one token from the bucket (name, subject) that allows limit requests per window.
+func (s *Store) AllowRate(ctx context.Context, name, subject string, limit int, window time.Duration) (RateLimitResult, error) {
+	if limit <= 0 || window <= 0 {
+		return RateLimitResult{Allowed: true, Limit: limit}, nil
+	}
+	res, err := tokenBucketScript.Run(ctx, s.rdb,
+		[]string{rateLimitKey(name, subject)},
+		limit, window.Milliseconds(), 1,
+	).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if len(res) != 4 {
+		return RateLimitResult{}, fmt.Errorf("ratelimit: unexpected script result %v", res)
+	}
+	return RateLimitResult{
+		Allowed:    res[0] == 1,
+		Limit:      limit,
+		Remaining:  int(res[1]),
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+		ResetAfter: time.Duration(res[3]) * time.Millisecond,
+	}, nil
+}
+
+// Daily token quotas are counted per UTC day.
+func dailyTokensKey(userID uint64, day time.Time) string {
+	return fmt.Sprintf("quota:tokens:%d:%s", userID, day.UTC().Format("20060102"))
+}
+
+// AddDailyTokens adds LLM tokens to the user's counter for today.
+func (s *Store) AddDailyTokens(ctx context.Context, userID uint64, tokens int64) error {
+	if tokens <= 0 {
+		return nil
+	}
+	key := dailyTokensKey(userID, time.Now())
+	pipe := s.rdb.TxPipeline()
+	pipe.IncrBy(ctx, key, tokens)
+	pipe.Expire(ctx, key, 48*time.Hour)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *Store) GetDailyTokens(ctx context.Context, userID uint64) (int64, error) {
+	n, err := s.rdb.Get(ctx, dailyTokensKey(userID, time.Now())).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
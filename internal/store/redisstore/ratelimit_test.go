@@ -0,0 +1,70 @@
+package redisstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// testRedis connects to the Redis at TEST_REDIS_ADDR, skipping the test without one: the token
+// bucket is a Lua script, which the in-process redistest server cannot run.
+func testRedis(t *testing.T) *Store {
+	t.Helper()
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	s := New(addr, "", 0)
+	t.Cleanup(func() { s.rdb.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Ping(ctx); err != nil {
+		t.Skipf("redis at %s: %v", addr, err)
+	}
+	return s
+}
+
+func TestAllowRate(t *testing.T) {
+	s := testRedis(t)
+	ctx := context.Background()
+	subject := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		s.rdb.Del(context.Background(), rateLimitKey("test", subject), rateLimitKey("test", subject+"-other"))
+	})
+
+	if res, err := s.AllowRate(ctx, "test", subject, 0, time.Minute); err != nil || !res.Allowed {
+		t.Fatalf("limit 0: res=%+v err=%v", res, err)
+	}
+
+	// 3 requests per 300ms: one token back every 100ms
+	const limit, window = 3, 300 * time.Millisecond
+	for want := limit - 1; want >= 0; want-- {
+		res, err := s.AllowRate(ctx, "test", subject, limit, window)
+		if err != nil || !res.Allowed || res.Limit != limit || res.Remaining != want || res.RetryAfter != 0 {
+			t.Fatalf("request %d: res=%+v err=%v", limit-want, res, err)
+		}
+	}
+	res, err := s.AllowRate(ctx, "test", subject, limit, window)
+	if err != nil || res.Allowed || res.Remaining != 0 {
+		t.Fatalf("over the limit: res=%+v err=%v", res, err)
+	}
+	if res.RetryAfter <= 0 || res.RetryAfter > window/limit {
+		t.Fatalf("retry after %v, want up to %v", res.RetryAfter, window/limit)
+	}
+	if res.ResetAfter < res.RetryAfter || res.ResetAfter > window {
+		t.Fatalf("reset after %v, want %v..%v", res.ResetAfter, res.RetryAfter, window)
+	}
+
+	// buckets are per subject
+	if res, err := s.AllowRate(ctx, "test", subject+"-other", limit, window); err != nil || !res.Allowed {
+		t.Fatalf("other subject: res=%+v err=%v", res, err)
+	}
+
+	// the bucket refills over time
+	time.Sleep(res.RetryAfter + 20*time.Millisecond)
+	if res, err := s.AllowRate(ctx, "test", subject, limit, window); err != nil || !res.Allowed {
+		t.Fatalf("after refill: res=%+v err=%v", res, err)
+	}
+}
@@ -0,0 +1,162 @@
+// Package redistest runs an in-process stand-in for Redis in tests.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/suPer8Hu/ai-platform/internal/store/redisstore"
+)
+
+// New serves the few string commands the auth and quota code use (GET, SET with PX/EX, EXISTS,
+// INCR, INCRBY, EXPIRE, MULTI/EXEC) over RESP2 and returns a Store connected to it. Anything
+// else, including HELLO and scripts, is an unknown command; see ratelimit_test.go for tests
+// that need a real Redis.
+func New(t testing.TB) *redisstore.Store {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	data := map[string]string{}
+	expires := map[string]time.Time{}
+	get := func(k string) (string, bool) {
+		if at, ok := expires[k]; ok && time.Now().After(at) {
+			delete(data, k)
+			delete(expires, k)
+		}
+		v, ok := data[k]
+		return v, ok
+	}
+	incrBy := func(k, by string) string {
+		d, err := strconv.ParseInt(by, 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		v, _ := get(k)
+		n, _ := strconv.ParseInt(v, 10, 64)
+		data[k] = strconv.FormatInt(n+d, 10)
+		return fmt.Sprintf(":%d\r\n", n+d)
+	}
+	// handle runs one command; the caller holds mu
+	handle := func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			return "+PONG\r\n"
+		case "GET":
+			if v, ok := get(args[1]); ok {
+				return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			}
+			return "$-1\r\n"
+		case "SET":
+			data[args[1]] = args[2]
+			delete(expires, args[1])
+			if len(args) == 5 {
+				n, _ := strconv.Atoi(args[4])
+				unit := time.Millisecond
+				if strings.EqualFold(args[3], "ex") {
+					unit = time.Second
+				}
+				expires[args[1]] = time.Now().Add(time.Duration(n) * unit)
+			}
+			return "+OK\r\n"
+		case "EXISTS":
+			if _, ok := get(args[1]); ok {
+				return ":1\r\n"
+			}
+			return ":0\r\n"
+		case "INCR":
+			return incrBy(args[1], "1")
+		case "INCRBY":
+			return incrBy(args[1], args[2])
+		case "EXPIRE":
+			if _, ok := get(args[1]); !ok {
+				return ":0\r\n"
+			}
+			n, _ := strconv.Atoi(args[2])
+			expires[args[1]] = time.Now().Add(time.Duration(n) * time.Second)
+			return ":1\r\n"
+		}
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				// commands queued by MULTI until EXEC; nil outside a transaction
+				var queued [][]string
+				for {
+					args, err := readArray(r)
+					if err != nil {
+						return
+					}
+					var reply string
+					mu.Lock()
+					switch cmd := strings.ToUpper(args[0]); {
+					case cmd == "MULTI":
+						queued = [][]string{}
+						reply = "+OK\r\n"
+					case cmd == "EXEC" && queued != nil:
+						reply = fmt.Sprintf("*%d\r\n", len(queued))
+						for _, q := range queued {
+							reply += handle(q)
+						}
+						queued = nil
+					case queued != nil:
+						queued = append(queued, args)
+						reply = "+QUEUED\r\n"
+					default:
+						reply = handle(args)
+					}
+					mu.Unlock()
+					if _, err := io.WriteString(conn, reply); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return redisstore.New(ln.Addr().String(), "", 0)
+}
+
+func readArray(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("bad array header %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
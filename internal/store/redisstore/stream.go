@@ -0,0 +1,105 @@
+package redisstore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Streamed replies are buffered for a while so a client that lost its
+// connection can reconnect with Last-Event-ID and replay what it missed.
+const streamBufferTTL = 10 * time.Minute
+
+const (
+	StreamRunning = "running"
+	StreamDone    = "done"
+	StreamFailed  = "failed"
+)
+
+type StreamState struct {
+	UserID         uint64
+	SessionID      string
+	Status         string
+	AssistantMsgID uint64
+	Error          string
+}
+
+func streamMetaKey(streamID string) string {
+	return fmt.Sprintf("chat:stream:%s:meta", streamID)
+}
+
+func streamChunksKey(streamID string) string {
+	return fmt.Sprintf("chat:stream:%s:chunks", streamID)
+}
+
+func (s *Store) InitStream(ctx context.Context, streamID string, userID uint64, sessionID string) error {
+	key := streamMetaKey(streamID)
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, key, map[string]any{
+		"user_id":    userID,
+		"session_id": sessionID,
+		"status":     StreamRunning,
+	})
+	pipe.Expire(ctx, key, streamBufferTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// AppendStreamChunk appends the next chunk; its 1-based position in the list is its SSE event id.
+func (s *Store) AppendStreamChunk(ctx context.Context, streamID string, chunk string) error {
+	key := streamChunksKey(streamID)
+	pipe := s.rdb.TxPipeline()
+	pipe.RPush(ctx, key, chunk)
+	pipe.Expire(ctx, key, streamBufferTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *Store) FinishStream(ctx context.Context, streamID string, assistantMsgID uint64, errMsg string) error {
+	status := StreamDone
+	if errMsg != "" {
+		status = StreamFailed
+	}
+	metaKey := streamMetaKey(streamID)
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, metaKey, map[string]any{
+		"status":     status,
+		"message_id": assistantMsgID,
+		"error":      errMsg,
+	})
+	pipe.Expire(ctx, metaKey, streamBufferTTL)
+	pipe.Expire(ctx, streamChunksKey(streamID), streamBufferTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetStreamState returns redis.Nil when the stream is unknown or expired.
+func (s *Store) GetStreamState(ctx context.Context, streamID string) (*StreamState, error) {
+	m, err := s.rdb.HGetAll(ctx, streamMetaKey(streamID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		return nil, redis.Nil
+	}
+	uid, _ := strconv.ParseUint(m["user_id"], 10, 64)
+	mid, _ := strconv.ParseUint(m["message_id"], 10, 64)
+	return &StreamState{
+		UserID:         uid,
+		SessionID:      m["session_id"],
+		Status:         m["status"],
+		AssistantMsgID: mid,
+		Error:          m["error"],
+	}, nil
+}
+
+// ReadStreamChunks returns the chunks with seq > afterSeq, in order.
+func (s *Store) ReadStreamChunks(ctx context.Context, streamID string, afterSeq int64) ([]string, error) {
+	if afterSeq < 0 {
+		afterSeq = 0
+	}
+	return s.rdb.LRange(ctx, streamChunksKey(streamID), afterSeq, -1).Result()
+}
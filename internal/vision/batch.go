@@ -0,0 +1,516 @@
+package vision
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/suPer8Hu/ai-platform/internal/store/blob"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrBatchNotFound = errors.New("vision job not found")
+	ErrEmptyBatch    = errors.New("no images in batch")
+	// returned by Run for a job another delivery is already running
+	ErrBatchTaken = errors.New("vision job already running")
+)
+
+type BatchStatus string
+
+const (
+	BatchQueued    BatchStatus = "queued"
+	BatchRunning   BatchStatus = "running"
+	BatchSucceeded BatchStatus = "succeeded"
+	BatchFailed    BatchStatus = "failed"
+)
+
+type ItemStatus string
+
+const (
+	ItemPending ItemStatus = "pending"
+	ItemDone    ItemStatus = "done"
+	ItemFailed  ItemStatus = "failed"
+)
+
+const (
+	DefaultItemsLimit = 100
+	MaxItemsLimit     = 500
+
+	batchRunSize   = 50
+	sweepBatchSize = 100
+)
+
+// BatchJob is a batch of images classified by the worker. Done and Failed count the items
+// finished so far; the job succeeds once every item is one or the other.
+type BatchJob struct {
+	ID     string      `gorm:"primaryKey;size:26" json:"id"`
+	UserID uint64      `gorm:"not null;index" json:"-"`
+	Status BatchStatus `gorm:"type:varchar(16);not null;index:idx_vision_jobs_status_updated,priority:1" json:"status"`
+	// "" for jobs from before the model registry: the default model
+	Model      string     `gorm:"type:varchar(64);not null;default:''" json:"model"`
+	TopK       int        `gorm:"not null" json:"top_k"`
+	Total      int        `gorm:"not null" json:"total"`
+	Done       int        `gorm:"not null;default:0" json:"done"`
+	Failed     int        `gorm:"not null;default:0" json:"failed"`
+	Error      *string    `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `gorm:"index:idx_vision_jobs_status_updated,priority:2" json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func (BatchJob) TableName() string { return "vision_jobs" }
+
+// BatchItem is one image of a batch. The image waits in the blob store under StorageKey
+// until the worker has classified it.
+type BatchItem struct {
+	ID          uint64         `gorm:"primaryKey;autoIncrement" json:"-"`
+	JobID       string         `gorm:"size:26;not null;uniqueIndex:idx_vision_items_job_seq,priority:1" json:"-"`
+	UserID      uint64         `gorm:"not null;index" json:"-"`
+	Seq         int            `gorm:"not null;uniqueIndex:idx_vision_items_job_seq,priority:2" json:"index"`
+	Filename    string         `gorm:"type:varchar(255);not null;default:''" json:"filename"`
+	StorageKey  string         `gorm:"type:varchar(255);not null;default:''" json:"-"`
+	Status      ItemStatus     `gorm:"type:varchar(16);not null" json:"status"`
+	Predictions PredictionList `gorm:"type:text" json:"predictions,omitempty"`
+	Error       string         `gorm:"type:varchar(255);not null;default:''" json:"error,omitempty"`
+}
+
+func (BatchItem) TableName() string { return "vision_job_items" }
+
+// PredictionList is stored as a JSON array.
+type PredictionList []Prediction
+
+func (l PredictionList) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal([]Prediction(l))
+	return string(b), err
+}
+
+func (l *PredictionList) Scan(src any) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("vision: cannot scan %T into PredictionList", src)
+	}
+	if len(b) == 0 {
+		*l = nil
+		return nil
+	}
+	return json.Unmarshal(b, (*[]Prediction)(l))
+}
+
+// JobPublisher hands a job to the worker queue.
+type JobPublisher interface {
+	PublishJob(ctx context.Context, jobID string, userID uint64, priority uint8) error
+}
+
+// Batches stores batch recognition jobs and runs them. The API side uploads and submits
+// them; the worker runs them with the classifier.
+type Batches struct {
+	db        *gorm.DB
+	store     blob.Store
+	models    *Registry
+	publisher JobPublisher
+}
+
+func NewBatches(db *gorm.DB, store blob.Store, models *Registry) *Batches {
+	return &Batches{db: db, store: store, models: models}
+}
+
+// SetPublisher sets where submitted and swept jobs are published. Without one they stay
+// queued until a process with a publisher sweeps them.
+func (b *Batches) SetPublisher(p JobPublisher) {
+	b.publisher = p
+}
+
+// BatchUpload collects the images of a new job. Each image goes to the blob store as it is
+// added, so a large batch is never held in memory; Abort removes them again.
+type BatchUpload struct {
+	b     *Batches
+	job   BatchJob
+	items []BatchItem
+}
+
+// NewUpload starts a job for the named model ("" for the default one); ErrUnknownModel if
+// there is no such model.
+func (b *Batches) NewUpload(userID uint64, model string, topK int) (*BatchUpload, error) {
+	svc, err := b.models.Get(model)
+	if err != nil {
+		return nil, err
+	}
+	id, err := ulid.New(ulid.Timestamp(time.Now()), ulid.Monotonic(rand.Reader, 0))
+	if err != nil {
+		return nil, err
+	}
+	return &BatchUpload{b: b, job: BatchJob{
+		ID:     id.String(),
+		UserID: userID,
+		Status: BatchQueued,
+		Model:  svc.Name(),
+		TopK:   svc.ResolveTopK(topK),
+	}}, nil
+}
+
+func (u *BatchUpload) Len() int { return len(u.items) }
+
+// Add stores one image. Files that are not a supported image are kept as failed items, so
+// the results still line up with what was sent.
+func (u *BatchUpload) Add(ctx context.Context, filename string, data []byte) error {
+	it := BatchItem{
+		JobID:    u.job.ID,
+		UserID:   u.job.UserID,
+		Seq:      len(u.items),
+		Filename: truncate(filename, 255),
+		Status:   ItemPending,
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		it.Status = ItemFailed
+		it.Error = "unsupported image format"
+		u.items = append(u.items, it)
+		return nil
+	}
+	it.StorageKey = fmt.Sprintf("vision/%d/%s/%d", u.job.UserID, u.job.ID, it.Seq)
+	if err := u.b.store.Put(ctx, it.StorageKey, data, http.DetectContentType(data)); err != nil {
+		return fmt.Errorf("vision: store image: %w", err)
+	}
+	u.items = append(u.items, it)
+	return nil
+}
+
+// Abort removes the images stored so far.
+func (u *BatchUpload) Abort(ctx context.Context) {
+	u.b.deleteImages(ctx, u.pendingKeys())
+}
+
+func (u *BatchUpload) pendingKeys() []string {
+	var keys []string
+	for _, it := range u.items {
+		if it.StorageKey != "" {
+			keys = append(keys, it.StorageKey)
+		}
+	}
+	return keys
+}
+
+// Submit saves the job and publishes it. A job whose publish fails stays queued and is
+// picked up by the sweeper. A batch without a single readable image finishes right away.
+func (u *BatchUpload) Submit(ctx context.Context) (*BatchJob, error) {
+	if len(u.items) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	j := u.job
+	j.Total = len(u.items)
+	for _, it := range u.items {
+		if it.Status == ItemFailed {
+			j.Failed++
+		}
+	}
+	if j.Failed == j.Total {
+		now := time.Now()
+		j.Status = BatchSucceeded
+		j.FinishedAt = &now
+	}
+	if err := u.b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&j).Error; err != nil {
+			return err
+		}
+		return tx.CreateInBatches(u.items, 100).Error
+	}); err != nil {
+		u.Abort(ctx)
+		return nil, err
+	}
+	if j.Status == BatchQueued {
+		u.b.publish(ctx, &j)
+	}
+	return &j, nil
+}
+
+func (b *Batches) publish(ctx context.Context, j *BatchJob) {
+	if b.publisher == nil {
+		return
+	}
+	if err := b.publisher.PublishJob(ctx, j.ID, j.UserID, 0); err != nil {
+		log.Printf("vision: publish job %s: %v", j.ID, err)
+	}
+}
+
+// Get returns a job of the user.
+func (b *Batches) Get(ctx context.Context, userID uint64, id string) (*BatchJob, error) {
+	var j BatchJob
+	err := b.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userID).Take(&j).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrBatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// ListItems returns up to limit items of a job in upload order, starting after index after
+// (-1 for the first page).
+func (b *Batches) ListItems(ctx context.Context, jobID string, after, limit int) ([]BatchItem, error) {
+	if limit <= 0 {
+		limit = DefaultItemsLimit
+	}
+	limit = min(limit, MaxItemsLimit)
+	var items []BatchItem
+	err := b.db.WithContext(ctx).
+		Where("job_id = ? AND seq > ?", jobID, after).
+		Order("seq ASC").
+		Limit(limit).
+		Find(&items).Error
+	return items, err
+}
+
+// Run claims a queued job and classifies its pending items, resuming where an earlier
+// delivery stopped. Jobs that are gone or already finished are skipped; a job running
+// elsewhere gives ErrBatchTaken. Other errors leave the job running for the caller to
+// requeue or fail.
+func (b *Batches) Run(ctx context.Context, id string) error {
+	res := b.db.WithContext(ctx).Model(&BatchJob{}).
+		Where("id = ? AND status = ?", id, BatchQueued).
+		Updates(map[string]any{"status": BatchRunning, "updated_at": time.Now()})
+	if res.Error != nil {
+		return res.Error
+	}
+	var j BatchJob
+	err := b.db.WithContext(ctx).Where("id = ?", id).Take(&j).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("vision: job %s skipped: not found", id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if j.Status != BatchRunning {
+		log.Printf("vision: job %s skipped status=%s", id, j.Status)
+		return nil
+	}
+	if res.RowsAffected == 0 {
+		return ErrBatchTaken
+	}
+	svc, err := b.models.Get(j.Model)
+	if errors.Is(err, ErrUnknownModel) {
+		// retrying will not bring the model back
+		log.Printf("vision: job %s failed: model %q not loaded", id, j.Model)
+		return b.Fail(ctx, id, fmt.Sprintf("model %q not available", j.Model))
+	}
+
+	for {
+		var items []BatchItem
+		if err := b.db.WithContext(ctx).
+			Where("job_id = ? AND status = ?", id, ItemPending).
+			Order("seq ASC").
+			Limit(batchRunSize).
+			Find(&items).Error; err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			break
+		}
+		for i := range items {
+			if err := b.runItem(ctx, svc, &j, &items[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	now := time.Now()
+	return b.db.WithContext(ctx).Model(&BatchJob{}).
+		Where("id = ? AND status = ?", id, BatchRunning).
+		Updates(map[string]any{"status": BatchSucceeded, "error": nil, "finished_at": &now, "updated_at": now}).Error
+}
+
+// runItem classifies one image and records the result. Images that are missing or cannot be
+// decoded fail the item; store and classifier errors fail the run.
+func (b *Batches) runItem(ctx context.Context, svc *Service, j *BatchJob, it *BatchItem) error {
+	var preds []Prediction
+	status, itemErr := ItemDone, ""
+	data, err := b.store.Get(ctx, it.StorageKey)
+	switch {
+	case errors.Is(err, blob.ErrNotFound):
+		status, itemErr = ItemFailed, "image missing"
+	case err != nil:
+		return fmt.Errorf("vision: load image %d: %w", it.Seq, err)
+	default:
+		img, _, err := DecodeImage(bytes.NewReader(data))
+		if err != nil {
+			status, itemErr = ItemFailed, "unsupported image format"
+			break
+		}
+		preds, err = svc.Recognize(ctx, img, j.TopK)
+		if err != nil {
+			return fmt.Errorf("vision: recognize image %d: %w", it.Seq, err)
+		}
+	}
+
+	counter := "done"
+	if status == ItemFailed {
+		counter = "failed"
+	}
+	if err := b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&BatchItem{}).
+			Where("id = ? AND status = ?", it.ID, ItemPending).
+			Updates(map[string]any{"status": status, "predictions": PredictionList(preds), "error": itemErr})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		// also keeps the sweeper off a long job
+		return tx.Model(&BatchJob{}).Where("id = ?", j.ID).
+			Updates(map[string]any{counter: gorm.Expr(counter + " + 1"), "updated_at": time.Now()}).Error
+	}); err != nil {
+		return err
+	}
+	b.deleteImages(ctx, []string{it.StorageKey})
+	return nil
+}
+
+// Requeue puts a running job back to queued ahead of a retry, recording why it stopped.
+func (b *Batches) Requeue(ctx context.Context, id, errMsg string) error {
+	return b.db.WithContext(ctx).Model(&BatchJob{}).
+		Where("id = ? AND status = ?", id, BatchRunning).
+		Updates(map[string]any{"status": BatchQueued, "error": errMsg, "updated_at": time.Now()}).Error
+}
+
+// Fail gives up on a job: its pending items fail and their images are removed.
+func (b *Batches) Fail(ctx context.Context, id, errMsg string) error {
+	var keys []string
+	if err := b.db.WithContext(ctx).Model(&BatchItem{}).
+		Where("job_id = ? AND status = ?", id, ItemPending).
+		Pluck("storage_key", &keys).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&BatchJob{}).
+			Where("id = ? AND status IN ?", id, []BatchStatus{BatchQueued, BatchRunning}).
+			Updates(map[string]any{
+				"status":      BatchFailed,
+				"error":       errMsg,
+				"failed":      gorm.Expr("total - done"),
+				"finished_at": &now,
+				"updated_at":  now,
+			})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		return tx.Model(&BatchItem{}).
+			Where("job_id = ? AND status = ?", id, ItemPending).
+			Updates(map[string]any{"status": ItemFailed, "error": "job failed"}).Error
+	}); err != nil {
+		return err
+	}
+	b.deleteImages(ctx, keys)
+	return nil
+}
+
+// SweepStuck publishes jobs again that sat queued since before queuedBefore, or running
+// since before runningBefore (those are reset to queued first). A zero time skips that
+// check. It returns how many jobs it published.
+func (b *Batches) SweepStuck(ctx context.Context, queuedBefore, runningBefore time.Time) (int, error) {
+	if b.publisher == nil {
+		return 0, nil
+	}
+	sweeps := []struct {
+		status BatchStatus
+		before time.Time
+	}{
+		{BatchQueued, queuedBefore},
+		{BatchRunning, runningBefore},
+	}
+	n := 0
+	for _, sw := range sweeps {
+		if sw.before.IsZero() {
+			continue
+		}
+		var jobs []BatchJob
+		if err := b.db.WithContext(ctx).
+			Select("id", "user_id").
+			Where("status = ? AND updated_at < ?", sw.status, sw.before).
+			Order("updated_at ASC").
+			Limit(sweepBatchSize).
+			Find(&jobs).Error; err != nil {
+			return n, err
+		}
+		for i := range jobs {
+			updates := map[string]any{"status": BatchQueued, "updated_at": time.Now()}
+			if sw.status == BatchRunning {
+				updates["error"] = "requeued after running too long"
+			}
+			res := b.db.WithContext(ctx).Model(&BatchJob{}).
+				Where("id = ? AND status = ? AND updated_at < ?", jobs[i].ID, sw.status, sw.before).
+				Updates(updates)
+			if res.Error != nil {
+				return n, res.Error
+			}
+			if res.RowsAffected == 0 {
+				continue
+			}
+			if err := b.publisher.PublishJob(ctx, jobs[i].ID, jobs[i].UserID, 0); err != nil {
+				return n, err
+			}
+			n++
+			log.Printf("vision: requeued stuck job=%s status=%s", jobs[i].ID, sw.status)
+		}
+	}
+	return n, nil
+}
+
+// UserImageKeys returns the storage keys of the images of the user still waiting to be
+// classified, so they can be removed with DeleteImages once the rows are gone.
+func (b *Batches) UserImageKeys(ctx context.Context, userID uint64) ([]string, error) {
+	var keys []string
+	err := b.db.WithContext(ctx).Model(&BatchItem{}).
+		Where("user_id = ? AND status = ? AND storage_key <> ''", userID, ItemPending).
+		Pluck("storage_key", &keys).Error
+	return keys, err
+}
+
+// DeleteImages removes stored images, logging failures.
+func (b *Batches) DeleteImages(ctx context.Context, keys []string) {
+	b.deleteImages(ctx, keys)
+}
+
+func (b *Batches) deleteImages(ctx context.Context, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	for _, k := range keys {
+		if err := b.store.Delete(ctx, k); err != nil {
+			log.Printf("vision: delete image %s: %v", k, err)
+		}
+	}
+}
+
+// truncate cuts s to at most n bytes without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
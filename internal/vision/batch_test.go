@@ -0,0 +1,312 @@
+package vision
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"sync"
+	"testing"
+	"time"
+
+	gormsqlite "github.com/glebarez/sqlite"
+	"github.com/suPer8Hu/ai-platform/internal/store/blob"
+	"gorm.io/gorm"
+)
+
+// countingClassifier answers every image with one prediction and fails call failAt (1-based).
+type countingClassifier struct {
+	mu     sync.Mutex
+	calls  int
+	failAt int
+}
+
+func (c *countingClassifier) Predict(ctx context.Context, img image.Image, topK int) ([]Prediction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.calls == c.failAt {
+		return nil, errors.New("classifier down")
+	}
+	return []Prediction{{Index: 1, Label: "cat", Score: 0.9}}, nil
+}
+
+func (c *countingClassifier) Close() error { return nil }
+
+type recordingPublisher struct {
+	mu        sync.Mutex
+	published []string
+}
+
+func (p *recordingPublisher) PublishJob(ctx context.Context, jobID string, userID uint64, priority uint8) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, jobID)
+	return nil
+}
+
+type batchEnv struct {
+	b     *Batches
+	db    *gorm.DB
+	store blob.Store
+	clf   *countingClassifier
+	pub   *recordingPublisher
+}
+
+func newBatchEnv(t *testing.T) *batchEnv {
+	t.Helper()
+	db, err := gorm.Open(gormsqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	// every connection to file::memory: is a database of its own
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("db: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&BatchJob{}, &BatchItem{}); err != nil {
+		t.Fatalf("automigrate: %v", err)
+	}
+	store, err := blob.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("blob store: %v", err)
+	}
+
+	clf := &countingClassifier{}
+	svc, err := NewService(clf, 3, 5)
+	if err != nil {
+		t.Fatalf("service: %v", err)
+	}
+	models := NewRegistry()
+	models.Add("tiny", svc, ModelInfo{})
+
+	pub := &recordingPublisher{}
+	b := NewBatches(db, store, models)
+	b.SetPublisher(pub)
+	return &batchEnv{b: b, db: db, store: store, clf: clf, pub: pub}
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// submit uploads files (nil entries are replaced by a valid image) and submits the job.
+func (e *batchEnv) submit(t *testing.T, files ...[]byte) *BatchJob {
+	t.Helper()
+	ctx := context.Background()
+	up, err := e.b.NewUpload(7, "", 0)
+	if err != nil {
+		t.Fatalf("new upload: %v", err)
+	}
+	for _, f := range files {
+		if f == nil {
+			f = testPNG(t)
+		}
+		if err := up.Add(ctx, "img.png", f); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	j, err := up.Submit(ctx)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	return j
+}
+
+func (e *batchEnv) job(t *testing.T, id string) *BatchJob {
+	t.Helper()
+	j, err := e.b.Get(context.Background(), 7, id)
+	if err != nil {
+		t.Fatalf("get job: %v", err)
+	}
+	return j
+}
+
+func (e *batchEnv) items(t *testing.T, id string) []BatchItem {
+	t.Helper()
+	items, err := e.b.ListItems(context.Background(), id, -1, 0)
+	if err != nil {
+		t.Fatalf("list items: %v", err)
+	}
+	return items
+}
+
+func TestBatchSubmit(t *testing.T) {
+	e := newBatchEnv(t)
+	ctx := context.Background()
+
+	up, err := e.b.NewUpload(7, "", 0)
+	if err != nil {
+		t.Fatalf("new upload: %v", err)
+	}
+	if _, err := up.Submit(ctx); !errors.Is(err, ErrEmptyBatch) {
+		t.Fatalf("empty batch: err = %v", err)
+	}
+	if _, err := e.b.NewUpload(7, "missing", 0); !errors.Is(err, ErrUnknownModel) {
+		t.Fatalf("unknown model: err = %v", err)
+	}
+
+	// nothing readable: the job is finished on the spot and never published
+	j := e.submit(t, []byte("not an image"), []byte("neither"))
+	if j.Status != BatchSucceeded || j.Total != 2 || j.Failed != 2 || j.FinishedAt == nil || j.Model != "tiny" || j.TopK != 3 {
+		t.Fatalf("all-invalid job = %+v", j)
+	}
+	for _, it := range e.items(t, j.ID) {
+		if it.Status != ItemFailed || it.StorageKey != "" || it.Error != "unsupported image format" {
+			t.Fatalf("item = %+v", it)
+		}
+	}
+	if len(e.pub.published) != 0 {
+		t.Fatalf("all-invalid job published: %v", e.pub.published)
+	}
+
+	// a mixed batch is queued and published, the bad file failing on its own
+	j = e.submit(t, nil, []byte("not an image"))
+	if j.Status != BatchQueued || j.Total != 2 || j.Failed != 1 {
+		t.Fatalf("mixed job = %+v", j)
+	}
+	if len(e.pub.published) != 1 || e.pub.published[0] != j.ID {
+		t.Fatalf("published = %v", e.pub.published)
+	}
+	if _, err := e.b.Get(ctx, 8, j.ID); !errors.Is(err, ErrBatchNotFound) {
+		t.Fatalf("another user's job: err = %v", err)
+	}
+}
+
+func TestBatchRun_ResumesAfterPartialRun(t *testing.T) {
+	e := newBatchEnv(t)
+	ctx := context.Background()
+	j := e.submit(t, nil, nil, nil, nil)
+	items := e.items(t, j.ID)
+
+	// the classifier fails on the second image: the first stays done, the job running
+	e.clf.failAt = 2
+	if err := e.b.Run(ctx, j.ID); err == nil {
+		t.Fatalf("expected the run to fail")
+	}
+	got := e.job(t, j.ID)
+	if got.Status != BatchRunning || got.Done != 1 || got.Failed != 0 {
+		t.Fatalf("after partial run: %+v", got)
+	}
+	if _, err := e.store.Get(ctx, items[0].StorageKey); !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("image of a done item kept: %v", err)
+	}
+
+	// the image of the last item went missing meanwhile
+	if err := e.store.Delete(ctx, items[3].StorageKey); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := e.b.Requeue(ctx, j.ID, "classifier down"); err != nil {
+		t.Fatalf("requeue: %v", err)
+	}
+	if err := e.b.Run(ctx, j.ID); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	got = e.job(t, j.ID)
+	if got.Status != BatchSucceeded || got.Done != 3 || got.Failed != 1 || got.Error != nil || got.FinishedAt == nil {
+		t.Fatalf("after resume: %+v", got)
+	}
+	// the done item is not classified again: 2 calls before, 2 after
+	if e.clf.calls != 4 {
+		t.Fatalf("classifier called %d times, want 4", e.clf.calls)
+	}
+	items = e.items(t, j.ID)
+	for i, want := range []ItemStatus{ItemDone, ItemDone, ItemDone, ItemFailed} {
+		if items[i].Status != want {
+			t.Fatalf("item %d status %s, want %s", i, items[i].Status, want)
+		}
+	}
+	if len(items[0].Predictions) != 1 || items[0].Predictions[0].Label != "cat" || items[3].Error != "image missing" {
+		t.Fatalf("items = %+v", items)
+	}
+}
+
+func TestBatchRun_DuplicateDelivery(t *testing.T) {
+	e := newBatchEnv(t)
+	ctx := context.Background()
+	j := e.submit(t, nil)
+
+	// another delivery claimed the job first
+	if err := e.db.Model(&BatchJob{}).Where("id = ?", j.ID).Update("status", BatchRunning).Error; err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if err := e.b.Run(ctx, j.ID); !errors.Is(err, ErrBatchTaken) {
+		t.Fatalf("expected ErrBatchTaken, got %v", err)
+	}
+	if e.clf.calls != 0 {
+		t.Fatalf("a taken job was classified")
+	}
+
+	// finished and unknown jobs are skipped without error
+	if err := e.db.Model(&BatchJob{}).Where("id = ?", j.ID).Update("status", BatchSucceeded).Error; err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	if err := e.b.Run(ctx, j.ID); err != nil {
+		t.Fatalf("finished job: %v", err)
+	}
+	if err := e.b.Run(ctx, "01NOSUCHJOB000000000000000"); err != nil {
+		t.Fatalf("unknown job: %v", err)
+	}
+}
+
+func TestBatchSweepStuck(t *testing.T) {
+	e := newBatchEnv(t)
+	ctx := context.Background()
+	stale := e.submit(t, nil)
+	fresh := e.submit(t, nil)
+	queued := e.submit(t, nil)
+	e.pub.published = nil
+
+	old := time.Now().Add(-time.Hour)
+	for id, status := range map[string]BatchStatus{stale.ID: BatchRunning, fresh.ID: BatchRunning, queued.ID: BatchQueued} {
+		if err := e.db.Model(&BatchJob{}).Where("id = ?", id).Update("status", status).Error; err != nil {
+			t.Fatalf("set status: %v", err)
+		}
+	}
+	for _, id := range []string{stale.ID, queued.ID} {
+		if err := e.db.Model(&BatchJob{}).Where("id = ?", id).UpdateColumn("updated_at", old).Error; err != nil {
+			t.Fatalf("age job: %v", err)
+		}
+	}
+
+	// running jobs only: the queued one is left alone
+	n, err := e.b.SweepStuck(ctx, time.Time{}, time.Now().Add(-time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("sweep running: n=%d err=%v", n, err)
+	}
+	if len(e.pub.published) != 1 || e.pub.published[0] != stale.ID {
+		t.Fatalf("published = %v", e.pub.published)
+	}
+	got := e.job(t, stale.ID)
+	if got.Status != BatchQueued || got.Error == nil || !got.UpdatedAt.After(old) {
+		t.Fatalf("swept job = %+v", got)
+	}
+	if got := e.job(t, fresh.ID); got.Status != BatchRunning {
+		t.Fatalf("recently updated job swept: %+v", got)
+	}
+
+	// the requeued job is fresh now and not swept again
+	n, err = e.b.SweepStuck(ctx, time.Now().Add(-time.Minute), time.Now().Add(-time.Minute))
+	if err != nil || n != 1 || e.pub.published[1] != queued.ID {
+		t.Fatalf("sweep queued: n=%d err=%v published=%v", n, err, e.pub.published)
+	}
+
+	// the requeued delivery runs the job to the end
+	if err := e.b.Run(ctx, stale.ID); err != nil {
+		t.Fatalf("run swept job: %v", err)
+	}
+	if got := e.job(t, stale.ID); got.Status != BatchSucceeded || got.Done != 1 {
+		t.Fatalf("swept job after run = %+v", got)
+	}
+}
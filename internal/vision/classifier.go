@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"image"
-	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,19 +15,17 @@ import (
 	ort "github.com/yalue/onnxruntime_go"
 )
 
-const (
-	defaultInputName  = "data"
-	defaultOutputName = "mobilenetv20_output_flatten0_reshape0"
-	defaultInputH     = 224
-	defaultInputW     = 224
-)
-
 type ONNXClassifier struct {
 	modelPath    string
 	inputName    string
 	outputName   string
 	inputH       int
 	inputW       int
+	layout       Layout
+	scale        float32
+	mean         [3]float32
+	std          [3]float32
+	probs        bool
 	labels       []Label
 	inputTensor  *ort.Tensor[float32]
 	outputTensor *ort.Tensor[float32]
@@ -41,36 +38,23 @@ var initOnce sync.Once
 var initErr error
 
 func NewONNXClassifier(cfg Config) (Classifier, error) {
-	modelPath := strings.TrimSpace(cfg.ModelPath)
-	if modelPath == "" {
-		return nil, errors.New("model path is required")
-	}
-	labelsPath := strings.TrimSpace(cfg.LabelsPath)
-	if labelsPath == "" {
-		return nil, errors.New("labels path is required")
-	}
-
-	inputH := cfg.InputH
-	inputW := cfg.InputW
-	if inputH <= 0 {
-		inputH = defaultInputH
-	}
-	if inputW <= 0 {
-		inputW = defaultInputW
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
 	}
-
-	inputName := strings.TrimSpace(cfg.InputName)
+	inputH, inputW, layout := cfg.InputH, cfg.InputW, cfg.Layout
+	inputName := cfg.InputName
 	if inputName == "" {
 		inputName = defaultInputName
 	}
-	outputName := strings.TrimSpace(cfg.OutputName)
+	outputName := cfg.OutputName
 	if outputName == "" {
 		outputName = defaultOutputName
 	}
 
 	setOrtLibraryPath(cfg.OrtLibraryPath)
 
-	labels, err := LoadLabels(labelsPath)
+	labels, err := LoadLabels(cfg.LabelsPath)
 	if err != nil {
 		return nil, err
 	}
@@ -83,6 +67,9 @@ func NewONNXClassifier(cfg Config) (Classifier, error) {
 	}
 
 	inputShape := ort.NewShape(1, 3, int64(inputH), int64(inputW))
+	if layout == LayoutNHWC {
+		inputShape = ort.NewShape(1, int64(inputH), int64(inputW), 3)
+	}
 	inData := make([]float32, inputShape.FlattenedSize())
 	inTensor, err := ort.NewTensor(inputShape, inData)
 	if err != nil {
@@ -97,7 +84,7 @@ func NewONNXClassifier(cfg Config) (Classifier, error) {
 	}
 
 	session, err := ort.NewSession[float32](
-		modelPath,
+		cfg.ModelPath,
 		[]string{inputName},
 		[]string{outputName},
 		[]*ort.Tensor[float32]{inTensor},
@@ -110,11 +97,16 @@ func NewONNXClassifier(cfg Config) (Classifier, error) {
 	}
 
 	return &ONNXClassifier{
-		modelPath:    modelPath,
+		modelPath:    cfg.ModelPath,
 		inputName:    inputName,
 		outputName:   outputName,
 		inputH:       inputH,
 		inputW:       inputW,
+		layout:       layout,
+		scale:        cfg.Scale,
+		mean:         cfg.Mean,
+		std:          cfg.Std,
+		probs:        cfg.Probabilities,
 		labels:       labels,
 		inputTensor:  inTensor,
 		outputTensor: outTensor,
@@ -129,7 +121,7 @@ func (c *ONNXClassifier) Predict(ctx context.Context, img image.Image, topK int)
 		}
 	}
 
-	data, err := Preprocess(img, c.inputW, c.inputH)
+	data, err := PreprocessTensor(img, c.inputW, c.inputH, c.layout, c.scale, c.mean, c.std)
 	if err != nil {
 		return nil, err
 	}
@@ -155,7 +147,10 @@ func (c *ONNXClassifier) Predict(ctx context.Context, img image.Image, topK int)
 		return nil, errors.New("empty output from model")
 	}
 
-	probs := softmax(outData)
+	probs := outData
+	if !c.probs {
+		probs = softmax(outData)
+	}
 	k := topK
 	if k <= 0 {
 		k = 1
@@ -219,67 +214,3 @@ func fileExists(path string) bool {
 	}
 	return !info.IsDir()
 }
-
-func topKPredictions(outData []float32, labels []Label, k int) []Prediction {
-	if k <= 0 {
-		return nil
-	}
-	top := make([]Prediction, 0, k)
-	for i, score := range outData {
-		label := ""
-		labelZH := ""
-		if i >= 0 && i < len(labels) {
-			label = labels[i].EN
-			labelZH = labels[i].ZH
-		} else {
-			label = "Unknown"
-		}
-		p := Prediction{Index: i, Label: label, LabelZH: labelZH, Score: score}
-
-		inserted := false
-		for j := 0; j < len(top); j++ {
-			if score > top[j].Score {
-				top = append(top, Prediction{})
-				copy(top[j+1:], top[j:])
-				top[j] = p
-				inserted = true
-				break
-			}
-		}
-		if !inserted {
-			if len(top) < k {
-				top = append(top, p)
-			}
-		}
-		if len(top) > k {
-			top = top[:k]
-		}
-	}
-	return top
-}
-
-func softmax(logits []float32) []float32 {
-	if len(logits) == 0 {
-		return nil
-	}
-	maxVal := logits[0]
-	for _, v := range logits[1:] {
-		if v > maxVal {
-			maxVal = v
-		}
-	}
-	out := make([]float32, len(logits))
-	var sum float64
-	for i, v := range logits {
-		expv := math.Exp(float64(v - maxVal))
-		sum += expv
-		out[i] = float32(expv)
-	}
-	if sum == 0 {
-		return out
-	}
-	for i := range out {
-		out[i] = float32(float64(out[i]) / sum)
-	}
-	return out
-}
@@ -0,0 +1,114 @@
+package vision
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	defaultInputName  = "data"
+	defaultOutputName = "mobilenetv20_output_flatten0_reshape0"
+	defaultInputH     = 224
+	defaultInputW     = 224
+)
+
+// withDefaults checks cfg and fills in the defaults both classifier backends share. The
+// input and output names are left to the backend.
+func (cfg Config) withDefaults() (Config, error) {
+	cfg.ModelPath = strings.TrimSpace(cfg.ModelPath)
+	if cfg.ModelPath == "" {
+		return cfg, errors.New("model path is required")
+	}
+	cfg.LabelsPath = strings.TrimSpace(cfg.LabelsPath)
+	if cfg.LabelsPath == "" {
+		return cfg, errors.New("labels path is required")
+	}
+	if cfg.InputH <= 0 {
+		cfg.InputH = defaultInputH
+	}
+	if cfg.InputW <= 0 {
+		cfg.InputW = defaultInputW
+	}
+	cfg.InputName = strings.TrimSpace(cfg.InputName)
+	cfg.OutputName = strings.TrimSpace(cfg.OutputName)
+
+	layout := Layout(strings.ToUpper(strings.TrimSpace(string(cfg.Layout))))
+	switch layout {
+	case "":
+		layout = LayoutNCHW
+	case LayoutNCHW, LayoutNHWC:
+	default:
+		return cfg, fmt.Errorf("unsupported layout %q", cfg.Layout)
+	}
+	cfg.Layout = layout
+	if cfg.Scale == 0 {
+		cfg.Scale = 1.0 / 255
+	}
+	return cfg, nil
+}
+
+func topKPredictions(outData []float32, labels []Label, k int) []Prediction {
+	if k <= 0 {
+		return nil
+	}
+	top := make([]Prediction, 0, k)
+	for i, score := range outData {
+		label := ""
+		labelZH := ""
+		if i >= 0 && i < len(labels) {
+			label = labels[i].EN
+			labelZH = labels[i].ZH
+		} else {
+			label = "Unknown"
+		}
+		p := Prediction{Index: i, Label: label, LabelZH: labelZH, Score: score}
+
+		inserted := false
+		for j := 0; j < len(top); j++ {
+			if score > top[j].Score {
+				top = append(top, Prediction{})
+				copy(top[j+1:], top[j:])
+				top[j] = p
+				inserted = true
+				break
+			}
+		}
+		if !inserted {
+			if len(top) < k {
+				top = append(top, p)
+			}
+		}
+		if len(top) > k {
+			top = top[:k]
+		}
+	}
+	return top
+}
+
+func softmax(logits []float32) []float32 {
+	if len(logits) == 0 {
+		return nil
+	}
+	maxVal := logits[0]
+	for _, v := range logits[1:] {
+		if v > maxVal {
+			maxVal = v
+		}
+	}
+	out := make([]float32, len(logits))
+	var sum float64
+	for i, v := range logits {
+		expv := math.Exp(float64(v - maxVal))
+		sum += expv
+		out[i] = float32(expv)
+	}
+	if sum == 0 {
+		return out
+	}
+	for i := range out {
+		out[i] = float32(float64(out[i]) / sum)
+	}
+	return out
+}
@@ -0,0 +1,265 @@
+package vision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Box is a rectangle in pixels of the original image.
+type Box struct {
+	X1 float32 `json:"x1"`
+	Y1 float32 `json:"y1"`
+	X2 float32 `json:"x2"`
+	Y2 float32 `json:"y2"`
+}
+
+func (b Box) area() float32 {
+	return max(0, b.X2-b.X1) * max(0, b.Y2-b.Y1)
+}
+
+func iou(a, b Box) float32 {
+	inter := Box{X1: max(a.X1, b.X1), Y1: max(a.Y1, b.Y1), X2: min(a.X2, b.X2), Y2: min(a.Y2, b.Y2)}.area()
+	if inter == 0 {
+		return 0
+	}
+	return inter / (a.area() + b.area() - inter)
+}
+
+type Detection struct {
+	Index   int     `json:"index"`
+	Label   string  `json:"label"`
+	LabelZH string  `json:"label_zh,omitempty"`
+	Score   float32 `json:"score"`
+	Box     Box     `json:"box"`
+}
+
+// DetectOptions filter the raw detections of a model. Zero values take the defaults.
+type DetectOptions struct {
+	// minimum class confidence (default 0.25)
+	ScoreThreshold float32
+	// boxes of one class overlapping a better one by more than this are dropped (default 0.45)
+	IOUThreshold float32
+	// kept after non-max suppression, best first (default 300)
+	MaxDetections int
+}
+
+func (o DetectOptions) withDefaults() DetectOptions {
+	if o.ScoreThreshold <= 0 {
+		o.ScoreThreshold = 0.25
+	}
+	if o.IOUThreshold <= 0 {
+		o.IOUThreshold = 0.45
+	}
+	if o.MaxDetections <= 0 {
+		o.MaxDetections = 300
+	}
+	return o
+}
+
+type Detector interface {
+	Detect(ctx context.Context, img image.Image, opts DetectOptions) ([]Detection, error)
+	Close() error
+}
+
+// DetectorConfig describes a YOLO-style detection model with a square input of InputSize
+// pixels (default 640) taking RGB values in [0,1], NCHW.
+type DetectorConfig struct {
+	ModelPath      string
+	LabelsPath     string
+	InputSize      int
+	InputName      string
+	OutputName     string
+	OrtLibraryPath string
+}
+
+// letterbox maps between the original image and the padded square the model sees.
+type letterbox struct {
+	scale      float32
+	padX, padY float32
+}
+
+// letterboxTensor scales img to fit a size x size square, keeping its aspect ratio, pads
+// the rest with gray and returns the square as an NCHW tensor of RGB values in [0,1].
+func letterboxTensor(img image.Image, size int) ([]float32, letterbox, error) {
+	if img == nil {
+		return nil, letterbox{}, errors.New("image is nil")
+	}
+	b := img.Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 || size <= 0 {
+		return nil, letterbox{}, errors.New("invalid image or input size")
+	}
+	scale := min(float32(size)/float32(b.Dx()), float32(size)/float32(b.Dy()))
+	w := max(1, int(math.Round(float64(float32(b.Dx())*scale))))
+	h := max(1, int(math.Round(float64(float32(b.Dy())*scale))))
+	lb := letterbox{scale: scale, padX: float32(size-w) / 2, padY: float32(size-h) / 2}
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.RGBA{114, 114, 114, 255}), image.Point{}, draw.Src)
+	x0, y0 := int(lb.padX), int(lb.padY)
+	draw.ApproxBiLinear.Scale(dst, image.Rect(x0, y0, x0+w, y0+h), img, b, draw.Over, nil)
+
+	plane := size * size
+	data := make([]float32, 3*plane)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			off := dst.PixOffset(x, y)
+			idx := y*size + x
+			data[idx] = float32(dst.Pix[off]) / 255
+			data[plane+idx] = float32(dst.Pix[off+1]) / 255
+			data[2*plane+idx] = float32(dst.Pix[off+2]) / 255
+		}
+	}
+	return data, lb, nil
+}
+
+// decodeYOLO turns the raw output of a YOLO model into detections in original image
+// pixels. It takes the YOLOv8 layout, [1, 4+classes, boxes] or transposed, and the YOLOv5
+// one, [1, boxes, 5+classes] with an objectness score. Box coordinates are center x/y and
+// width/height in input pixels.
+func decodeYOLO(out []float32, shape []int64, labels []Label, lb letterbox, bounds image.Rectangle, threshold float32) ([]Detection, error) {
+	nc := len(labels)
+	if len(shape) != 3 || shape[0] != 1 || int64(len(out)) != shape[1]*shape[2] {
+		return nil, fmt.Errorf("unexpected detection output shape %v", shape)
+	}
+	d1, d2 := int(shape[1]), int(shape[2])
+
+	var n, attrs int
+	var attrsFirst, objectness bool
+	switch {
+	case d1 == 4+nc:
+		n, attrs, attrsFirst = d2, d1, true
+	case d2 == 4+nc:
+		n, attrs = d1, d2
+	case d2 == 5+nc:
+		n, attrs, objectness = d1, d2, true
+	case d1 == 5+nc:
+		n, attrs, attrsFirst, objectness = d2, d1, true, true
+	default:
+		return nil, fmt.Errorf("detection output shape %v does not match %d labels", shape, nc)
+	}
+	at := func(i, a int) float32 {
+		if attrsFirst {
+			return out[a*n+i]
+		}
+		return out[i*attrs+a]
+	}
+	first := 4
+	if objectness {
+		first = 5
+	}
+
+	var dets []Detection
+	w, h := float32(bounds.Dx()), float32(bounds.Dy())
+	for i := 0; i < n; i++ {
+		best, score := -1, float32(0)
+		for c := 0; c < nc; c++ {
+			if s := at(i, first+c); s > score {
+				best, score = c, s
+			}
+		}
+		if objectness {
+			score *= at(i, 4)
+		}
+		if best < 0 || score < threshold {
+			continue
+		}
+		cx, cy, bw, bh := at(i, 0), at(i, 1), at(i, 2), at(i, 3)
+		box := Box{
+			X1: clamp((cx-bw/2-lb.padX)/lb.scale, 0, w),
+			Y1: clamp((cy-bh/2-lb.padY)/lb.scale, 0, h),
+			X2: clamp((cx+bw/2-lb.padX)/lb.scale, 0, w),
+			Y2: clamp((cy+bh/2-lb.padY)/lb.scale, 0, h),
+		}
+		if box.area() == 0 {
+			continue
+		}
+		dets = append(dets, Detection{Index: best, Label: labels[best].EN, LabelZH: labels[best].ZH, Score: score, Box: box})
+	}
+	return dets, nil
+}
+
+func clamp(v, lo, hi float32) float32 {
+	return min(max(v, lo), hi)
+}
+
+// NMS does per-class non-max suppression: going from the best detection down, it drops
+// those overlapping an already kept one of the same class by more than iouThreshold. At
+// most maxDets detections are kept, best first.
+func NMS(dets []Detection, iouThreshold float32, maxDets int) []Detection {
+	sorted := append([]Detection(nil), dets...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Score > sorted[j].Score })
+	kept := make([]Detection, 0, min(len(sorted), maxDets))
+	for _, d := range sorted {
+		if len(kept) == maxDets {
+			break
+		}
+		overlaps := false
+		for _, k := range kept {
+			if k.Index == d.Index && iou(k.Box, d.Box) > iouThreshold {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+var boxPalette = []color.RGBA{
+	{230, 25, 75, 255}, {60, 180, 75, 255}, {0, 130, 200, 255}, {245, 130, 48, 255},
+	{145, 30, 180, 255}, {70, 240, 240, 255}, {240, 50, 230, 255}, {210, 245, 60, 255},
+	{0, 128, 128, 255}, {170, 110, 40, 255},
+}
+
+// Annotate returns a copy of img with the detections drawn on it: a box and a
+// "label score" tag per detection, colored by class.
+func Annotate(img image.Image, dets []Detection) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+
+	thick := max(2, min(b.Dx(), b.Dy())/300)
+	face := basicfont.Face7x13
+	for _, d := range dets {
+		c := boxPalette[d.Index%len(boxPalette)]
+		r := image.Rect(int(d.Box.X1), int(d.Box.Y1), int(d.Box.X2), int(d.Box.Y2))
+		for _, edge := range []image.Rectangle{
+			image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+thick),
+			image.Rect(r.Min.X, r.Max.Y-thick, r.Max.X, r.Max.Y),
+			image.Rect(r.Min.X, r.Min.Y, r.Min.X+thick, r.Max.Y),
+			image.Rect(r.Max.X-thick, r.Min.Y, r.Max.X, r.Max.Y),
+		} {
+			draw.Draw(out, edge.Intersect(out.Bounds()), image.NewUniform(c), image.Point{}, draw.Src)
+		}
+
+		text := fmt.Sprintf("%s %.2f", d.Label, d.Score)
+		tw := font.MeasureString(face, text).Ceil()
+		th := face.Height
+		ty := r.Min.Y - th
+		if ty < 0 {
+			ty = r.Min.Y
+		}
+		tag := image.Rect(r.Min.X, ty, r.Min.X+tw+4, ty+th)
+		draw.Draw(out, tag.Intersect(out.Bounds()), image.NewUniform(c), image.Point{}, draw.Src)
+		dr := font.Drawer{
+			Dst:  out,
+			Src:  image.White,
+			Face: face,
+			Dot:  fixed.P(tag.Min.X+2, tag.Min.Y+face.Ascent),
+		}
+		dr.DrawString(text)
+	}
+	return out
+}
@@ -0,0 +1,226 @@
+package vision
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func near(a, b float32) bool {
+	return math.Abs(float64(a-b)) < 1e-3
+}
+
+func sameBox(a, b Box) bool {
+	return near(a.X1, b.X1) && near(a.Y1, b.Y1) && near(a.X2, b.X2) && near(a.Y2, b.Y2)
+}
+
+// yoloOutput lays rows of box attributes out as a model would: attribute-major when
+// attrsFirst ([1, attrs, boxes]), box-major otherwise ([1, boxes, attrs]).
+func yoloOutput(rows [][]float32, attrsFirst bool) ([]float32, []int64) {
+	n, attrs := len(rows), len(rows[0])
+	out := make([]float32, n*attrs)
+	for i, row := range rows {
+		for a, v := range row {
+			if attrsFirst {
+				out[a*n+i] = v
+			} else {
+				out[i*attrs+a] = v
+			}
+		}
+	}
+	if attrsFirst {
+		return out, []int64{1, int64(attrs), int64(n)}
+	}
+	return out, []int64{1, int64(n), int64(attrs)}
+}
+
+func TestDecodeYOLO(t *testing.T) {
+	labels := []Label{{EN: "cat", ZH: "猫"}, {EN: "dog", ZH: "狗"}}
+	// a 200x100 image letterboxed into 100x100: half size, 25 pixels of padding on top
+	bounds := image.Rect(0, 0, 200, 100)
+	lb := letterbox{scale: 0.5, padY: 25}
+
+	// center x/y and width/height in input pixels
+	cat := []float32{20, 40, 20, 20}  // (20,10)-(60,50) in the image
+	dog := []float32{75, 50, 50, 50}  // (100,0)-(200,100)
+	edge := []float32{5, 30, 20, 20}  // reaches past the left edge: clamped to x=0
+	pad := []float32{50, 10, 100, 10} // entirely in the padding: no area left
+	want := []Detection{
+		{Index: 0, Label: "cat", LabelZH: "猫", Score: 0.9, Box: Box{X1: 20, Y1: 10, X2: 60, Y2: 50}},
+		{Index: 1, Label: "dog", LabelZH: "狗", Score: 0.8, Box: Box{X1: 100, Y1: 0, X2: 200, Y2: 100}},
+		{Index: 0, Label: "cat", LabelZH: "猫", Score: 0.6, Box: Box{X1: 0, Y1: 0, X2: 30, Y2: 30}},
+	}
+	row := func(box []float32, scores ...float32) []float32 {
+		return append(append([]float32(nil), box...), scores...)
+	}
+
+	v8 := [][]float32{
+		row(cat, 0.9, 0.1),
+		row(dog, 0.2, 0.8),
+		row(edge, 0.6, 0.1),
+		row(cat, 0.1, 0.2), // below the threshold
+		row(pad, 0.9, 0),
+	}
+	// YOLOv5 rows carry objectness: class scores are multiplied by it
+	v5 := [][]float32{
+		row(cat, 1, 0.9, 0.1),
+		row(dog, 0.5, 0.2, 1.6),
+		row(edge, 0.75, 0.8, 0.1),
+		row(cat, 0.2, 0.9, 0.5), // 0.18: below the threshold
+		row(pad, 1, 0.9, 0),
+	}
+
+	cases := []struct {
+		name       string
+		rows       [][]float32
+		attrsFirst bool
+	}{
+		{"v8", v8, true},
+		{"v8 transposed", v8, false},
+		{"v5", v5, false},
+		{"v5 transposed", v5, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, shape := yoloOutput(tc.rows, tc.attrsFirst)
+			dets, err := decodeYOLO(out, shape, labels, lb, bounds, 0.25)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if len(dets) != len(want) {
+				t.Fatalf("got %d detections, want %d: %+v", len(dets), len(want), dets)
+			}
+			for i, d := range dets {
+				w := want[i]
+				if d.Index != w.Index || d.Label != w.Label || d.LabelZH != w.LabelZH || !near(d.Score, w.Score) || !sameBox(d.Box, w.Box) {
+					t.Fatalf("detection %d = %+v, want %+v", i, d, w)
+				}
+			}
+		})
+	}
+
+	t.Run("bad shapes", func(t *testing.T) {
+		out, shape := yoloOutput(v8, true)
+		for _, bad := range []struct {
+			name  string
+			out   []float32
+			shape []int64
+		}{
+			{"two dims", out, []int64{6, 5}},
+			{"batch of two", out, []int64{2, 6, 5}},
+			{"size mismatch", out[:len(out)-1], shape},
+			{"labels mismatch", make([]float32, 8*5), []int64{1, 8, 5}},
+		} {
+			if _, err := decodeYOLO(bad.out, bad.shape, labels, lb, bounds, 0.25); err == nil {
+				t.Fatalf("%s: expected error", bad.name)
+			}
+		}
+	})
+}
+
+func TestLetterboxTensor(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	gray := float32(114) / 255
+
+	cases := []struct {
+		name       string
+		w, h, size int
+		want       letterbox
+		padX, padY int // a pixel of the padding
+		imgX, imgY int // a pixel of the image
+	}{
+		{"wide", 200, 100, 100, letterbox{scale: 0.5, padY: 25}, 50, 10, 50, 50},
+		{"tall", 50, 100, 100, letterbox{scale: 1, padX: 25}, 10, 50, 50, 50},
+		{"upscaled", 20, 10, 40, letterbox{scale: 2, padY: 10}, 20, 5, 20, 20},
+		{"square", 64, 64, 32, letterbox{scale: 0.5}, -1, -1, 16, 16},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			img := image.NewRGBA(image.Rect(0, 0, tc.w, tc.h))
+			for y := 0; y < tc.h; y++ {
+				for x := 0; x < tc.w; x++ {
+					img.SetRGBA(x, y, red)
+				}
+			}
+			data, lb, err := letterboxTensor(img, tc.size)
+			if err != nil {
+				t.Fatalf("letterbox: %v", err)
+			}
+			if !near(lb.scale, tc.want.scale) || !near(lb.padX, tc.want.padX) || !near(lb.padY, tc.want.padY) {
+				t.Fatalf("letterbox = %+v, want %+v", lb, tc.want)
+			}
+			plane := tc.size * tc.size
+			if len(data) != 3*plane {
+				t.Fatalf("tensor has %d values, want %d", len(data), 3*plane)
+			}
+			rgb := func(x, y int) [3]float32 {
+				i := y*tc.size + x
+				return [3]float32{data[i], data[plane+i], data[2*plane+i]}
+			}
+			if tc.padX >= 0 {
+				if p := rgb(tc.padX, tc.padY); !near(p[0], gray) || !near(p[1], gray) || !near(p[2], gray) {
+					t.Fatalf("padding pixel = %v, want gray", p)
+				}
+			}
+			if p := rgb(tc.imgX, tc.imgY); !near(p[0], 1) || !near(p[1], 0) || !near(p[2], 0) {
+				t.Fatalf("image pixel = %v, want red", p)
+			}
+
+			// a box over the whole letterboxed image maps back onto the original
+			cx, cy := float32(tc.size)/2, float32(tc.size)/2
+			bw, bh := float32(tc.size)-2*lb.padX, float32(tc.size)-2*lb.padY
+			out, shape := yoloOutput([][]float32{{cx, cy, bw, bh, 1}}, false)
+			dets, err := decodeYOLO(out, shape, []Label{{EN: "x"}}, lb, img.Bounds(), 0.5)
+			if err != nil || len(dets) != 1 {
+				t.Fatalf("decode: %+v %v", dets, err)
+			}
+			if full := (Box{X2: float32(tc.w), Y2: float32(tc.h)}); !sameBox(dets[0].Box, full) {
+				t.Fatalf("box maps to %+v, want %+v", dets[0].Box, full)
+			}
+		})
+	}
+
+	if _, _, err := letterboxTensor(nil, 32); err == nil {
+		t.Fatalf("expected error for a nil image")
+	}
+	if _, _, err := letterboxTensor(image.NewRGBA(image.Rect(0, 0, 4, 4)), 0); err == nil {
+		t.Fatalf("expected error for size 0")
+	}
+}
+
+func TestNMS(t *testing.T) {
+	box := func(x, y, s float32) Box { return Box{X1: x, Y1: y, X2: x + s, Y2: y + s} }
+	a := Detection{Index: 0, Score: 0.9, Box: box(0, 0, 10)}
+	b := Detection{Index: 0, Score: 0.8, Box: box(1, 1, 10)}   // overlaps a: iou 81/119
+	c := Detection{Index: 1, Score: 0.7, Box: box(0, 0, 10)}   // same box as a, other class
+	d := Detection{Index: 0, Score: 0.6, Box: box(50, 50, 10)} // far away
+	e := Detection{Index: 0, Score: 0.5, Box: box(5, 0, 10)}   // overlaps a: iou 50/150
+
+	cases := []struct {
+		name    string
+		in      []Detection
+		iou     float32
+		maxDets int
+		want    []Detection
+	}{
+		{"per class", []Detection{d, c, b, a, e}, 0.45, 10, []Detection{a, c, d, e}},
+		{"looser threshold", []Detection{a, b, e}, 0.9, 10, []Detection{a, b, e}},
+		{"stricter threshold", []Detection{a, b, e}, 0.3, 10, []Detection{a}},
+		{"max detections", []Detection{e, d, c, b, a}, 0.45, 2, []Detection{a, c}},
+		{"empty", nil, 0.45, 10, []Detection{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := NMS(tc.in, tc.iou, tc.maxDets)
+			if len(got) != len(tc.want) {
+				t.Fatalf("kept %+v, want %+v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("kept %+v, want %+v", got, tc.want)
+				}
+			}
+		})
+	}
+}
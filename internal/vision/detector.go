@@ -0,0 +1,136 @@
+//go:build onnx
+
+package vision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"strings"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+const (
+	defaultDetectInputName  = "images"
+	defaultDetectOutputName = "output0"
+	defaultDetectInputSize  = 640
+)
+
+// ONNXDetector runs a YOLO-style detection model through onnxruntime. The output is
+// allocated by onnxruntime on every run since the number of boxes depends on the model.
+type ONNXDetector struct {
+	inputSize   int
+	labels      []Label
+	inputTensor *ort.Tensor[float32]
+	session     *ort.DynamicAdvancedSession
+	mu          sync.Mutex
+	closed      bool
+}
+
+func NewONNXDetector(cfg DetectorConfig) (Detector, error) {
+	modelPath := strings.TrimSpace(cfg.ModelPath)
+	if modelPath == "" {
+		return nil, errors.New("model path is required")
+	}
+	labelsPath := strings.TrimSpace(cfg.LabelsPath)
+	if labelsPath == "" {
+		return nil, errors.New("labels path is required")
+	}
+	size := cfg.InputSize
+	if size <= 0 {
+		size = defaultDetectInputSize
+	}
+	inputName := strings.TrimSpace(cfg.InputName)
+	if inputName == "" {
+		inputName = defaultDetectInputName
+	}
+	outputName := strings.TrimSpace(cfg.OutputName)
+	if outputName == "" {
+		outputName = defaultDetectOutputName
+	}
+
+	setOrtLibraryPath(cfg.OrtLibraryPath)
+
+	labels, err := LoadLabels(labelsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	initOnce.Do(func() {
+		initErr = ort.InitializeEnvironment()
+	})
+	if initErr != nil {
+		return nil, fmt.Errorf("onnxruntime init failed: %w", initErr)
+	}
+
+	inTensor, err := ort.NewEmptyTensor[float32](ort.NewShape(1, 3, int64(size), int64(size)))
+	if err != nil {
+		return nil, fmt.Errorf("create input tensor failed: %w", err)
+	}
+	session, err := ort.NewDynamicAdvancedSession(modelPath, []string{inputName}, []string{outputName}, nil)
+	if err != nil {
+		inTensor.Destroy()
+		return nil, fmt.Errorf("create onnx session failed: %w", err)
+	}
+
+	return &ONNXDetector{
+		inputSize:   size,
+		labels:      labels,
+		inputTensor: inTensor,
+		session:     session,
+	}, nil
+}
+
+func (d *ONNXDetector) Detect(ctx context.Context, img image.Image, opts DetectOptions) ([]Detection, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+
+	data, lb, err := letterboxTensor(img, d.inputSize)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, errors.New("detector closed")
+	}
+
+	copy(d.inputTensor.GetData(), data)
+	outputs := []ort.Value{nil}
+	if err := d.session.Run([]ort.Value{d.inputTensor}, outputs); err != nil {
+		return nil, fmt.Errorf("onnx run failed: %w", err)
+	}
+	defer outputs[0].Destroy()
+	out, ok := outputs[0].(*ort.Tensor[float32])
+	if !ok {
+		return nil, fmt.Errorf("unexpected detection output type %T", outputs[0])
+	}
+
+	dets, err := decodeYOLO(out.GetData(), out.GetShape(), d.labels, lb, img.Bounds(), opts.ScoreThreshold)
+	if err != nil {
+		return nil, err
+	}
+	return NMS(dets, opts.IOUThreshold, opts.MaxDetections), nil
+}
+
+func (d *ONNXDetector) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	if d.session != nil {
+		d.session.Destroy()
+	}
+	if d.inputTensor != nil {
+		d.inputTensor.Destroy()
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package vision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+
+	"github.com/suPer8Hu/ai-platform/internal/vision/onnxgo"
+)
+
+// GoClassifier runs an ONNX classifier on the pure-Go interpreter of package onnxgo. It
+// needs neither cgo nor onnxruntime but is several times slower, and it knows only the
+// operators of small CNNs such as MobileNetV2; other models fail to load.
+type GoClassifier struct {
+	modelPath  string
+	model      *onnxgo.Model
+	inputName  string
+	outputName string
+	inputH     int
+	inputW     int
+	inputShape []int
+	layout     Layout
+	scale      float32
+	mean       [3]float32
+	std        [3]float32
+	probs      bool
+	labels     []Label
+	closed     atomic.Bool
+}
+
+// NewGoClassifier loads a classifier for the pure-Go interpreter. Without InputName or
+// OutputName it takes the first input and output of the graph.
+func NewGoClassifier(cfg Config) (Classifier, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	labels, err := LoadLabels(cfg.LabelsPath)
+	if err != nil {
+		return nil, err
+	}
+	model, err := onnxgo.Load(cfg.ModelPath)
+	if err != nil {
+		return nil, fmt.Errorf("load onnx model failed: %w", err)
+	}
+
+	inputName := cfg.InputName
+	if inputName == "" {
+		inputs := model.Inputs()
+		if len(inputs) == 0 {
+			return nil, errors.New("model has no inputs")
+		}
+		inputName = inputs[0]
+	}
+	outputName := cfg.OutputName
+	if outputName == "" {
+		outputs := model.Outputs()
+		if len(outputs) == 0 {
+			return nil, errors.New("model has no outputs")
+		}
+		outputName = outputs[0]
+	}
+	if !slices.Contains(model.Outputs(), outputName) {
+		return nil, fmt.Errorf("model has no output %q", outputName)
+	}
+
+	inputShape := []int{1, 3, cfg.InputH, cfg.InputW}
+	if cfg.Layout == LayoutNHWC {
+		inputShape = []int{1, cfg.InputH, cfg.InputW, 3}
+	}
+	declared, ok := model.InputShape(inputName)
+	if !ok {
+		return nil, fmt.Errorf("model has no input %q", inputName)
+	}
+	if declared != nil && !fitsShape(declared, inputShape) {
+		return nil, fmt.Errorf("model input %q has shape %v, configured for %v", inputName, declared, inputShape)
+	}
+
+	return &GoClassifier{
+		modelPath:  cfg.ModelPath,
+		model:      model,
+		inputName:  inputName,
+		outputName: outputName,
+		inputH:     cfg.InputH,
+		inputW:     cfg.InputW,
+		inputShape: inputShape,
+		layout:     cfg.Layout,
+		scale:      cfg.Scale,
+		mean:       cfg.Mean,
+		std:        cfg.Std,
+		probs:      cfg.Probabilities,
+		labels:     labels,
+	}, nil
+}
+
+// fitsShape reports whether shape matches a declared one whose unknown dimensions are -1.
+func fitsShape(declared, shape []int) bool {
+	if len(declared) != len(shape) {
+		return false
+	}
+	for i, d := range declared {
+		if d >= 0 && d != shape[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *GoClassifier) Predict(ctx context.Context, img image.Image, topK int) ([]Prediction, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.closed.Load() {
+		return nil, errors.New("classifier closed")
+	}
+
+	data, err := PreprocessTensor(img, c.inputW, c.inputH, c.layout, c.scale, c.mean, c.std)
+	if err != nil {
+		return nil, err
+	}
+	in, err := onnxgo.NewTensor(c.inputShape, data)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.model.Run(ctx, map[string]*onnxgo.Tensor{c.inputName: in}, c.outputName)
+	if err != nil {
+		return nil, fmt.Errorf("onnx run failed: %w", err)
+	}
+
+	outData := out[c.outputName].Data
+	if len(outData) == 0 {
+		return nil, errors.New("empty output from model")
+	}
+	probs := outData
+	if !c.probs {
+		probs = softmax(outData)
+	}
+	k := min(max(topK, 1), len(probs))
+	return topKPredictions(probs, c.labels, k), nil
+}
+
+// Close only marks the classifier closed; the model is plain Go memory.
+func (c *GoClassifier) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func (c *GoClassifier) ModelName() string {
+	return filepath.Base(c.modelPath)
+}
@@ -2,9 +2,24 @@
 
 package vision
 
-import "fmt"
+import (
+	"fmt"
+	"log"
+	"sync"
+)
 
+var stubNotice sync.Once
+
+// NewONNXClassifier falls back to the pure-Go interpreter when built without onnxruntime,
+// so vision works in plain development and CI builds, only slower.
 func NewONNXClassifier(cfg Config) (Classifier, error) {
+	stubNotice.Do(func() {
+		log.Printf("vision: built without onnxruntime, classifiers run on the pure-Go interpreter")
+	})
+	return NewGoClassifier(cfg)
+}
+
+func NewONNXDetector(cfg DetectorConfig) (Detector, error) {
 	_ = cfg
 	return nil, fmt.Errorf("onnx support not enabled (build with -tags=onnx)")
 }
@@ -0,0 +1,286 @@
+package onnxgo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// parallel calls fn(0) .. fn(n-1) spread over GOMAXPROCS goroutines. A panic in fn is
+// raised again in the caller, where Model.Run recovers it.
+func parallel(n int, fn func(i int)) {
+	workers := min(runtime.GOMAXPROCS(0), n)
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	var panicOnce sync.Once
+	var panicked any
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					panicOnce.Do(func() { panicked = r })
+					next.Store(int64(n)) // stop the other workers early
+				}
+			}()
+			for i := int(next.Add(1)) - 1; i < n; i = int(next.Add(1)) - 1 {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+}
+
+// window is the geometry of a 2-D convolution or pooling: kernel, strides, dilations, the
+// padding on each side and the output size.
+type window struct {
+	kh, kw     int
+	sh, sw     int
+	dh, dw     int
+	padT, padL int
+	padB, padR int
+	oh, ow     int
+}
+
+// newWindow works out the window of node n over an h x w input for a kh x kw kernel,
+// honoring auto_pad, pads, strides, dilations and, for pooling, ceil_mode.
+func newWindow(n *node, h, w, kh, kw int) (window, error) {
+	strides := n.attrInts("strides", []int{1, 1})
+	dilations := n.attrInts("dilations", []int{1, 1})
+	pads := n.attrInts("pads", []int{0, 0, 0, 0})
+	if len(strides) != 2 || len(dilations) != 2 || len(pads) != 4 {
+		return window{}, errors.New("only 2-D windows are supported")
+	}
+	win := window{kh: kh, kw: kw, sh: strides[0], sw: strides[1], dh: dilations[0], dw: dilations[1]}
+	if win.sh <= 0 || win.sw <= 0 || win.dh <= 0 || win.dw <= 0 || kh <= 0 || kw <= 0 {
+		return window{}, errors.New("invalid kernel, strides or dilations")
+	}
+	ceil := n.attrInt("ceil_mode", 0) != 0
+
+	// size computes the output length and the padding of one spatial dimension.
+	size := func(in, k, s, d, padBegin, padEnd int) (int, int, int) {
+		span := (k-1)*d + 1
+		switch autoPad := n.attrString("auto_pad", "NOTSET"); autoPad {
+		case "VALID":
+			return (in-span)/s + 1, 0, 0
+		case "SAME_UPPER", "SAME_LOWER":
+			out := (in + s - 1) / s
+			total := max(0, (out-1)*s+span-in)
+			if autoPad == "SAME_LOWER" {
+				return out, total - total/2, total / 2
+			}
+			return out, total / 2, total - total/2
+		}
+		num := in + padBegin + padEnd - span
+		out := num/s + 1
+		if ceil {
+			out = (num+s-1)/s + 1
+			// the last window has to start inside the input or the leading padding
+			if (out-1)*s >= in+padBegin {
+				out--
+			}
+		}
+		return out, padBegin, padEnd
+	}
+	win.oh, win.padT, win.padB = size(h, kh, win.sh, win.dh, pads[0], pads[2])
+	win.ow, win.padL, win.padR = size(w, kw, win.sw, win.dw, pads[1], pads[3])
+	if win.oh <= 0 || win.ow <= 0 {
+		return window{}, fmt.Errorf("kernel %dx%d does not fit input %dx%d", kh, kw, h, w)
+	}
+	return win, nil
+}
+
+// cols returns the range of output columns whose input column ox*sw+off lies in [0, w).
+func (win window) cols(off, w int) (int, int) {
+	lo := 0
+	if off < 0 {
+		lo = (-off + win.sw - 1) / win.sw
+	}
+	if w-1-off < 0 {
+		return 0, 0
+	}
+	return lo, min(win.ow, (w-1-off)/win.sw+1)
+}
+
+// conv is a 2-D convolution of an NCHW input, grouped when group > 1; depthwise
+// convolutions, as in MobileNet, have one group per channel.
+func conv(n *node, in []*Tensor) ([]*Tensor, error) {
+	x, w, bias := in[0], in[1], input(in, 2)
+	if len(x.Shape) != 4 || len(w.Shape) != 4 {
+		return nil, errors.New("only 2-D convolutions are supported")
+	}
+	batch, c, h, wd := x.Shape[0], x.Shape[1], x.Shape[2], x.Shape[3]
+	m, cg, kh, kw := w.Shape[0], w.Shape[1], w.Shape[2], w.Shape[3]
+	group := n.attrInt("group", 1)
+	if group <= 0 || c != cg*group || m%group != 0 {
+		return nil, fmt.Errorf("input %v does not match weights %v in %d groups", x.Shape, w.Shape, group)
+	}
+	if bias != nil && len(bias.Data) != m {
+		return nil, fmt.Errorf("bias needs %d values, got %d", m, len(bias.Data))
+	}
+	win, err := newWindow(n, h, wd, kh, kw)
+	if err != nil {
+		return nil, err
+	}
+	pointwise := kh == 1 && kw == 1 && win.sh == 1 && win.sw == 1 && win.padT == 0 && win.padL == 0 &&
+		win.oh == h && win.ow == wd
+
+	plane, outPlane := h*wd, win.oh*win.ow
+	mg := m / group
+	out := make([]float32, batch*m*outPlane)
+	parallel(batch*m, func(job int) {
+		b, oc := job/m, job%m
+		g := oc / mg
+		dst := out[job*outPlane : (job+1)*outPlane]
+		if bias != nil {
+			for i := range dst {
+				dst[i] = bias.Data[oc]
+			}
+		}
+		for ic := 0; ic < cg; ic++ {
+			src := x.Data[(b*c+g*cg+ic)*plane:][:plane]
+			kern := w.Data[(oc*cg+ic)*kh*kw:][:kh*kw]
+			if pointwise {
+				k := kern[0]
+				for i, v := range src {
+					dst[i] += k * v
+				}
+				continue
+			}
+			for ky := 0; ky < kh; ky++ {
+				for kx := 0; kx < kw; kx++ {
+					k := kern[ky*kw+kx]
+					if k == 0 {
+						continue
+					}
+					off := kx*win.dw - win.padL
+					lo, hi := win.cols(off, wd)
+					for oy := 0; oy < win.oh; oy++ {
+						iy := oy*win.sh - win.padT + ky*win.dh
+						if iy < 0 || iy >= h {
+							continue
+						}
+						row := src[iy*wd : (iy+1)*wd]
+						drow := dst[oy*win.ow : (oy+1)*win.ow]
+						for ox := lo; ox < hi; ox++ {
+							drow[ox] += k * row[ox*win.sw+off]
+						}
+					}
+				}
+			}
+		}
+	})
+	return []*Tensor{{Shape: []int{batch, m, win.oh, win.ow}, Data: out}}, nil
+}
+
+func maxPool(n *node, in []*Tensor) ([]*Tensor, error) {
+	return pool(n, in[0], true)
+}
+
+func averagePool(n *node, in []*Tensor) ([]*Tensor, error) {
+	return pool(n, in[0], false)
+}
+
+// pool is 2-D max or average pooling of an NCHW input. Padding never counts for max
+// pooling, and for average pooling only with count_include_pad.
+func pool(n *node, x *Tensor, isMax bool) ([]*Tensor, error) {
+	if len(x.Shape) != 4 {
+		return nil, errors.New("only 2-D pooling is supported")
+	}
+	kernel := n.attrInts("kernel_shape", nil)
+	if len(kernel) != 2 {
+		return nil, errors.New("kernel_shape must have 2 values")
+	}
+	h, w := x.Shape[2], x.Shape[3]
+	win, err := newWindow(n, h, w, kernel[0], kernel[1])
+	if err != nil {
+		return nil, err
+	}
+	includePad := n.attrInt("count_include_pad", 0) != 0
+
+	planes, plane, outPlane := x.Shape[0]*x.Shape[1], h*w, win.oh*win.ow
+	out := make([]float32, planes*outPlane)
+	parallel(planes, func(p int) {
+		src := x.Data[p*plane : (p+1)*plane]
+		dst := out[p*outPlane : (p+1)*outPlane]
+		for oy := 0; oy < win.oh; oy++ {
+			for ox := 0; ox < win.ow; ox++ {
+				acc := float32(0)
+				if isMax {
+					acc = float32(math.Inf(-1))
+				}
+				count := 0
+				for ky := 0; ky < win.kh; ky++ {
+					iy := oy*win.sh - win.padT + ky*win.dh
+					for kx := 0; kx < win.kw; kx++ {
+						ix := ox*win.sw - win.padL + kx*win.dw
+						if iy < 0 || iy >= h || ix < 0 || ix >= w {
+							if includePad && iy < h+win.padB && ix < w+win.padR {
+								count++
+							}
+							continue
+						}
+						v := src[iy*w+ix]
+						if isMax {
+							acc = max(acc, v)
+						} else {
+							acc += v
+						}
+						count++
+					}
+				}
+				if !isMax && count > 0 {
+					acc /= float32(count)
+				}
+				dst[oy*win.ow+ox] = acc
+			}
+		}
+	})
+	return []*Tensor{{Shape: []int{x.Shape[0], x.Shape[1], win.oh, win.ow}, Data: out}}, nil
+}
+
+// globalPool reduces every spatial dimension to 1, by mean or max.
+func globalPool(isMax bool) opFunc {
+	return func(_ *node, in []*Tensor) ([]*Tensor, error) {
+		x := in[0]
+		if len(x.Shape) < 3 {
+			return nil, errors.New("input needs at least 3 dimensions")
+		}
+		planes, plane := x.Shape[0]*x.Shape[1], numel(x.Shape[2:])
+		out := make([]float32, planes)
+		for p := range out {
+			src := x.Data[p*plane : (p+1)*plane]
+			if isMax {
+				acc := float32(math.Inf(-1))
+				for _, v := range src {
+					acc = max(acc, v)
+				}
+				out[p] = acc
+				continue
+			}
+			var sum float64
+			for _, v := range src {
+				sum += float64(v)
+			}
+			out[p] = float32(sum / float64(plane))
+		}
+		shape := []int{x.Shape[0], x.Shape[1]}
+		for range x.Shape[2:] {
+			shape = append(shape, 1)
+		}
+		return []*Tensor{{Shape: shape, Data: out}}, nil
+	}
+}
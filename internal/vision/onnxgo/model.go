@@ -0,0 +1,319 @@
+package onnxgo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// Model is a loaded ONNX graph. It is read-only once loaded, so Run may be called from
+// several goroutines at once.
+type Model struct {
+	opset   int64
+	nodes   []*node
+	inits   map[string]*Tensor
+	inputs  []valueInfo
+	outputs []valueInfo
+	// index of the last node reading each intermediate value; it is dropped after that
+	// node runs
+	lastUse map[string]int
+}
+
+type valueInfo struct {
+	name  string
+	shape []int
+}
+
+type node struct {
+	op      string
+	domain  string
+	name    string
+	inputs  []string
+	outputs []string
+	attrs   map[string]attribute
+	opset   int64
+	run     opFunc
+}
+
+// Load reads an ONNX model file. The weights must be stored in the file itself.
+func Load(path string) (*Model, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse decodes a serialized ONNX ModelProto. It fails on operators the package does not
+// implement, so an unsupported model is caught at load time rather than on first use.
+func Parse(b []byte) (*Model, error) {
+	m := &Model{inits: make(map[string]*Tensor), lastUse: make(map[string]int)}
+	var graph []byte
+	err := walk(b, func(f field) error {
+		switch f.num {
+		case 7: // graph
+			graph = f.b
+		case 8: // opset_import
+			var domain string
+			var version int64
+			err := walk(f.b, func(f field) error {
+				switch f.num {
+				case 1:
+					domain = string(f.b)
+				case 2:
+					version = int64(f.x)
+				}
+				return nil
+			})
+			if err == nil && (domain == "" || domain == "ai.onnx") {
+				m.opset = version
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("onnxgo: parse model: %w", err)
+	}
+	if graph == nil {
+		return nil, fmt.Errorf("onnxgo: model has no graph")
+	}
+	if err := m.parseGraph(graph); err != nil {
+		return nil, fmt.Errorf("onnxgo: parse graph: %w", err)
+	}
+	if err := m.link(); err != nil {
+		return nil, fmt.Errorf("onnxgo: %w", err)
+	}
+	return m, nil
+}
+
+func (m *Model) parseGraph(b []byte) error {
+	var inputs []valueInfo
+	err := walk(b, func(f field) error {
+		switch f.num {
+		case 1: // node
+			n, err := parseNode(f.b)
+			if err != nil {
+				return fmt.Errorf("node %d: %w", len(m.nodes), err)
+			}
+			m.nodes = append(m.nodes, n)
+		case 5: // initializer
+			name, t, err := parseTensor(f.b)
+			if err != nil {
+				return err
+			}
+			m.inits[name] = t
+		case 11: // input
+			vi, err := parseValueInfo(f.b)
+			if err != nil {
+				return err
+			}
+			inputs = append(inputs, vi)
+		case 12: // output
+			vi, err := parseValueInfo(f.b)
+			if err != nil {
+				return err
+			}
+			m.outputs = append(m.outputs, vi)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// older exporters list the initializers among the inputs too
+	for _, vi := range inputs {
+		if _, ok := m.inits[vi.name]; !ok {
+			m.inputs = append(m.inputs, vi)
+		}
+	}
+	return nil
+}
+
+// link binds each node to its operator and checks that the graph only reads values defined
+// before, as ONNX requires nodes to be sorted topologically.
+func (m *Model) link() error {
+	defined := make(map[string]bool, len(m.inits)+len(m.inputs))
+	for name := range m.inits {
+		defined[name] = true
+	}
+	for _, vi := range m.inputs {
+		defined[vi.name] = true
+	}
+	for i, n := range m.nodes {
+		if n.domain != "" && n.domain != "ai.onnx" {
+			return fmt.Errorf("operator %s.%s is not supported", n.domain, n.op)
+		}
+		op, ok := operators[n.op]
+		if !ok {
+			return fmt.Errorf("operator %s is not supported", n.op)
+		}
+		if len(n.inputs) < op.minIn || (op.maxIn >= 0 && len(n.inputs) > op.maxIn) {
+			return fmt.Errorf("%s node %q has %d inputs", n.op, n.name, len(n.inputs))
+		}
+		for j, in := range n.inputs[:op.minIn] {
+			if in == "" {
+				return fmt.Errorf("%s node %q: required input %d is missing", n.op, n.name, j)
+			}
+		}
+		if len(n.outputs) == 0 || n.outputs[0] == "" {
+			return fmt.Errorf("%s node %q has no output", n.op, n.name)
+		}
+		n.run, n.opset = op.run, m.opset
+		for _, in := range n.inputs {
+			if in == "" {
+				continue
+			}
+			if !defined[in] {
+				return fmt.Errorf("%s node %q reads undefined value %q", n.op, n.name, in)
+			}
+			if _, ok := m.inits[in]; !ok {
+				m.lastUse[in] = i
+			}
+		}
+		for _, out := range n.outputs {
+			if out != "" {
+				defined[out] = true
+			}
+		}
+	}
+	for _, vi := range m.outputs {
+		if !defined[vi.name] {
+			return fmt.Errorf("output %q is never computed", vi.name)
+		}
+		delete(m.lastUse, vi.name)
+	}
+	return nil
+}
+
+// Inputs lists the names of the inputs the graph must be fed.
+func (m *Model) Inputs() []string {
+	names := make([]string, len(m.inputs))
+	for i, vi := range m.inputs {
+		names[i] = vi.name
+	}
+	return names
+}
+
+// Outputs lists the names of the graph outputs.
+func (m *Model) Outputs() []string {
+	names := make([]string, len(m.outputs))
+	for i, vi := range m.outputs {
+		names[i] = vi.name
+	}
+	return names
+}
+
+// InputShape returns the declared shape of an input, with -1 for dimensions not fixed by
+// the model, and false when there is no such input. The shape is nil when undeclared.
+func (m *Model) InputShape(name string) ([]int, bool) {
+	for _, vi := range m.inputs {
+		if vi.name == name {
+			return slices.Clone(vi.shape), true
+		}
+	}
+	return nil, false
+}
+
+// Run evaluates the graph on inputs, keyed by input name, and returns the named outputs,
+// or all of them when none is named.
+func (m *Model) Run(ctx context.Context, inputs map[string]*Tensor, outputs ...string) (res map[string]*Tensor, err error) {
+	if len(outputs) == 0 {
+		outputs = m.Outputs()
+	}
+	for _, name := range outputs {
+		if !slices.ContainsFunc(m.outputs, func(vi valueInfo) bool { return vi.name == name }) {
+			return nil, fmt.Errorf("onnxgo: %q is not an output of the model", name)
+		}
+	}
+
+	values := make(map[string]*Tensor, len(m.inputs)+len(m.nodes))
+	for _, vi := range m.inputs {
+		t, ok := inputs[vi.name]
+		if !ok || t == nil {
+			return nil, fmt.Errorf("onnxgo: missing input %q", vi.name)
+		}
+		if !shapeMatches(vi.shape, t.Shape) {
+			return nil, fmt.Errorf("onnxgo: input %q has shape %v, model expects %v", vi.name, t.Shape, vi.shape)
+		}
+		if numel(t.Shape) != len(t.Data) {
+			return nil, fmt.Errorf("onnxgo: input %q: shape %v needs %d values, got %d", vi.name, t.Shape, numel(t.Shape), len(t.Data))
+		}
+		values[vi.name] = t
+	}
+
+	// operators check the shapes they are given, but a model can still hold inconsistencies
+	// they miss; fail the run rather than the process
+	var cur *node
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, fmt.Errorf("onnxgo: panic: %v", r)
+			if cur != nil {
+				res, err = nil, fmt.Errorf("onnxgo: %s node %q: panic: %v", cur.op, cur.name, r)
+			}
+		}
+	}()
+
+	for i, n := range m.nodes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		cur = n
+		in := make([]*Tensor, len(n.inputs))
+		for j, name := range n.inputs {
+			if name == "" {
+				continue
+			}
+			if t, ok := values[name]; ok {
+				in[j] = t
+			} else if t, ok := m.inits[name]; ok {
+				in[j] = t
+			} else {
+				return nil, fmt.Errorf("onnxgo: %s node %q: value %q was not computed", n.op, n.name, name)
+			}
+		}
+		out, err := n.run(n, in)
+		if err != nil {
+			return nil, fmt.Errorf("onnxgo: %s node %q: %w", n.op, n.name, err)
+		}
+		for j, name := range n.outputs {
+			if name != "" && j < len(out) {
+				values[name] = out[j]
+			}
+		}
+		for _, name := range n.inputs {
+			if last, ok := m.lastUse[name]; ok && last == i {
+				delete(values, name)
+			}
+		}
+	}
+
+	res = make(map[string]*Tensor, len(outputs))
+	for _, name := range outputs {
+		if t, ok := values[name]; ok {
+			res[name] = t
+		} else if t, ok := m.inits[name]; ok {
+			res[name] = t
+		} else {
+			return nil, fmt.Errorf("onnxgo: output %q was not computed", name)
+		}
+	}
+	return res, nil
+}
+
+// shapeMatches reports whether shape fits a declared one, where -1 matches any size.
+func shapeMatches(declared, shape []int) bool {
+	if declared == nil {
+		return true
+	}
+	if len(declared) != len(shape) {
+		return false
+	}
+	for i, d := range declared {
+		if d >= 0 && d != shape[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+package onnxgo
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"runtime"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pb builds protobuf messages for the tests.
+type pb []byte
+
+func (m pb) bytes(num protowire.Number, b []byte) pb {
+	m = protowire.AppendTag(m, num, protowire.BytesType)
+	return protowire.AppendBytes(m, b)
+}
+
+func (m pb) str(num protowire.Number, s string) pb { return m.bytes(num, []byte(s)) }
+
+func (m pb) varint(num protowire.Number, v int64) pb {
+	m = protowire.AppendTag(m, num, protowire.VarintType)
+	return protowire.AppendVarint(m, uint64(v))
+}
+
+func floatTensorPB(name string, dims []int64, data []float32) pb {
+	var packed []byte
+	for _, d := range dims {
+		packed = protowire.AppendVarint(packed, uint64(d))
+	}
+	raw := make([]byte, 4*len(data))
+	for i, v := range data {
+		binary.LittleEndian.PutUint32(raw[4*i:], math.Float32bits(v))
+	}
+	return pb(nil).bytes(1, packed).varint(2, dtFloat).str(8, name).bytes(9, raw)
+}
+
+func nodePB(op string, inputs []string, output string, attrs ...pb) pb {
+	var m pb
+	for _, in := range inputs {
+		m = m.str(1, in)
+	}
+	m = m.str(2, output).str(3, op+"_"+output).str(4, op)
+	for _, a := range attrs {
+		m = m.bytes(5, a)
+	}
+	return m
+}
+
+func intsAttrPB(name string, v ...int64) pb {
+	var packed []byte
+	for _, x := range v {
+		packed = protowire.AppendVarint(packed, uint64(x))
+	}
+	return pb(nil).str(1, name).bytes(8, packed)
+}
+
+func valueInfoPB(name string, dims ...int64) pb {
+	var shape pb
+	for _, d := range dims {
+		shape = shape.bytes(1, pb(nil).varint(1, d))
+	}
+	tensorType := pb(nil).varint(1, dtFloat).bytes(2, shape)
+	return pb(nil).str(1, name).bytes(2, pb(nil).bytes(1, tensorType))
+}
+
+func modelPB(nodes, inits []pb, input, output pb) []byte {
+	var g pb
+	for _, n := range nodes {
+		g = g.bytes(1, n)
+	}
+	for _, t := range inits {
+		g = g.bytes(5, t)
+	}
+	g = g.bytes(11, input).bytes(12, output)
+	opset := pb(nil).str(1, "").varint(2, 13)
+	return pb(nil).varint(1, 8).bytes(7, g).bytes(8, opset)
+}
+
+// tinyModel is conv 3x3 with padding -> +bias -> relu -> global average pool -> flatten, on
+// a 1x1x3x3 input.
+func tinyModel() []byte {
+	return modelPB(
+		[]pb{
+			nodePB("Conv", []string{"x", "w"}, "c", intsAttrPB("pads", 1, 1, 1, 1)),
+			nodePB("Add", []string{"c", "b"}, "a"),
+			nodePB("Relu", []string{"a"}, "r"),
+			nodePB("GlobalAveragePool", []string{"r"}, "p"),
+			nodePB("Flatten", []string{"p"}, "y"),
+		},
+		[]pb{
+			floatTensorPB("w", []int64{1, 1, 3, 3}, []float32{1, 1, 1, 1, 1, 1, 1, 1, 1}),
+			floatTensorPB("b", []int64{1}, []float32{-30}),
+		},
+		valueInfoPB("x", 1, 1, 3, 3),
+		valueInfoPB("y", 1, 1),
+	)
+}
+
+func TestRunTinyModel(t *testing.T) {
+	m, err := Parse(tinyModel())
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if in, out := m.Inputs(), m.Outputs(); len(in) != 1 || in[0] != "x" || len(out) != 1 || out[0] != "y" {
+		t.Fatalf("inputs %v outputs %v", in, out)
+	}
+	if shape, ok := m.InputShape("x"); !ok || len(shape) != 4 || shape[2] != 3 {
+		t.Fatalf("input shape %v %v", shape, ok)
+	}
+
+	x := tensor([]int{1, 1, 3, 3}, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	res, err := m.Run(context.Background(), map[string]*Tensor{"x": x})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	// neighborhood sums 12 21 16 27 45 33 24 39 28, minus 30 and relu: 15+3+9 over 9 values
+	y := res["y"]
+	if len(y.Shape) != 2 || y.Shape[0] != 1 || y.Shape[1] != 1 || math.Abs(float64(y.Data[0])-3) > 1e-5 {
+		t.Fatalf("y = %v %v, want [1 1] [3]", y.Shape, y.Data)
+	}
+
+	if _, err := m.Run(context.Background(), map[string]*Tensor{}); err == nil {
+		t.Fatalf("expected error for a missing input")
+	}
+	if _, err := m.Run(context.Background(), map[string]*Tensor{"x": seq(1, 1, 4, 4)}); err == nil {
+		t.Fatalf("expected error for a wrong input shape")
+	}
+	if _, err := m.Run(context.Background(), map[string]*Tensor{"x": x}, "c"); err == nil {
+		t.Fatalf("expected error for an intermediate value as output")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.Run(ctx, map[string]*Tensor{"x": x}); err != context.Canceled {
+		t.Fatalf("canceled run: err = %v", err)
+	}
+}
+
+func TestRunRecoversPanics(t *testing.T) {
+	prev := runtime.GOMAXPROCS(4)
+	defer runtime.GOMAXPROCS(prev)
+
+	for name, run := range map[string]opFunc{
+		"in node": func(*node, []*Tensor) ([]*Tensor, error) {
+			var s []float32
+			_ = s[3]
+			return nil, nil
+		},
+		"in worker": func(*node, []*Tensor) ([]*Tensor, error) {
+			parallel(16, func(i int) {
+				if i == 7 {
+					panic("boom")
+				}
+			})
+			return nil, nil
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m, err := Parse(tinyModel())
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			m.nodes[2].run = run
+			_, err = m.Run(context.Background(), map[string]*Tensor{"x": seq(1, 1, 3, 3)})
+			if err == nil || !strings.Contains(err.Error(), "panic") || !strings.Contains(err.Error(), "Relu") {
+				t.Fatalf("err = %v, want a recovered panic in the Relu node", err)
+			}
+		})
+	}
+}
+
+func TestParseRejectsBadModels(t *testing.T) {
+	valid := tinyModel()
+	x, y := valueInfoPB("x", 1, 1, 3, 3), valueInfoPB("y", 1, 1)
+	w := floatTensorPB("w", []int64{1, 1, 3, 3}, make([]float32, 9))
+
+	cases := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "no graph"},
+		{"truncated", valid[:len(valid)/2], ""},
+		{"bad wire type", []byte{0x0f, 0x00}, ""},
+		{"bad length", []byte{0x3a, 0x7f, 0x01}, ""},
+		{
+			"unknown operator",
+			modelPB([]pb{nodePB("Resize", []string{"x"}, "y")}, nil, x, y),
+			"Resize is not supported",
+		},
+		{
+			"operator of another domain",
+			modelPB([]pb{nodePB("Relu", []string{"x"}, "y").str(7, "com.microsoft")}, nil, x, y),
+			"not supported",
+		},
+		{
+			"too few inputs",
+			modelPB([]pb{nodePB("Conv", []string{"x"}, "y")}, nil, x, y),
+			"has 1 inputs",
+		},
+		{
+			"too many inputs",
+			modelPB([]pb{nodePB("Relu", []string{"x", "x"}, "y")}, nil, x, y),
+			"has 2 inputs",
+		},
+		{
+			"required input left empty",
+			modelPB([]pb{nodePB("Conv", []string{"", "w"}, "y")}, []pb{w}, x, y),
+			"required input 0",
+		},
+		{
+			"undefined value",
+			modelPB([]pb{nodePB("Relu", []string{"z"}, "y")}, nil, x, y),
+			"undefined value",
+		},
+		{
+			"output never computed",
+			modelPB([]pb{nodePB("Relu", []string{"x"}, "r")}, nil, x, y),
+			"never computed",
+		},
+		{
+			"huge dims",
+			modelPB([]pb{nodePB("Relu", []string{"x"}, "y")}, []pb{floatTensorPB("h", []int64{1 << 20, 1 << 20, 1 << 30}, nil)}, x, y),
+			"invalid dims",
+		},
+		{
+			"dims beyond data",
+			modelPB([]pb{nodePB("Relu", []string{"x"}, "y")}, []pb{floatTensorPB("h", []int64{1000}, []float32{1})}, x, y),
+			"bytes of data",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(tc.data)
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			if tc.want != "" && !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+}
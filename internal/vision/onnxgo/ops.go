@@ -0,0 +1,699 @@
+package onnxgo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// opFunc computes the outputs of a node from its inputs, nil for optional inputs left out.
+// It must not modify the inputs.
+type opFunc func(n *node, in []*Tensor) ([]*Tensor, error)
+
+// operator is an implemented ONNX operator with the number of inputs it takes; the first
+// minIn are required, and maxIn < 0 means any number.
+type operator struct {
+	run          opFunc
+	minIn, maxIn int
+}
+
+var operators map[string]operator
+
+func init() {
+	operators = map[string]operator{
+		"Add": {binaryOp(func(a, b float32) float32 { return a + b }), 2, 2},
+		"Sub": {binaryOp(func(a, b float32) float32 { return a - b }), 2, 2},
+		"Mul": {binaryOp(func(a, b float32) float32 { return a * b }), 2, 2},
+		"Div": {binaryOp(func(a, b float32) float32 { return a / b }), 2, 2},
+
+		"Relu":        {unaryOp(func(_ *node) func(float32) float32 { return func(x float32) float32 { return max(x, 0) } }), 1, 1},
+		"LeakyRelu":   {unaryOp(leakyRelu), 1, 1},
+		"Sigmoid":     {unaryOp(func(_ *node) func(float32) float32 { return sigmoid }), 1, 1},
+		"HardSigmoid": {unaryOp(hardSigmoid), 1, 1},
+		"HardSwish": {unaryOp(func(_ *node) func(float32) float32 {
+			return func(x float32) float32 { return x * min(max(x/6+0.5, 0), 1) }
+		}), 1, 1},
+		"Clip": {clip, 1, 3},
+
+		"Identity": {identity, 1, 1},
+		"Dropout":  {identity, 1, 3},
+
+		"Conv":               {conv, 2, 3},
+		"MaxPool":            {maxPool, 1, 1},
+		"AveragePool":        {averagePool, 1, 1},
+		"GlobalAveragePool":  {globalPool(false), 1, 1},
+		"GlobalMaxPool":      {globalPool(true), 1, 1},
+		"BatchNormalization": {batchNorm, 5, 5},
+		"Gemm":               {gemmOp, 2, 3},
+		"MatMul":             {matMulOp, 2, 2},
+		"Softmax":            {softmaxOp, 1, 1},
+
+		"Constant":  {constant, 0, 0},
+		"Shape":     {shapeOp, 1, 1},
+		"Gather":    {gather, 2, 2},
+		"Concat":    {concat, 1, -1},
+		"Flatten":   {flatten, 1, 1},
+		"Reshape":   {reshape, 1, 2},
+		"Squeeze":   {squeeze, 1, 2},
+		"Unsqueeze": {unsqueeze, 1, 2},
+		"Transpose": {transpose, 1, 1},
+	}
+}
+
+func (n *node) attrInt(name string, def int) int {
+	if a, ok := n.attrs[name]; ok {
+		return int(a.i)
+	}
+	return def
+}
+
+func (n *node) attrFloat(name string, def float32) float32 {
+	if a, ok := n.attrs[name]; ok {
+		return a.f
+	}
+	return def
+}
+
+func (n *node) attrString(name, def string) string {
+	if a, ok := n.attrs[name]; ok {
+		return a.s
+	}
+	return def
+}
+
+func (n *node) attrInts(name string, def []int) []int {
+	a, ok := n.attrs[name]
+	if !ok {
+		return def
+	}
+	out := make([]int, len(a.is))
+	for i, v := range a.is {
+		out[i] = int(v)
+	}
+	return out
+}
+
+// input returns the i-th input, or nil when left out.
+func input(in []*Tensor, i int) *Tensor {
+	if i < len(in) {
+		return in[i]
+	}
+	return nil
+}
+
+func identity(_ *node, in []*Tensor) ([]*Tensor, error) {
+	return []*Tensor{in[0]}, nil
+}
+
+func unaryOp(build func(n *node) func(float32) float32) opFunc {
+	return func(n *node, in []*Tensor) ([]*Tensor, error) {
+		f := build(n)
+		x := in[0]
+		out := make([]float32, len(x.Data))
+		for i, v := range x.Data {
+			out[i] = f(v)
+		}
+		return []*Tensor{{Shape: x.Shape, Data: out}}, nil
+	}
+}
+
+func sigmoid(x float32) float32 {
+	return float32(1 / (1 + math.Exp(-float64(x))))
+}
+
+func leakyRelu(n *node) func(float32) float32 {
+	alpha := n.attrFloat("alpha", 0.01)
+	return func(x float32) float32 {
+		if x < 0 {
+			return alpha * x
+		}
+		return x
+	}
+}
+
+func hardSigmoid(n *node) func(float32) float32 {
+	alpha, beta := n.attrFloat("alpha", 0.2), n.attrFloat("beta", 0.5)
+	return func(x float32) float32 { return min(max(alpha*x+beta, 0), 1) }
+}
+
+// clip takes its bounds as attributes up to opset 10 and as optional inputs from 11 on;
+// MobileNetV2 uses it for ReLU6.
+func clip(n *node, in []*Tensor) ([]*Tensor, error) {
+	lo, hi := n.attrFloat("min", -math.MaxFloat32), n.attrFloat("max", math.MaxFloat32)
+	if t := input(in, 1); t != nil && len(t.Data) > 0 {
+		lo = t.Data[0]
+	}
+	if t := input(in, 2); t != nil && len(t.Data) > 0 {
+		hi = t.Data[0]
+	}
+	return unaryOp(func(_ *node) func(float32) float32 {
+		return func(x float32) float32 { return min(max(x, lo), hi) }
+	})(n, in[:1])
+}
+
+// broadcastShape returns the shape two tensors broadcast to, numpy style.
+func broadcastShape(a, b []int) ([]int, error) {
+	rank := max(len(a), len(b))
+	out := make([]int, rank)
+	for i := range out {
+		da, db := 1, 1
+		if j := i - rank + len(a); j >= 0 {
+			da = a[j]
+		}
+		if j := i - rank + len(b); j >= 0 {
+			db = b[j]
+		}
+		switch {
+		case da == db, db == 1:
+			out[i] = da
+		case da == 1:
+			out[i] = db
+		default:
+			return nil, fmt.Errorf("shapes %v and %v do not broadcast", a, b)
+		}
+	}
+	return out, nil
+}
+
+// broadcastStrides returns the strides to walk a tensor of shape with while iterating over
+// the broadcast shape out; broadcast dimensions get a stride of 0.
+func broadcastStrides(shape, out []int) []int {
+	strides := make([]int, len(out))
+	stride := 1
+	for i := len(out) - 1; i >= 0; i-- {
+		j := i - len(out) + len(shape)
+		if j < 0 {
+			break
+		}
+		if shape[j] != 1 {
+			strides[i] = stride
+		}
+		stride *= shape[j]
+	}
+	return strides
+}
+
+func binaryOp(f func(a, b float32) float32) opFunc {
+	return func(_ *node, in []*Tensor) ([]*Tensor, error) {
+		a, b := in[0], in[1]
+		shape, err := broadcastShape(a.Shape, b.Shape)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]float32, numel(shape))
+		switch {
+		case len(a.Data) == len(out) && len(b.Data) == len(out):
+			for i := range out {
+				out[i] = f(a.Data[i], b.Data[i])
+			}
+		case len(b.Data) == 1 && len(a.Data) == len(out):
+			for i := range out {
+				out[i] = f(a.Data[i], b.Data[0])
+			}
+		default:
+			as, bs := broadcastStrides(a.Shape, shape), broadcastStrides(b.Shape, shape)
+			idx := make([]int, len(shape))
+			ai, bi := 0, 0
+			for i := range out {
+				out[i] = f(a.Data[ai], b.Data[bi])
+				for d := len(shape) - 1; d >= 0; d-- {
+					idx[d]++
+					ai += as[d]
+					bi += bs[d]
+					if idx[d] < shape[d] {
+						break
+					}
+					ai -= as[d] * shape[d]
+					bi -= bs[d] * shape[d]
+					idx[d] = 0
+				}
+			}
+		}
+		return []*Tensor{{Shape: shape, Data: out}}, nil
+	}
+}
+
+// batchNorm is inference-mode batch normalization over dimension 1.
+func batchNorm(n *node, in []*Tensor) ([]*Tensor, error) {
+	x, scale, bias, mean, variance := in[0], in[1], in[2], in[3], in[4]
+	if len(x.Shape) < 2 {
+		return nil, errors.New("input needs at least 2 dimensions")
+	}
+	c := x.Shape[1]
+	for _, t := range []*Tensor{scale, bias, mean, variance} {
+		if len(t.Data) != c {
+			return nil, fmt.Errorf("parameters need %d values, got %d", c, len(t.Data))
+		}
+	}
+	eps := n.attrFloat("epsilon", 1e-5)
+	plane := numel(x.Shape[2:])
+	out := make([]float32, len(x.Data))
+	for ch := 0; ch < c; ch++ {
+		k := scale.Data[ch] / float32(math.Sqrt(float64(variance.Data[ch]+eps)))
+		b := bias.Data[ch] - mean.Data[ch]*k
+		for off := ch * plane; off < len(out); off += c * plane {
+			src, dst := x.Data[off:off+plane], out[off:off+plane]
+			for i, v := range src {
+				dst[i] = v*k + b
+			}
+		}
+	}
+	return []*Tensor{{Shape: x.Shape, Data: out}}, nil
+}
+
+// matMul computes dst[m x n] = a[m x k] * b[k x n], reading a(i, p) at
+// a[i*as0+p*as1] and b(p, j) at b[p*bs0+j*bs1] so transposed operands need no copy.
+func matMul(dst []float32, m, n, k int, a []float32, as0, as1 int, b []float32, bs0, bs1 int) {
+	parallel(m, func(i int) {
+		row := dst[i*n : (i+1)*n]
+		for p := 0; p < k; p++ {
+			av := a[i*as0+p*as1]
+			if av == 0 {
+				continue
+			}
+			if bs1 == 1 {
+				brow := b[p*bs0 : p*bs0+n]
+				for j, bv := range brow {
+					row[j] += av * bv
+				}
+				continue
+			}
+			for j := range row {
+				row[j] += av * b[p*bs0+j*bs1]
+			}
+		}
+	})
+}
+
+// gemmOp computes alpha*A'*B' + beta*C for 2-D A and B, optionally transposed.
+func gemmOp(n *node, in []*Tensor) ([]*Tensor, error) {
+	a, b, c := in[0], in[1], input(in, 2)
+	if len(a.Shape) != 2 || len(b.Shape) != 2 {
+		return nil, errors.New("A and B must be 2-D")
+	}
+	m, k := a.Shape[0], a.Shape[1]
+	as0, as1 := k, 1
+	if n.attrInt("transA", 0) != 0 {
+		m, k = k, m
+		as0, as1 = 1, m
+	}
+	kb, nn := b.Shape[0], b.Shape[1]
+	bs0, bs1 := nn, 1
+	if n.attrInt("transB", 0) != 0 {
+		kb, nn = nn, kb
+		bs0, bs1 = 1, kb
+	}
+	if k != kb {
+		return nil, fmt.Errorf("cannot multiply %v by %v", a.Shape, b.Shape)
+	}
+
+	out := make([]float32, m*nn)
+	matMul(out, m, nn, k, a.Data, as0, as1, b.Data, bs0, bs1)
+	if alpha := n.attrFloat("alpha", 1); alpha != 1 {
+		for i := range out {
+			out[i] *= alpha
+		}
+	}
+	res := &Tensor{Shape: []int{m, nn}, Data: out}
+	if c != nil {
+		beta := n.attrFloat("beta", 1)
+		sum, err := binaryOp(func(x, y float32) float32 { return x + beta*y })(n, []*Tensor{res, c})
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Equal(sum[0].Shape, res.Shape) {
+			return nil, fmt.Errorf("C of shape %v does not broadcast to %v", c.Shape, res.Shape)
+		}
+		res = sum[0]
+	}
+	return []*Tensor{res}, nil
+}
+
+// matMulOp is numpy matmul for a 2-D right operand or for operands with the same batch
+// dimensions.
+func matMulOp(_ *node, in []*Tensor) ([]*Tensor, error) {
+	a, b := in[0], in[1]
+	as, bs := a.Shape, b.Shape
+	if len(as) == 1 {
+		as = []int{1, as[0]}
+	}
+	if len(bs) == 1 {
+		bs = []int{bs[0], 1}
+	}
+	if len(as) < 2 || len(bs) < 2 {
+		return nil, fmt.Errorf("cannot multiply %v by %v", a.Shape, b.Shape)
+	}
+	m, k := as[len(as)-2], as[len(as)-1]
+	kb, nn := bs[len(bs)-2], bs[len(bs)-1]
+	if k != kb {
+		return nil, fmt.Errorf("cannot multiply %v by %v", a.Shape, b.Shape)
+	}
+
+	var batch []int
+	var out []float32
+	switch {
+	case len(bs) == 2:
+		batch = as[:len(as)-2]
+		rows := numel(batch) * m
+		out = make([]float32, rows*nn)
+		matMul(out, rows, nn, k, a.Data, k, 1, b.Data, nn, 1)
+	case slices.Equal(as[:len(as)-2], bs[:len(bs)-2]):
+		batch = as[:len(as)-2]
+		out = make([]float32, numel(batch)*m*nn)
+		for i := 0; i < numel(batch); i++ {
+			matMul(out[i*m*nn:(i+1)*m*nn], m, nn, k, a.Data[i*m*k:], k, 1, b.Data[i*k*nn:], nn, 1)
+		}
+	default:
+		return nil, fmt.Errorf("broadcasting %v against %v is not supported", a.Shape, b.Shape)
+	}
+
+	shape := slices.Clone(batch)
+	if len(a.Shape) > 1 {
+		shape = append(shape, m)
+	}
+	if len(b.Shape) > 1 {
+		shape = append(shape, nn)
+	}
+	return []*Tensor{{Shape: shape, Data: out}}, nil
+}
+
+// softmaxOp normalizes along axis. Before opset 13 the input is seen as a 2-D matrix split at
+// axis (default 1), and each row is normalized; from 13 on only the single axis (default -1)
+// is.
+func softmaxOp(n *node, in []*Tensor) ([]*Tensor, error) {
+	x := in[0]
+	def := -1
+	if n.opset < 13 {
+		def = 1
+	}
+	ax, err := axis(n.attrInt("axis", def), len(x.Shape))
+	if err != nil {
+		return nil, err
+	}
+	outer, size, inner := numel(x.Shape[:ax]), x.Shape[ax], numel(x.Shape[ax+1:])
+	if n.opset < 13 {
+		size, inner = numel(x.Shape[ax:]), 1
+	}
+
+	out := make([]float32, len(x.Data))
+	for o := 0; o < outer; o++ {
+		for i := 0; i < inner; i++ {
+			base := o*size*inner + i
+			hi := float32(math.Inf(-1))
+			for j := 0; j < size; j++ {
+				hi = max(hi, x.Data[base+j*inner])
+			}
+			var sum float64
+			for j := 0; j < size; j++ {
+				e := math.Exp(float64(x.Data[base+j*inner] - hi))
+				out[base+j*inner] = float32(e)
+				sum += e
+			}
+			for j := 0; j < size; j++ {
+				out[base+j*inner] = float32(float64(out[base+j*inner]) / sum)
+			}
+		}
+	}
+	return []*Tensor{{Shape: x.Shape, Data: out}}, nil
+}
+
+func constant(n *node, _ []*Tensor) ([]*Tensor, error) {
+	for name, a := range n.attrs {
+		switch name {
+		case "value":
+			if a.t != nil {
+				return []*Tensor{a.t}, nil
+			}
+		case "value_float":
+			return []*Tensor{{Shape: []int{}, Data: []float32{a.f}}}, nil
+		case "value_int":
+			return []*Tensor{{Shape: []int{}, Data: []float32{float32(a.i)}}}, nil
+		case "value_floats":
+			return []*Tensor{{Shape: []int{len(a.fs)}, Data: slices.Clone(a.fs)}}, nil
+		case "value_ints":
+			data := make([]float32, len(a.is))
+			for i, v := range a.is {
+				data[i] = float32(v)
+			}
+			return []*Tensor{{Shape: []int{len(data)}, Data: data}}, nil
+		}
+	}
+	return nil, errors.New("no supported value attribute")
+}
+
+func shapeOp(n *node, in []*Tensor) ([]*Tensor, error) {
+	shape := in[0].Shape
+	rank := len(shape)
+	start, end := n.attrInt("start", 0), n.attrInt("end", rank)
+	if start < 0 {
+		start += rank
+	}
+	if end < 0 {
+		end += rank
+	}
+	start, end = min(max(start, 0), rank), min(max(end, 0), rank)
+	data := make([]float32, 0, rank)
+	for i := start; i < end; i++ {
+		data = append(data, float32(shape[i]))
+	}
+	return []*Tensor{{Shape: []int{len(data)}, Data: data}}, nil
+}
+
+func gather(n *node, in []*Tensor) ([]*Tensor, error) {
+	x, indices := in[0], in[1]
+	ax, err := axis(n.attrInt("axis", 0), len(x.Shape))
+	if err != nil {
+		return nil, err
+	}
+	dim := x.Shape[ax]
+	outer, inner := numel(x.Shape[:ax]), numel(x.Shape[ax+1:])
+	idx := indices.ints()
+	for i, v := range idx {
+		if v < 0 {
+			v += dim
+		}
+		if v < 0 || v >= dim {
+			return nil, fmt.Errorf("index %d out of range for dimension of %d", idx[i], dim)
+		}
+		idx[i] = v
+	}
+
+	out := make([]float32, 0, outer*len(idx)*inner)
+	for o := 0; o < outer; o++ {
+		for _, v := range idx {
+			off := (o*dim + v) * inner
+			out = append(out, x.Data[off:off+inner]...)
+		}
+	}
+	shape := slices.Concat(x.Shape[:ax], indices.Shape, x.Shape[ax+1:])
+	return []*Tensor{{Shape: shape, Data: out}}, nil
+}
+
+func concat(n *node, in []*Tensor) ([]*Tensor, error) {
+	var parts []*Tensor
+	for _, t := range in {
+		if t != nil {
+			parts = append(parts, t)
+		}
+	}
+	if len(parts) == 0 {
+		return nil, errors.New("no inputs")
+	}
+	first := parts[0].Shape
+	ax, err := axis(n.attrInt("axis", 0), len(first))
+	if err != nil {
+		return nil, err
+	}
+	shape := slices.Clone(first)
+	shape[ax] = 0
+	for _, t := range parts {
+		if len(t.Shape) != len(first) {
+			return nil, fmt.Errorf("cannot concatenate %v and %v", first, t.Shape)
+		}
+		for d := range first {
+			if d != ax && t.Shape[d] != first[d] {
+				return nil, fmt.Errorf("cannot concatenate %v and %v", first, t.Shape)
+			}
+		}
+		shape[ax] += t.Shape[ax]
+	}
+
+	outer := numel(first[:ax])
+	out := make([]float32, 0, numel(shape))
+	for o := 0; o < outer; o++ {
+		for _, t := range parts {
+			chunk := numel(t.Shape[ax:])
+			out = append(out, t.Data[o*chunk:(o+1)*chunk]...)
+		}
+	}
+	return []*Tensor{{Shape: shape, Data: out}}, nil
+}
+
+func flatten(n *node, in []*Tensor) ([]*Tensor, error) {
+	x := in[0]
+	ax := n.attrInt("axis", 1)
+	if ax < 0 {
+		ax += len(x.Shape)
+	}
+	if ax < 0 || ax > len(x.Shape) {
+		return nil, fmt.Errorf("axis %d out of range for rank %d", ax, len(x.Shape))
+	}
+	return []*Tensor{x.reshaped([]int{numel(x.Shape[:ax]), numel(x.Shape[ax:])})}, nil
+}
+
+// reshape takes the target shape as its second input, or as an attribute before opset 5.
+// A 0 copies the input dimension (unless allowzero is set) and one -1 is inferred.
+func reshape(n *node, in []*Tensor) ([]*Tensor, error) {
+	x := in[0]
+	var shape []int
+	if t := input(in, 1); t != nil {
+		shape = t.ints()
+	} else {
+		shape = n.attrInts("shape", nil)
+	}
+	shape = slices.Clone(shape)
+	infer := -1
+	known := 1
+	for i, d := range shape {
+		switch {
+		case d == 0 && n.attrInt("allowzero", 0) == 0:
+			if i >= len(x.Shape) {
+				return nil, fmt.Errorf("cannot copy dimension %d of %v", i, x.Shape)
+			}
+			shape[i] = x.Shape[i]
+		case d == -1:
+			if infer >= 0 {
+				return nil, errors.New("more than one -1 in shape")
+			}
+			infer = i
+			continue
+		case d < 0:
+			return nil, fmt.Errorf("invalid shape %v", shape)
+		}
+		known *= shape[i]
+	}
+	if infer >= 0 {
+		if known == 0 || len(x.Data)%known != 0 {
+			return nil, fmt.Errorf("cannot reshape %v to %v", x.Shape, shape)
+		}
+		shape[infer] = len(x.Data) / known
+	}
+	if numel(shape) != len(x.Data) {
+		return nil, fmt.Errorf("cannot reshape %v to %v", x.Shape, shape)
+	}
+	return []*Tensor{x.reshaped(shape)}, nil
+}
+
+// axesArg returns the axes of Squeeze and Unsqueeze, an input from opset 13 on and an
+// attribute before.
+func axesArg(n *node, in []*Tensor) []int {
+	if t := input(in, 1); t != nil {
+		return t.ints()
+	}
+	return n.attrInts("axes", nil)
+}
+
+func squeeze(n *node, in []*Tensor) ([]*Tensor, error) {
+	x := in[0]
+	drop := make([]bool, len(x.Shape))
+	axes := axesArg(n, in)
+	if axes == nil {
+		for i, d := range x.Shape {
+			drop[i] = d == 1
+		}
+	}
+	for _, a := range axes {
+		ax, err := axis(a, len(x.Shape))
+		if err != nil {
+			return nil, err
+		}
+		if x.Shape[ax] != 1 {
+			return nil, fmt.Errorf("cannot squeeze dimension %d of %v", ax, x.Shape)
+		}
+		drop[ax] = true
+	}
+	shape := make([]int, 0, len(x.Shape))
+	for i, d := range x.Shape {
+		if !drop[i] {
+			shape = append(shape, d)
+		}
+	}
+	return []*Tensor{x.reshaped(shape)}, nil
+}
+
+func unsqueeze(n *node, in []*Tensor) ([]*Tensor, error) {
+	x := in[0]
+	axes := axesArg(n, in)
+	rank := len(x.Shape) + len(axes)
+	insert := make([]bool, rank)
+	for _, a := range axes {
+		ax, err := axis(a, rank)
+		if err != nil {
+			return nil, err
+		}
+		if insert[ax] {
+			return nil, fmt.Errorf("duplicate axis %d", a)
+		}
+		insert[ax] = true
+	}
+	shape := make([]int, rank)
+	j := 0
+	for i := range shape {
+		if insert[i] {
+			shape[i] = 1
+			continue
+		}
+		shape[i] = x.Shape[j]
+		j++
+	}
+	return []*Tensor{x.reshaped(shape)}, nil
+}
+
+func transpose(n *node, in []*Tensor) ([]*Tensor, error) {
+	x := in[0]
+	rank := len(x.Shape)
+	perm := n.attrInts("perm", nil)
+	if perm == nil {
+		perm = make([]int, rank)
+		for i := range perm {
+			perm[i] = rank - 1 - i
+		}
+	}
+	if len(perm) != rank {
+		return nil, fmt.Errorf("perm %v does not match rank %d", perm, rank)
+	}
+
+	srcStrides := make([]int, rank)
+	stride := 1
+	for d := rank - 1; d >= 0; d-- {
+		srcStrides[d] = stride
+		stride *= x.Shape[d]
+	}
+	shape := make([]int, rank)
+	strides := make([]int, rank)
+	for i, p := range perm {
+		if p < 0 || p >= rank {
+			return nil, fmt.Errorf("invalid perm %v", perm)
+		}
+		shape[i] = x.Shape[p]
+		strides[i] = srcStrides[p]
+	}
+
+	out := make([]float32, len(x.Data))
+	idx := make([]int, rank)
+	src := 0
+	for i := range out {
+		out[i] = x.Data[src]
+		for d := rank - 1; d >= 0; d-- {
+			idx[d]++
+			src += strides[d]
+			if idx[d] < shape[d] {
+				break
+			}
+			src -= strides[d] * shape[d]
+			idx[d] = 0
+		}
+	}
+	return []*Tensor{{Shape: shape, Data: out}}, nil
+}
@@ -0,0 +1,341 @@
+package onnxgo
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func tensor(shape []int, data ...float32) *Tensor {
+	return &Tensor{Shape: shape, Data: data}
+}
+
+func seq(shape ...int) *Tensor {
+	t := &Tensor{Shape: shape, Data: make([]float32, numel(shape))}
+	for i := range t.Data {
+		t.Data[i] = float32(i)
+	}
+	return t
+}
+
+func ones(shape ...int) *Tensor {
+	t := &Tensor{Shape: shape, Data: make([]float32, numel(shape))}
+	for i := range t.Data {
+		t.Data[i] = 1
+	}
+	return t
+}
+
+func ints(v ...int64) attribute { return attribute{is: v} }
+
+func withAttrs(attrs map[string]attribute) *node {
+	if attrs == nil {
+		attrs = map[string]attribute{}
+	}
+	return &node{attrs: attrs, opset: 13}
+}
+
+type opCase struct {
+	name  string
+	op    string
+	attrs map[string]attribute
+	opset int64
+	in    []*Tensor
+	want  *Tensor
+	err   bool
+}
+
+func runOpCases(t *testing.T, cases []opCase) {
+	t.Helper()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			n := withAttrs(tc.attrs)
+			if tc.opset != 0 {
+				n.opset = tc.opset
+			}
+			out, err := operators[tc.op].run(n, tc.in)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v", out[0])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tc.op, err)
+			}
+			got := out[0]
+			if !slices.Equal(got.Shape, tc.want.Shape) {
+				t.Fatalf("shape = %v, want %v", got.Shape, tc.want.Shape)
+			}
+			for i := range got.Data {
+				if math.Abs(float64(got.Data[i]-tc.want.Data[i])) > 1e-5 {
+					t.Fatalf("data = %v, want %v", got.Data, tc.want.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestConv(t *testing.T) {
+	x3 := tensor([]int{1, 1, 3, 3}, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	runOpCases(t, []opCase{
+		{
+			name:  "pads",
+			op:    "Conv",
+			attrs: map[string]attribute{"pads": ints(1, 1, 1, 1)},
+			in:    []*Tensor{x3, ones(1, 1, 3, 3)},
+			want:  tensor([]int{1, 1, 3, 3}, 12, 21, 16, 27, 45, 33, 24, 39, 28),
+		},
+		{
+			name:  "strides",
+			op:    "Conv",
+			attrs: map[string]attribute{"pads": ints(1, 1, 1, 1), "strides": ints(2, 2)},
+			in:    []*Tensor{x3, ones(1, 1, 3, 3)},
+			want:  tensor([]int{1, 1, 2, 2}, 12, 16, 24, 28),
+		},
+		{
+			// each output sums v, v+2, v+10 and v+12 for v at its top-left corner
+			name:  "dilations",
+			op:    "Conv",
+			attrs: map[string]attribute{"dilations": ints(2, 2)},
+			in:    []*Tensor{seq(1, 1, 5, 5), ones(1, 1, 2, 2)},
+			want:  tensor([]int{1, 1, 3, 3}, 24, 28, 32, 44, 48, 52, 64, 68, 72),
+		},
+		{
+			name:  "groups and bias",
+			op:    "Conv",
+			attrs: map[string]attribute{"group": {i: 2}},
+			in: []*Tensor{
+				tensor([]int{1, 2, 1, 2}, 1, -1, 2, 3),
+				tensor([]int{4, 1, 1, 1}, 1, 2, 3, 4),
+				tensor([]int{4}, 0, 0, 0, 10),
+			},
+			want: tensor([]int{1, 4, 1, 2}, 1, -1, 2, -2, 6, 9, 18, 22),
+		},
+		{
+			// stride 2 over 4 columns pads one column, at the end
+			name:  "same upper",
+			op:    "Conv",
+			attrs: map[string]attribute{"auto_pad": {s: "SAME_UPPER"}, "strides": ints(2, 2)},
+			in:    []*Tensor{seq(1, 1, 4, 4), ones(1, 1, 3, 3)},
+			want:  tensor([]int{1, 1, 2, 2}, 45, 39, 66, 50),
+		},
+		{
+			name:  "groups do not divide channels",
+			op:    "Conv",
+			attrs: map[string]attribute{"group": {i: 2}},
+			in:    []*Tensor{seq(1, 3, 2, 2), ones(2, 1, 1, 1)},
+			err:   true,
+		},
+		{
+			name: "kernel larger than input",
+			op:   "Conv",
+			in:   []*Tensor{seq(1, 1, 2, 2), ones(1, 1, 3, 3)},
+			err:  true,
+		},
+	})
+}
+
+func TestPool(t *testing.T) {
+	x3 := tensor([]int{1, 1, 3, 3}, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	runOpCases(t, []opCase{
+		{
+			name:  "max",
+			op:    "MaxPool",
+			attrs: map[string]attribute{"kernel_shape": ints(2, 2), "strides": ints(2, 2)},
+			in:    []*Tensor{seq(1, 1, 4, 4)},
+			want:  tensor([]int{1, 1, 2, 2}, 5, 7, 13, 15),
+		},
+		{
+			name:  "max ceil mode",
+			op:    "MaxPool",
+			attrs: map[string]attribute{"kernel_shape": ints(2, 2), "strides": ints(2, 2), "ceil_mode": {i: 1}},
+			in:    []*Tensor{seq(1, 1, 4, 5)},
+			want:  tensor([]int{1, 1, 2, 3}, 6, 8, 9, 16, 18, 19),
+		},
+		{
+			name:  "average without padding",
+			op:    "AveragePool",
+			attrs: map[string]attribute{"kernel_shape": ints(3, 3), "pads": ints(1, 1, 1, 1)},
+			in:    []*Tensor{x3},
+			want:  tensor([]int{1, 1, 3, 3}, 3, 3.5, 4, 4.5, 5, 5.5, 6, 6.5, 7),
+		},
+		{
+			name:  "average counting padding",
+			op:    "AveragePool",
+			attrs: map[string]attribute{"kernel_shape": ints(3, 3), "pads": ints(1, 1, 1, 1), "count_include_pad": {i: 1}},
+			in:    []*Tensor{x3},
+			want:  tensor([]int{1, 1, 3, 3}, 12.0/9, 21.0/9, 16.0/9, 27.0/9, 5, 33.0/9, 24.0/9, 39.0/9, 28.0/9),
+		},
+		{
+			name: "global average",
+			op:   "GlobalAveragePool",
+			in:   []*Tensor{seq(1, 2, 2, 2)},
+			want: tensor([]int{1, 2, 1, 1}, 1.5, 5.5),
+		},
+		{
+			name: "global max",
+			op:   "GlobalMaxPool",
+			in:   []*Tensor{seq(1, 2, 2, 2)},
+			want: tensor([]int{1, 2, 1, 1}, 3, 7),
+		},
+		{
+			name: "missing kernel shape",
+			op:   "MaxPool",
+			in:   []*Tensor{seq(1, 1, 4, 4)},
+			err:  true,
+		},
+	})
+}
+
+func TestGemmAndMatMul(t *testing.T) {
+	a := tensor([]int{2, 3}, 1, 2, 3, 4, 5, 6)
+	b := tensor([]int{3, 2}, 7, 8, 9, 10, 11, 12)
+	ab := tensor([]int{2, 2}, 58, 64, 139, 154)
+	runOpCases(t, []opCase{
+		{name: "plain", op: "Gemm", in: []*Tensor{a, b}, want: ab},
+		{
+			name:  "transA",
+			op:    "Gemm",
+			attrs: map[string]attribute{"transA": {i: 1}},
+			in:    []*Tensor{tensor([]int{3, 2}, 1, 4, 2, 5, 3, 6), b},
+			want:  ab,
+		},
+		{
+			name:  "transB",
+			op:    "Gemm",
+			attrs: map[string]attribute{"transB": {i: 1}},
+			in:    []*Tensor{a, tensor([]int{2, 3}, 7, 9, 11, 8, 10, 12)},
+			want:  ab,
+		},
+		{
+			name:  "alpha beta and broadcast C",
+			op:    "Gemm",
+			attrs: map[string]attribute{"alpha": {f: 2}, "beta": {f: 0.5}},
+			in:    []*Tensor{a, b, tensor([]int{2}, 2, 4)},
+			want:  tensor([]int{2, 2}, 117, 130, 279, 310),
+		},
+		{name: "inner dims differ", op: "Gemm", in: []*Tensor{a, a}, err: true},
+		{name: "matmul", op: "MatMul", in: []*Tensor{a, b}, want: ab},
+		{
+			name: "matmul batched against 2-D",
+			op:   "MatMul",
+			in:   []*Tensor{tensor([]int{2, 1, 3}, 1, 2, 3, 4, 5, 6), b},
+			want: tensor([]int{2, 1, 2}, 58, 64, 139, 154),
+		},
+		{
+			name: "matmul vector",
+			op:   "MatMul",
+			in:   []*Tensor{tensor([]int{3}, 1, 2, 3), b},
+			want: tensor([]int{2}, 58, 64),
+		},
+	})
+}
+
+func TestBroadcast(t *testing.T) {
+	runOpCases(t, []opCase{
+		{
+			name: "same shape",
+			op:   "Sub",
+			in:   []*Tensor{tensor([]int{2}, 5, 7), tensor([]int{2}, 1, 2)},
+			want: tensor([]int{2}, 4, 5),
+		},
+		{
+			name: "scalar",
+			op:   "Mul",
+			in:   []*Tensor{tensor([]int{2, 2}, 1, 2, 3, 4), tensor([]int{}, 3)},
+			want: tensor([]int{2, 2}, 3, 6, 9, 12),
+		},
+		{
+			name: "trailing dims",
+			op:   "Add",
+			in:   []*Tensor{tensor([]int{2, 3}, 0, 1, 2, 3, 4, 5), tensor([]int{3}, 10, 20, 30)},
+			want: tensor([]int{2, 3}, 10, 21, 32, 13, 24, 35),
+		},
+		{
+			name: "both sides",
+			op:   "Add",
+			in:   []*Tensor{tensor([]int{2, 1}, 1, 2), tensor([]int{1, 3}, 10, 20, 30)},
+			want: tensor([]int{2, 3}, 11, 21, 31, 12, 22, 32),
+		},
+		{
+			name: "left operand broadcast",
+			op:   "Div",
+			in:   []*Tensor{tensor([]int{1}, 12), tensor([]int{3}, 1, 2, 3)},
+			want: tensor([]int{3}, 12, 6, 4),
+		},
+		{
+			name: "incompatible",
+			op:   "Add",
+			in:   []*Tensor{seq(2, 3), seq(2)},
+			err:  true,
+		},
+	})
+}
+
+func TestShapeOps(t *testing.T) {
+	x := seq(2, 3, 4)
+	runOpCases(t, []opCase{
+		{name: "reshape copies 0 and infers -1", op: "Reshape", in: []*Tensor{x, tensor([]int{2}, 0, -1)}, want: seq(2, 12)},
+		{name: "reshape infers leading -1", op: "Reshape", in: []*Tensor{x, tensor([]int{2}, -1, 4)}, want: seq(6, 4)},
+		{name: "reshape keeps dims by 0", op: "Reshape", in: []*Tensor{x, tensor([]int{3}, 0, 0, -1)}, want: seq(2, 3, 4)},
+		{name: "reshape attribute before opset 5", op: "Reshape", attrs: map[string]attribute{"shape": ints(4, 6)}, in: []*Tensor{x}, want: seq(4, 6)},
+		{name: "reshape two -1", op: "Reshape", in: []*Tensor{x, tensor([]int{2}, -1, -1)}, err: true},
+		{name: "reshape wrong size", op: "Reshape", in: []*Tensor{x, tensor([]int{2}, 5, 5)}, err: true},
+		{name: "flatten", op: "Flatten", in: []*Tensor{x}, want: seq(2, 12)},
+		{name: "flatten axis 0", op: "Flatten", attrs: map[string]attribute{"axis": {i: 0}}, in: []*Tensor{x}, want: seq(1, 24)},
+		{name: "squeeze all", op: "Squeeze", in: []*Tensor{seq(1, 3, 1)}, want: seq(3)},
+		{name: "squeeze axes input", op: "Squeeze", in: []*Tensor{seq(1, 3, 1), tensor([]int{1}, -1)}, want: seq(1, 3)},
+		{name: "squeeze non-1 dim", op: "Squeeze", attrs: map[string]attribute{"axes": ints(1)}, in: []*Tensor{seq(1, 3, 1)}, err: true},
+		{name: "unsqueeze", op: "Unsqueeze", in: []*Tensor{seq(3), tensor([]int{2}, 0, -1)}, want: seq(1, 3, 1)},
+		{name: "transpose", op: "Transpose", attrs: map[string]attribute{"perm": ints(1, 0)}, in: []*Tensor{seq(2, 3)}, want: tensor([]int{3, 2}, 0, 3, 1, 4, 2, 5)},
+		{name: "transpose reverses by default", op: "Transpose", in: []*Tensor{seq(1, 2, 3)}, want: tensor([]int{3, 2, 1}, 0, 3, 1, 4, 2, 5)},
+		{name: "concat", op: "Concat", attrs: map[string]attribute{"axis": {i: 1}}, in: []*Tensor{seq(2, 1), ones(2, 2)}, want: tensor([]int{2, 3}, 0, 1, 1, 1, 1, 1)},
+		{name: "concat mismatch", op: "Concat", attrs: map[string]attribute{"axis": {i: 0}}, in: []*Tensor{seq(2, 1), ones(2, 2)}, err: true},
+		{name: "gather scalar index", op: "Gather", in: []*Tensor{tensor([]int{4}, 2, 3, 224, 224), tensor([]int{}, 0)}, want: tensor([]int{}, 2)},
+		{name: "gather axis 1", op: "Gather", attrs: map[string]attribute{"axis": {i: 1}}, in: []*Tensor{seq(2, 3), tensor([]int{2}, 2, -3)}, want: tensor([]int{2, 2}, 2, 0, 5, 3)},
+		{name: "gather out of range", op: "Gather", in: []*Tensor{seq(2), tensor([]int{1}, 2)}, err: true},
+		{name: "shape", op: "Shape", in: []*Tensor{x}, want: tensor([]int{3}, 2, 3, 4)},
+		{name: "shape slice", op: "Shape", attrs: map[string]attribute{"start": {i: -2}}, in: []*Tensor{x}, want: tensor([]int{2}, 3, 4)},
+		{name: "constant", op: "Constant", attrs: map[string]attribute{"value_ints": ints(1, -1)}, want: tensor([]int{2}, 1, -1)},
+	})
+}
+
+func TestElementwise(t *testing.T) {
+	x := tensor([]int{4}, -2, 0, 3, 8)
+	runOpCases(t, []opCase{
+		{name: "relu", op: "Relu", in: []*Tensor{x}, want: tensor([]int{4}, 0, 0, 3, 8)},
+		{name: "clip attributes", op: "Clip", attrs: map[string]attribute{"min": {f: 0}, "max": {f: 6}}, in: []*Tensor{x}, want: tensor([]int{4}, 0, 0, 3, 6)},
+		{name: "clip inputs", op: "Clip", in: []*Tensor{x, tensor([]int{}, -1), tensor([]int{}, 1)}, want: tensor([]int{4}, -1, 0, 1, 1)},
+		{name: "clip max only", op: "Clip", in: []*Tensor{x, nil, tensor([]int{}, 5)}, want: tensor([]int{4}, -2, 0, 3, 5)},
+		{name: "leaky relu", op: "LeakyRelu", attrs: map[string]attribute{"alpha": {f: 0.5}}, in: []*Tensor{x}, want: tensor([]int{4}, -1, 0, 3, 8)},
+		{name: "hard swish", op: "HardSwish", in: []*Tensor{x}, want: tensor([]int{4}, -2.0/6, 0, 3, 8)},
+		{
+			name:  "batch norm",
+			op:    "BatchNormalization",
+			attrs: map[string]attribute{"epsilon": {f: 0}},
+			in: []*Tensor{
+				tensor([]int{1, 2, 2}, 1, 3, 10, 20),
+				tensor([]int{2}, 2, 1),   // scale
+				tensor([]int{2}, 0, 1),   // bias
+				tensor([]int{2}, 2, 10),  // mean
+				tensor([]int{2}, 4, 100), // var
+			},
+			want: tensor([]int{1, 2, 2}, -1, 1, 1, 2),
+		},
+		{
+			name: "softmax last axis",
+			op:   "Softmax",
+			in:   []*Tensor{tensor([]int{2, 2}, 0, 0, 0, float32(math.Log(3)))},
+			want: tensor([]int{2, 2}, 0.5, 0.5, 0.25, 0.75),
+		},
+		{
+			// before opset 13 the trailing dims from axis 1 are normalized together
+			name:  "softmax opset 11",
+			op:    "Softmax",
+			opset: 11,
+			in:    []*Tensor{tensor([]int{1, 2, 2}, 0, 0, 0, 0)},
+			want:  tensor([]int{1, 2, 2}, 0.25, 0.25, 0.25, 0.25),
+		},
+	})
+}
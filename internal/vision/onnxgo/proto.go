@@ -0,0 +1,332 @@
+package onnxgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The ONNX file format is a protobuf ModelProto. Only the fields needed to run a graph are
+// decoded, straight from the wire format, so the package does not need generated code for
+// onnx.proto. Field numbers below are those of onnx.proto.
+
+// field is one decoded protobuf field: x holds varint and fixed-size values, b the payload
+// of length-delimited ones.
+type field struct {
+	num protowire.Number
+	typ protowire.Type
+	x   uint64
+	b   []byte
+}
+
+// walk calls fn for each field of the message in b.
+func walk(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.x, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.x = uint64(v)
+		case protowire.Fixed64Type:
+			f.x, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.b, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// int64s appends the values of a repeated int64 field, packed or not.
+func (f field) int64s(dst []int64) ([]int64, error) {
+	if f.typ == protowire.VarintType {
+		return append(dst, int64(f.x)), nil
+	}
+	b := f.b
+	for len(b) > 0 {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		dst = append(dst, int64(v))
+		b = b[n:]
+	}
+	return dst, nil
+}
+
+// float32s appends the values of a repeated float field, packed or not.
+func (f field) float32s(dst []float32) ([]float32, error) {
+	if f.typ == protowire.Fixed32Type {
+		return append(dst, math.Float32frombits(uint32(f.x))), nil
+	}
+	if len(f.b)%4 != 0 {
+		return nil, errors.New("malformed packed float field")
+	}
+	for i := 0; i < len(f.b); i += 4 {
+		dst = append(dst, math.Float32frombits(binary.LittleEndian.Uint32(f.b[i:])))
+	}
+	return dst, nil
+}
+
+// float64s appends the values of a repeated double field, packed or not.
+func (f field) float64s(dst []float64) ([]float64, error) {
+	if f.typ == protowire.Fixed64Type {
+		return append(dst, math.Float64frombits(f.x)), nil
+	}
+	if len(f.b)%8 != 0 {
+		return nil, errors.New("malformed packed double field")
+	}
+	for i := 0; i < len(f.b); i += 8 {
+		dst = append(dst, math.Float64frombits(binary.LittleEndian.Uint64(f.b[i:])))
+	}
+	return dst, nil
+}
+
+// TensorProto.DataType values the package reads.
+const (
+	dtFloat  = 1
+	dtUint8  = 2
+	dtInt8   = 3
+	dtInt32  = 6
+	dtInt64  = 7
+	dtBool   = 9
+	dtDouble = 11
+)
+
+// maxTensorSize caps the number of values of a tensor read from a model file (1 GiB of
+// float32), so corrupt dims fail cleanly instead of overflowing or exhausting memory.
+const maxTensorSize = 1 << 28
+
+// parseTensor decodes a TensorProto into its name and values.
+func parseTensor(b []byte) (string, *Tensor, error) {
+	var (
+		name     string
+		dims     []int64
+		dtype    uint64
+		raw      []byte
+		floats   []float32
+		doubles  []float64
+		ints     []int64
+		external bool
+	)
+	err := walk(b, func(f field) error {
+		var err error
+		switch f.num {
+		case 1: // dims
+			dims, err = f.int64s(dims)
+		case 2: // data_type
+			dtype = f.x
+		case 4: // float_data
+			floats, err = f.float32s(floats)
+		case 5, 7: // int32_data, int64_data
+			ints, err = f.int64s(ints)
+		case 8: // name
+			name = string(f.b)
+		case 9: // raw_data
+			raw = f.b
+		case 10: // double_data
+			doubles, err = f.float64s(doubles)
+		case 13: // external_data
+			external = true
+		case 14: // data_location
+			external = external || f.x == 1
+		}
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if external {
+		return "", nil, fmt.Errorf("tensor %q: external data is not supported", name)
+	}
+
+	shape := make([]int, len(dims))
+	n := 1
+	for i, d := range dims {
+		if d < 0 || (d > 0 && int64(n) > maxTensorSize/d) {
+			return "", nil, fmt.Errorf("tensor %q: invalid dims %v", name, dims)
+		}
+		shape[i] = int(d)
+		n *= int(d)
+	}
+
+	// the values are counted before allocating, so the dims cannot claim more than the file
+	// holds
+	if raw != nil {
+		size := map[uint64]int{dtFloat: 4, dtUint8: 1, dtInt8: 1, dtInt32: 4, dtInt64: 8, dtBool: 1, dtDouble: 8}[dtype]
+		if size == 0 {
+			return "", nil, fmt.Errorf("tensor %q: unsupported data type %d", name, dtype)
+		}
+		if len(raw) != n*size {
+			return "", nil, fmt.Errorf("tensor %q: %d bytes of data for shape %v", name, len(raw), shape)
+		}
+		data := make([]float32, n)
+		for i := range data {
+			switch dtype {
+			case dtFloat:
+				data[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[4*i:]))
+			case dtUint8, dtBool:
+				data[i] = float32(raw[i])
+			case dtInt8:
+				data[i] = float32(int8(raw[i]))
+			case dtInt32:
+				data[i] = float32(int32(binary.LittleEndian.Uint32(raw[4*i:])))
+			case dtInt64:
+				data[i] = float32(int64(binary.LittleEndian.Uint64(raw[8*i:])))
+			case dtDouble:
+				data[i] = float32(math.Float64frombits(binary.LittleEndian.Uint64(raw[8*i:])))
+			}
+		}
+		return name, &Tensor{Shape: shape, Data: data}, nil
+	}
+
+	var count int
+	switch dtype {
+	case dtFloat:
+		count = len(floats)
+	case dtDouble:
+		count = len(doubles)
+	case dtUint8, dtInt8, dtInt32, dtInt64, dtBool:
+		count = len(ints)
+	default:
+		return "", nil, fmt.Errorf("tensor %q: unsupported data type %d", name, dtype)
+	}
+	if count != n {
+		return "", nil, fmt.Errorf("tensor %q: %d values for shape %v", name, count, shape)
+	}
+	data := make([]float32, n)
+	switch dtype {
+	case dtFloat:
+		copy(data, floats)
+	case dtDouble:
+		for i, v := range doubles {
+			data[i] = float32(v)
+		}
+	default:
+		for i, v := range ints {
+			data[i] = float32(v)
+		}
+	}
+	return name, &Tensor{Shape: shape, Data: data}, nil
+}
+
+// attribute is a decoded AttributeProto; which field is set depends on the attribute.
+type attribute struct {
+	f  float32
+	i  int64
+	s  string
+	t  *Tensor
+	fs []float32
+	is []int64
+}
+
+func parseAttribute(b []byte) (string, attribute, error) {
+	var name string
+	var a attribute
+	err := walk(b, func(f field) error {
+		var err error
+		switch f.num {
+		case 1: // name
+			name = string(f.b)
+		case 2: // f
+			a.f = math.Float32frombits(uint32(f.x))
+		case 3: // i
+			a.i = int64(f.x)
+		case 4: // s
+			a.s = string(f.b)
+		case 5: // t
+			_, a.t, err = parseTensor(f.b)
+		case 7: // floats
+			a.fs, err = f.float32s(a.fs)
+		case 8: // ints
+			a.is, err = f.int64s(a.is)
+		}
+		return err
+	})
+	return name, a, err
+}
+
+func parseNode(b []byte) (*node, error) {
+	n := &node{attrs: make(map[string]attribute)}
+	err := walk(b, func(f field) error {
+		switch f.num {
+		case 1: // input
+			n.inputs = append(n.inputs, string(f.b))
+		case 2: // output
+			n.outputs = append(n.outputs, string(f.b))
+		case 3: // name
+			n.name = string(f.b)
+		case 4: // op_type
+			n.op = string(f.b)
+		case 5: // attribute
+			name, a, err := parseAttribute(f.b)
+			if err != nil {
+				return fmt.Errorf("attribute %q: %w", name, err)
+			}
+			n.attrs[name] = a
+		case 7: // domain
+			n.domain = string(f.b)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// parseValueInfo decodes a ValueInfoProto into its name and tensor shape, with -1 for
+// dimensions that are symbolic or left out. The shape is nil when the type has none.
+func parseValueInfo(b []byte) (valueInfo, error) {
+	var vi valueInfo
+	err := walk(b, func(f field) error {
+		switch f.num {
+		case 1: // name
+			vi.name = string(f.b)
+		case 2: // type: TypeProto.tensor_type.shape.dim
+			return walk(f.b, func(f field) error {
+				if f.num != 1 { // tensor_type
+					return nil
+				}
+				return walk(f.b, func(f field) error {
+					if f.num != 2 { // shape
+						return nil
+					}
+					vi.shape = []int{}
+					return walk(f.b, func(f field) error {
+						if f.num != 1 { // dim
+							return nil
+						}
+						d := -1
+						err := walk(f.b, func(f field) error {
+							if f.num == 1 && f.typ == protowire.VarintType { // dim_value
+								d = int(int64(f.x))
+							}
+							return nil
+						})
+						vi.shape = append(vi.shape, d)
+						return err
+					})
+				})
+			})
+		}
+		return nil
+	})
+	return vi, err
+}
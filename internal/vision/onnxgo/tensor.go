@@ -0,0 +1,61 @@
+// Package onnxgo runs ONNX models in pure Go, without cgo or onnxruntime. It covers the
+// operators of small image classifiers such as MobileNetV2 and evaluates them with plain
+// loops, so it is several times slower than onnxruntime; it is meant for development
+// builds and CI rather than production traffic.
+package onnxgo
+
+import "fmt"
+
+// Tensor is a dense row-major tensor. Integer tensors, which in the models this package
+// targets only carry shapes and indices, are held as float32 too.
+type Tensor struct {
+	Shape []int
+	Data  []float32
+}
+
+// NewTensor wraps data in a tensor of the given shape; len(data) must match it.
+func NewTensor(shape []int, data []float32) (*Tensor, error) {
+	for _, d := range shape {
+		if d < 0 {
+			return nil, fmt.Errorf("onnxgo: invalid shape %v", shape)
+		}
+	}
+	if n := numel(shape); n != len(data) {
+		return nil, fmt.Errorf("onnxgo: shape %v needs %d values, got %d", shape, n, len(data))
+	}
+	return &Tensor{Shape: shape, Data: data}, nil
+}
+
+func numel(shape []int) int {
+	n := 1
+	for _, d := range shape {
+		n *= d
+	}
+	return n
+}
+
+// reshaped returns a tensor sharing t's data under another shape. Operators never write
+// to their inputs, so sharing is safe.
+func (t *Tensor) reshaped(shape []int) *Tensor {
+	return &Tensor{Shape: shape, Data: t.Data}
+}
+
+// ints returns the values of a shape or index tensor.
+func (t *Tensor) ints() []int {
+	out := make([]int, len(t.Data))
+	for i, v := range t.Data {
+		out[i] = int(v)
+	}
+	return out
+}
+
+// axis resolves a possibly negative axis against rank.
+func axis(a, rank int) (int, error) {
+	if a < 0 {
+		a += rank
+	}
+	if a < 0 || a >= rank {
+		return 0, fmt.Errorf("axis %d out of range for rank %d", a, rank)
+	}
+	return a, nil
+}
@@ -2,6 +2,7 @@ package vision
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
@@ -15,13 +16,25 @@ func DecodeImage(r io.Reader) (image.Image, string, error) {
 	return image.Decode(r)
 }
 
+// Preprocess resizes img to inputW x inputH and returns it as an NCHW tensor of RGB values
+// in [0,1].
 func Preprocess(img image.Image, inputW, inputH int) ([]float32, error) {
+	return PreprocessTensor(img, inputW, inputH, LayoutNCHW, 1.0/255, [3]float32{}, [3]float32{})
+}
+
+// PreprocessTensor resizes img to inputW x inputH and returns it as a tensor in the given
+// layout. Each RGB value v (0..255) becomes (v*scale - mean[c]) / std[c]; a zero std leaves
+// the channel unnormalized.
+func PreprocessTensor(img image.Image, inputW, inputH int, layout Layout, scale float32, mean, std [3]float32) ([]float32, error) {
 	if img == nil {
 		return nil, errors.New("image is nil")
 	}
 	if inputW <= 0 || inputH <= 0 {
 		return nil, errors.New("invalid input size")
 	}
+	if layout != LayoutNCHW && layout != LayoutNHWC {
+		return nil, fmt.Errorf("unsupported layout %q", layout)
+	}
 
 	dst := image.NewRGBA(image.Rect(0, 0, inputW, inputH))
 	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
@@ -31,15 +44,19 @@ func Preprocess(img image.Image, inputW, inputH int) ([]float32, error) {
 	planeSize := inputW * inputH
 	for y := 0; y < inputH; y++ {
 		for x := 0; x < inputW; x++ {
-			r, g, b, _ := dst.At(x, y).RGBA()
-			rf := float32(r>>8) / 255.0
-			gf := float32(g>>8) / 255.0
-			bf := float32(b>>8) / 255.0
-
+			off := dst.PixOffset(x, y)
 			idx := y*inputW + x
-			data[idx] = rf
-			data[planeSize+idx] = gf
-			data[2*planeSize+idx] = bf
+			for ch := 0; ch < channels; ch++ {
+				v := float32(dst.Pix[off+ch]) * scale
+				if std[ch] != 0 {
+					v = (v - mean[ch]) / std[ch]
+				}
+				if layout == LayoutNHWC {
+					data[idx*channels+ch] = v
+				} else {
+					data[ch*planeSize+idx] = v
+				}
+			}
 		}
 	}
 	return data, nil
@@ -0,0 +1,243 @@
+package vision
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrUnknownModel = errors.New("unknown model")
+	ErrNoModels     = errors.New("no vision models configured")
+)
+
+var modelNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// ModelSpec describes one classifier of a manifest. Relative paths are resolved against the
+// directory of the manifest. Zero values take the ONNXClassifier defaults (224x224 NCHW,
+// values in [0,1], no mean/std normalization, softmax over the output).
+type ModelSpec struct {
+	Name          string     `json:"name"`
+	Description   string     `json:"description,omitempty"`
+	ModelPath     string     `json:"model_path"`
+	LabelsPath    string     `json:"labels_path"`
+	InputName     string     `json:"input_name,omitempty"`
+	OutputName    string     `json:"output_name,omitempty"`
+	InputH        int        `json:"input_h,omitempty"`
+	InputW        int        `json:"input_w,omitempty"`
+	Layout        Layout     `json:"layout,omitempty"`
+	Scale         float32    `json:"scale,omitempty"`
+	Mean          [3]float32 `json:"mean"`
+	Std           [3]float32 `json:"std"`
+	Probabilities bool       `json:"probabilities,omitempty"`
+}
+
+// Manifest lists the models served. Default is used when a request names none; it falls
+// back to the first model.
+type Manifest struct {
+	Default string      `json:"default,omitempty"`
+	Models  []ModelSpec `json:"models"`
+}
+
+// LoadManifest reads a JSON manifest:
+//
+//	{
+//	  "default": "mobilenetv2",
+//	  "models": [
+//	    {"name": "mobilenetv2", "model_path": "mobilenetv2-7.onnx", "labels_path": "imagenet_labels.txt",
+//	     "mean": [0.485, 0.456, 0.406], "std": [0.229, 0.224, 0.225]},
+//	    {"name": "plants", "model_path": "plants.onnx", "labels_path": "plants.txt",
+//	     "input_h": 256, "input_w": 256, "layout": "NHWC", "output_name": "probs", "probabilities": true}
+//	  ]
+//	}
+func LoadManifest(path string) (*Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read model manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("parse model manifest: %w", err)
+	}
+	if len(m.Models) == 0 {
+		return nil, fmt.Errorf("model manifest lists no models")
+	}
+	dir := filepath.Dir(path)
+	seen := make(map[string]bool, len(m.Models))
+	for i := range m.Models {
+		spec := &m.Models[i]
+		if !modelNameRe.MatchString(spec.Name) {
+			return nil, fmt.Errorf("model manifest: invalid model name %q", spec.Name)
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("model manifest: duplicate model %q", spec.Name)
+		}
+		seen[spec.Name] = true
+		spec.ModelPath = resolvePath(dir, spec.ModelPath)
+		spec.LabelsPath = resolvePath(dir, spec.LabelsPath)
+	}
+	if m.Default != "" && !seen[m.Default] {
+		return nil, fmt.Errorf("model manifest: default model %q not listed", m.Default)
+	}
+	return &m, nil
+}
+
+func resolvePath(dir, p string) string {
+	p = strings.TrimSpace(p)
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+// ModelInfo is what GET /vision/models tells about a model.
+type ModelInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputH      int    `json:"input_h"`
+	InputW      int    `json:"input_w"`
+	Layout      Layout `json:"layout"`
+	Default     bool   `json:"default"`
+}
+
+// Registry serves the classifiers of a manifest by name.
+type Registry struct {
+	models map[string]*Service
+	infos  []ModelInfo
+	def    string
+}
+
+// LoadRegistry loads the models of the manifest at manifestPath or, without one, the
+// single model of fallback, named after its file. fallback.OrtLibraryPath applies to every
+// model. Models that fail to load are logged and left out; it fails only when none loads.
+func LoadRegistry(manifestPath string, fallback Config, defaultTopK, maxTopK int) (*Registry, error) {
+	var m *Manifest
+	if p := strings.TrimSpace(manifestPath); p != "" {
+		var err error
+		if m, err = LoadManifest(p); err != nil {
+			return nil, err
+		}
+	} else {
+		if strings.TrimSpace(fallback.ModelPath) == "" || strings.TrimSpace(fallback.LabelsPath) == "" {
+			return nil, ErrNoModels
+		}
+		name := strings.ToLower(strings.TrimSuffix(filepath.Base(fallback.ModelPath), filepath.Ext(fallback.ModelPath)))
+		m = &Manifest{Models: []ModelSpec{{
+			Name:       name,
+			ModelPath:  fallback.ModelPath,
+			LabelsPath: fallback.LabelsPath,
+			InputName:  fallback.InputName,
+			OutputName: fallback.OutputName,
+			InputH:     fallback.InputH,
+			InputW:     fallback.InputW,
+		}}}
+	}
+
+	r := NewRegistry()
+	for _, spec := range m.Models {
+		cfg := spec.config()
+		cfg.OrtLibraryPath = fallback.OrtLibraryPath
+		classifier, err := NewONNXClassifier(cfg)
+		if err != nil {
+			log.Printf("vision: model %s not loaded: %v", spec.Name, err)
+			continue
+		}
+		svc, err := NewService(classifier, defaultTopK, maxTopK)
+		if err != nil {
+			_ = classifier.Close()
+			log.Printf("vision: model %s not loaded: %v", spec.Name, err)
+			continue
+		}
+		r.Add(spec.Name, svc, spec.info())
+	}
+	if len(r.models) == 0 {
+		return nil, fmt.Errorf("vision: no model could be loaded")
+	}
+	if _, ok := r.models[m.Default]; ok {
+		r.def = m.Default
+	} else if m.Default != "" {
+		log.Printf("vision: default model %s not loaded, using %s", m.Default, r.def)
+	}
+	return r, nil
+}
+
+// NewRegistry returns an empty registry for Add. LoadRegistry builds one from a manifest.
+func NewRegistry() *Registry {
+	return &Registry{models: make(map[string]*Service)}
+}
+
+// Add serves svc under name. The first model added is the default one.
+func (r *Registry) Add(name string, svc *Service, info ModelInfo) {
+	svc.name = name
+	info.Name = name
+	r.models[name] = svc
+	r.infos = append(r.infos, info)
+	if r.def == "" {
+		r.def = name
+	}
+}
+
+func (spec ModelSpec) config() Config {
+	return Config{
+		ModelPath:     spec.ModelPath,
+		LabelsPath:    spec.LabelsPath,
+		InputH:        spec.InputH,
+		InputW:        spec.InputW,
+		InputName:     spec.InputName,
+		OutputName:    spec.OutputName,
+		Layout:        spec.Layout,
+		Scale:         spec.Scale,
+		Mean:          spec.Mean,
+		Std:           spec.Std,
+		Probabilities: spec.Probabilities,
+	}
+}
+
+func (spec ModelSpec) info() ModelInfo {
+	info := ModelInfo{
+		Name:        spec.Name,
+		Description: spec.Description,
+		InputH:      spec.InputH,
+		InputW:      spec.InputW,
+		Layout:      Layout(strings.ToUpper(string(spec.Layout))),
+	}
+	if info.InputH <= 0 {
+		info.InputH = 224
+	}
+	if info.InputW <= 0 {
+		info.InputW = 224
+	}
+	if info.Layout == "" {
+		info.Layout = LayoutNCHW
+	}
+	return info
+}
+
+// Get returns the named model, or the default one for "".
+func (r *Registry) Get(name string) (*Service, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = r.def
+	}
+	svc, ok := r.models[name]
+	if !ok {
+		return nil, ErrUnknownModel
+	}
+	return svc, nil
+}
+
+func (r *Registry) Default() string { return r.def }
+
+// Models lists the loaded models in manifest order.
+func (r *Registry) Models() []ModelInfo {
+	infos := append([]ModelInfo(nil), r.infos...)
+	for i := range infos {
+		infos[i].Default = infos[i].Name == r.def
+	}
+	return infos
+}
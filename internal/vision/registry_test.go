@@ -0,0 +1,127 @@
+package vision
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeManifest(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "models.json")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	return path
+}
+
+func TestLoadManifest(t *testing.T) {
+	path := writeManifest(t, `{
+		"default": "plants",
+		"models": [
+			{"name": "mobilenetv2", "model_path": "mobilenetv2-7.onnx", "labels_path": "labels/imagenet.txt"},
+			{"name": "plants", "model_path": "/opt/models/plants.onnx", "labels_path": " plants.txt ", "layout": "NHWC"}
+		]
+	}`)
+	m, err := LoadManifest(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	dir := filepath.Dir(path)
+	if m.Default != "plants" || len(m.Models) != 2 {
+		t.Fatalf("manifest = %+v", m)
+	}
+	// relative paths are resolved against the manifest's directory, absolute ones kept
+	if got, want := m.Models[0].ModelPath, filepath.Join(dir, "mobilenetv2-7.onnx"); got != want {
+		t.Fatalf("model path %q, want %q", got, want)
+	}
+	if got, want := m.Models[0].LabelsPath, filepath.Join(dir, "labels", "imagenet.txt"); got != want {
+		t.Fatalf("labels path %q, want %q", got, want)
+	}
+	if got := m.Models[1].ModelPath; got != "/opt/models/plants.onnx" {
+		t.Fatalf("absolute model path rewritten to %q", got)
+	}
+	if got, want := m.Models[1].LabelsPath, filepath.Join(dir, "plants.txt"); got != want {
+		t.Fatalf("labels path %q, want %q", got, want)
+	}
+
+	cases := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"not json", `{"models": [`, "parse"},
+		{"no models", `{"models": []}`, "no models"},
+		{"empty name", `{"models": [{"name": "", "model_path": "a.onnx"}]}`, "invalid model name"},
+		{"upper case name", `{"models": [{"name": "MobileNet", "model_path": "a.onnx"}]}`, "invalid model name"},
+		{"name with a slash", `{"models": [{"name": "a/b", "model_path": "a.onnx"}]}`, "invalid model name"},
+		{"name too long", `{"models": [{"name": "` + strings.Repeat("a", 65) + `", "model_path": "a.onnx"}]}`, "invalid model name"},
+		{"duplicate", `{"models": [{"name": "a", "model_path": "a.onnx"}, {"name": "a", "model_path": "b.onnx"}]}`, "duplicate model"},
+		{"unknown default", `{"default": "b", "models": [{"name": "a", "model_path": "a.onnx"}]}`, "not listed"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadManifest(writeManifest(t, tc.body))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+	if _, err := LoadManifest(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatalf("expected error for a missing manifest")
+	}
+}
+
+func TestLoadRegistry_Errors(t *testing.T) {
+	if _, err := LoadRegistry("", Config{}, 3, 5); !errors.Is(err, ErrNoModels) {
+		t.Fatalf("no models: err = %v", err)
+	}
+	// a model that fails to load is left out; with none left the registry fails
+	path := writeManifest(t, `{"models": [{"name": "a", "model_path": "missing.onnx", "labels_path": "missing.txt"}]}`)
+	if _, err := LoadRegistry(path, Config{}, 3, 5); err == nil {
+		t.Fatalf("expected error when no model loads")
+	}
+}
+
+func TestRegistryGet(t *testing.T) {
+	r := NewRegistry()
+	for _, name := range []string{"first", "second"} {
+		svc, err := NewService(&countingClassifier{}, 3, 5)
+		if err != nil {
+			t.Fatalf("service: %v", err)
+		}
+		r.Add(name, svc, ModelInfo{InputH: 224, InputW: 224})
+	}
+
+	cases := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"", "first", nil},
+		{"  ", "first", nil},
+		{"second", "second", nil},
+		{" second ", "second", nil},
+		{"third", "", ErrUnknownModel},
+		{"Second", "", ErrUnknownModel},
+	}
+	for _, tc := range cases {
+		svc, err := r.Get(tc.name)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("Get(%q): err = %v, want %v", tc.name, err, tc.err)
+		}
+		if err == nil && svc.Name() != tc.want {
+			t.Fatalf("Get(%q) = %s, want %s", tc.name, svc.Name(), tc.want)
+		}
+	}
+
+	if r.Default() != "first" {
+		t.Fatalf("default = %s", r.Default())
+	}
+	infos := r.Models()
+	if len(infos) != 2 || infos[0].Name != "first" || !infos[0].Default || infos[1].Default {
+		t.Fatalf("models = %+v", infos)
+	}
+}
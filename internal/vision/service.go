@@ -7,6 +7,7 @@ import (
 )
 
 type Service struct {
+	name        string
 	classifier  Classifier
 	defaultTopK int
 	maxTopK     int
@@ -32,6 +33,11 @@ func NewService(classifier Classifier, defaultTopK, maxTopK int) (*Service, erro
 	}, nil
 }
 
+// Name is the name of the model in its Registry.
+func (s *Service) Name() string {
+	return s.name
+}
+
 func (s *Service) ResolveTopK(k int) int {
 	if k <= 0 {
 		return s.defaultTopK
@@ -18,11 +18,28 @@ type Classifier interface {
 }
 
 type Config struct {
-	ModelPath  string
-	LabelsPath string
-	InputH     int
-	InputW     int
-	InputName  string
-	OutputName string
+	ModelPath      string
+	LabelsPath     string
+	InputH         int
+	InputW         int
+	InputName      string
+	OutputName     string
 	OrtLibraryPath string
+	// input tensor layout: NCHW (default) or NHWC
+	Layout Layout
+	// pixel values are multiplied by Scale (default 1/255), then normalized per RGB channel
+	// as (v - Mean) / Std; zero Mean and Std leave them as they are
+	Scale float32
+	Mean  [3]float32
+	Std   [3]float32
+	// the model outputs probabilities already: no softmax on top
+	Probabilities bool
 }
+
+// Layout is the order of the dimensions of an image tensor.
+type Layout string
+
+const (
+	LayoutNCHW Layout = "NCHW"
+	LayoutNHWC Layout = "NHWC"
+)
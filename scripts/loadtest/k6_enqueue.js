@@ -41,6 +41,8 @@ export default function () {
   const payload = JSON.stringify({
     session_id: SID,
     message: `Reply with exactly: OK (t=${Date.now()})`,
+    // e.g. PRIORITY=low to check that bulk jobs do not hold up other users
+    ...(__ENV.PRIORITY ? { priority: __ENV.PRIORITY } : {}),
   });
 
   const params = {
@@ -4,7 +4,7 @@ import Link from "next/link";
 import { useCallback, useEffect, useState } from "react";
 import { usePathname, useRouter, useSearchParams } from "next/navigation";
 import { apiFetch } from "@/lib/api";
-import { clearToken, getToken } from "@/lib/auth";
+import { clearToken, getToken, setToken } from "@/lib/auth";
 import FlowBackground from "@/components/FlowBackground";
 import { useI18n } from "@/components/LanguageProvider";
 
@@ -171,11 +171,13 @@ export default function ChatLayout({ children }: { children: React.ReactNode })
     }
     setProfileBusy(true);
     try {
-      await apiFetch("/me/password", {
+      // the server revokes every existing session and returns a fresh pair for this one
+      const tokens = await apiFetch<{ token: string; refresh_token: string }>("/me/password", {
         method: "PATCH",
         auth: true,
         body: JSON.stringify({ old_password: oldPassword, new_password: newPassword }),
       });
+      setToken(tokens.token, tokens.refresh_token);
       setOldPassword("");
       setNewPassword("");
       setConfirmPassword("");
@@ -4,8 +4,8 @@ import { useEffect, useMemo, useRef, useState } from "react";
 import MessageContent from "@/components/MessageContent";
 import { useRouter, useSearchParams } from "next/navigation";
 import Link from "next/link";
-import { apiFetch } from "@/lib/api";
-import { clearToken, getToken } from "@/lib/auth";
+import { apiFetch, logout, refreshAccessToken } from "@/lib/api";
+import { getToken } from "@/lib/auth";
 import { useI18n } from "@/components/LanguageProvider";
 import LanguageToggle from "@/components/LanguageToggle";
 
@@ -212,7 +212,7 @@ export default function ChatPage() {
     if (!API_BASE_URL) {
       throw new Error(t("chat.missingApiBase"));
     }
-    const token = getToken();
+    let token = getToken();
     if (!token) throw new Error(t("chat.notAuthed"));
 
     if (streamAbort.current) streamAbort.current.abort();
@@ -228,16 +228,25 @@ export default function ChatPage() {
       }
     }, STREAM_FIRST_CHUNK_TIMEOUT_MS);
 
-    const res = await fetch(`${API_BASE_URL}/chat/messages/stream`, {
-      method: "POST",
-      headers: {
-        "Content-Type": "application/json",
-        Authorization: `Bearer ${token}`,
-        "Idempotency-Key": idemKey,
-      },
-      body: JSON.stringify({ session_id: sid, message: msg }),
-      signal: controller.signal,
-    });
+    const post = (bearer: string) =>
+      fetch(`${API_BASE_URL}/chat/messages/stream`, {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+          Authorization: `Bearer ${bearer}`,
+          "Idempotency-Key": idemKey,
+        },
+        body: JSON.stringify({ session_id: sid, message: msg }),
+        signal: controller.signal,
+      });
+    let res = await post(token);
+    if (res.status === 401) {
+      const refreshed = await refreshAccessToken();
+      if (refreshed) {
+        token = refreshed;
+        res = await post(token);
+      }
+    }
 
     if (!res.ok || !res.body) {
       const text = await res.text();
@@ -394,8 +403,8 @@ export default function ChatPage() {
         <LanguageToggle floating={false} />
         <button
           className="border rounded px-3 py-1"
-          onClick={() => {
-            clearToken();
+          onClick={async () => {
+            await logout();
             router.push("/login");
           }}
         >
@@ -9,7 +9,7 @@ import FlowBackground from "@/components/FlowBackground";
 import { useI18n } from "@/components/LanguageProvider";
 
 
-type LoginResponse = { token: string };
+type LoginResponse = { token: string; refresh_token?: string };
 
 export default function LoginPage() {
   const router = useRouter();
@@ -68,7 +68,7 @@ export default function LoginPage() {
         const next = [normalized, ...list.filter((v) => v !== normalized)].slice(0, 10);
         window.localStorage.setItem("remembered_emails", JSON.stringify(next));
       }
-      setToken(data.token);
+      setToken(data.token, data.refresh_token);
       router.push("/chat");
     } catch (err) {
       setError(err instanceof ApiError ? err.message : t("login.failed"));
@@ -13,6 +13,7 @@ type RegisterResponse = {
   email: string;
   username: string;
   token: string;
+  refresh_token?: string;
 };
 
 export default function RegisterPage() {
@@ -78,7 +79,7 @@ export default function RegisterPage() {
           password,
         }),
       });
-      setToken(data.token);
+      setToken(data.token, data.refresh_token);
       router.push("/chat");
     } catch (err) {
       setError(err instanceof ApiError ? err.message : t("register.failed"));
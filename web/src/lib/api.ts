@@ -1,4 +1,4 @@
-import { getToken } from "./auth";
+import { clearToken, getRefreshToken, getToken, setToken } from "./auth";
 
 const API_BASE_URL = process.env.NEXT_PUBLIC_API_BASE_URL;
 
@@ -33,9 +33,70 @@ async function parseJsonSafely(res: Response): Promise<any> {
   }
 }
 
+export type TokenPair = {
+  token: string;
+  access_token: string;
+  refresh_token: string;
+  expires_in: number;
+};
+
+let refreshing: Promise<string | null> | null = null;
+
+// refreshAccessToken rotates the stored refresh token; concurrent callers share one request.
+export function refreshAccessToken(): Promise<string | null> {
+  if (refreshing) return refreshing;
+  // checked before the shared promise exists: an async body that returns before its first
+  // await runs its finally before `refreshing` is assigned, which would leave it set forever
+  const refreshToken = getRefreshToken();
+  if (!refreshToken) return Promise.resolve(null);
+  refreshing = (async () => {
+    try {
+      const res = await fetch(`${API_BASE_URL}/token/refresh`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ refresh_token: refreshToken }),
+      });
+      const json = (await parseJsonSafely(res)) as ApiEnvelope<TokenPair> | null;
+      if (!res.ok || !json || json.code !== 0) {
+        if (res.status === 401) clearToken();
+        return null;
+      }
+      setToken(json.data.access_token, json.data.refresh_token);
+      return json.data.access_token;
+    } catch {
+      return null;
+    } finally {
+      refreshing = null;
+    }
+  })();
+  return refreshing;
+}
+
+export async function logout(): Promise<void> {
+  const token = getToken();
+  const refreshToken = getRefreshToken();
+  try {
+    if (token) {
+      await fetch(`${API_BASE_URL}/logout`, {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+          Authorization: `Bearer ${token}`,
+        },
+        body: JSON.stringify({ refresh_token: refreshToken ?? "" }),
+      });
+    }
+  } catch {
+    // signing out locally is what matters
+  } finally {
+    clearToken();
+  }
+}
+
 export async function apiFetch<T>(
   path: string,
-  init?: RequestInit & { auth?: boolean }
+  init?: RequestInit & { auth?: boolean },
+  retried = false
 ): Promise<T> {
   const url = `${API_BASE_URL}${path}`;
   const headers = new Headers(init?.headers);
@@ -53,6 +114,12 @@ export async function apiFetch<T>(
 
   const res = await fetch(url, { ...init, headers });
 
+  if (res.status === 401 && init?.auth && !retried) {
+    if (await refreshAccessToken()) {
+      return apiFetch<T>(path, init, true);
+    }
+  }
+
   const json = (await parseJsonSafely(res)) as ApiEnvelope<T> | null;
 
   if (!res.ok) {
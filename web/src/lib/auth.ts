@@ -1,16 +1,26 @@
 export const TOKEN_STORAGE_KEY = "ai_platform_token";
+export const REFRESH_TOKEN_STORAGE_KEY = "ai_platform_refresh_token";
 
 export function getToken(): string | null {
   if (typeof window === "undefined") return null;
   return window.localStorage.getItem(TOKEN_STORAGE_KEY);
 }
 
-export function setToken(token: string) {
+export function getRefreshToken(): string | null {
+  if (typeof window === "undefined") return null;
+  return window.localStorage.getItem(REFRESH_TOKEN_STORAGE_KEY);
+}
+
+export function setToken(token: string, refreshToken?: string) {
   if (typeof window === "undefined") return;
   window.localStorage.setItem(TOKEN_STORAGE_KEY, token);
+  if (refreshToken) {
+    window.localStorage.setItem(REFRESH_TOKEN_STORAGE_KEY, refreshToken);
+  }
 }
 
 export function clearToken() {
   if (typeof window === "undefined") return;
   window.localStorage.removeItem(TOKEN_STORAGE_KEY);
-}
\ No newline at end of file
+  window.localStorage.removeItem(REFRESH_TOKEN_STORAGE_KEY);
+}